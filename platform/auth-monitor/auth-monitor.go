@@ -21,6 +21,7 @@ import (
 	"github.com/sipb/homeworld/platform/keysystem/api"
 	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
 	"github.com/sipb/homeworld/platform/keysystem/api/server"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
 	"github.com/sipb/homeworld/platform/util/osutil"
 )
@@ -152,7 +153,7 @@ func attemptKAuth(keyserver *server.Keyserver) error {
 		return err
 	}
 
-	hostport, err := paths.GetKeyserver()
+	hostport, err := paths.GetKeyserver(hostenv.FromEnvironment())
 	if err != nil {
 		return err
 	}
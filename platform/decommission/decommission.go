@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/kubernetes/wrapper"
+)
+
+const KubeConfigPath = "/etc/homeworld/config/kubeconfig-decommission"
+
+func kubectl(kubeconfig string, args ...string) error {
+	cmd := exec.Command("hyperkube", append([]string{"kubectl", "--kubeconfig", kubeconfig}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Decommission removes a node from Kubernetes, after moving its pods elsewhere. The keyserver should already have
+// revoked the node's certificates, so that it can't rejoin.
+func Decommission(hostname string) error {
+	err := wrapper.GenerateKubeConfigToFile(paths.KubernetesSupervisorKey, paths.KubernetesSupervisorCert, KubeConfigPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("cordoning %s\n", hostname)
+	err = kubectl(KubeConfigPath, "cordon", hostname)
+	if err != nil {
+		return err
+	}
+	log.Printf("draining %s\n", hostname)
+	err = kubectl(KubeConfigPath, "drain", hostname, "--ignore-daemonsets", "--delete-local-data", "--force")
+	if err != nil {
+		return err
+	}
+	log.Printf("deleting %s\n", hostname)
+	err = kubectl(KubeConfigPath, "delete", "node", hostname)
+	if err != nil {
+		return err
+	}
+	log.Printf("finished decommissioning %s\n", hostname)
+	return nil
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatalln("usage: decommission-node <hostname>")
+	}
+	err := Decommission(os.Args[1])
+	if err != nil {
+		log.Fatalf("error in decommission-node: %s\n", err.Error())
+	}
+}
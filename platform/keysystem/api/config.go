@@ -4,30 +4,46 @@ import (
 	"crypto/tls"
 	"github.com/pkg/errors"
 	"io/ioutil"
+	"log"
 
 	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
 	"github.com/sipb/homeworld/platform/keysystem/api/server"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
 )
 
-func LoadDefaultKeyserver() (*server.Keyserver, error) {
-	authoritydata, err := ioutil.ReadFile(paths.KeyserverTLSCert)
+// LoadDefaultKeyserver connects to the keyservers configured for this host, which may be relocated by the environment.
+func LoadDefaultKeyserver(logger *log.Logger) (*server.Keyserver, error) {
+	return LoadKeyserver(hostenv.FromEnvironment(), logger)
+}
+
+// LoadKeyserver connects to the keyservers configured in env. The list of keyservers is read again before each pass
+// through it, so that changes to the SRV records it names are picked up.
+func LoadKeyserver(env hostenv.Env, logger *log.Logger) (*server.Keyserver, error) {
+	authoritydata, err := ioutil.ReadFile(env.Path(paths.KeyserverTLSCert))
 	if err != nil {
 		return nil, errors.Wrap(err, "while loading authority")
 	}
-	keyserver, err := paths.GetKeyserver()
+	ks, err := server.NewKeyserverWithResolver(authoritydata, func() ([]string, error) {
+		keyservers, err := paths.GetKeyservers(env, logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "while determining keyservers")
+		}
+		return keyservers, nil
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "while determining keyserver")
+		return nil, err
 	}
-	return server.NewKeyserver(authoritydata, keyserver)
+	return ks.WithClock(env.Clock), nil
 }
 
-func LoadDefaultKeyserverWithCert() (*server.Keyserver, reqtarget.RequestTarget, error) {
-	k, err := LoadDefaultKeyserver()
+func LoadDefaultKeyserverWithCert(logger *log.Logger) (*server.Keyserver, reqtarget.RequestTarget, error) {
+	env := hostenv.FromEnvironment()
+	k, err := LoadKeyserver(env, logger)
 	if err != nil {
 		return nil, nil, err
 	}
-	keypair, err := tls.LoadX509KeyPair(paths.GrantingCertPath, paths.GrantingKeyPath)
+	keypair, err := tls.LoadX509KeyPair(env.Path(paths.GrantingCertPath), env.Path(paths.GrantingKeyPath))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "while loading keypair")
 	}
@@ -11,6 +11,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
 )
 
 type ServerEndpoint struct {
@@ -19,7 +21,9 @@ type ServerEndpoint struct {
 	extraHeaders map[string]string
 	certificates []tls.Certificate
 	timeout      time.Duration
-	client       *http.Client
+	// nil to use the system clock
+	clock  clock.Clock
+	client *http.Client
 }
 
 func (s *ServerEndpoint) buildClient() {
@@ -30,6 +34,7 @@ func (s *ServerEndpoint) buildClient() {
 				RootCAs:      s.rootCAs,
 				Certificates: s.certificates,
 				MinVersion:   tls.VersionTLS12,
+				Time:         s.now,
 			},
 			TLSHandshakeTimeout: s.timeout,
 			DisableCompression:  true,
@@ -38,6 +43,10 @@ func (s *ServerEndpoint) buildClient() {
 	}
 }
 
+func (s ServerEndpoint) now() time.Time {
+	return clock.Now(s.clock)
+}
+
 func NewServerEndpoint(url string, authorities *x509.CertPool) (ServerEndpoint, error) {
 	if url == "" {
 		return ServerEndpoint{}, errors.New("empty base URL")
@@ -74,50 +83,106 @@ func (s ServerEndpoint) WithCertificate(cert tls.Certificate) ServerEndpoint {
 	return s
 }
 
+// WithClock checks the server's certificate against clk instead of the system clock.
+func (s ServerEndpoint) WithClock(clk clock.Clock) ServerEndpoint {
+	s.clock = clk
+	s.buildClient()
+	return s
+}
+
+// ServerTimeHeader carries the server's time in every response, so that clients can measure how far off their own
+// clocks are.
+const ServerTimeHeader = "X-Homeworld-Server-Time"
+
+// CertBackdateHeader carries how long before issuance the server's certificates become valid, so that clients can tell
+// how far off their own clocks can be before those certificates are rejected.
+const CertBackdateHeader = "X-Homeworld-Cert-Backdate"
+
+// clockReport is what a server reported about its clock in a response.
+type clockReport struct {
+	// how far the server's clock was ahead of ours; nil if the server didn't report its time
+	skew *time.Duration
+	// nil if the server didn't report how far it backdates certificates
+	backdate *time.Duration
+}
+
+// measureSkew finds how far the server's clock was ahead of ours, assuming that it handled the request halfway between
+// when we sent it and when we received the response. The result is nil if the server didn't report its time.
+func measureSkew(response *http.Response, sentAt time.Time, receivedAt time.Time) *time.Duration {
+	serverTime, err := time.Parse(time.RFC3339Nano, response.Header.Get(ServerTimeHeader))
+	if err != nil {
+		return nil
+	}
+	skew := serverTime.Sub(sentAt.Add(receivedAt.Sub(sentAt) / 2))
+	return &skew
+}
+
+// reportClock collects what the server reported about its clock.
+func reportClock(response *http.Response, sentAt time.Time, receivedAt time.Time) clockReport {
+	report := clockReport{skew: measureSkew(response, sentAt, receivedAt)}
+	backdate, err := time.ParseDuration(response.Header.Get(CertBackdateHeader))
+	if err == nil && backdate >= 0 {
+		report.backdate = &backdate
+	}
+	return report
+}
+
 type OperationForbidden struct{}
 
 func (o OperationForbidden) Error() string {
 	return "operation forbidden by server"
 }
 
-func (s ServerEndpoint) Request(path string, method string, reqbody []byte) ([]byte, error) {
+// request performs a request, and also reports whether the server was reached at all, so that callers can distinguish
+// an unavailable server from a server that rejected the request, and what the server reported about its clock. Once the
+// server has responded, it counts as reached even if the response is cut off, because the request may already have
+// taken effect, and so must not be sent anywhere else.
+func (s ServerEndpoint) request(path string, method string, reqbody []byte) (body []byte, reached bool, report clockReport, err error) {
 	if path[0] != '/' {
-		return nil, errors.New("while validating request: path must be absolute")
+		return nil, false, clockReport{}, errors.New("while validating request: path must be absolute")
 	}
 	req, err := http.NewRequest(method, s.baseURL+path[1:], bytes.NewReader(reqbody))
 	if err != nil {
-		return nil, errors.Wrap(err, "while preparing request")
+		return nil, false, clockReport{}, errors.Wrap(err, "while preparing request")
 	}
 	for k, v := range s.extraHeaders {
 		req.Header.Set(k, v)
 	}
+	sentAt := s.now()
 	response, err := s.client.Do(req)
 	if err != nil {
-		return nil, errors.Wrap(err, "while processing request")
+		return nil, false, clockReport{}, errors.Wrap(err, "while processing request")
 	}
+	defer response.Body.Close()
+	report = reportClock(response, sentAt, s.now())
 	if response.StatusCode != 200 {
 		if response.StatusCode == 403 {
-			return nil, OperationForbidden{}
+			return nil, true, report, OperationForbidden{}
 		}
-		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+		return nil, true, report, fmt.Errorf("unexpected status code: %d", response.StatusCode)
 	}
-	body, err := ioutil.ReadAll(response.Body)
+	body, err = ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, errors.Wrap(err, "while receiving response")
+		return nil, true, report, errors.Wrap(err, "while receiving response")
 	}
-	return body, nil
+	return body, true, report, nil
+}
+
+func (s ServerEndpoint) Request(path string, method string, reqbody []byte) ([]byte, error) {
+	body, _, _, err := s.request(path, method, reqbody)
+	return body, err
 }
 
 func (s ServerEndpoint) Get(path string) ([]byte, error) {
 	return s.Request(path, "GET", nil)
 }
 
-func (s ServerEndpoint) PostJSON(path string, input interface{}, output interface{}) error {
+func postJSON(request func(path string, method string, reqbody []byte) ([]byte, error), path string, input interface{}, output interface{}) error {
 	reqbody, err := json.Marshal(input)
 	if err != nil {
 		return errors.Wrap(err, "while marshalling json for request")
 	}
-	body, err := s.Request(path, "POST", reqbody)
+	body, err := request(path, "POST", reqbody)
 	if err != nil {
 		return errors.Wrap(err, "while posting request")
 	}
@@ -127,3 +192,7 @@ func (s ServerEndpoint) PostJSON(path string, input interface{}, output interfac
 	}
 	return nil
 }
+
+func (s ServerEndpoint) PostJSON(path string, input interface{}, output interface{}) error {
+	return postJSON(s.Request, path, input, output)
+}
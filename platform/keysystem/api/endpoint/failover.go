@@ -0,0 +1,304 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+// EndpointHealth records how a single endpoint in a Failover has behaved so far.
+type EndpointHealth struct {
+	BaseURL             string     `json:"base-url"`
+	Served              uint64     `json:"served"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures uint64     `json:"consecutive-failures"`
+	LastFailure         *time.Time `json:"last-failure,omitempty"`
+	// how far the endpoint's clock was ahead of ours when it last responded, if it reported its time
+	ClockSkew *time.Duration `json:"clock-skew,omitempty"`
+	// how long before issuance the endpoint's certificates become valid, if it reported it
+	CertBackdate *time.Duration `json:"cert-backdate,omitempty"`
+}
+
+// health is shared between all copies of a Failover derived from the same NewFailover or NewResolvingFailover
+// call, so that an endpoint found
+// to be unreachable by one authenticated client is deprioritized for the others as well.
+type health struct {
+	mu         sync.Mutex
+	endpoints  []EndpointHealth
+	lastServed string
+	// nil if the list of endpoints never changes
+	resolve func() ([]string, error)
+}
+
+// Failover sends each request to the first reachable endpoint from an ordered list. Endpoints that have recently failed
+// to respond are tried after the ones that have not. Only failures to reach an endpoint cause failover; an endpoint that
+// responds with an error is assumed to be authoritative, so its error is returned directly.
+type Failover struct {
+	authorities *x509.CertPool
+	// applied to each endpoint when it is created, so that endpoints added by a later resolution match the others
+	derive    func(ServerEndpoint) ServerEndpoint
+	endpoints *endpointCache
+	health    *health
+}
+
+// endpointCache holds the endpoints created so far by one copy of a Failover, so that they can reuse connections.
+type endpointCache struct {
+	mu        sync.Mutex
+	endpoints map[string]ServerEndpoint
+}
+
+func NewFailover(urls []string, authorities *x509.CertPool) (Failover, error) {
+	return newFailover(urls, nil, authorities)
+}
+
+// NewResolvingFailover is like NewFailover, but calls resolve again before each pass through the endpoints, so that
+// the list can change while the Failover is in use. If a later resolution fails, the previous list remains in use.
+func NewResolvingFailover(resolve func() ([]string, error), authorities *x509.CertPool) (Failover, error) {
+	urls, err := resolve()
+	if err != nil {
+		return Failover{}, err
+	}
+	return newFailover(urls, resolve, authorities)
+}
+
+func newFailover(urls []string, resolve func() ([]string, error), authorities *x509.CertPool) (Failover, error) {
+	f := Failover{
+		authorities: authorities,
+		derive:      func(ep ServerEndpoint) ServerEndpoint { return ep },
+		endpoints:   &endpointCache{endpoints: map[string]ServerEndpoint{}},
+		health:      &health{resolve: resolve},
+	}
+	if err := f.update(urls); err != nil {
+		return Failover{}, err
+	}
+	return f, nil
+}
+
+// update replaces the list of endpoints, keeping the health of any endpoint that remains listed.
+func (f Failover) update(urls []string) error {
+	if len(urls) == 0 {
+		return errors.New("no endpoints specified")
+	}
+	for _, url := range urls {
+		if _, err := f.endpoint(url); err != nil {
+			return err
+		}
+	}
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	previous := map[string]EndpointHealth{}
+	for _, h := range f.health.endpoints {
+		previous[h.BaseURL] = h
+	}
+	endpoints := make([]EndpointHealth, len(urls))
+	for i, url := range urls {
+		if h, found := previous[url]; found {
+			endpoints[i] = h
+		} else {
+			endpoints[i] = EndpointHealth{BaseURL: url}
+		}
+	}
+	f.health.endpoints = endpoints
+	return nil
+}
+
+// refresh resolves the list of endpoints again, if it can change.
+func (f Failover) refresh() error {
+	if f.health.resolve == nil {
+		return nil
+	}
+	urls, err := f.health.resolve()
+	if err != nil {
+		return err
+	}
+	return f.update(urls)
+}
+
+func (f Failover) endpoint(url string) (ServerEndpoint, error) {
+	f.endpoints.mu.Lock()
+	defer f.endpoints.mu.Unlock()
+	if ep, found := f.endpoints.endpoints[url]; found {
+		return ep, nil
+	}
+	ep, err := NewServerEndpoint(url, f.authorities)
+	if err != nil {
+		return ServerEndpoint{}, err
+	}
+	ep = f.derive(ep)
+	f.endpoints.endpoints[url] = ep
+	return ep, nil
+}
+
+func (f Failover) with(transform func(ServerEndpoint) ServerEndpoint) Failover {
+	derive := f.derive
+	return Failover{
+		authorities: f.authorities,
+		derive:      func(ep ServerEndpoint) ServerEndpoint { return transform(derive(ep)) },
+		endpoints:   &endpointCache{endpoints: map[string]ServerEndpoint{}},
+		health:      f.health,
+	}
+}
+
+func (f Failover) WithHeader(key string, value string) Failover {
+	return f.with(func(ep ServerEndpoint) ServerEndpoint {
+		return ep.WithHeader(key, value)
+	})
+}
+
+func (f Failover) WithCertificate(cert tls.Certificate) Failover {
+	return f.with(func(ep ServerEndpoint) ServerEndpoint {
+		return ep.WithCertificate(cert)
+	})
+}
+
+func (f Failover) WithClock(clk clock.Clock) Failover {
+	return f.with(func(ep ServerEndpoint) ServerEndpoint {
+		return ep.WithClock(clk)
+	})
+}
+
+// BaseURL returns the base URL of the endpoint that would be tried first for the next request.
+func (f Failover) BaseURL() string {
+	return f.order()[0]
+}
+
+// order lists the base URLs of the endpoints in the order in which they should be tried: first every endpoint without
+// outstanding failures, in the configured order, and then the rest, starting with the one that failed longest ago.
+func (f Failover) order() []string {
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	endpoints := make([]EndpointHealth, len(f.health.endpoints))
+	copy(endpoints, f.health.endpoints)
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		hi, hj := endpoints[i], endpoints[j]
+		if (hi.ConsecutiveFailures == 0) != (hj.ConsecutiveFailures == 0) {
+			return hi.ConsecutiveFailures == 0
+		}
+		if hi.ConsecutiveFailures == 0 {
+			return false
+		}
+		return hi.LastFailure.Before(*hj.LastFailure)
+	})
+	order := make([]string, len(endpoints))
+	for i, h := range endpoints {
+		order[i] = h.BaseURL
+	}
+	return order
+}
+
+func (f Failover) record(ep ServerEndpoint, reached bool, report clockReport) {
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	var h *EndpointHealth
+	for i := range f.health.endpoints {
+		if f.health.endpoints[i].BaseURL == ep.BaseURL() {
+			h = &f.health.endpoints[i]
+		}
+	}
+	if h == nil {
+		// no longer listed, because the endpoints were resolved again during the request
+		return
+	}
+	if report.skew != nil {
+		h.ClockSkew = report.skew
+	}
+	if report.backdate != nil {
+		h.CertBackdate = report.backdate
+	}
+	if reached {
+		h.Served++
+		h.ConsecutiveFailures = 0
+		f.health.lastServed = h.BaseURL
+	} else {
+		now := ep.now()
+		h.Failures++
+		h.ConsecutiveFailures++
+		h.LastFailure = &now
+	}
+}
+
+// RequestFrom performs a request, and also reports the base URL of the endpoint that handled it.
+func (f Failover) RequestFrom(path string, method string, reqbody []byte) (body []byte, servedBy string, err error) {
+	var failures []string
+	if err := f.refresh(); err != nil {
+		// keep trying the endpoints from the last successful resolution
+		failures = append(failures, "while resolving endpoints: "+err.Error())
+	}
+	order := f.order()
+	for _, url := range order {
+		ep, err := f.endpoint(url)
+		if err != nil {
+			return nil, "", err // should not happen, because each URL was checked when it was listed
+		}
+		body, reached, report, err := ep.request(path, method, reqbody)
+		f.record(ep, reached, report)
+		if reached {
+			return body, ep.BaseURL(), err
+		}
+		failures = append(failures, ep.BaseURL()+": "+err.Error())
+		if len(failures) == 1 && len(order) == 1 {
+			return nil, "", err
+		}
+	}
+	return nil, "", errors.Errorf("no endpoint reachable: %v", failures)
+}
+
+func (f Failover) Request(path string, method string, reqbody []byte) ([]byte, error) {
+	body, _, err := f.RequestFrom(path, method, reqbody)
+	return body, err
+}
+
+func (f Failover) Get(path string) ([]byte, error) {
+	return f.Request(path, "GET", nil)
+}
+
+func (f Failover) PostJSON(path string, input interface{}, output interface{}) error {
+	return postJSON(f.Request, path, input, output)
+}
+
+// Health returns a snapshot of the health of each endpoint, in the configured order.
+func (f Failover) Health() []EndpointHealth {
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	result := make([]EndpointHealth, len(f.health.endpoints))
+	copy(result, f.health.endpoints)
+	return result
+}
+
+// LastServed returns the base URL of the endpoint that most recently handled a request, or "" if none has.
+func (f Failover) LastServed() string {
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	return f.health.lastServed
+}
+
+// ClockSkew reports how far the clock of the endpoint that most recently handled a request was ahead of ours, or false
+// if that isn't known.
+func (f Failover) ClockSkew() (time.Duration, bool) {
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	for _, h := range f.health.endpoints {
+		if h.BaseURL == f.health.lastServed && h.ClockSkew != nil {
+			return *h.ClockSkew, true
+		}
+	}
+	return 0, false
+}
+
+// CertBackdate reports how long before issuance the certificates of the endpoint that most recently handled a request
+// become valid, or false if that isn't known.
+func (f Failover) CertBackdate() (time.Duration, bool) {
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	for _, h := range f.health.endpoints {
+		if h.BaseURL == f.health.lastServed && h.CertBackdate != nil {
+			return *h.CertBackdate, true
+		}
+	}
+	return 0, false
+}
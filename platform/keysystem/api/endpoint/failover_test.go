@@ -0,0 +1,302 @@
+package endpoint
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+func launchPlainServer(t *testing.T, response string, status int) (url string, stop func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(status)
+		_, err := writer.Write([]byte(response))
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	return srv.URL + "/", srv.Close
+}
+
+func launchUnreachable(t *testing.T) string {
+	url, stop := launchPlainServer(t, "", 200)
+	stop()
+	return url
+}
+
+func TestNewFailover_Empty(t *testing.T) {
+	_, err := NewFailover(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "no endpoints") {
+		t.Errorf("expected error about missing endpoints, not %v", err)
+	}
+}
+
+func TestNewFailover_BadURL(t *testing.T) {
+	_, err := NewFailover([]string{"http://localhost:1/", "http://localhost:2"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "must end in a slash") {
+		t.Errorf("expected error about trailing slash, not %v", err)
+	}
+}
+
+func TestFailover_FirstServes(t *testing.T) {
+	first, stop1 := launchPlainServer(t, "first", 200)
+	defer stop1()
+	second, stop2 := launchPlainServer(t, "second", 200)
+	defer stop2()
+	f, err := NewFailover([]string{first, second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, servedBy, err := f.RequestFrom("/test", "GET", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "first" || servedBy != first {
+		t.Errorf("wrong endpoint served request: %s from %s", body, servedBy)
+	}
+	if f.LastServed() != first {
+		t.Errorf("wrong last served endpoint %s", f.LastServed())
+	}
+}
+
+func TestFailover_SkipsUnreachable(t *testing.T) {
+	dead := launchUnreachable(t)
+	live, stop := launchPlainServer(t, "live", 200)
+	defer stop()
+	f, err := NewFailover([]string{dead, live}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		body, servedBy, err := f.RequestFrom("/test", "GET", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "live" || servedBy != live {
+			t.Errorf("wrong endpoint served request: %s from %s", body, servedBy)
+		}
+	}
+	health := f.Health()
+	if len(health) != 2 || health[0].BaseURL != dead || health[1].BaseURL != live {
+		t.Fatalf("wrong health entries: %v", health)
+	}
+	// after the first failure, the dead endpoint should have been tried last, and so not tried again
+	if health[0].Failures != 1 || health[0].ConsecutiveFailures != 1 || health[0].LastFailure == nil {
+		t.Errorf("wrong health for dead endpoint: %v", health[0])
+	}
+	if health[1].Served != 3 || health[1].Failures != 0 {
+		t.Errorf("wrong health for live endpoint: %v", health[1])
+	}
+	if f.BaseURL() != live {
+		t.Errorf("expected live endpoint to be preferred, not %s", f.BaseURL())
+	}
+}
+
+func TestFailover_NoFailoverOnRejection(t *testing.T) {
+	first, stop1 := launchPlainServer(t, "", 403)
+	defer stop1()
+	second, stop2 := launchPlainServer(t, "second", 200)
+	defer stop2()
+	f, err := NewFailover([]string{first, second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, servedBy, err := f.RequestFrom("/test", "GET", nil)
+	if _, ok := err.(OperationForbidden); !ok {
+		t.Errorf("expected forbidden error, not %v", err)
+	}
+	if servedBy != first {
+		t.Errorf("expected rejection from first endpoint, not %s", servedBy)
+	}
+}
+
+func TestFailover_NoFailoverOnTruncatedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		// promise more of the body than is sent, so that the response is cut off when the handler returns
+		writer.Header().Set("Content-Length", "100")
+		writer.WriteHeader(200)
+		_, err := writer.Write([]byte("partial"))
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+	second, stop2 := launchPlainServer(t, "second", 200)
+	defer stop2()
+	f, err := NewFailover([]string{srv.URL + "/", second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, servedBy, err := f.RequestFrom("/test", "POST", []byte("request"))
+	if err == nil || !strings.Contains(err.Error(), "while receiving response") {
+		t.Errorf("expected error about receiving response, not %v", err)
+	}
+	if servedBy != srv.URL+"/" {
+		t.Errorf("expected the request to stay with the first endpoint, not %s", servedBy)
+	}
+	if health := f.Health(); health[0].Failures != 0 || health[1].Served != 0 {
+		t.Errorf("wrong health after truncated response: %v", health)
+	}
+}
+
+func TestFailover_AllUnreachable(t *testing.T) {
+	f, err := NewFailover([]string{launchUnreachable(t), launchUnreachable(t)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Get("/test")
+	if err == nil || !strings.Contains(err.Error(), "no endpoint reachable") {
+		t.Errorf("expected error about unreachable endpoints, not %v", err)
+	}
+}
+
+func TestFailover_SharedHealth(t *testing.T) {
+	dead := launchUnreachable(t)
+	live, stop := launchPlainServer(t, "live", 200)
+	defer stop()
+	f, err := NewFailover([]string{dead, live}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WithHeader("X-Test", "value").Get("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.BaseURL() != live {
+		t.Errorf("expected health to be shared with derived failovers")
+	}
+}
+
+func TestResolvingFailover_Reresolves(t *testing.T) {
+	dead := launchUnreachable(t)
+	live, stop := launchPlainServer(t, "live", 200)
+	defer stop()
+	listed := []string{dead}
+	f, err := NewResolvingFailover(func() ([]string, error) {
+		return listed, nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = f.WithHeader("X-Test", "value")
+	_, err = f.Get("/test")
+	if err == nil {
+		t.Fatal("expected unreachable endpoint to fail")
+	}
+	listed = []string{dead, live}
+	body, servedBy, err := f.RequestFrom("/test", "GET", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "live" || servedBy != live {
+		t.Errorf("wrong endpoint served request: %s from %s", body, servedBy)
+	}
+	health := f.Health()
+	if len(health) != 2 || health[0].BaseURL != dead || health[0].Failures != 1 || health[1].Served != 1 {
+		t.Errorf("health not kept across resolutions: %v", health)
+	}
+}
+
+func TestResolvingFailover_ResolutionFails(t *testing.T) {
+	live, stop := launchPlainServer(t, "live", 200)
+	defer stop()
+	var failure error
+	f, err := NewResolvingFailover(func() ([]string, error) {
+		if failure != nil {
+			return nil, failure
+		}
+		return []string{live}, nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure = errors.New("lookup failed")
+	// the last resolved list is still used
+	body, err := f.Get("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "live" {
+		t.Errorf("wrong response: %s", body)
+	}
+}
+
+func TestResolvingFailover_InitialResolutionFails(t *testing.T) {
+	_, err := NewResolvingFailover(func() ([]string, error) {
+		return nil, errors.New("lookup failed")
+	}, nil)
+	if err == nil || err.Error() != "lookup failed" {
+		t.Errorf("expected resolution error, not %v", err)
+	}
+}
+
+func TestFailover_ClockSkew(t *testing.T) {
+	serverTime := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(ServerTimeHeader, serverTime.Format(time.RFC3339Nano))
+		_, _ = writer.Write([]byte("response"))
+	}))
+	defer srv.Close()
+	f, err := NewFailover([]string{srv.URL + "/"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f = f.WithClock(clock.NewFake(serverTime.Add(-time.Minute)))
+	if _, known := f.ClockSkew(); known {
+		t.Error("expected clock skew to be unknown before any requests")
+	}
+	_, err = f.Get("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	skew, known := f.ClockSkew()
+	if !known || skew != time.Minute {
+		t.Errorf("wrong clock skew: %v (known: %v)", skew, known)
+	}
+}
+
+func TestFailover_CertBackdate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(CertBackdateHeader, (10 * time.Minute).String())
+		_, _ = writer.Write([]byte("response"))
+	}))
+	defer srv.Close()
+	f, err := NewFailover([]string{srv.URL + "/"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, known := f.CertBackdate(); known {
+		t.Error("expected backdate to be unknown before any requests")
+	}
+	_, err = f.Get("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backdate, known := f.CertBackdate()
+	if !known || backdate != 10*time.Minute {
+		t.Errorf("wrong backdate: %v (known: %v)", backdate, known)
+	}
+}
+
+func TestFailover_ClockSkew_NotReported(t *testing.T) {
+	url, stop := launchPlainServer(t, "response", 200)
+	defer stop()
+	f, err := NewFailover([]string{url}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Get("/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, known := f.ClockSkew(); known {
+		t.Error("expected clock skew to be unknown when the server doesn't report its time")
+	}
+	if _, known := f.CertBackdate(); known {
+		t.Error("expected backdate to be unknown when the server doesn't report it")
+	}
+}
@@ -2,31 +2,82 @@ package server
 
 import (
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/api/endpoint"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/reenroll"
+	"github.com/sipb/homeworld/platform/util/clock"
 	"github.com/sipb/homeworld/platform/util/wraputil"
 )
 
 type Keyserver struct {
-	endpoint endpoint.ServerEndpoint
+	endpoint endpoint.Failover
 }
 
 func NewKeyserver(authority []byte, hostname string) (*Keyserver, error) {
+	return NewKeyserverWithFailover(authority, []string{hostname})
+}
+
+// NewKeyserverWithFailover connects to whichever of a list of equivalent keyservers is reachable, preferring them in
+// the order listed.
+func NewKeyserverWithFailover(authority []byte, hostnames []string) (*Keyserver, error) {
+	pool, err := keyserverPool(authority)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := endpoint.NewFailover(keyserverURLs(hostnames), pool)
+	if err != nil {
+		return nil, err // should only happen if no hostnames were provided
+	}
+	return &Keyserver{endpoint: ep}, nil
+}
+
+// NewKeyserverWithResolver is like NewKeyserverWithFailover, but calls resolve to list the keyservers again before each
+// pass through them, so that keyservers found through DNS can change while the Keyserver is in use.
+func NewKeyserverWithResolver(authority []byte, resolve func() ([]string, error)) (*Keyserver, error) {
+	pool, err := keyserverPool(authority)
+	if err != nil {
+		return nil, err
+	}
+	ep, err := endpoint.NewResolvingFailover(func() ([]string, error) {
+		hostnames, err := resolve()
+		if err != nil {
+			return nil, err
+		}
+		return keyserverURLs(hostnames), nil
+	}, pool)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyserver{endpoint: ep}, nil
+}
+
+func keyserverPool(authority []byte) (*x509.CertPool, error) {
 	cert, err := wraputil.LoadX509CertFromPEM(authority)
 	if err != nil {
 		return nil, errors.Wrap(err, "while parsing authority certificate")
 	}
-
 	pool := x509.NewCertPool()
 	pool.AddCert(cert)
+	return pool, nil
+}
+
+func keyserverURLs(hostnames []string) []string {
 	// TODO: more robust hostname handling code
-	ep, err := endpoint.NewServerEndpoint(fmt.Sprintf("https://%s/", hostname), pool)
-	if err != nil {
-		return nil, err // should not happen -- the URL provided also satisfies the checked constraints
+	var urls []string
+	for _, hostname := range hostnames {
+		urls = append(urls, fmt.Sprintf("https://%s/", hostname))
 	}
-	return &Keyserver{endpoint: ep}, nil
+	return urls
+}
+
+// WithClock returns a Keyserver that checks the validity of the server's certificate against clk.
+func (k *Keyserver) WithClock(clk clock.Clock) *Keyserver {
+	return &Keyserver{endpoint: k.endpoint.WithClock(clk)}
 }
 
 func (k *Keyserver) GetStatic(staticname string) ([]byte, error) {
@@ -42,3 +93,82 @@ func (k *Keyserver) GetPubkey(authorityname string) ([]byte, error) {
 	}
 	return k.endpoint.Get("/pub/" + authorityname)
 }
+
+// GetRotations fetches the records of past replacements of an authority.
+func (k *Keyserver) GetRotations(authorityname string) ([]byte, error) {
+	if authorityname == "" {
+		return nil, errors.New("authority name is empty")
+	}
+	return k.endpoint.Get("/rotation/" + authorityname)
+}
+
+// GetReenrollChallenge fetches a challenge to sign in order to re-enroll as principal.
+func (k *Keyserver) GetReenrollChallenge(principal string) (string, error) {
+	if principal == "" {
+		return "", errors.New("principal is empty")
+	}
+	challenge, err := k.endpoint.Get("/reenroll/challenge/" + principal)
+	if err != nil {
+		return "", err
+	}
+	return string(challenge), nil
+}
+
+// Reenroll requests a new keygranting certificate based on proof of possession of an SSH host key.
+func (k *Keyserver) Reenroll(request *reenroll.Request) (string, error) {
+	var cert string
+	err := k.endpoint.PostJSON("/reenroll", request, &cert)
+	if err != nil {
+		return "", err
+	}
+	return cert, nil
+}
+
+// SubmitEnrollment asks for a new node to be admitted to the cluster, and returns the ID of the request.
+func (k *Keyserver) SubmitEnrollment(request *enrollment.Request) (string, error) {
+	var id string
+	err := k.endpoint.PostJSON("/enroll", request, &id)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetEnrollmentStatus finds out whether an enrollment request has been approved.
+func (k *Keyserver) GetEnrollmentStatus(id string) (*enrollment.Status, error) {
+	if id == "" {
+		return nil, errors.New("enrollment request ID is empty")
+	}
+	data, err := k.endpoint.Get("/enroll/" + id)
+	if err != nil {
+		return nil, err
+	}
+	status := &enrollment.Status{}
+	err = json.Unmarshal(data, status)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding enrollment status")
+	}
+	return status, nil
+}
+
+// Endpoints reports the health of each keyserver endpoint, in the order configured.
+func (k *Keyserver) Endpoints() []endpoint.EndpointHealth {
+	return k.endpoint.Health()
+}
+
+// LastServed returns the address of the keyserver that most recently handled a request, or "" if none has.
+func (k *Keyserver) LastServed() string {
+	return k.endpoint.LastServed()
+}
+
+// ClockSkew reports how far the clock of the keyserver that most recently handled a request was ahead of ours, or false
+// if that isn't known yet.
+func (k *Keyserver) ClockSkew() (time.Duration, bool) {
+	return k.endpoint.ClockSkew()
+}
+
+// CertBackdate reports how long before issuance the certificates of the keyserver that most recently handled a request
+// become valid, or false if that isn't known.
+func (k *Keyserver) CertBackdate() (time.Duration, bool) {
+	return k.endpoint.CertBackdate()
+}
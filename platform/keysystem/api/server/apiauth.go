@@ -11,7 +11,7 @@ import (
 )
 
 type authenticated struct {
-	endpoint endpoint.ServerEndpoint
+	endpoint endpoint.Failover
 }
 
 func (k *Keyserver) AuthenticateWithToken(token string) (reqtarget.RequestTarget, error) {
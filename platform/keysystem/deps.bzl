@@ -18,3 +18,10 @@ def keysystem_dependencies():
         commit = "51d6538a90f86fe93ac480b35f37b2be17fef232",  # 2.2.2
         importpath = "gopkg.in/yaml.v2",
     )
+
+    go_repository(
+        name = "com_github_miekg_pkcs11",
+        importpath = "github.com/miekg/pkcs11",
+        sum = "h1:Ugu9pdy6vAYku5DEpVWVFPYnzV+bxB+iRdbuFSu7TvU=",
+        version = "v1.1.1",
+    )
@@ -0,0 +1,129 @@
+package hostenv
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sipb/homeworld/platform/util/sdnotify"
+)
+
+// Effects are the changes that the keysystem makes to the rest of the system, beyond the files that it manages.
+type Effects interface {
+	Hostname() (string, error)
+	SetHostname(hostname string) error
+	// Notify sends state assignments, such as sdnotify.Ready, to the service manager.
+	Notify(state ...string) error
+	// Run runs a command to completion, and returns its combined output.
+	Run(argv []string) ([]byte, error)
+	// Output runs a command to completion, and returns only its standard output, for commands that print a result
+	// that must not be mixed up with their diagnostics.
+	Output(argv []string) ([]byte, error)
+	Signal(pid int, signal syscall.Signal) error
+}
+
+// SystemEffects apply to the actual host.
+type SystemEffects struct{}
+
+func (SystemEffects) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+func (SystemEffects) SetHostname(hostname string) error {
+	return exec.Command("hostnamectl", "set-hostname", hostname).Run()
+}
+
+func (SystemEffects) Notify(state ...string) error {
+	return sdnotify.Notify(state...)
+}
+
+func (SystemEffects) Run(argv []string) ([]byte, error) {
+	return exec.Command(argv[0], argv[1:]...).CombinedOutput()
+}
+
+func (SystemEffects) Output(argv []string) ([]byte, error) {
+	return exec.Command(argv[0], argv[1:]...).Output()
+}
+
+func (SystemEffects) Signal(pid int, signal syscall.Signal) error {
+	return syscall.Kill(pid, signal)
+}
+
+// SimulatedEffects record each effect instead of applying it, and otherwise behave as if every effect succeeded, except
+// for commands that have been made to fail with FailRuns.
+type SimulatedEffects struct {
+	mutex    sync.Mutex
+	hostname string
+	log      []string
+	failing  []string
+}
+
+func NewSimulatedEffects() *SimulatedEffects {
+	return &SimulatedEffects{hostname: "localhost"}
+}
+
+func (s *SimulatedEffects) record(effect string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.log = append(s.log, effect)
+}
+
+// Log lists every effect recorded so far, in order.
+func (s *SimulatedEffects) Log() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+// FailRuns makes every later run of a command fail if its command line starts with one of prefixes, in place of any
+// prefixes passed previously. With no prefixes, every command succeeds again.
+func (s *SimulatedEffects) FailRuns(prefixes ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = prefixes
+}
+
+func (s *SimulatedEffects) Hostname() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.hostname, nil
+}
+
+func (s *SimulatedEffects) SetHostname(hostname string) error {
+	s.record("set-hostname " + hostname)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hostname = hostname
+	return nil
+}
+
+func (s *SimulatedEffects) Notify(state ...string) error {
+	s.record("notify " + strings.Join(state, " "))
+	return nil
+}
+
+func (s *SimulatedEffects) Run(argv []string) ([]byte, error) {
+	command := strings.Join(argv, " ")
+	s.record("run " + command)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, prefix := range s.failing {
+		if strings.HasPrefix(command, prefix) {
+			return nil, fmt.Errorf("simulated failure of %s", command)
+		}
+	}
+	return nil, nil
+}
+
+// Output behaves just like Run, because simulated commands print nothing.
+func (s *SimulatedEffects) Output(argv []string) ([]byte, error) {
+	return s.Run(argv)
+}
+
+func (s *SimulatedEffects) Signal(pid int, signal syscall.Signal) error {
+	s.record(fmt.Sprintf("signal %d to %d", signal, pid))
+	return nil
+}
@@ -0,0 +1,78 @@
+package hostenv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+// Env describes the host that a keysystem instance manages: where the files it reads and writes are located, and how
+// it makes changes to the rest of the system. Production instances use System(), but a keyserver and several keyclients
+// can run side by side on one machine, such as in tests, by giving each a separate root and simulated effects.
+type Env struct {
+	// prepended to every path that the instance reads or writes; empty to use the paths as-is
+	Root    string
+	Effects Effects
+	// nil to use the system clock
+	Clock clock.Clock
+}
+
+// setting this environment variable relocates the files of every keysystem binary into the specified directory, but
+// leaves its side effects on the real system; only test harnesses simulate effects
+const RootVariable = "HOMEWORLD_ROOT"
+
+func System() Env {
+	return Env{Effects: SystemEffects{}, Clock: clock.Real}
+}
+
+// Relocated keeps all of an instance's files under root, and only records the side effects that it would have had.
+func Relocated(root string) Env {
+	return Env{Root: root, Effects: NewSimulatedEffects(), Clock: clock.Real}
+}
+
+// FromEnvironment returns System(), unless the RootVariable is set, in which case its files are relocated there. Its
+// effects stay real either way, because a production binary that silently recorded its effects instead of making them
+// would appear to succeed without doing anything.
+func FromEnvironment() Env {
+	if root := os.Getenv(RootVariable); root != "" {
+		return System().Within(root)
+	}
+	return System()
+}
+
+// Within keeps all of an instance's files under root, which is itself relocated by this env, but shares this env's
+// effects and clock, such as for one of several clusters hosted by a single keyserver.
+func (e Env) Within(root string) Env {
+	return Env{Root: e.Path(root), Effects: e.Effects, Clock: e.Clock}
+}
+
+// Path maps an absolute path on the host to where the instance actually stores it.
+func (e Env) Path(path string) string {
+	if e.Root == "" {
+		return path
+	}
+	relocated := filepath.Join(e.Root, path)
+	// directories are sometimes specified with trailing slashes, which filepath.Join would otherwise drop
+	if strings.HasSuffix(path, "/") {
+		relocated += "/"
+	}
+	return relocated
+}
+
+// Now returns the current time according to the env's clock.
+func (e Env) Now() time.Time {
+	return clock.Now(e.Clock)
+}
+
+// Stamp marks the file at path as modified at the env's current time, so that ages computed from modification times
+// agree with the env's clock. Files written under the system clock are already stamped correctly.
+func (e Env) Stamp(path string) error {
+	if e.Clock == nil || e.Clock == clock.Real {
+		return nil
+	}
+	now := e.Now()
+	return os.Chtimes(path, now, now)
+}
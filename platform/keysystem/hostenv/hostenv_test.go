@@ -0,0 +1,143 @@
+package hostenv
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+func TestSystem_Path(t *testing.T) {
+	if path := System().Path("/etc/homeworld/keys/"); path != "/etc/homeworld/keys/" {
+		t.Errorf("unexpected relocation to %s", path)
+	}
+}
+
+func TestRelocated_Path(t *testing.T) {
+	env := Relocated("/tmp/node1")
+	if path := env.Path("/etc/homeworld/config/local.conf"); path != "/tmp/node1/etc/homeworld/config/local.conf" {
+		t.Errorf("wrong relocation to %s", path)
+	}
+	if path := env.Path("/etc/homeworld/keyserver/authorities/"); path != "/tmp/node1/etc/homeworld/keyserver/authorities/" {
+		t.Errorf("wrong relocation to %s", path)
+	}
+}
+
+func TestWithin(t *testing.T) {
+	effects := NewSimulatedEffects()
+	env := Env{Root: "/tmp/node3", Effects: effects, Clock: clock.Real}.Within("/srv/homeworld/staging")
+	if path := env.Path("/etc/homeworld/keyserver/setup.yaml"); path != "/tmp/node3/srv/homeworld/staging/etc/homeworld/keyserver/setup.yaml" {
+		t.Errorf("wrong relocation to %s", path)
+	}
+	if env.Effects != effects || env.Clock != clock.Real {
+		t.Error("effects and clock not shared")
+	}
+	if path := System().Within("/srv/homeworld/staging").Path("/var/lib/homeworld/keyserver/"); path != "/srv/homeworld/staging/var/lib/homeworld/keyserver/" {
+		t.Errorf("wrong relocation to %s", path)
+	}
+}
+
+func TestFromEnvironment(t *testing.T) {
+	defer os.Unsetenv(RootVariable)
+	os.Unsetenv(RootVariable)
+	if env := FromEnvironment(); env.Root != "" {
+		t.Errorf("unexpected root %s", env.Root)
+	}
+	os.Setenv(RootVariable, "/tmp/node2")
+	env := FromEnvironment()
+	if env.Root != "/tmp/node2" {
+		t.Errorf("wrong root %s", env.Root)
+	}
+	if _, ok := env.Effects.(SystemEffects); !ok {
+		t.Errorf("relocated env should still have system effects, not %T", env.Effects)
+	}
+}
+
+func TestSimulatedEffects(t *testing.T) {
+	effects := NewSimulatedEffects()
+	if err := effects.SetHostname("node1"); err != nil {
+		t.Fatal(err)
+	}
+	hostname, err := effects.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostname != "node1" {
+		t.Errorf("wrong hostname %s", hostname)
+	}
+	if _, err := effects.Run([]string{"update-ca-certificates"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := effects.Signal(1234, syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	if err := effects.Notify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"set-hostname node1", "run update-ca-certificates", "signal 1 to 1234", "notify READY=1"}
+	if !reflect.DeepEqual(effects.Log(), expected) {
+		t.Errorf("wrong effects recorded: %v", effects.Log())
+	}
+}
+
+func TestSystemEffects_Output(t *testing.T) {
+	argv := []string{"sh", "-c", "echo result; echo warning >&2"}
+	output, err := SystemEffects{}.Output(argv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "result\n" {
+		t.Errorf("wrong standard output %q", output)
+	}
+	combined, err := SystemEffects{}.Run(argv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(combined) != "result\nwarning\n" {
+		t.Errorf("wrong combined output %q", combined)
+	}
+}
+
+func TestSimulatedEffects_FailRuns(t *testing.T) {
+	effects := NewSimulatedEffects()
+	effects.FailRuns("systemctl restart")
+	if _, err := effects.Run([]string{"systemctl", "restart", "kubelet.service"}); err == nil {
+		t.Error("expected simulated failure")
+	}
+	if _, err := effects.Output([]string{"systemctl", "show", "kubelet.service"}); err != nil {
+		t.Error(err)
+	}
+	effects.FailRuns()
+	if _, err := effects.Run([]string{"systemctl", "restart", "kubelet.service"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnv_Stamp(t *testing.T) {
+	f, err := ioutil.TempFile("", "hostenv-stamp-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	start := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	env := Relocated("/tmp/node1")
+	env.Clock = clock.NewFake(start)
+	if !env.Now().Equal(start) {
+		t.Error("env did not use its clock")
+	}
+	if err := env.Stamp(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(start) {
+		t.Errorf("wrong modification time %v", info.ModTime())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/sipb/homeworld/platform/keysystem/api/endpoint"
@@ -18,16 +19,22 @@ import (
 )
 
 func Bootstrap(api string, nac *actloop.NewActionContext) {
+	tokenpath, keypath := nac.State.Env.Path(paths.BootstrapTokenPath), nac.State.Env.Path(paths.GrantingKeyPath)
+	info := fmt.Sprintf("bootstrap with token API %s from path %s", api, tokenpath)
+	nac.Checked(info)
+	// so that a newly-provided token is used immediately
+	nac.Schedule(info, tokenpath, time.Time{})
 	if !nac.State.CanRetry(api) {
 		// nothing to do
 	} else if nac.State.Keygrant != nil {
 		// nothing to do
-	} else if !fileutil.Exists(paths.BootstrapTokenPath) {
+	} else if !fileutil.Exists(tokenpath) {
 		// nothing to do
-	} else if !fileutil.Exists(paths.GrantingKeyPath) {
-		nac.Blocked(fmt.Errorf("key does not yet exist: %s", paths.GrantingKeyPath))
+	} else if !fileutil.Exists(keypath) {
+		nac.Blocked(info, fmt.Errorf("key does not yet exist: %s", keypath))
+	} else if nac.BackingOff(info) {
+		// wait to retry
 	} else {
-		info := fmt.Sprintf("bootstrap with token API %s from path %s", api, paths.BootstrapTokenPath)
 		err := bootstrap(api, nac.State)
 		if err != nil {
 			nac.Errored(info, err)
@@ -37,8 +44,8 @@ func Bootstrap(api string, nac *actloop.NewActionContext) {
 	}
 }
 
-func getToken() (string, error) {
-	contents, err := ioutil.ReadFile(paths.BootstrapTokenPath)
+func getToken(tokenpath string) (string, error) {
+	contents, err := ioutil.ReadFile(tokenpath)
 	if err != nil {
 		return "", err
 	}
@@ -54,8 +61,8 @@ func getToken() (string, error) {
 	return token, nil
 }
 
-func buildCSR() ([]byte, error) {
-	privkey, err := ioutil.ReadFile(paths.GrantingKeyPath)
+func buildCSR(keypath string) ([]byte, error) {
+	privkey, err := ioutil.ReadFile(keypath)
 	if err != nil {
 		return nil, err
 	}
@@ -67,7 +74,8 @@ func buildCSR() ([]byte, error) {
 }
 
 func sendRequest(state *state.ClientState, api string, param string) (string, error) {
-	token, err := getToken()
+	tokenpath := state.Env.Path(paths.BootstrapTokenPath)
+	token, err := getToken(tokenpath)
 	if err != nil {
 		return "", err
 	}
@@ -83,7 +91,7 @@ func sendRequest(state *state.ClientState, api string, param string) (string, er
 		return "", err
 	}
 	// remove token file, because it can't be used more than once, enforced by the server
-	err = os.Remove(paths.BootstrapTokenPath)
+	err = os.Remove(tokenpath)
 	if err != nil {
 		return "", err
 	}
@@ -91,7 +99,7 @@ func sendRequest(state *state.ClientState, api string, param string) (string, er
 }
 
 func bootstrap(api string, state *state.ClientState) error {
-	csr, err := buildCSR()
+	csr, err := buildCSR(state.Env.Path(paths.GrantingKeyPath))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,126 @@
+package checkin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/api/endpoint"
+	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/inventory"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+// Version identifies the build of the keyclient in check-ins. It is set at link time.
+var Version = "unknown"
+
+// serial finds the serial number of a TLS or SSH certificate, in hexadecimal.
+func serial(certpath string) (string, error) {
+	data, err := ioutil.ReadFile(certpath)
+	if err != nil {
+		return "", err
+	}
+	if wraputil.IsPEMBlock(data) {
+		cert, err := wraputil.LoadX509CertFromPEM(data)
+		if err != nil {
+			return "", err
+		}
+		return cert.SerialNumber.Text(16), nil
+	}
+	pubkey, err := wraputil.ParseSSHTextPubkey(data)
+	if err != nil {
+		return "", err
+	}
+	cert, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return "", fmt.Errorf("found public key instead of certificate in %s", certpath)
+	}
+	return fmt.Sprintf("%x", cert.Serial), nil
+}
+
+// buildReport summarizes the state of the other actions, as they were when they last ran.
+func buildReport(nac *actloop.NewActionContext, info string) *inventory.Report {
+	report := &inventory.Report{Version: Version}
+	for _, action := range nac.Snapshot().Actions {
+		if action.Info == info {
+			continue
+		}
+		if len(action.BlockedBy) > 0 {
+			report.Blocked = append(report.Blocked, action.Info)
+		}
+		if action.CertPath != "" && action.Expires != nil {
+			// a certificate that can't be read is still reported, because its expiration is already known
+			serial, _ := serial(action.CertPath)
+			report.Certificates = append(report.Certificates, inventory.Certificate{
+				Path:    action.CertPath,
+				Serial:  serial,
+				Expires: *action.Expires,
+			})
+		}
+	}
+	return report
+}
+
+// CheckIn reports this node's keyclient version, managed certificates, blocked actions and clock time to the keyserver,
+// so that administrators can see the state of the whole cluster. A check-in is sent every interval, and also as soon as
+// anything other than the time has changed. This should be the last action, so that it can report on the others.
+func CheckIn(api string, interval time.Duration, nac *actloop.NewActionContext) {
+	info := fmt.Sprintf("check in with keyserver through api %s every %v", api, interval)
+	nac.Checked(info)
+	if !nac.State.CanRetry(api) {
+		// nothing to do
+		return
+	}
+	if nac.State.Keygrant == nil {
+		nac.Blocked(info, errors.New("no keygranting certificate ready"))
+		return
+	}
+	report := buildReport(nac, info)
+	content, err := json.Marshal(report)
+	if err != nil {
+		nac.Errored(info, err)
+		return
+	}
+	dueAt := nac.State.LastCheckin.Add(interval)
+	nac.Schedule(info, "", dueAt)
+	if string(content) == nac.State.LastCheckinContent && nac.State.Env.Now().Before(dueAt) {
+		// nothing to do
+		return
+	}
+	if nac.BackingOff(info) {
+		// wait to retry
+		return
+	}
+	report.Time = nac.State.Env.Now()
+	err = send(api, report, nac)
+	if err != nil {
+		nac.Errored(info, err)
+		return
+	}
+	nac.State.LastCheckin = report.Time
+	nac.State.LastCheckinContent = string(content)
+	nac.Schedule(info, "", report.Time.Add(interval))
+}
+
+func send(api string, report *inventory.Report, nac *actloop.NewActionContext) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	rt, err := nac.State.Keyserver.AuthenticateWithCert(*nac.State.Keygrant)
+	if err != nil {
+		return err // no actual way for this part to fail
+	}
+	_, err = reqtarget.SendRequest(rt, api, string(data))
+	if err != nil {
+		if _, is := errors.Cause(err).(endpoint.OperationForbidden); is {
+			nac.State.RetryFailed(api)
+		}
+		return errors.Wrap(err, "while checking in")
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package clockcheck
+
+import (
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+)
+
+const info = "check clock against keyserver"
+
+// CheckClock reports the action loop as blocked while our clock is too far from the keyserver's, so that the problem is
+// noticed even when no certificate is due for renewal. The skew is measured from every response from the keyserver.
+func CheckClock(nac *actloop.NewActionContext) {
+	nac.Checked(info)
+	err := nac.State.CheckClock()
+	if err != nil {
+		nac.Blocked(info, err)
+	}
+}
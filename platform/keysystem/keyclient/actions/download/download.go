@@ -1,51 +1,69 @@
 package download
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/pkg/errors"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
-	"strings"
 	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/reload"
 	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
 )
 
-type FetchFunc func(nac *actloop.NewActionContext) ([]byte, error)
+type FetchFunc func(nac *actloop.NewActionContext, info string) ([]byte, error)
 
 type config struct {
 	Path    string
 	Refresh time.Duration
 	Mode    uint64
+	// checks downloaded data before it replaces the current file; nil to accept anything
+	Validate func(nac *actloop.NewActionContext, info string, data []byte) error
+	// run after a new version of the file is written
+	Hooks []reload.Hook
 }
 
-func DownloadAuthority(name string, path string, refreshPeriod time.Duration, nac *actloop.NewActionContext) {
+// DownloadAuthority keeps a local copy of an authority up to date, but refuses to replace it with an authority that
+// doesn't match the pinned authority unless the keyserver has published a rotation record for the change.
+func DownloadAuthority(name string, path string, refreshPeriod time.Duration, hooks []reload.Hook, nac *actloop.NewActionContext) {
 	act := &config{
-		Path:    path,
+		Path:    nac.State.Env.Path(path),
 		Refresh: refreshPeriod,
 		Mode:    0644,
+		Validate: func(nac *actloop.NewActionContext, info string, data []byte) error {
+			err := validateAuthority(data)
+			if err != nil {
+				return err
+			}
+			return pinAuthority(name, nac, info, data)
+		},
+		Hooks: hooks,
 	}
 	fetch, fetchInfo := fetchAuthority(name)
 	act.Download(nac, fetch, fetchInfo)
 }
 
-func DownloadStatic(name string, path string, refreshPeriod time.Duration, nac *actloop.NewActionContext) {
+func DownloadStatic(name string, path string, refreshPeriod time.Duration, hooks []reload.Hook, nac *actloop.NewActionContext) {
 	act := &config{
-		Path:    path,
+		Path:    nac.State.Env.Path(path),
 		Refresh: refreshPeriod,
 		Mode:    0644,
+		Hooks:   hooks,
 	}
 	fetch, fetchInfo := fetchStatic(name)
 	act.Download(nac, fetch, fetchInfo)
 }
 
-func DownloadFromAPI(api string, path string, refreshPeriod time.Duration, mode uint64, nac *actloop.NewActionContext) {
+func DownloadFromAPI(api string, path string, refreshPeriod time.Duration, mode uint64, hooks []reload.Hook, nac *actloop.NewActionContext) {
 	act := &config{
-		Path:    path,
+		Path:    nac.State.Env.Path(path),
 		Refresh: refreshPeriod,
 		Mode:    mode,
+		Hooks:   hooks,
 	}
 	fetch, fetchInfo := fetchAPI(api)
 	act.Download(nac, fetch, fetchInfo)
@@ -53,7 +71,8 @@ func DownloadFromAPI(api string, path string, refreshPeriod time.Duration, mode
 
 func (da *config) Download(nac *actloop.NewActionContext, fetcher FetchFunc, fetchInfo string) {
 	info := fmt.Sprintf("download to file %s (mode %o) every %v: %s", da.Path, da.Mode, da.Refresh, fetchInfo)
-	if da.needsRefresh(nac, info) {
+	nac.Checked(info)
+	if da.needsRefresh(nac, info) && !nac.BackingOff(info) {
 		err := da.refresh(nac, fetcher, info)
 		if err != nil {
 			nac.Errored(info, err)
@@ -63,6 +82,7 @@ func (da *config) Download(nac *actloop.NewActionContext, fetcher FetchFunc, fet
 
 func (da *config) needsRefresh(nac *actloop.NewActionContext, info string) bool {
 	if statinfo, err := os.Stat(da.Path); err != nil {
+		nac.Schedule(info, da.Path, time.Time{})
 		if os.IsNotExist(err) {
 			return true
 		}
@@ -70,15 +90,14 @@ func (da *config) needsRefresh(nac *actloop.NewActionContext, info string) bool
 		nac.Errored(info, err)
 		return false
 	} else {
-		staleness := time.Now().Sub(statinfo.ModTime())
+		nac.Schedule(info, da.Path, statinfo.ModTime().Add(da.Refresh))
+		staleness := nac.State.Env.Now().Sub(statinfo.ModTime())
 		return staleness > da.Refresh
 	}
 }
 
-const SystemCertificatesBase = "/usr/local/share/ca-certificates/extra/"
-
 func (da *config) refresh(nac *actloop.NewActionContext, fetcher FetchFunc, info string) error {
-	data, err := fetcher(nac)
+	data, err := fetcher(nac, info)
 	if err != nil {
 		return err
 	}
@@ -90,17 +109,51 @@ func (da *config) refresh(nac *actloop.NewActionContext, fetcher FetchFunc, info
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(da.Path, data, os.FileMode(da.Mode))
-	if err != nil {
+	if da.Validate != nil {
+		err = da.Validate(nac, info, data)
+		if err != nil {
+			return errors.Wrap(err, "while validating downloaded data")
+		}
+	}
+	current, err := ioutil.ReadFile(da.Path)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	if strings.HasPrefix(da.Path, SystemCertificatesBase) {
-		nac.Logger.Println("reloading ca-certificates")
-		err := exec.Command("update-ca-certificates").Run()
+	if err == nil && bytes.Equal(current, data) {
+		// most refreshes return the same data, and those shouldn't replace the previous version or restart daemons
+		err = fileutil.WriteAtomic(da.Path, data, os.FileMode(da.Mode))
+		if err == nil {
+			err = nac.State.Env.Stamp(da.Path)
+		}
 		if err != nil {
 			return err
 		}
+		nac.NotifyPerformed(info)
+		return nil
+	}
+	err = fileutil.ReplaceKeepingPrevious(da.Path, data, os.FileMode(da.Mode))
+	if err == nil {
+		err = nac.State.Env.Stamp(da.Path)
+	}
+	if err != nil {
+		return err
 	}
 	nac.NotifyPerformed(info)
+	nac.TriggerHooks(info, da.Hooks, da.rollback)
 	return nil
 }
+
+// rollback reinstates the version of the file replaced by the last refresh
+func (da *config) rollback() error {
+	return fileutil.RestorePrevious(da.Path)
+}
+
+// authorities are either PEM-encoded TLS certificates or SSH public keys
+func validateAuthority(data []byte) error {
+	if wraputil.IsPEMBlock(data) {
+		_, err := wraputil.LoadX509CertFromPEM(data)
+		return err
+	}
+	_, err := wraputil.ParseSSHTextPubkey(data)
+	return err
+}
@@ -11,7 +11,7 @@ import (
 
 func fetchAuthority(authority string) (FetchFunc, string) {
 	info := fmt.Sprintf("pubkey for authority %s", authority)
-	fetch := func(nac *actloop.NewActionContext) ([]byte, error) {
+	fetch := func(nac *actloop.NewActionContext, _ string) ([]byte, error) {
 		result, err := nac.State.Keyserver.GetPubkey(authority)
 		if err != nil {
 			return nil, err
@@ -26,7 +26,7 @@ func fetchAuthority(authority string) (FetchFunc, string) {
 
 func fetchStatic(static string) (FetchFunc, string) {
 	info := fmt.Sprintf("static file %s", static)
-	fetch := func(nac *actloop.NewActionContext) ([]byte, error) {
+	fetch := func(nac *actloop.NewActionContext, _ string) ([]byte, error) {
 		result, err := nac.State.Keyserver.GetStatic(static)
 		if err != nil {
 			return nil, err
@@ -41,13 +41,13 @@ func fetchStatic(static string) (FetchFunc, string) {
 
 func fetchAPI(api string) (FetchFunc, string) {
 	info := fmt.Sprintf("result from api %s", api)
-	fetch := func(nac *actloop.NewActionContext) ([]byte, error) {
+	fetch := func(nac *actloop.NewActionContext, info string) ([]byte, error) {
 		if !nac.State.CanRetry(api) {
 			// nothing to do
 			return nil, nil
 		}
 		if nac.State.Keygrant == nil {
-			nac.Blocked(errors.New("no keygranting certificate ready"))
+			nac.Blocked(info, errors.New("no keygranting certificate ready"))
 			return nil, nil
 		}
 		rt, err := nac.State.Keyserver.AuthenticateWithCert(*nac.State.Keygrant)
@@ -0,0 +1,75 @@
+package download
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+)
+
+// pinAuthority only accepts a downloaded authority if it matches the authority pinned for this node, or if the keyserver
+// can show a chain of rotation records from the pinned authority to the downloaded one. If nothing is pinned yet, the
+// downloaded authority is pinned, on the assumption that the first download happens before anything could be tampered
+// with. Nodes installed by spire have their pins included in the installation image instead.
+func pinAuthority(name string, nac *actloop.NewActionContext, info string, data []byte) error {
+	pinpath := path.Join(nac.State.Env.Path(paths.AuthorityPinDirectory), name)
+	offered, err := rotation.Fingerprint(data)
+	if err != nil {
+		return err
+	}
+	pinned, err := ioutil.ReadFile(pinpath)
+	if os.IsNotExist(err) {
+		err = fileutil.EnsureIsFolder(path.Dir(pinpath))
+		if err != nil {
+			return err
+		}
+		err = fileutil.WriteAtomic(pinpath, data, os.FileMode(0644))
+		if err != nil {
+			return errors.Wrap(err, "while pinning authority")
+		}
+		nac.Logger.Printf("pinned authority %s on first use: %s\n", name, offered)
+		nac.ReportPin(info, name, offered, "")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pinnedFingerprint, err := rotation.Fingerprint(pinned)
+	if err != nil {
+		return errors.Wrapf(err, "while loading pin for authority %s", name)
+	}
+	if pinnedFingerprint == offered {
+		nac.ReportPin(info, name, pinnedFingerprint, "")
+		return nil
+	}
+	err = followRotations(name, nac, pinned, data)
+	if err != nil {
+		nac.Logger.Printf("PIN MISMATCH: keyserver offered authority %s with key %s, but %s is pinned: %v\n", name, offered, pinnedFingerprint, err)
+		nac.ReportPin(info, name, pinnedFingerprint, offered)
+		return fmt.Errorf("refusing to replace pinned authority %s (%s) with %s: %v", name, pinnedFingerprint, offered, err)
+	}
+	err = fileutil.WriteAtomic(pinpath, data, os.FileMode(0644))
+	if err != nil {
+		return errors.Wrap(err, "while updating pinned authority")
+	}
+	nac.Logger.Printf("authority %s rotated from %s to %s\n", name, pinnedFingerprint, offered)
+	nac.ReportPin(info, name, offered, "")
+	return nil
+}
+
+func followRotations(name string, nac *actloop.NewActionContext, pinned []byte, offered []byte) error {
+	data, err := nac.State.Keyserver.GetRotations(name)
+	if err != nil {
+		return errors.Wrap(err, "while fetching rotation records")
+	}
+	records, err := rotation.Parse(data)
+	if err != nil {
+		return err
+	}
+	return rotation.Follow(name, pinned, records, offered)
+}
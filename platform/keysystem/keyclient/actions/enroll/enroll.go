@@ -0,0 +1,175 @@
+package enroll
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/util/csrutil"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+)
+
+// how often to ask the keyserver whether a pending enrollment request has been decided
+const PollInterval = time.Minute
+
+// intent is stored in the enrollment file, to describe the node that this machine wants to become, and to remember the
+// ID of its request once it has been submitted.
+type intent struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+	Kind     string `json:"kind"`
+	ID       string `json:"id,omitempty"`
+}
+
+func loadIntent(enrollpath string) (*intent, error) {
+	data, err := ioutil.ReadFile(enrollpath)
+	if err != nil {
+		return nil, err
+	}
+	in := &intent{}
+	err = json.Unmarshal(data, in)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding enrollment file")
+	}
+	return in, nil
+}
+
+func (in *intent) save(enrollpath string) error {
+	data, err := json.MarshalIndent(in, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = fileutil.EnsureIsFolder(path.Dir(enrollpath))
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(enrollpath, data, os.FileMode(0644))
+}
+
+// RequestEnrollment records that this machine should ask to join the cluster as the described node, replacing any
+// earlier request. The request is submitted by Enroll.
+func RequestEnrollment(env hostenv.Env, hostname string, ip string, kind string) error {
+	in := &intent{Hostname: hostname, IP: ip, Kind: kind}
+	return in.save(env.Path(paths.EnrollmentPath))
+}
+
+// Enroll submits the enrollment request recorded by RequestEnrollment, if this node has no other way to get a
+// keygranting certificate, and then waits for an administrator to approve it.
+func Enroll(hostkey string, nac *actloop.NewActionContext) {
+	hostkey = nac.State.Env.Path(hostkey)
+	enrollpath, keypath := nac.State.Env.Path(paths.EnrollmentPath), nac.State.Env.Path(paths.GrantingKeyPath)
+	info := fmt.Sprintf("enroll as requested in %s", enrollpath)
+	nac.Checked(info)
+	// so that a new request is submitted immediately
+	nac.Schedule(info, enrollpath, time.Time{})
+	if nac.State.Keygrant != nil {
+		// nothing to do
+	} else if fileutil.Exists(nac.State.Env.Path(paths.BootstrapTokenPath)) {
+		// nothing to do; bootstrap will handle it
+	} else if !fileutil.Exists(enrollpath) {
+		// nothing to do
+	} else if !fileutil.Exists(keypath) {
+		nac.Blocked(info, fmt.Errorf("key does not yet exist: %s", keypath))
+	} else if !fileutil.Exists(hostkey) {
+		nac.Blocked(info, fmt.Errorf("ssh host key does not yet exist: %s", hostkey))
+	} else if nac.BackingOff(info) {
+		// wait to retry
+	} else {
+		waiting, err := enroll(enrollpath, hostkey, keypath, nac)
+		if err != nil {
+			nac.Errored(info, err)
+		} else if waiting != nil {
+			nac.Blocked(info, waiting)
+			nac.Schedule(info, enrollpath, nac.State.Env.Now().Add(PollInterval))
+		} else {
+			nac.NotifyPerformed(info)
+		}
+	}
+}
+
+func hostKeyFingerprint(hostkey string) (string, error) {
+	data, err := ioutil.ReadFile(hostkey)
+	if err != nil {
+		return "", err
+	}
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return "", errors.Wrap(err, "while parsing ssh host key")
+	}
+	return ssh.FingerprintSHA256(pubkey), nil
+}
+
+func submit(in *intent, hostkey string, keypath string, nac *actloop.NewActionContext) error {
+	fingerprint, err := hostKeyFingerprint(hostkey)
+	if err != nil {
+		return err
+	}
+	privkey, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return err
+	}
+	csr, err := csrutil.BuildTLSCSR(privkey)
+	if err != nil {
+		return err
+	}
+	in.ID, err = nac.State.Keyserver.SubmitEnrollment(&enrollment.Request{
+		Hostname:           in.Hostname,
+		IP:                 in.IP,
+		Kind:               in.Kind,
+		CSR:                string(csr),
+		HostKeyFingerprint: fingerprint,
+	})
+	if err != nil {
+		return errors.Wrap(err, "while submitting enrollment request")
+	}
+	nac.Logger.Printf("submitted enrollment request %s for %s with host key %s\n", in.ID, in.Hostname, fingerprint)
+	return nil
+}
+
+// enroll returns a non-nil waiting error if the request has not been approved yet.
+func enroll(enrollpath string, hostkey string, keypath string, nac *actloop.NewActionContext) (waiting error, err error) {
+	in, err := loadIntent(enrollpath)
+	if err != nil {
+		return nil, err
+	}
+	if in.ID == "" {
+		err = submit(in, hostkey, keypath, nac)
+		if err != nil {
+			return nil, err
+		}
+		err = in.save(enrollpath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	status, err := nac.State.Keyserver.GetEnrollmentStatus(in.ID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while checking on enrollment request %s", in.ID)
+	}
+	switch status.State {
+	case enrollment.Pending:
+		return fmt.Errorf("waiting for an administrator to approve enrollment request %s", in.ID), nil
+	case enrollment.Denied:
+		return fmt.Errorf("enrollment request %s was denied", in.ID), nil
+	case enrollment.Approved:
+		if status.Certificate == "" {
+			return nil, errors.New("received empty certificate")
+		}
+		err = nac.State.ReplaceKeygrantingCert([]byte(status.Certificate))
+		if err != nil {
+			return nil, err
+		}
+		return nil, os.Remove(enrollpath)
+	default:
+		return nil, fmt.Errorf("unrecognized state of enrollment request %s: %s", in.ID, status.State)
+	}
+}
@@ -2,37 +2,19 @@ package hostname
 
 import (
 	"errors"
-	"io/ioutil"
 	"os"
-	"os/exec"
-	"strings"
+	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/localconf"
 )
 
-func readConfig(path string) (map[string]string, error) {
-	conf, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	kvs := map[string]string{}
-	for _, line := range strings.Split(string(conf), "\n") {
-		line = strings.TrimSpace(line)
-		if len(line) > 0 && line[0] != '#' {
-			kv := strings.SplitN(line, "=", 2)
-			if len(kv) != 2 {
-				return nil, errors.New("incorrectly formatted local.conf")
-			}
-			kvs[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
-		}
-	}
-	return kvs, nil
-}
+const info = "reload hostname"
 
 func performReload(path string, nac *actloop.NewActionContext) error {
-	conf, err := readConfig(path)
+	conf, err := localconf.Read(path)
 	if os.IsNotExist(err) {
-		nac.Blocked(err)
+		nac.Blocked(info, err)
 		return nil
 	} else if err != nil {
 		return err
@@ -41,25 +23,28 @@ func performReload(path string, nac *actloop.NewActionContext) error {
 		if !found {
 			return errors.New("no HOST_NODE entry in local.conf")
 		}
-		currentHostname, err := os.Hostname()
+		currentHostname, err := nac.State.Env.Effects.Hostname()
 		if err != nil {
 			return err
 		}
 		if hostname == currentHostname {
 			return nil
 		}
-		err = exec.Command("hostnamectl", "set-hostname", hostname).Run()
+		err = nac.State.Env.Effects.SetHostname(hostname)
 		if err != nil {
 			return err
 		}
-		nac.NotifyPerformed("reload hostname")
+		nac.NotifyPerformed(info)
 		return nil
 	}
 }
 
 func ReloadHostnameFrom(path string, nac *actloop.NewActionContext) {
+	path = nac.State.Env.Path(path)
+	nac.Checked(info)
+	nac.Schedule(info, path, time.Time{})
 	err := performReload(path, nac)
 	if err != nil {
-		nac.Errored("reload hostname", err)
+		nac.Errored(info, err)
 	}
 }
@@ -0,0 +1,200 @@
+package hosts
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+// Node is a single entry in the node directory served by the keyserver.
+type Node struct {
+	IP       string
+	DNS      string
+	Hostname string
+}
+
+// the node directory is written into system files, so names are restricted to what DNS itself allows
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?)*$`)
+
+// ReadDirectory parses a node directory, which has the same format as /etc/hosts: an IP address, the node's fully
+// qualified name, and its short hostname on each line.
+func ReadDirectory(path string) ([]Node, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []Node
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("incorrectly formatted node directory line: '%s'", line)
+		}
+		if net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("invalid IP address in node directory: %s", fields[0])
+		}
+		for _, name := range fields[1:] {
+			if !namePattern.MatchString(name) {
+				return nil, fmt.Errorf("invalid name in node directory: %s", name)
+			}
+		}
+		nodes = append(nodes, Node{IP: fields[0], DNS: fields[1], Hostname: fields[2]})
+	}
+	return nodes, nil
+}
+
+const blockBegin = "# BEGIN homeworld nodes (maintained by keyclient; do not edit)"
+const blockEnd = "# END homeworld nodes"
+
+// findLine finds the first line at or after offset from that consists of exactly line, and returns the offsets of its
+// start and of the start of the next line. The last line of contents may lack a trailing newline.
+func findLine(contents string, line string, from int) (start int, next int, found bool) {
+	for from <= len(contents) {
+		index := strings.Index(contents[from:], line)
+		if index == -1 {
+			return 0, 0, false
+		}
+		start = from + index
+		next = start + len(line)
+		atStart := start == 0 || contents[start-1] == '\n'
+		if atStart && next == len(contents) {
+			return start, next, true
+		}
+		if atStart && contents[next] == '\n' {
+			return start, next + 1, true
+		}
+		from = start + 1
+	}
+	return 0, 0, false
+}
+
+// replaceBlock replaces the managed block in a file's contents with the specified lines, or appends a new managed
+// block if there isn't one. Everything outside of the block is left alone, so that administrators can still add their
+// own entries.
+func replaceBlock(contents string, lines []string) (string, error) {
+	block := blockBegin + "\n" + strings.Join(append(lines, blockEnd), "\n") + "\n"
+	begin, afterBegin, found := findLine(contents, blockBegin, 0)
+	if !found {
+		if contents != "" && !strings.HasSuffix(contents, "\n") {
+			contents += "\n"
+		}
+		return contents + block, nil
+	}
+	_, end, found := findLine(contents, blockEnd, afterBegin)
+	if !found {
+		return "", errors.New("managed block is missing its end marker")
+	}
+	return contents[:begin] + block + contents[end:], nil
+}
+
+// generates the lines of a managed block from the node directory
+type generator func(nodes []Node) ([]string, error)
+
+// maintain keeps the managed block in target up to date with the node directory. Any other files that the generator
+// reads are listed in inputs, so that the block is updated as soon as they change.
+func maintain(info string, directory string, inputs []string, target string, generate generator, nac *actloop.NewActionContext) {
+	nac.Checked(info)
+	for _, input := range append([]string{directory}, inputs...) {
+		nac.Schedule(info, input, time.Time{})
+		if !fileutil.Exists(input) {
+			nac.Blocked(info, fmt.Errorf("file does not yet exist: %s", input))
+			return
+		}
+	}
+	changed, err := update(directory, target, generate)
+	if err != nil {
+		nac.Errored(info, err)
+	} else if changed {
+		nac.NotifyPerformed(info)
+	}
+}
+
+func update(directory string, target string, generate generator) (changed bool, err error) {
+	nodes, err := ReadDirectory(directory)
+	if err != nil {
+		return false, errors.Wrap(err, "while reading node directory")
+	}
+	lines, err := generate(nodes)
+	if err != nil {
+		return false, err
+	}
+	current, err := ioutil.ReadFile(target)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	updated, err := replaceBlock(string(current), lines)
+	if err != nil {
+		return false, errors.Wrapf(err, "while updating %s", target)
+	}
+	if updated == string(current) {
+		return false, nil
+	}
+	err = fileutil.EnsureIsFolder(path.Dir(target))
+	if err != nil {
+		return false, err
+	}
+	err = fileutil.WriteAtomic(target, []byte(updated), os.FileMode(0644))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MaintainHosts keeps a block of entries for every node in the cluster in an /etc/hosts file, so that nodes can reach
+// each other by name without depending on external DNS.
+func MaintainHosts(directory string, hostsfile string, nac *actloop.NewActionContext) {
+	directory, hostsfile = nac.State.Env.Path(directory), nac.State.Env.Path(hostsfile)
+	info := fmt.Sprintf("maintain node entries in %s from %s", hostsfile, directory)
+	maintain(info, directory, nil, hostsfile, func(nodes []Node) ([]string, error) {
+		var lines []string
+		for _, node := range nodes {
+			lines = append(lines, fmt.Sprintf("%s\t%s %s", node.IP, node.DNS, node.Hostname))
+		}
+		return lines, nil
+	}, nac)
+}
+
+// the same marker is used by spire for the entries it adds to administrators' own known_hosts files
+const KnownHostsMarker = "homeworld-keydef"
+
+// MaintainKnownHosts keeps an @cert-authority entry in an ssh_known_hosts file, which trusts the SSH host authority
+// for every name and address of every node in the cluster, so that host keys never need to be verified by hand.
+func MaintainKnownHosts(directory string, authority string, knownhosts string, nac *actloop.NewActionContext) {
+	env := nac.State.Env
+	directory, authority, knownhosts = env.Path(directory), env.Path(authority), env.Path(knownhosts)
+	info := fmt.Sprintf("maintain cert-authority entry in %s from %s and %s", knownhosts, directory, authority)
+	maintain(info, directory, []string{authority}, knownhosts, func(nodes []Node) ([]string, error) {
+		if len(nodes) == 0 {
+			return nil, nil
+		}
+		data, err := ioutil.ReadFile(authority)
+		if err != nil {
+			return nil, err
+		}
+		pubkey, err := wraputil.ParseSSHTextPubkey(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "while parsing SSH host authority")
+		}
+		var patterns []string
+		for _, node := range nodes {
+			patterns = append(patterns, node.DNS, node.Hostname, node.IP)
+		}
+		entry := fmt.Sprintf("@cert-authority %s %s %s", strings.Join(patterns, ","),
+			strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))), KnownHostsMarker)
+		return []string{entry}, nil
+	}, nac)
+}
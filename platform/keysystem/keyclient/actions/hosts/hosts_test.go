@@ -0,0 +1,119 @@
+package hosts
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func TestReplaceBlock(t *testing.T) {
+	lines := []string{"10.0.0.1\tnode1.example.com node1"}
+	block := blockBegin + "\n10.0.0.1\tnode1.example.com node1\n" + blockEnd + "\n"
+	oldBlock := blockBegin + "\n10.0.0.9\tnode9.example.com node9\n" + blockEnd + "\n"
+	for _, test := range []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{"empty", "", block},
+		{"appended", "127.0.0.1\tlocalhost\n", "127.0.0.1\tlocalhost\n" + block},
+		{"appended without newline", "127.0.0.1\tlocalhost", "127.0.0.1\tlocalhost\n" + block},
+		{"replaced", oldBlock, block},
+		{"replaced between entries", "127.0.0.1\tlocalhost\n" + oldBlock + "10.1.0.1\tother\n",
+			"127.0.0.1\tlocalhost\n" + block + "10.1.0.1\tother\n"},
+		{"replaced at end of file", "127.0.0.1\tlocalhost\n" + oldBlock[:len(oldBlock)-1],
+			"127.0.0.1\tlocalhost\n" + block},
+		{"begin marker at end of file", "127.0.0.1\tlocalhost\n" + blockBegin + "\n" + blockEnd,
+			"127.0.0.1\tlocalhost\n" + block},
+		{"unchanged", "127.0.0.1\tlocalhost\n" + block, "127.0.0.1\tlocalhost\n" + block},
+		{"marker not on its own line", "# see " + blockBegin + "\n", "# see " + blockBegin + "\n" + block},
+		{"end marker with suffix ignored", blockBegin + "\n" + blockEnd + " and more\n" + blockEnd + "\n", block},
+	} {
+		updated, err := replaceBlock(test.contents, lines)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if updated != test.expected {
+			t.Errorf("%s: wrong result %q", test.name, updated)
+		}
+	}
+}
+
+func TestReplaceBlock_Idempotent(t *testing.T) {
+	lines := []string{"10.0.0.1\tnode1.example.com node1"}
+	once, err := replaceBlock("127.0.0.1\tlocalhost", lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := replaceBlock(once, lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if once != twice {
+		t.Errorf("block duplicated: %q", twice)
+	}
+}
+
+func TestReplaceBlock_MissingEnd(t *testing.T) {
+	_, err := replaceBlock("127.0.0.1\tlocalhost\n"+blockBegin+"\n10.0.0.1\tnode1\n", nil)
+	testutil.CheckError(t, err, "managed block is missing its end marker")
+}
+
+func TestReadDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		name     string
+		contents string
+		nodes    []Node
+		err      string
+	}{
+		{"empty", "", nil, ""},
+		{"comments and blank lines", "# nodes\n\n  \n", nil, ""},
+		{"nodes", "10.0.0.1 node1.example.com node1\n  fd00::2\tnode2.example.com\tnode2  \n", []Node{
+			{IP: "10.0.0.1", DNS: "node1.example.com", Hostname: "node1"},
+			{IP: "fd00::2", DNS: "node2.example.com", Hostname: "node2"},
+		}, ""},
+		{"too few fields", "10.0.0.1 node1.example.com\n", nil,
+			"incorrectly formatted node directory line: '10.0.0.1 node1.example.com'"},
+		{"too many fields", "10.0.0.1 node1.example.com node1 extra\n", nil,
+			"incorrectly formatted node directory line"},
+		{"invalid IP", "10.0.0 node1.example.com node1\n", nil, "invalid IP address in node directory: 10.0.0"},
+		{"invalid name", "10.0.0.1 node1.example.com node_1\n", nil, "invalid name in node directory: node_1"},
+		{"name with trailing hyphen", "10.0.0.1 node1-.example.com node1\n", nil,
+			"invalid name in node directory: node1-.example.com"},
+	} {
+		filename := path.Join(dir, "nodes.conf")
+		if err := ioutil.WriteFile(filename, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		nodes, err := ReadDirectory(filename)
+		if test.err != "" {
+			testutil.CheckError(t, err, test.err)
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(nodes) != len(test.nodes) {
+			t.Errorf("%s: wrong nodes %+v", test.name, nodes)
+			continue
+		}
+		for i, node := range nodes {
+			if node != test.nodes[i] {
+				t.Errorf("%s: wrong node %+v", test.name, node)
+			}
+		}
+	}
+}
+
+func TestReadDirectory_Missing(t *testing.T) {
+	_, err := ReadDirectory("/nonexistent/nodes.conf")
+	testutil.CheckError(t, err, "no such file or directory")
+}
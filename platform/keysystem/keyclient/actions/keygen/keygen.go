@@ -5,6 +5,7 @@ import (
 	"github.com/pkg/errors"
 	"os"
 	"path"
+	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
 	"github.com/sipb/homeworld/platform/util/certutil"
@@ -14,12 +15,18 @@ import (
 const DefaultRSAKeyLength = 4096
 
 func GenerateKey(keypath string, nac *actloop.NewActionContext) {
+	keypath = nac.State.Env.Path(keypath)
+	info := fmt.Sprintf("generate key %s", keypath)
+	nac.Checked(info)
+	nac.Schedule(info, keypath, time.Time{})
 	if fileutil.Exists(keypath) {
 		// nothing to do
 	} else {
 		// it's acceptable for the directory to not exist, because we'll just create it later
-		info := fmt.Sprintf("generate key %s", keypath)
-		err := keygen(keypath)
+		err := CreateKey(keypath)
+		if err == nil {
+			err = nac.State.Env.Stamp(keypath)
+		}
 		if err != nil {
 			nac.Errored(info, err)
 		} else {
@@ -28,7 +35,8 @@ func GenerateKey(keypath string, nac *actloop.NewActionContext) {
 	}
 }
 
-func keygen(keypath string) error {
+// CreateKey generates a new RSA private key at keypath, which must not already exist.
+func CreateKey(keypath string) error {
 	dirname := path.Dir(keypath)
 	err := fileutil.EnsureIsFolder(dirname)
 	if err != nil {
@@ -10,49 +10,77 @@ import (
 
 	"github.com/sipb/homeworld/platform/keysystem/api/endpoint"
 	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/localconf"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/reload"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
 	"github.com/sipb/homeworld/platform/util/certutil"
 	"github.com/sipb/homeworld/platform/util/csrutil"
 	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/strutil"
 )
 
+// Expectations describe what a newly-issued certificate must satisfy before it replaces the current one. The paths are
+// relocated through the env when they are used.
+type Expectations struct {
+	// path to the authority that must have issued the certificate; empty to skip this check
+	Authority string
+	// names or addresses that the certificate must include, with (VAR) references filled in from local.conf
+	Names []string
+}
+
 type RequestOrRenewAction struct {
 	InAdvance       time.Duration
 	API             string
 	CheckExpiration func([]byte) (time.Time, error)
 	GenCSR          func([]byte) ([]byte, error)
+	Verify          func(cert []byte, key []byte, authority []byte, names []string, now time.Time) error
 	KeyFile         string
 	CertFile        string
+	Expect          Expectations
+	// run after a new certificate is installed
+	Hooks []reload.Hook
 }
 
-func RequestOrRenewTLSKey(key string, cert string, api string, inadvance time.Duration, nac *actloop.NewActionContext) {
+func RequestOrRenewTLSKey(key string, cert string, api string, inadvance time.Duration, expect Expectations, hooks []reload.Hook, nac *actloop.NewActionContext) {
 	action := &RequestOrRenewAction{
 		InAdvance:       inadvance,
 		API:             api,
-		KeyFile:         key,
-		CertFile:        cert,
+		KeyFile:         nac.State.Env.Path(key),
+		CertFile:        nac.State.Env.Path(cert),
 		CheckExpiration: certutil.CheckTLSCertExpiration,
 		GenCSR:          csrutil.BuildTLSCSR,
+		Verify:          certutil.VerifyTLSCert,
+		Expect:          expect,
+		Hooks:           hooks,
 	}
 	action.Act(nac)
 }
 
-func RequestOrRenewSSHKey(key string, cert string, api string, inadvance time.Duration, nac *actloop.NewActionContext) {
+func RequestOrRenewSSHKey(key string, cert string, api string, inadvance time.Duration, expect Expectations, hooks []reload.Hook, nac *actloop.NewActionContext) {
 	action := &RequestOrRenewAction{
 		InAdvance:       inadvance,
 		API:             api,
-		KeyFile:         key,
-		CertFile:        cert,
+		KeyFile:         nac.State.Env.Path(key),
+		CertFile:        nac.State.Env.Path(cert),
 		CheckExpiration: certutil.CheckSSHCertExpiration,
 		GenCSR:          csrutil.BuildSSHCSR,
+		Verify:          certutil.VerifySSHHostCert,
+		Expect:          expect,
+		Hooks:           hooks,
 	}
 	action.Act(nac)
 }
 
+// renewals are spread across the first part of the renewal margin, so that nodes with certificates issued at the same
+// time don't all renew at the same time
+const RenewalSpreadFraction = 4
+
 func (ra *RequestOrRenewAction) shouldRegenerate(nac *actloop.NewActionContext, info string) bool {
 	existing, err := ioutil.ReadFile(ra.CertFile)
 	if err != nil {
+		nac.Schedule(info, ra.CertFile, time.Time{})
 		if !os.IsNotExist(err) {
 			// this will probably fail to regenerate, but at least we tried? and this way, it's made clear that a problem is continuing.
 			nac.Errored(info, err)
@@ -63,10 +91,15 @@ func (ra *RequestOrRenewAction) shouldRegenerate(nac *actloop.NewActionContext,
 	expiration, err := ra.CheckExpiration(existing)
 	if err != nil {
 		nac.Errored(info, errors.Wrap(err, "while trying to check expiration status of certificate"))
+		nac.Schedule(info, ra.CertFile, time.Time{})
 		return true // fix malformed certificate by renewal
 	}
-	renewAt := expiration.Add(-ra.InAdvance)
-	if renewAt.After(time.Now()) {
+	renewAt := expiration.Add(-ra.InAdvance).Add(-actloop.Spread(nac.State.Env, ra.CertFile, ra.InAdvance/RenewalSpreadFraction))
+	nac.ReportCertificate(info, ra.CertFile, expiration, renewAt)
+	nac.Schedule(info, ra.CertFile, renewAt)
+	if nac.ForcingRenewal(ra.CertFile) {
+		return true // renewal requested by an operator
+	} else if renewAt.After(nac.State.Env.Now()) {
 		return false // not time to renew
 	} else {
 		return true // time to renew
@@ -79,7 +112,7 @@ func (ra *RequestOrRenewAction) checkReload(nac *actloop.NewActionContext) error
 	if err != nil {
 		return err
 	}
-	grantabs, err := filepath.Abs(paths.GrantingCertPath)
+	grantabs, err := filepath.Abs(nac.State.Env.Path(paths.GrantingCertPath))
 	if err != nil {
 		return err
 	}
@@ -92,7 +125,44 @@ func (ra *RequestOrRenewAction) checkReload(nac *actloop.NewActionContext) error
 	return nil
 }
 
-func (ra *RequestOrRenewAction) generateCSR() ([]byte, error) {
+// the expectations can only be checked once the authority and local configuration have been downloaded
+func (ra *RequestOrRenewAction) expectationsReady(env hostenv.Env) error {
+	if ra.Expect.Authority != "" && !fileutil.Exists(env.Path(ra.Expect.Authority)) {
+		return fmt.Errorf("authority does not yet exist: %s", env.Path(ra.Expect.Authority))
+	}
+	if len(ra.Expect.Names) > 0 && !fileutil.Exists(env.Path(paths.LocalConfPath)) {
+		return fmt.Errorf("local configuration does not yet exist: %s", env.Path(paths.LocalConfPath))
+	}
+	return nil
+}
+
+// Resolve reads the expected authority (or nil, if none is expected), and fills in the expected names.
+func (e Expectations) Resolve(env hostenv.Env) (authority []byte, names []string, err error) {
+	if e.Authority != "" {
+		authority, err = ioutil.ReadFile(env.Path(e.Authority))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "while reading authority")
+		}
+	}
+	if len(e.Names) > 0 {
+		vars, err := localconf.Read(env.Path(paths.LocalConfPath))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "while reading local configuration")
+		}
+		names, err = strutil.SubstituteAllVars(e.Names, vars)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "while resolving expected names")
+		}
+	}
+	return authority, names, nil
+}
+
+// requestVerified requests a certificate for the key, and only returns it if it passes verification.
+func (ra *RequestOrRenewAction) requestVerified(nac *actloop.NewActionContext) ([]byte, error) {
+	authority, names, err := ra.Expect.Resolve(nac.State.Env)
+	if err != nil {
+		return nil, err
+	}
 	keydata, err := ioutil.ReadFile(ra.KeyFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "while reading keyfile")
@@ -101,7 +171,15 @@ func (ra *RequestOrRenewAction) generateCSR() ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "while generating CSR")
 	}
-	return csr, err
+	cert, err := ra.requestSignature(csr, nac)
+	if err != nil {
+		return nil, err
+	}
+	err = ra.Verify(cert, keydata, authority, names, nac.State.Env.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "while verifying received certificate")
+	}
+	return cert, nil
 }
 
 func (ra *RequestOrRenewAction) requestSignature(csr []byte, nac *actloop.NewActionContext) ([]byte, error) {
@@ -123,16 +201,11 @@ func (ra *RequestOrRenewAction) requestSignature(csr []byte, nac *actloop.NewAct
 }
 
 func (ra *RequestOrRenewAction) regenerate(nac *actloop.NewActionContext) error {
-	csr, err := ra.generateCSR()
+	cert, err := ra.requestVerified(nac)
 	if err != nil {
 		return err
 	}
-	cert, err := ra.requestSignature(csr, nac)
-	if err != nil {
-		return err
-	}
-	// TODO: confirm it's valid before saving it?
-	err = ioutil.WriteFile(ra.CertFile, cert, os.FileMode(0644))
+	err = fileutil.ReplaceKeepingPrevious(ra.CertFile, cert, os.FileMode(0644))
 	if err != nil {
 		return errors.Wrap(err, "while writing result")
 	}
@@ -144,21 +217,35 @@ func (ra *RequestOrRenewAction) regenerate(nac *actloop.NewActionContext) error
 }
 
 func (ra *RequestOrRenewAction) Act(nac *actloop.NewActionContext) {
-	info := fmt.Sprintf("req/renew key %s into cert %s with API %s in advance by %v", ra.CertFile, ra.KeyFile, ra.InAdvance, ra.API)
+	info := fmt.Sprintf("req/renew key %s into cert %s with API %s in advance by %v", ra.KeyFile, ra.CertFile, ra.API, ra.InAdvance)
+	nac.Checked(info)
 	if !nac.State.CanRetry(ra.API) {
 		// nothing to do
 	} else if !ra.shouldRegenerate(nac, info) {
 		// nothing to do
 	} else if nac.State.Keygrant == nil {
-		nac.Blocked(errors.New("no keygranting certificate ready"))
+		nac.Blocked(info, errors.New("no keygranting certificate ready"))
+	} else if err := nac.State.CheckClock(); err != nil {
+		nac.Blocked(info, err)
 	} else if !fileutil.Exists(ra.KeyFile) {
-		nac.Blocked(fmt.Errorf("key does not yet exist: %s", ra.KeyFile))
+		nac.Blocked(info, fmt.Errorf("key does not yet exist: %s", ra.KeyFile))
+	} else if err := ra.expectationsReady(nac.State.Env); err != nil {
+		nac.Blocked(info, err)
+	} else if nac.BackingOff(info) {
+		// wait to retry
 	} else {
 		err := ra.regenerate(nac)
 		if err != nil {
 			nac.Errored(info, err)
 		} else {
 			nac.NotifyPerformed(info)
+			nac.Renewed(ra.CertFile)
+			nac.TriggerHooks(info, ra.Hooks, ra.rollback)
 		}
 	}
 }
+
+// rollback reinstates the certificate replaced by the last renewal
+func (ra *RequestOrRenewAction) rollback() error {
+	return fileutil.RestorePrevious(ra.CertFile)
+}
@@ -0,0 +1,170 @@
+package keyreq
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/keygen"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/reload"
+	"github.com/sipb/homeworld/platform/util/certutil"
+	"github.com/sipb/homeworld/platform/util/csrutil"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+)
+
+// Private key rotation works in three steps, each of which can be resumed after a crash:
+//  1. generate a replacement key alongside the current key, at <key>.next
+//  2. request a certificate for the replacement key, into <cert>.next
+//  3. install both replacements over the current key and certificate with fileutil.InstallPair
+// The key and certificate are switched together by the last step, so a mismatched pair is never installed.
+
+const NextSuffix = ".next"
+
+// operators can create this file (next to the key) to request an immediate rotation
+const RotateRequestSuffix = ".rotate"
+
+type RotateAction struct {
+	RotateEvery time.Duration
+	Request     RequestOrRenewAction
+}
+
+func RotateTLSKey(key string, cert string, api string, rotateEvery time.Duration, expect Expectations, hooks []reload.Hook, nac *actloop.NewActionContext) {
+	action := &RotateAction{
+		RotateEvery: rotateEvery,
+		Request: RequestOrRenewAction{
+			API:             api,
+			KeyFile:         nac.State.Env.Path(key),
+			CertFile:        nac.State.Env.Path(cert),
+			CheckExpiration: certutil.CheckTLSCertExpiration,
+			GenCSR:          csrutil.BuildTLSCSR,
+			Verify:          certutil.VerifyTLSCert,
+			Expect:          expect,
+			Hooks:           hooks,
+		},
+	}
+	action.Act(nac)
+}
+
+// RequestRotation asks the keyclient to rotate the private key at keypath on its next pass.
+func RequestRotation(keypath string) error {
+	return ioutil.WriteFile(keypath+RotateRequestSuffix, nil, os.FileMode(0600))
+}
+
+func (ra *RotateAction) nextKey() string {
+	return ra.Request.KeyFile + NextSuffix
+}
+
+func (ra *RotateAction) nextCert() string {
+	return ra.Request.CertFile + NextSuffix
+}
+
+// dueAt returns the zero time if rotation is disabled
+func (ra *RotateAction) dueAt() (time.Time, error) {
+	if ra.RotateEvery <= 0 {
+		return time.Time{}, nil
+	}
+	info, err := os.Stat(ra.Request.KeyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime().Add(ra.RotateEvery), nil
+}
+
+func (ra *RotateAction) isDue(nac *actloop.NewActionContext, info string) (bool, error) {
+	dueAt, err := ra.dueAt()
+	if err != nil {
+		return false, err
+	}
+	nac.Schedule(info, ra.Request.KeyFile, dueAt)
+	if fileutil.Exists(ra.nextKey()) || fileutil.Exists(ra.Request.KeyFile+RotateRequestSuffix) {
+		return true, nil
+	}
+	return !dueAt.IsZero() && nac.State.Env.Now().After(dueAt), nil
+}
+
+func isMatchingPair(keyfile string, certfile string) bool {
+	_, err := tls.LoadX509KeyPair(certfile, keyfile)
+	return err == nil
+}
+
+func (ra *RotateAction) finishRotation(nac *actloop.NewActionContext) error {
+	err := os.Remove(ra.Request.KeyFile + RotateRequestSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ra.Request.checkReload(nac)
+}
+
+func (ra *RotateAction) rotate(nac *actloop.NewActionContext) error {
+	if !fileutil.Exists(ra.nextKey()) {
+		if err := os.Remove(ra.nextCert()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := keygen.CreateKey(ra.nextKey()); err != nil {
+			return errors.Wrap(err, "while generating replacement key")
+		}
+		// the rotation period is measured from the modification time of the key
+		if err := nac.State.Env.Stamp(ra.nextKey()); err != nil {
+			return err
+		}
+	}
+	if !isMatchingPair(ra.nextKey(), ra.nextCert()) {
+		nextRequest := ra.Request
+		nextRequest.KeyFile = ra.nextKey()
+		nextRequest.CertFile = ra.nextCert()
+		cert, err := nextRequest.requestVerified(nac)
+		if err != nil {
+			return errors.Wrap(err, "while requesting certificate for replacement key")
+		}
+		if err := fileutil.WriteAtomic(ra.nextCert(), cert, os.FileMode(0644)); err != nil {
+			return err
+		}
+	}
+	// the current pair is kept, in case the rotated pair needs to be rolled back
+	if err := fileutil.InstallPair(ra.Request.KeyFile, ra.nextKey(), ra.Request.CertFile, ra.nextCert()); err != nil {
+		return err
+	}
+	return ra.finishRotation(nac)
+}
+
+func (ra *RotateAction) Act(nac *actloop.NewActionContext) {
+	info := fmt.Sprintf("rotate key %s with cert %s with API %s every %v", ra.Request.KeyFile, ra.Request.CertFile, ra.Request.API, ra.RotateEvery)
+	nac.Checked(info)
+	if !fileutil.Exists(ra.Request.KeyFile) || !fileutil.Exists(ra.Request.CertFile) {
+		// nothing to do; the initial key and certificate are handled by the keygen and keyreq actions
+		return
+	}
+	due, err := ra.isDue(nac, info)
+	if err != nil {
+		nac.Errored(info, err)
+	} else if !due {
+		// nothing to do
+	} else if !nac.State.CanRetry(ra.Request.API) {
+		// nothing to do
+	} else if nac.State.Keygrant == nil {
+		nac.Blocked(info, errors.New("no keygranting certificate ready"))
+	} else if err := nac.State.CheckClock(); err != nil {
+		nac.Blocked(info, err)
+	} else if err := ra.Request.expectationsReady(nac.State.Env); err != nil {
+		nac.Blocked(info, err)
+	} else if nac.BackingOff(info) {
+		// wait to retry
+	} else {
+		err := ra.rotate(nac)
+		if err != nil {
+			nac.Errored(info, err)
+		} else {
+			nac.NotifyPerformed(info)
+			nac.TriggerHooks(info, ra.Request.Hooks, ra.rollback)
+		}
+	}
+}
+
+// rollback reinstates the key and certificate replaced by the last rotation
+func (ra *RotateAction) rollback() error {
+	return fileutil.RestorePair(ra.Request.KeyFile, ra.Request.CertFile)
+}
@@ -0,0 +1,104 @@
+package reenroll
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/reenroll"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/util/csrutil"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+)
+
+// Reenroll requests a new keygranting certificate once the current one has expired, such as after the node has been
+// powered off for a long time, by proving possession of the node's SSH host key and its certificate. A bootstrap
+// token takes precedence, so that an administrator can always re-admit a node explicitly.
+func Reenroll(hostkey string, hostcert string, nac *actloop.NewActionContext) {
+	hostkey, hostcert = nac.State.Env.Path(hostkey), nac.State.Env.Path(hostcert)
+	keypath, tokenpath := nac.State.Env.Path(paths.GrantingKeyPath), nac.State.Env.Path(paths.BootstrapTokenPath)
+	info := fmt.Sprintf("re-enroll with ssh host key %s and certificate %s", hostkey, hostcert)
+	nac.Checked(info)
+	expired := expiredKeygrant(nac)
+	if expired == nil {
+		// nothing to do
+	} else if fileutil.Exists(tokenpath) {
+		// nothing to do; bootstrap will handle it
+	} else if !fileutil.Exists(hostkey) || !fileutil.Exists(hostcert) {
+		nac.Blocked(info, errors.New("no ssh host certificate to re-enroll with; a new bootstrap token is required"))
+	} else if !fileutil.Exists(keypath) {
+		nac.Blocked(info, fmt.Errorf("key does not yet exist: %s", keypath))
+	} else if nac.BackingOff(info) {
+		// wait to retry
+	} else {
+		// the keyserver issues keygranting certificates for the principal of the node's account
+		err := reenrollWith(expired.Subject.CommonName, hostkey, hostcert, keypath, nac)
+		if err != nil {
+			nac.Errored(info, err)
+		} else {
+			nac.NotifyPerformed(info)
+		}
+	}
+}
+
+// expiredKeygrant returns the keygranting certificate if it has expired, or nil if it is still usable or missing.
+func expiredKeygrant(nac *actloop.NewActionContext) *x509.Certificate {
+	if nac.State.Keygrant == nil || len(nac.State.Keygrant.Certificate) == 0 {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(nac.State.Keygrant.Certificate[0])
+	if err != nil || nac.State.Env.Now().Before(cert.NotAfter) {
+		return nil
+	}
+	return cert
+}
+
+func reenrollWith(principal string, hostkey string, hostcert string, keypath string, nac *actloop.NewActionContext) error {
+	keydata, err := ioutil.ReadFile(hostkey)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey(keydata)
+	if err != nil {
+		return errors.Wrap(err, "while parsing ssh host key")
+	}
+	cert, err := ioutil.ReadFile(hostcert)
+	if err != nil {
+		return err
+	}
+	privkey, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return err
+	}
+	csr, err := csrutil.BuildTLSCSR(privkey)
+	if err != nil {
+		return err
+	}
+	challenge, err := nac.State.Keyserver.GetReenrollChallenge(principal)
+	if err != nil {
+		return errors.Wrap(err, "while requesting re-enrollment challenge")
+	}
+	signature, err := signer.Sign(rand.Reader, reenroll.SignedData(challenge, string(csr)))
+	if err != nil {
+		return err
+	}
+	request := &reenroll.Request{
+		Principal:   principal,
+		Certificate: string(cert),
+		Challenge:   challenge,
+		CSR:         string(csr),
+		Signature:   ssh.Marshal(signature),
+	}
+	certbytes, err := nac.State.Keyserver.Reenroll(request)
+	if err != nil {
+		return errors.Wrap(err, "while re-enrolling")
+	}
+	if len(certbytes) == 0 {
+		return errors.New("received empty response")
+	}
+	return nac.State.ReplaceKeygrantingCert([]byte(certbytes))
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/reload"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/state"
 )
 
@@ -13,6 +14,9 @@ type ActLoop struct {
 	stoplock   sync.Mutex
 	shouldStop bool
 	logger     *log.Logger
+	status     *Status
+	hooks      *hookQueue
+	forced     *forcedRenewals
 }
 
 type NewAction func(nac *NewActionContext)
@@ -22,23 +26,83 @@ type NewActionContext struct {
 	Logger    *log.Logger
 	BlockedBy []error
 	Performed bool
+	status    *Status
+	hooks     *hookQueue
+	forced    *forcedRenewals
+}
+
+// Checked records that an action was considered during this cycle, whether or not it had anything to do.
+func (nac *NewActionContext) Checked(info string) {
+	nac.status.checked(info)
 }
 
 func (nac *NewActionContext) Errored(info string, err error) {
 	nac.Logger.Printf("action stop error: %s (in %s)\n", err.Error(), info)
+	nac.status.errored(info, err)
 }
 
-func (nac *NewActionContext) Blocked(err error) {
+func (nac *NewActionContext) Blocked(info string, err error) {
 	nac.BlockedBy = append(nac.BlockedBy, err)
+	nac.status.blockedBy(info, err)
 }
 
 func (nac *NewActionContext) NotifyPerformed(info string) {
 	nac.Logger.Printf("action performed: %s\n", info)
 	nac.Performed = true
+	nac.status.performed(info)
+}
+
+// TriggerHooks schedules hooks to run once the action loop has settled, because an action installed a new file. If one
+// of the hooks keeps failing, rollback (if not nil) is called to reinstate the file that was replaced.
+func (nac *NewActionContext) TriggerHooks(info string, hooks []reload.Hook, rollback func() error) {
+	nac.hooks.trigger(info, hooks, rollback)
+}
+
+// Schedule records which file an action manages, so that the loop can wake up when it changes, and when the action next
+// expects to have something to do, so that the loop can wake up then. Either may be omitted with an empty path or a
+// zero time.
+func (nac *NewActionContext) Schedule(info string, path string, dueAt time.Time) {
+	nac.status.schedule(info, path, dueAt)
+}
+
+// BackingOff reports whether an action has failed recently enough that it should not yet try again.
+func (nac *NewActionContext) BackingOff(info string) bool {
+	return nac.status.backingOff(info)
+}
+
+// ReportCertificate records the expiration and planned renewal time of a certificate managed by an action.
+func (nac *NewActionContext) ReportCertificate(info string, certpath string, expires time.Time, renewAt time.Time) {
+	nac.status.certificate(info, certpath, expires, renewAt)
+}
+
+// ReportPin records the fingerprint of the authority that an action has pinned, and the fingerprint of the authority
+// that it last refused to install in its place, if any.
+func (nac *NewActionContext) ReportPin(info string, authority string, pinned string, mismatch string) {
+	nac.status.pinned(info, authority, pinned, mismatch)
+}
+
+// ForcingRenewal reports whether an operator has asked for the certificate at certpath to be renewed immediately,
+// regardless of when it expires.
+func (nac *NewActionContext) ForcingRenewal(certpath string) bool {
+	return nac.forced.forcing(certpath)
+}
+
+// Renewed records that the certificate at certpath has been replaced, so that a forced renewal is not repeated.
+func (nac *NewActionContext) Renewed(certpath string) {
+	nac.forced.renewed(certpath)
+}
+
+// Snapshot returns the status of every action as of this point in the cycle, such as for reporting it elsewhere.
+func (nac *NewActionContext) Snapshot() LoopStatus {
+	return nac.status.Snapshot()
 }
 
 func NewActLoop(actions NewAction, logger *log.Logger) ActLoop {
-	return ActLoop{actions: actions, logger: logger}
+	return ActLoop{actions: actions, logger: logger, status: NewStatus(), hooks: newHookQueue(), forced: &forcedRenewals{}}
+}
+
+func (m *ActLoop) Status() *Status {
+	return m.status
 }
 
 func (m *ActLoop) Cancel() {
@@ -53,18 +117,28 @@ func (m *ActLoop) IsCancelled() bool {
 	return m.shouldStop
 }
 
+// how long to wait after a watched file changes, so that related changes are handled together
+const WatchSettleTime = 500 * time.Millisecond
+
+// the shortest time to sleep when stable, so that a due time that's slightly off can't cause a busy loop
+const minimumPause = time.Second
+
+// Run repeatedly runs the actions. After a cycle that performed an action, it runs again after cycletime. Otherwise, it
+// waits until the next action is due, but no longer than pausetime, or until a managed file changes.
 func (m *ActLoop) Run(state *state.ClientState, cycletime time.Duration, pausetime time.Duration, onReady func(*log.Logger)) {
+	watch, err := newWatcher()
+	if err != nil {
+		m.logger.Printf("cannot watch for changes to managed files: %v\n", err)
+	}
 	wasStabilized := false
 	for !m.IsCancelled() {
-		nac := NewActionContext{
-			Logger: m.logger,
-			State:  state,
+		nac, err := m.lockedCycle(state)
+		if err != nil {
+			m.logger.Printf("cannot run actions: %v\n", err)
+			time.Sleep(cycletime)
+			continue
 		}
-		m.actions(&nac)
-
-		// TODO: report current status somewhere -- health checker endpoint?
-
-		if nac.Performed {
+		if nac.Performed || m.hooks.hasPending() {
 			time.Sleep(cycletime) // usually two seconds
 		} else {
 			if !wasStabilized {
@@ -81,8 +155,90 @@ func (m *ActLoop) Run(state *state.ClientState, cycletime time.Duration, pauseti
 					}
 				}
 			}
-			time.Sleep(pausetime) // usually five minutes
+			m.pause(watch, pausetime)
 		}
 		wasStabilized = !nac.Performed
 	}
 }
+
+// lockedCycle runs a single cycle, once no other keyclient process is running its actions.
+func (m *ActLoop) lockedCycle(state *state.ClientState) (NewActionContext, error) {
+	unlock, err := lockActions(state.Env)
+	if err != nil {
+		return NewActionContext{}, err
+	}
+	defer unlock()
+	return m.cycle(state), nil
+}
+
+func (m *ActLoop) cycle(state *state.ClientState) NewActionContext {
+	nac := NewActionContext{
+		Logger: m.logger,
+		State:  state,
+		status: m.status,
+		hooks:  m.hooks,
+		forced: m.forced,
+	}
+	m.status.beginCycle(state.Env.Clock)
+	m.actions(&nac)
+	if !nac.Performed {
+		// only run hooks once the other actions have settled, so that related changes only trigger each hook once
+		m.hooks.runDue(&nac)
+	}
+	m.status.endCycle(!nac.Performed, len(nac.BlockedBy) > 0)
+	return nac
+}
+
+// RunOnce runs the actions until a cycle performs nothing, or until maxCycles have run, and reports whether the loop
+// stabilized. This is used for a single convergence pass, rather than running as a daemon, so failures are not retried.
+// A running daemon does not run its actions until the pass is over.
+func (m *ActLoop) RunOnce(state *state.ClientState, cycletime time.Duration, maxCycles int) (stable bool, err error) {
+	unlock, err := lockActions(state.Env)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	for i := 0; i < maxCycles; i++ {
+		nac := m.cycle(state)
+		if !nac.Performed {
+			return true, nil
+		}
+		if i < maxCycles-1 {
+			time.Sleep(cycletime)
+		}
+	}
+	return false, nil
+}
+
+// ForceRenewal asks the actions to renew the certificates at certpaths (or every certificate, if all is set) regardless
+// of when they expire. Each is renewed at most once.
+func (m *ActLoop) ForceRenewal(all bool, certpaths []string) {
+	m.forced.force(all, certpaths)
+}
+
+// PendingRenewals lists the certificates that have been forced to renew, but have not yet been renewed. If every
+// certificate was forced, only the ones that an action has since asked about are listed.
+func (m *ActLoop) PendingRenewals() []string {
+	return m.forced.pending()
+}
+
+func (m *ActLoop) pause(watch *watcher, pausetime time.Duration) {
+	duration := pausetime
+	if next := m.status.NextWake(); !next.IsZero() && m.status.untilTime(next) < duration {
+		duration = m.status.untilTime(next)
+	}
+	if duration < minimumPause {
+		duration = minimumPause
+	}
+	if watch == nil {
+		time.Sleep(duration)
+		return
+	}
+	for _, dir := range m.status.watchedDirs() {
+		err := watch.add(dir)
+		if err != nil {
+			m.logger.Printf("cannot watch %s for changes: %v\n", dir, err)
+		}
+	}
+	watch.wait(duration)
+}
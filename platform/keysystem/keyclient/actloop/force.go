@@ -0,0 +1,77 @@
+package actloop
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// forcedRenewals tracks the certificates that an operator has asked to renew immediately.
+type forcedRenewals struct {
+	mutex sync.Mutex
+	all   bool
+	paths map[string]bool
+	seen  map[string]bool
+	done  map[string]bool
+}
+
+func cleanPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+func (f *forcedRenewals) force(all bool, certpaths []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.all = f.all || all
+	if f.paths == nil {
+		f.paths = map[string]bool{}
+		f.seen = map[string]bool{}
+		f.done = map[string]bool{}
+	}
+	for _, certpath := range certpaths {
+		f.paths[cleanPath(certpath)] = true
+	}
+}
+
+func (f *forcedRenewals) forcing(certpath string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	certpath = cleanPath(certpath)
+	if !f.all && !f.paths[certpath] {
+		return false
+	}
+	f.seen[certpath] = true
+	return !f.done[certpath]
+}
+
+func (f *forcedRenewals) renewed(certpath string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.done != nil {
+		f.done[cleanPath(certpath)] = true
+	}
+}
+
+func (f *forcedRenewals) pending() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var pending []string
+	for certpath := range f.paths {
+		if !f.done[certpath] {
+			pending = append(pending, certpath)
+		}
+	}
+	if f.all {
+		for certpath := range f.seen {
+			if !f.done[certpath] && !f.paths[certpath] {
+				pending = append(pending, certpath)
+			}
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
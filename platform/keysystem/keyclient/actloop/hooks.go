@@ -0,0 +1,118 @@
+package actloop
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/reload"
+)
+
+// minimum time between two runs of the same hook, so that a burst of renewals doesn't restart a daemon repeatedly
+const HookInterval = time.Minute
+
+// number of times a failing hook is attempted before the files that triggered it are rolled back
+const HookAttempts = 3
+
+type hookTrigger struct {
+	info     string
+	rollback func() error
+}
+
+type pendingHook struct {
+	hook     reload.Hook
+	triggers []hookTrigger
+	attempts int
+}
+
+type hookQueue struct {
+	pending []*pendingHook
+	lastRun map[string]time.Time
+}
+
+func newHookQueue() *hookQueue {
+	return &hookQueue{lastRun: map[string]time.Time{}}
+}
+
+func (q *hookQueue) trigger(info string, hooks []reload.Hook, rollback func() error) {
+	for _, hook := range hooks {
+		found := false
+		for _, ph := range q.pending {
+			if ph.hook.Name() == hook.Name() {
+				ph.triggers = append(ph.triggers, hookTrigger{info: info, rollback: rollback})
+				found = true
+				break
+			}
+		}
+		if !found {
+			q.pending = append(q.pending, &pendingHook{hook: hook, triggers: []hookTrigger{{info: info, rollback: rollback}}})
+		}
+	}
+}
+
+func (q *hookQueue) hasPending() bool {
+	return len(q.pending) > 0
+}
+
+func (ph *pendingHook) triggeredBy() string {
+	var infos []string
+	for _, trigger := range ph.triggers {
+		infos = append(infos, trigger.info)
+	}
+	return strings.Join(infos, "; ")
+}
+
+// rollback reinstates the files replaced by the actions that triggered a failed hook, and returns a new pending hook to
+// restart the daemon with the reinstated files, or nil if nothing could be rolled back.
+func (ph *pendingHook) rollback(nac *NewActionContext) *pendingHook {
+	retry := &pendingHook{hook: ph.hook}
+	for _, trigger := range ph.triggers {
+		if trigger.rollback == nil {
+			continue
+		}
+		info := "roll back " + trigger.info
+		nac.Checked(info)
+		err := trigger.rollback()
+		if err != nil {
+			nac.Errored(info, err)
+		} else {
+			nac.NotifyPerformed(info)
+			// no further rollback is possible if this fails, because the previous version has been consumed
+			retry.triggers = append(retry.triggers, hookTrigger{info: info})
+		}
+	}
+	if len(retry.triggers) == 0 {
+		return nil
+	}
+	return retry
+}
+
+// runDue runs every pending hook that hasn't been run within HookInterval, and reports the results to nac.
+func (q *hookQueue) runDue(nac *NewActionContext) {
+	var remaining []*pendingHook
+	for _, ph := range q.pending {
+		name := ph.hook.Name()
+		if lastRun, found := q.lastRun[name]; found && nac.State.Env.Now().Before(lastRun.Add(HookInterval)) {
+			remaining = append(remaining, ph)
+			continue
+		}
+		info := "run hook " + name
+		nac.Checked(info)
+		nac.Logger.Printf("running hook %s, triggered by: %s\n", name, ph.triggeredBy())
+		q.lastRun[name] = nac.State.Env.Now()
+		ph.attempts++
+		err := ph.hook.Run(nac.State.Env)
+		if err == nil {
+			nac.NotifyPerformed(info)
+		} else if ph.attempts < HookAttempts {
+			nac.Errored(info, err)
+			remaining = append(remaining, ph)
+		} else {
+			nac.Errored(info, fmt.Errorf("giving up after %d attempts: %v", ph.attempts, err))
+			if retry := ph.rollback(nac); retry != nil {
+				remaining = append(remaining, retry)
+			}
+		}
+	}
+	q.pending = remaining
+}
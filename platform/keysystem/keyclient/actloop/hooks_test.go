@@ -0,0 +1,180 @@
+package actloop
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/reload"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/state"
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+type fakeHook struct {
+	name string
+	runs *int
+	err  error
+}
+
+func (f fakeHook) Name() string {
+	return f.name
+}
+
+func (f fakeHook) Run(env hostenv.Env) error {
+	*f.runs++
+	return f.err
+}
+
+func prepHookContext() (*NewActionContext, *hookQueue, *clock.Fake) {
+	fake := clock.NewFake(start)
+	env := hostenv.Relocated("/nonexistent")
+	env.Clock = fake
+	q := newHookQueue()
+	nac := &NewActionContext{
+		Logger: log.New(ioutil.Discard, "", 0),
+		State:  &state.ClientState{Env: env},
+		status: NewStatus(),
+		hooks:  q,
+	}
+	nac.status.beginCycle(fake)
+	return nac, q, fake
+}
+
+func TestHookQueue_Deduplicates(t *testing.T) {
+	nac, q, _ := prepHookContext()
+	restarts, reloads := 0, 0
+	restart := fakeHook{name: "try-restart etcd.service", runs: &restarts}
+	q.trigger("renew etcd server cert", []reload.Hook{restart}, nil)
+	q.trigger("renew etcd client cert", []reload.Hook{restart, fakeHook{name: "try-reload-or-restart ssh.service", runs: &reloads}}, nil)
+	if len(q.pending) != 2 || len(q.pending[0].triggers) != 2 {
+		t.Fatalf("wrong pending hooks: %+v", q.pending)
+	}
+	if triggeredBy := q.pending[0].triggeredBy(); triggeredBy != "renew etcd server cert; renew etcd client cert" {
+		t.Errorf("wrong triggers: %s", triggeredBy)
+	}
+	q.runDue(nac)
+	if restarts != 1 || reloads != 1 || q.hasPending() {
+		t.Errorf("wrong runs: %d restarts, %d reloads, pending: %v", restarts, reloads, q.hasPending())
+	}
+}
+
+func TestHookQueue_Interval(t *testing.T) {
+	nac, q, fake := prepHookContext()
+	runs := 0
+	hook := fakeHook{name: "try-restart kubelet.service", runs: &runs}
+	q.trigger("renew kubelet cert", []reload.Hook{hook}, nil)
+	q.runDue(nac)
+	q.trigger("renew kubelet cert again", []reload.Hook{hook}, nil)
+	q.runDue(nac)
+	if runs != 1 || !q.hasPending() {
+		t.Fatalf("hook rerun within interval: %d runs", runs)
+	}
+	fake.Advance(HookInterval)
+	q.runDue(nac)
+	if runs != 2 || q.hasPending() {
+		t.Errorf("hook not rerun after interval: %d runs", runs)
+	}
+}
+
+func TestHookQueue_RetriesThenRollsBack(t *testing.T) {
+	nac, q, fake := prepHookContext()
+	runs, rollbacks := 0, 0
+	hook := fakeHook{name: "try-restart apiserver.service", runs: &runs, err: errors.New("unit failed")}
+	q.trigger("renew apiserver cert", []reload.Hook{hook}, func() error {
+		rollbacks++
+		return nil
+	})
+	for i := 0; i < HookAttempts; i++ {
+		q.runDue(nac)
+		fake.Advance(HookInterval)
+	}
+	if runs != HookAttempts || rollbacks != 1 {
+		t.Fatalf("wrong attempts: %d runs, %d rollbacks", runs, rollbacks)
+	}
+	// the hook is run once more, to restart the daemon with the reinstated files, but can't be rolled back again
+	if len(q.pending) != 1 || q.pending[0].triggers[0].info != "roll back renew apiserver cert" || q.pending[0].triggers[0].rollback != nil {
+		t.Fatalf("wrong retry after rollback: %+v", q.pending)
+	}
+	for i := 0; i < HookAttempts; i++ {
+		q.runDue(nac)
+		fake.Advance(HookInterval)
+	}
+	if rollbacks != 1 || q.hasPending() {
+		t.Errorf("expected hook to be given up on: %d rollbacks, pending: %v", rollbacks, q.hasPending())
+	}
+	snapshot := nac.status.Snapshot()
+	found := false
+	for _, as := range snapshot.Actions {
+		if as.Info == "run hook try-restart apiserver.service" {
+			found = true
+			if as.Failures != uint64(2*HookAttempts) || as.LastError != "giving up after 3 attempts: unit failed" {
+				t.Errorf("wrong status for hook: %+v", as)
+			}
+		}
+	}
+	if !found {
+		t.Error("hook not reported in status")
+	}
+}
+
+func TestHookQueue_NoRollback(t *testing.T) {
+	nac, q, fake := prepHookContext()
+	runs := 0
+	hook := fakeHook{name: "try-restart kube-proxy.service", runs: &runs, err: errors.New("unit failed")}
+	q.trigger("download authority", []reload.Hook{hook}, nil)
+	for i := 0; i < HookAttempts; i++ {
+		q.runDue(nac)
+		fake.Advance(HookInterval)
+	}
+	if runs != HookAttempts || q.hasPending() {
+		t.Errorf("expected hook without rollback to be dropped: %d runs, pending: %v", runs, q.hasPending())
+	}
+}
+
+func TestHookQueue_FailedRollback(t *testing.T) {
+	nac, q, fake := prepHookContext()
+	runs := 0
+	hook := fakeHook{name: "try-restart etcd.service", runs: &runs, err: errors.New("unit failed")}
+	q.trigger("renew etcd cert", []reload.Hook{hook}, func() error {
+		return errors.New("previous version missing")
+	})
+	for i := 0; i < HookAttempts; i++ {
+		q.runDue(nac)
+		fake.Advance(HookInterval)
+	}
+	if q.hasPending() {
+		t.Error("expected nothing to retry when the rollback failed")
+	}
+	for _, as := range nac.status.Snapshot().Actions {
+		if as.Info == "roll back renew etcd cert" && as.LastError != "previous version missing" {
+			t.Errorf("wrong status for rollback: %+v", as)
+		}
+	}
+}
+
+func TestHookQueue_WaitsForActionsToSettle(t *testing.T) {
+	runs := 0
+	hook := fakeHook{name: "try-restart kubelet.service", runs: &runs}
+	cycles := 0
+	loop := NewActLoop(func(nac *NewActionContext) {
+		cycles++
+		if cycles <= 2 {
+			nac.Checked("renew cert")
+			nac.TriggerHooks("renew cert", []reload.Hook{hook}, nil)
+			nac.NotifyPerformed("renew cert")
+		}
+	}, log.New(ioutil.Discard, "", 0))
+	env := hostenv.Relocated("/nonexistent")
+	env.Clock = clock.NewFake(start)
+	for i := 0; i < 3; i++ {
+		loop.cycle(&state.ClientState{Env: env})
+		if i < 2 && runs != 0 {
+			t.Fatalf("hook run while actions were still being performed, in cycle %d", i)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("expected hook to run once after settling, not %d times", runs)
+	}
+}
@@ -0,0 +1,35 @@
+package actloop
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+)
+
+// lockActions waits until no other keyclient process on this node is running its actions, and then holds them off until
+// unlock is called. Otherwise, a one-shot command and the daemon could both decide to replace the same file, and the
+// daemon could install a certificate for a key that the one-shot command had just replaced.
+func lockActions(env hostenv.Env) (unlock func(), err error) {
+	lockpath := env.Path(paths.KeyclientLockPath)
+	err = os.MkdirAll(filepath.Dir(lockpath), 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "while preparing lock directory")
+	}
+	lockfile, err := os.OpenFile(lockpath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening lock file")
+	}
+	err = syscall.Flock(int(lockfile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		lockfile.Close()
+		return nil, errors.Wrap(os.NewSyscallError("flock", err), "while taking lock")
+	}
+	return func() {
+		// closing the file releases the lock
+		lockfile.Close()
+	}, nil
+}
@@ -0,0 +1,47 @@
+package actloop
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+)
+
+func TestLockActions_Exclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actloop-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env := hostenv.Relocated(dir)
+	unlock, err := lockActions(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan func())
+	go func() {
+		unlockOther, err := lockActions(env)
+		if err != nil {
+			t.Error(err)
+			close(acquired)
+			return
+		}
+		acquired <- unlockOther
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock taken twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case unlockOther := <-acquired:
+		if unlockOther != nil {
+			unlockOther()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not released")
+	}
+}
@@ -0,0 +1,44 @@
+package actloop
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+)
+
+// the delay before retrying an action after its first failure; doubled for each further consecutive failure
+const BackoffInitial = 10 * time.Second
+
+// the longest delay between retries of a failing action
+const BackoffMax = time.Hour
+
+// only used while holding the status mutex, because a rand.Rand is not safe for concurrent use
+var jitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// backoff computes how long to wait after a given number of consecutive failures. The delay is randomized to between
+// half and one and a half times the nominal delay, so that nodes that failed together don't retry together.
+func backoff(failures uint64) time.Duration {
+	delay := BackoffInitial
+	for i := uint64(1); i < failures && delay < BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > BackoffMax {
+		delay = BackoffMax
+	}
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay)))
+}
+
+// Spread computes a fixed offset within [0, window) for the node managed by env and a particular key, so that nodes
+// which were issued certificates at the same time (such as during cluster setup) don't all ask for renewals at the
+// same time.
+func Spread(env hostenv.Env, key string, window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	hostname, _ := env.Effects.Hostname() // if this fails, every node will get the same spread, which is merely suboptimal
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(hostname + "\x00" + key))
+	return time.Duration(hash.Sum64() % uint64(window))
+}
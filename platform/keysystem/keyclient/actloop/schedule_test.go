@@ -0,0 +1,86 @@
+package actloop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+)
+
+func TestBackoff(t *testing.T) {
+	for _, test := range []struct {
+		failures uint64
+		nominal  time.Duration
+	}{
+		{1, BackoffInitial},
+		{2, 2 * BackoffInitial},
+		{3, 4 * BackoffInitial},
+		{9, 256 * BackoffInitial},
+		{10, BackoffMax},
+		{1000, BackoffMax},
+	} {
+		for i := 0; i < 100; i++ {
+			delay := backoff(test.failures)
+			if delay < test.nominal/2 || delay >= test.nominal*3/2 {
+				t.Errorf("backoff after %d failures out of range: %v", test.failures, delay)
+				break
+			}
+		}
+	}
+}
+
+func TestBackoff_Jittered(t *testing.T) {
+	first := backoff(5)
+	for i := 0; i < 100; i++ {
+		if backoff(5) != first {
+			return
+		}
+	}
+	t.Error("backoff is not randomized")
+}
+
+func envWithHostname(t *testing.T, hostname string) hostenv.Env {
+	env := hostenv.Relocated("/nonexistent")
+	if err := env.Effects.SetHostname(hostname); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestSpread(t *testing.T) {
+	window := 6 * time.Hour
+	node1, node2 := envWithHostname(t, "node1"), envWithHostname(t, "node2")
+	spread := Spread(node1, "/etc/homeworld/keys/kubernetes-worker.pem", window)
+	if spread < 0 || spread >= window {
+		t.Errorf("spread out of range: %v", spread)
+	}
+	if again := Spread(envWithHostname(t, "node1"), "/etc/homeworld/keys/kubernetes-worker.pem", window); again != spread {
+		t.Errorf("spread not stable: %v then %v", spread, again)
+	}
+	if other := Spread(node2, "/etc/homeworld/keys/kubernetes-worker.pem", window); other == spread {
+		t.Error("expected different nodes to be spread apart")
+	}
+	if other := Spread(node1, "/etc/homeworld/keys/kubernetes-proxy.pem", window); other == spread {
+		t.Error("expected different keys to be spread apart")
+	}
+}
+
+func TestSpread_Range(t *testing.T) {
+	window := time.Minute
+	for _, hostname := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		spread := Spread(envWithHostname(t, hostname), "key", window)
+		if spread < 0 || spread >= window {
+			t.Errorf("spread for %s out of range: %v", hostname, spread)
+		}
+	}
+}
+
+func TestSpread_EmptyWindow(t *testing.T) {
+	env := envWithHostname(t, "node1")
+	if spread := Spread(env, "key", 0); spread != 0 {
+		t.Errorf("expected no spread for an empty window, not %v", spread)
+	}
+	if spread := Spread(env, "key", -time.Hour); spread != 0 {
+		t.Errorf("expected no spread for a negative window, not %v", spread)
+	}
+}
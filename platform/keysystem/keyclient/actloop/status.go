@@ -0,0 +1,283 @@
+package actloop
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+// ActionStatus is the most recent state of a single action, identified by its info string.
+type ActionStatus struct {
+	Info          string     `json:"info"`
+	LastChecked   time.Time  `json:"last-checked"`
+	LastPerformed *time.Time `json:"last-performed,omitempty"`
+	LastError     string     `json:"last-error,omitempty"`
+	LastErrorAt   *time.Time `json:"last-error-at,omitempty"`
+	Failures      uint64     `json:"failures"`
+	BlockedBy     []string   `json:"blocked-by,omitempty"`
+	// only populated for actions that manage a certificate
+	CertPath string     `json:"cert-path,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	RenewAt  *time.Time `json:"renew-at,omitempty"`
+	// only populated for actions that download a pinned authority
+	Authority string `json:"authority,omitempty"`
+	Pinned    string `json:"pinned,omitempty"`
+	// the fingerprint of an authority offered by the keyserver that did not match the pin and was refused
+	Mismatch string `json:"pin-mismatch,omitempty"`
+	// when the action next expects to have something to do, if known
+	NextDue *time.Time `json:"next-due,omitempty"`
+	// set while the action is backing off after failures
+	ConsecutiveFailures uint64     `json:"consecutive-failures,omitempty"`
+	RetryAt             *time.Time `json:"retry-at,omitempty"`
+
+	erroredThisCycle bool
+	skippedThisCycle bool
+}
+
+type LoopStatus struct {
+	LastCycle *time.Time     `json:"last-cycle,omitempty"`
+	Stable    bool           `json:"stable"`
+	Blocked   bool           `json:"blocked"`
+	Actions   []ActionStatus `json:"actions"`
+}
+
+// Status is shared between the action loop, which updates it, and anything reporting on the keyclient's progress.
+type Status struct {
+	mutex      sync.Mutex
+	actions    map[string]*ActionStatus
+	lastCycle  time.Time
+	cycleStart time.Time
+	inCycle    bool
+	stable     bool
+	blocked    bool
+	// the clock of the state being converged; nil to use the system clock
+	clock clock.Clock
+	// directories containing files that the actions manage
+	watched map[string]bool
+}
+
+func NewStatus() *Status {
+	return &Status{actions: map[string]*ActionStatus{}, watched: map[string]bool{}}
+}
+
+// must be called with the mutex held
+func (s *Status) action(info string) *ActionStatus {
+	as, found := s.actions[info]
+	if !found {
+		as = &ActionStatus{Info: info}
+		s.actions[info] = as
+	}
+	return as
+}
+
+// must be called with the mutex held
+func (s *Status) now() time.Time {
+	return clock.Now(s.clock)
+}
+
+// untilTime finds how long it will be until t, according to the clock used by the most recent cycle.
+func (s *Status) untilTime(t time.Time) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return t.Sub(s.now())
+}
+
+func (s *Status) beginCycle(clk clock.Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clock = clk
+	s.cycleStart = s.now()
+	s.inCycle = true
+	for _, as := range s.actions {
+		as.BlockedBy = nil
+		as.erroredThisCycle = false
+		as.skippedThisCycle = false
+	}
+}
+
+func (s *Status) endCycle(stable bool, blocked bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastCycle = s.now()
+	s.inCycle = false
+	s.stable = stable
+	s.blocked = blocked
+	for _, as := range s.actions {
+		// an action that ran without failing has recovered
+		if !as.LastChecked.Before(s.cycleStart) && !as.erroredThisCycle && !as.skippedThisCycle {
+			as.ConsecutiveFailures = 0
+			as.RetryAt = nil
+		}
+	}
+}
+
+func (s *Status) checked(info string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.action(info).LastChecked = s.now()
+}
+
+func (s *Status) performed(info string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	s.action(info).LastPerformed = &now
+}
+
+func (s *Status) errored(info string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	as := s.action(info)
+	as.LastError = err.Error()
+	as.LastErrorAt = &now
+	as.Failures++
+	if !as.erroredThisCycle {
+		as.erroredThisCycle = true
+		as.ConsecutiveFailures++
+		retryAt := now.Add(backoff(as.ConsecutiveFailures))
+		as.RetryAt = &retryAt
+	}
+}
+
+func (s *Status) backingOff(info string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	as := s.action(info)
+	if as.RetryAt != nil && s.now().Before(*as.RetryAt) {
+		as.skippedThisCycle = true
+		return true
+	}
+	return false
+}
+
+func (s *Status) schedule(info string, path string, dueAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if path != "" {
+		s.watched[filepath.Dir(path)] = true
+	}
+	as := s.action(info)
+	if dueAt.IsZero() {
+		as.NextDue = nil
+	} else {
+		as.NextDue = &dueAt
+	}
+}
+
+// watchedDirs lists the directories containing the files that the actions manage
+func (s *Status) watchedDirs() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var dirs []string
+	for dir := range s.watched {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// NextWake finds the earliest future time at which an action is due or can retry after a failure, or the zero time if
+// there is none. A simulation can advance its clock to this time to skip past the intervening idle cycles.
+func (s *Status) NextWake() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	var next time.Time
+	consider := func(at *time.Time) {
+		// times in the past are for actions that are waiting on something else, such as a blocker or RetryFailed
+		if at != nil && at.After(now) && (next.IsZero() || at.Before(next)) {
+			next = *at
+		}
+	}
+	for _, as := range s.actions {
+		consider(as.NextDue)
+		consider(as.RetryAt)
+	}
+	return next
+}
+
+func (s *Status) blockedBy(info string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	as := s.action(info)
+	as.BlockedBy = append(as.BlockedBy, err.Error())
+}
+
+func (s *Status) certificate(info string, certpath string, expires time.Time, renewAt time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	as := s.action(info)
+	as.CertPath = certpath
+	as.Expires = &expires
+	as.RenewAt = &renewAt
+}
+
+func (s *Status) pinned(info string, authority string, pinned string, mismatch string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	as := s.action(info)
+	as.Authority = authority
+	as.Pinned = pinned
+	as.Mismatch = mismatch
+}
+
+// Stalled reports whether the current cycle has been running for longer than limit, which means that an action is stuck.
+func (s *Status) Stalled(limit time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inCycle && s.now().Sub(s.cycleStart) > limit
+}
+
+// Summary describes the state of the loop in a single line, such as for systemctl status.
+func (s *Status) Summary() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.lastCycle.IsZero() {
+		return "starting"
+	}
+	failing, blocked := 0, 0
+	for _, as := range s.actions {
+		if as.ConsecutiveFailures > 0 {
+			failing++
+		}
+		if len(as.BlockedBy) > 0 {
+			blocked++
+		}
+	}
+	state := "converging"
+	if s.stable && s.blocked {
+		state = "blocked"
+	} else if s.stable {
+		state = "stable"
+	}
+	return fmt.Sprintf("%s: %d actions, %d failing, %d blocked", state, len(s.actions), failing, blocked)
+}
+
+// Snapshot returns a copy of the current status, with actions sorted by info string.
+func (s *Status) Snapshot() LoopStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ls := LoopStatus{
+		Stable:  s.stable,
+		Blocked: s.blocked,
+		Actions: make([]ActionStatus, 0, len(s.actions)),
+	}
+	if !s.lastCycle.IsZero() {
+		lastCycle := s.lastCycle
+		ls.LastCycle = &lastCycle
+	}
+	for _, as := range s.actions {
+		copied := *as
+		copied.BlockedBy = append([]string(nil), as.BlockedBy...)
+		ls.Actions = append(ls.Actions, copied)
+	}
+	sort.Slice(ls.Actions, func(i, j int) bool {
+		return ls.Actions[i].Info < ls.Actions[j].Info
+	})
+	return ls
+}
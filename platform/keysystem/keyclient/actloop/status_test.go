@@ -0,0 +1,118 @@
+package actloop
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+var start = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestNextWake_Empty(t *testing.T) {
+	s := NewStatus()
+	s.beginCycle(clock.NewFake(start))
+	if next := s.NextWake(); !next.IsZero() {
+		t.Errorf("expected no wake time, not %v", next)
+	}
+}
+
+func TestNextWake_EarliestDue(t *testing.T) {
+	s := NewStatus()
+	s.beginCycle(clock.NewFake(start))
+	s.schedule("later", "", start.Add(time.Hour))
+	s.schedule("sooner", "", start.Add(time.Minute))
+	s.schedule("unscheduled", "/etc/homeworld/keys/example.pem", time.Time{})
+	// times in the past are for actions waiting on something else, so they shouldn't cause a busy loop
+	s.schedule("overdue", "", start.Add(-time.Minute))
+	s.endCycle(true, false)
+	if next := s.NextWake(); !next.Equal(start.Add(time.Minute)) {
+		t.Errorf("wrong wake time %v", next)
+	}
+	// rescheduling an action with a zero time clears its due time
+	s.schedule("sooner", "", time.Time{})
+	if next := s.NextWake(); !next.Equal(start.Add(time.Hour)) {
+		t.Errorf("wrong wake time after clearing %v", next)
+	}
+}
+
+func TestNextWake_Retry(t *testing.T) {
+	fake := clock.NewFake(start)
+	s := NewStatus()
+	s.beginCycle(fake)
+	s.checked("failing")
+	s.schedule("failing", "", start.Add(24*time.Hour))
+	s.errored("failing", errors.New("keyserver unreachable"))
+	s.endCycle(true, false)
+	next := s.NextWake()
+	if next.Before(start.Add(BackoffInitial/2)) || !next.Before(start.Add(BackoffInitial*3/2)) {
+		t.Errorf("expected to wake for retry, not at %v", next)
+	}
+	fake.Set(next.Add(time.Second))
+	if next := s.NextWake(); !next.Equal(start.Add(24 * time.Hour)) {
+		t.Errorf("expected to wake when due once retry time passed, not at %v", next)
+	}
+}
+
+func TestBackingOff(t *testing.T) {
+	fake := clock.NewFake(start)
+	s := NewStatus()
+
+	s.beginCycle(fake)
+	s.checked("action")
+	s.errored("action", errors.New("first failure"))
+	s.errored("action", errors.New("second failure in the same cycle"))
+	s.endCycle(true, false)
+	as := s.Snapshot().Actions[0]
+	if as.Failures != 2 || as.ConsecutiveFailures != 1 || as.RetryAt == nil {
+		t.Fatalf("wrong status after failing: %+v", as)
+	}
+	retryAt := *as.RetryAt
+
+	s.beginCycle(fake)
+	if !s.backingOff("action") {
+		t.Error("expected action to back off")
+	}
+	s.endCycle(true, false)
+	// skipping the action is not a recovery
+	if as := s.Snapshot().Actions[0]; as.ConsecutiveFailures != 1 || as.RetryAt == nil {
+		t.Errorf("backoff cleared by skipped cycle: %+v", as)
+	}
+
+	fake.Set(retryAt)
+	s.beginCycle(fake)
+	if s.backingOff("action") {
+		t.Error("expected action to retry once its retry time arrived")
+	}
+	s.checked("action")
+	s.errored("action", errors.New("third failure"))
+	s.endCycle(true, false)
+	as = s.Snapshot().Actions[0]
+	if as.ConsecutiveFailures != 2 || as.RetryAt == nil || as.RetryAt.Before(retryAt.Add(BackoffInitial)) {
+		t.Errorf("expected backoff to grow: %+v", as)
+	}
+
+	fake.Set(*as.RetryAt)
+	s.beginCycle(fake)
+	if s.backingOff("action") {
+		t.Error("expected action to retry once its retry time arrived")
+	}
+	s.checked("action")
+	s.endCycle(true, false)
+	if as := s.Snapshot().Actions[0]; as.ConsecutiveFailures != 0 || as.RetryAt != nil {
+		t.Errorf("expected action to recover: %+v", as)
+	}
+}
+
+func TestWatchedDirs(t *testing.T) {
+	s := NewStatus()
+	s.schedule("cert", "/etc/homeworld/keys/kubernetes-worker.pem", time.Time{})
+	s.schedule("key", "/etc/homeworld/keys/kubernetes-worker.key", time.Time{})
+	s.schedule("hosts", "/etc/hosts", time.Time{})
+	s.schedule("timer", "", start)
+	dirs := s.watchedDirs()
+	if len(dirs) != 2 || dirs[0] != "/etc" || dirs[1] != "/etc/homeworld/keys" {
+		t.Errorf("wrong watched directories: %v", dirs)
+	}
+}
@@ -0,0 +1,81 @@
+package actloop
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// watcher wakes up the action loop when files in the watched directories change, so that (for example) a deleted
+// certificate is replaced immediately, rather than at the next scheduled check.
+type watcher struct {
+	fd      int
+	watched map[string]bool
+	events  chan struct{}
+}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+func newWatcher() (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &watcher{
+		fd:      fd,
+		watched: map[string]bool{},
+		events:  make(chan struct{}, 1),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *watcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		_, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return
+		}
+		// the contents of the events don't matter, because the action loop rechecks everything when it wakes up
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// add watches a directory, unless it's already watched. Directories that don't exist yet are skipped, and can be added
+// again once they do.
+func (w *watcher) add(dir string) error {
+	if w.watched[dir] {
+		return nil
+	}
+	_, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err == syscall.ENOENT {
+		return nil
+	} else if err != nil {
+		w.watched[dir] = true // don't keep retrying (and reporting) a watch that can't work
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	w.watched[dir] = true
+	return nil
+}
+
+// wait returns once a watched directory changes, or once the timeout passes.
+func (w *watcher) wait(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.events:
+		// give the writer a moment to finish related changes, and then discard the events they caused
+		time.Sleep(WatchSettleTime)
+		select {
+		case <-w.events:
+		default:
+		}
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,84 @@
+package actloop
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actloop-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := newWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.add(dir); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := ioutil.WriteFile(path.Join(dir, "granting.pem"), []byte("cert"), 0644); err != nil {
+			t.Error(err)
+		}
+	}()
+	began := time.Now()
+	w.wait(time.Minute)
+	if elapsed := time.Since(began); elapsed > 10*time.Second {
+		t.Errorf("watcher did not wake up on change, after %v", elapsed)
+	}
+}
+
+func TestWatcher_Timeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actloop-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := newWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.add(dir); err != nil {
+		t.Fatal(err)
+	}
+	began := time.Now()
+	w.wait(200 * time.Millisecond)
+	if elapsed := time.Since(began); elapsed < 200*time.Millisecond {
+		t.Errorf("watcher woke up without a change, after %v", elapsed)
+	}
+}
+
+func TestWatcher_MissingDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "actloop-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	missing := path.Join(dir, "keys")
+	w, err := newWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// directories that don't exist yet are skipped, so that they can be added once they do
+	if err := w.add(missing); err != nil {
+		t.Fatal(err)
+	}
+	if w.watched[missing] {
+		t.Error("missing directory recorded as watched")
+	}
+	if err := os.Mkdir(missing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.add(missing); err != nil {
+		t.Fatal(err)
+	}
+	if !w.watched[missing] {
+		t.Error("directory not watched once it exists")
+	}
+}
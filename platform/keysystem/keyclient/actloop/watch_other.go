@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package actloop
+
+import "time"
+
+// watcher only supports inotify, so on other platforms, the action loop just sleeps until the next action is due.
+type watcher struct{}
+
+func newWatcher() (*watcher, error) {
+	return &watcher{}, nil
+}
+
+func (w *watcher) add(dir string) error {
+	return nil
+}
+
+func (w *watcher) wait(timeout time.Duration) {
+	time.Sleep(timeout)
+}
@@ -1,22 +1,61 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/oneshot"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/setup"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
 )
 
 // the keyclient is a daemon with a few different responsibilities:
-//  - perform initial token authentication to get a keygranting certificate
+//  - perform initial token authentication to get a keygranting certificate, or enroll with an administrator's approval
 //  - generate local key material
 //  - renew the keygranting certificate
 //  - renew other certificates
+// it can also be run by an operator for a single command, to inspect or drive the keyclient on a node.
+// setting HOMEWORLD_ROOT relocates every file that the keyclient manages, but its other side effects still happen.
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: keyclient                        run as a daemon")
+	fmt.Fprintln(os.Stderr, "       keyclient status                 show managed files and the daemon's action state")
+	fmt.Fprintln(os.Stderr, "       keyclient renew <path>... | --all  renew certificates now, regardless of expiration")
+	fmt.Fprintln(os.Stderr, "       keyclient check                  verify that certificates match their keys and authorities")
+	fmt.Fprintln(os.Stderr, "       keyclient run-once               run a single convergence pass")
+	fmt.Fprintln(os.Stderr, "       keyclient enroll <hostname> <ip> <kind>  ask an administrator to admit this machine")
+	os.Exit(oneshot.ExitInvalidInvocation)
+}
 
 func main() {
 	logger := log.New(os.Stderr, "[keyclient] ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
 
+	if len(os.Args) > 1 {
+		env := hostenv.FromEnvironment()
+		switch os.Args[1] {
+		case "status":
+			os.Exit(oneshot.Status(env, os.Stdout))
+		case "renew":
+			if len(os.Args) == 3 && os.Args[2] == "--all" {
+				os.Exit(oneshot.Renew(env, worldconfig.ConvergeState, nil, true, os.Stdout, logger))
+			}
+			os.Exit(oneshot.Renew(env, worldconfig.ConvergeState, os.Args[2:], false, os.Stdout, logger))
+		case "check":
+			os.Exit(oneshot.Check(env, os.Stdout))
+		case "run-once":
+			os.Exit(oneshot.RunOnce(env, worldconfig.ConvergeState, os.Stdout, logger))
+		case "enroll":
+			if len(os.Args) != 5 {
+				usage()
+			}
+			os.Exit(oneshot.Enroll(env, worldconfig.ConvergeState, os.Args[2], os.Args[3], os.Args[4], os.Stdout, logger))
+		default:
+			usage()
+		}
+	}
+
 	err := setup.LoadAndLaunchDefault(worldconfig.ConvergeState, logger)
 	if err != nil {
 		logger.Fatal(err)
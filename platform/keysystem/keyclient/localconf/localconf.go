@@ -0,0 +1,27 @@
+package localconf
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+// Read parses the KEY=VALUE lines of a local.conf file, as generated by the keyserver.
+func Read(path string) (map[string]string, error) {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kvs := map[string]string{}
+	for _, line := range strings.Split(string(conf), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && line[0] != '#' {
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("incorrectly formatted local.conf")
+			}
+			kvs[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return kvs, nil
+}
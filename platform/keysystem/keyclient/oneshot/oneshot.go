@@ -0,0 +1,362 @@
+package oneshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/enroll"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/keyreq"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/outputs"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/setup"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/status"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/util/certutil"
+)
+
+// The one-shot commands let an operator inspect and drive the keyclient on a node, using the same actions as the
+// daemon. A running daemon waits for a one-shot convergence pass to finish before it runs its own actions again, and
+// then notices the changes.
+
+const (
+	ExitOK                = 0
+	ExitFailed            = 1
+	ExitBlocked           = 2
+	ExitUnstable          = 3
+	ExitInvalidInvocation = 255
+)
+
+// how long to wait between cycles of a one-shot convergence pass that performed actions
+const CycleTime = 2 * time.Second
+
+// the most cycles that a one-shot convergence pass will run before giving up on the loop stabilizing
+const MaxCycles = 50
+
+type managedKey struct {
+	// either "tls" or "ssh"
+	Type   string
+	Key    string
+	Cert   string
+	Expect keyreq.Expectations
+}
+
+func (mk managedKey) checkExpiration(cert []byte) (time.Time, error) {
+	if mk.Type == "ssh" {
+		return certutil.CheckSSHCertExpiration(cert)
+	}
+	return certutil.CheckTLSCertExpiration(cert)
+}
+
+func (mk managedKey) verify(cert []byte, key []byte, authority []byte, names []string, now time.Time) error {
+	if mk.Type == "ssh" {
+		return certutil.VerifySSHHostCert(cert, key, authority, names, now)
+	}
+	return certutil.VerifyTLSCert(cert, key, authority, names, now)
+}
+
+// loadConfig reads the keyclient configuration, which may legitimately be missing on a node that hasn't finished
+// bootstrapping.
+func loadConfig(env hostenv.Env) (*outputs.Config, error) {
+	data, err := ioutil.ReadFile(env.Path(paths.KeyclientConfigPath))
+	if os.IsNotExist(err) {
+		return &outputs.Config{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return outputs.Parse(data)
+}
+
+// managedKeys lists the keygranting key, which is always managed, followed by every key in the configuration. The key
+// and certificate paths are relocated through the env.
+func managedKeys(env hostenv.Env, config *outputs.Config) []managedKey {
+	keys := []managedKey{{Type: "tls", Key: env.Path(paths.GrantingKeyPath), Cert: env.Path(paths.GrantingCertPath)}}
+	for _, k := range config.Keys {
+		keys = append(keys, managedKey{
+			Type:   k.Type,
+			Key:    env.Path(k.Key),
+			Cert:   env.Path(k.Cert),
+			Expect: keyreq.Expectations{Authority: k.Authority, Names: k.Names},
+		})
+	}
+	return keys
+}
+
+func describeCert(mk managedKey, now time.Time) string {
+	cert, err := ioutil.ReadFile(mk.Cert)
+	if os.IsNotExist(err) {
+		return "missing"
+	} else if err != nil {
+		return fmt.Sprintf("unreadable: %v", err)
+	}
+	expires, err := mk.checkExpiration(cert)
+	if err != nil {
+		return fmt.Sprintf("invalid: %v", err)
+	}
+	if expires.Before(now) {
+		return fmt.Sprintf("EXPIRED at %s", expires.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("expires %s (in %v)", expires.Format(time.RFC3339), expires.Sub(now).Round(time.Hour))
+}
+
+func describeFile(path string) string {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "missing"
+	} else if err != nil {
+		return fmt.Sprintf("unreadable: %v", err)
+	}
+	return fmt.Sprintf("updated %s", info.ModTime().Format(time.RFC3339))
+}
+
+func describeAction(as actloop.ActionStatus, now time.Time) string {
+	if len(as.BlockedBy) > 0 {
+		return "blocked: " + strings.Join(as.BlockedBy, "; ")
+	}
+	if as.RetryAt != nil && as.RetryAt.After(now) {
+		return fmt.Sprintf("backing off until %s after: %s", as.RetryAt.Format(time.RFC3339), as.LastError)
+	}
+	if as.ConsecutiveFailures > 0 {
+		return "failing: " + as.LastError
+	}
+	if as.NextDue != nil {
+		return fmt.Sprintf("ok, next due %s", as.NextDue.Format(time.RFC3339))
+	}
+	return "ok"
+}
+
+func fetchDaemonStatus() (*status.Status, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get("http://" + status.StatusAddress + "/status")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	daemonStatus := &status.Status{}
+	err = json.NewDecoder(response.Body).Decode(daemonStatus)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding status")
+	}
+	return daemonStatus, nil
+}
+
+// Status shows every file managed by the keyclient, and the state of each action in the running daemon, if any.
+func Status(env hostenv.Env, out io.Writer) int {
+	now := env.Now()
+	config, err := loadConfig(env)
+	if err != nil {
+		fmt.Fprintf(out, "cannot load keyclient configuration: %v\n", err)
+		config = &outputs.Config{}
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tKIND\tSTATE")
+	for _, mk := range managedKeys(env, config) {
+		fmt.Fprintf(tw, "%s\t%s key\t%s\n", mk.Key, mk.Type, describeFile(mk.Key))
+		fmt.Fprintf(tw, "%s\t%s cert\t%s\n", mk.Cert, mk.Type, describeCert(mk, now))
+	}
+	for _, d := range config.Downloads {
+		fmt.Fprintf(tw, "%s\t%s download\t%s\n", env.Path(d.Path), d.Type, describeFile(env.Path(d.Path)))
+	}
+	err = tw.Flush()
+	if err != nil {
+		return ExitFailed
+	}
+
+	fmt.Fprintln(out)
+	daemonStatus, err := fetchDaemonStatus()
+	if err != nil {
+		fmt.Fprintf(out, "keyclient daemon not reachable on %s: %v\n", status.StatusAddress, err)
+		return ExitOK
+	}
+	if daemonStatus.LastCycle == nil {
+		fmt.Fprintln(out, "keyclient daemon has not yet completed a cycle")
+	} else {
+		fmt.Fprintf(out, "keyclient daemon last cycle at %s (stable: %v, blocked: %v)\n",
+			daemonStatus.LastCycle.Format(time.RFC3339), daemonStatus.Stable, daemonStatus.Blocked)
+	}
+	for _, ks := range daemonStatus.Keyservers {
+		fmt.Fprintf(out, "keyserver %s: %d served, %d failures\n", ks.BaseURL, ks.Served, ks.Failures)
+	}
+	tw = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tSTATE")
+	for _, as := range daemonStatus.Actions {
+		fmt.Fprintf(tw, "%s\t%s\n", as.Info, describeAction(as, now))
+	}
+	err = tw.Flush()
+	if err != nil {
+		return ExitFailed
+	}
+	return ExitOK
+}
+
+// summarize reports the outcome of a one-shot convergence pass, and picks the corresponding exit code.
+func summarize(out io.Writer, loop *actloop.ActLoop, stable bool) int {
+	snapshot := loop.Status().Snapshot()
+	code := ExitOK
+	for _, as := range snapshot.Actions {
+		if as.LastErrorAt != nil {
+			fmt.Fprintf(out, "failed: %s: %s\n", as.Info, as.LastError)
+			code = ExitFailed
+		} else if len(as.BlockedBy) > 0 {
+			fmt.Fprintf(out, "blocked: %s: %s\n", as.Info, strings.Join(as.BlockedBy, "; "))
+			if code == ExitOK {
+				code = ExitBlocked
+			}
+		} else if as.LastPerformed != nil {
+			fmt.Fprintf(out, "performed: %s\n", as.Info)
+		}
+	}
+	if !stable {
+		fmt.Fprintf(out, "still performing actions after %d cycles\n", MaxCycles)
+		if code == ExitOK {
+			code = ExitUnstable
+		}
+	}
+	return code
+}
+
+// RunOnce runs a single convergence pass, continuing until the actions stabilize.
+func RunOnce(env hostenv.Env, actions actloop.NewAction, out io.Writer, logger *log.Logger) int {
+	loop, clientState, err := setup.Load(env, actions, logger)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return ExitFailed
+	}
+	stable, err := loop.RunOnce(clientState, CycleTime, MaxCycles)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return ExitFailed
+	}
+	return summarize(out, loop, stable)
+}
+
+// Enroll asks for this machine to join the cluster as the described node, and then converges. The keyclient keeps
+// checking on the request until an administrator approves it.
+func Enroll(env hostenv.Env, actions actloop.NewAction, hostname string, ip string, kind string, out io.Writer, logger *log.Logger) int {
+	err := enroll.RequestEnrollment(env, hostname, ip, kind)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return ExitFailed
+	}
+	return RunOnce(env, actions, out, logger)
+}
+
+// findCerts maps each target, which may name either a managed key or its certificate, to the certificate path.
+func findCerts(env hostenv.Env, targets []string) ([]string, error) {
+	config, err := loadConfig(env)
+	if err != nil {
+		return nil, errors.Wrap(err, "while loading keyclient configuration")
+	}
+	var certs []string
+	for _, target := range targets {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, mk := range managedKeys(env, config) {
+			if abs == mk.Key || abs == mk.Cert {
+				certs = append(certs, mk.Cert)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("not a key or certificate managed by the keyclient: %s", target)
+		}
+	}
+	return certs, nil
+}
+
+// Renew renews the listed certificates (or all of them), regardless of their renewal margin, and then converges.
+func Renew(env hostenv.Env, actions actloop.NewAction, targets []string, all bool, out io.Writer, logger *log.Logger) int {
+	if all == (len(targets) > 0) {
+		fmt.Fprintln(out, "expected either --all or a list of keys or certificates to renew")
+		return ExitInvalidInvocation
+	}
+	certs, err := findCerts(env, targets)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return ExitInvalidInvocation
+	}
+	loop, clientState, err := setup.Load(env, actions, logger)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return ExitFailed
+	}
+	loop.ForceRenewal(all, certs)
+	stable, err := loop.RunOnce(clientState, CycleTime, MaxCycles)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return ExitFailed
+	}
+	code := summarize(out, loop, stable)
+	for _, cert := range loop.PendingRenewals() {
+		fmt.Fprintf(out, "not renewed: %s\n", cert)
+		code = ExitFailed
+	}
+	return code
+}
+
+func checkKey(env hostenv.Env, mk managedKey, now time.Time) error {
+	key, err := ioutil.ReadFile(mk.Key)
+	if err != nil {
+		return errors.Wrap(err, "while reading key")
+	}
+	cert, err := ioutil.ReadFile(mk.Cert)
+	if err != nil {
+		return errors.Wrap(err, "while reading certificate")
+	}
+	authority, names, err := mk.Expect.Resolve(env)
+	if err != nil {
+		return err
+	}
+	err = mk.verify(cert, key, authority, names, now)
+	if err != nil {
+		return err
+	}
+	expires, err := mk.checkExpiration(cert)
+	if err != nil {
+		return err
+	}
+	if expires.Before(now) {
+		return fmt.Errorf("certificate expired at %s", expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Check verifies that each managed certificate matches its key, chains to its authority, includes the expected names,
+// and has not expired.
+func Check(env hostenv.Env, out io.Writer) int {
+	config, err := loadConfig(env)
+	if err != nil {
+		fmt.Fprintf(out, "cannot load keyclient configuration: %v\n", err)
+		return ExitFailed
+	}
+	now := env.Now()
+	code := ExitOK
+	for _, mk := range managedKeys(env, config) {
+		err := checkKey(env, mk, now)
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", mk.Cert, err)
+			code = ExitFailed
+		} else {
+			fmt.Fprintf(out, "ok   %s\n", mk.Cert)
+		}
+	}
+	return code
+}
@@ -0,0 +1,260 @@
+package outputs
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/download"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/keygen"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/keyreq"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/reload"
+)
+
+// The keyclient configuration lists the files that the keyclient should maintain on a particular node, beyond the
+// keygranting certificate and local configuration that it needs to bootstrap itself. It is normally generated by the
+// keyserver for each node, based on the node's kind, but can be written by hand.
+
+// Hook describes a reload.Hook. Exactly one of Restart or Reload must be specified, naming one of hookUnits.
+type Hook struct {
+	Restart string `yaml:"restart,omitempty"`
+	Reload  string `yaml:"reload,omitempty"`
+}
+
+type Download struct {
+	// one of "authority", "static", or "api"
+	Type    string        `yaml:"type"`
+	Name    string        `yaml:"name"`
+	Path    string        `yaml:"path"`
+	Refresh time.Duration `yaml:"refresh"`
+	// octal, such as "0644"
+	Mode  string `yaml:"mode"`
+	Hooks []Hook `yaml:"hooks,omitempty"`
+}
+
+type Key struct {
+	// either "tls" (for which the keyclient generates the private key) or "ssh" (for which Key names an existing
+	// public key)
+	Type        string        `yaml:"type"`
+	Key         string        `yaml:"key"`
+	Cert        string        `yaml:"cert"`
+	API         string        `yaml:"api"`
+	InAdvance   time.Duration `yaml:"in-advance"`
+	RotateEvery time.Duration `yaml:"rotate-every,omitempty"`
+	Authority   string        `yaml:"authority,omitempty"`
+	Names       []string      `yaml:"names,omitempty"`
+	Hooks       []Hook        `yaml:"hooks,omitempty"`
+}
+
+type Config struct {
+	Downloads []Download `yaml:"downloads"`
+	Keys      []Key      `yaml:"keys"`
+}
+
+func RestartUnits(units ...string) []Hook {
+	var hooks []Hook
+	for _, unit := range units {
+		hooks = append(hooks, Hook{Restart: unit})
+	}
+	return hooks
+}
+
+// hookUnits lists the units that hooks may restart or reload. The keyclient runs as root, so a configuration must not be
+// able to make it act on anything else on the node.
+var hookUnits = map[string]bool{
+	"apiserver.service":             true,
+	"docker-registry.service":       true,
+	"etcd.service":                  true,
+	"etcd-metrics-exporter.service": true,
+	"keyclient-update-ca.service":   true,
+	"kube-ctrlmgr.service":          true,
+	"kube-proxy.service":            true,
+	"kube-scheduler.service":        true,
+	"kube-state-metrics.service":    true,
+	"kubelet.service":               true,
+	"prometheus.service":            true,
+	"ssh.service":                   true,
+}
+
+func (h Hook) Build() (reload.Hook, error) {
+	if (h.Restart == "") == (h.Reload == "") {
+		return nil, errors.New("hook must specify exactly one of restart or reload")
+	}
+	if h.Restart != "" {
+		if !hookUnits[h.Restart] {
+			return nil, fmt.Errorf("hooks cannot restart unit %s", h.Restart)
+		}
+		return reload.RestartUnit(h.Restart), nil
+	}
+	if !hookUnits[h.Reload] {
+		return nil, fmt.Errorf("hooks cannot reload unit %s", h.Reload)
+	}
+	return reload.ReloadUnit(h.Reload), nil
+}
+
+func buildHooks(hooks []Hook) ([]reload.Hook, error) {
+	var built []reload.Hook
+	for _, hook := range hooks {
+		rh, err := hook.Build()
+		if err != nil {
+			return nil, err
+		}
+		built = append(built, rh)
+	}
+	return built, nil
+}
+
+func (d Download) mode() (uint64, error) {
+	return strconv.ParseUint(d.Mode, 8, 32)
+}
+
+func (d Download) validate() error {
+	if d.Type != "authority" && d.Type != "static" && d.Type != "api" {
+		return fmt.Errorf("unknown download type '%s'", d.Type)
+	}
+	if d.Name == "" {
+		return errors.New("download requires a name")
+	}
+	if !filepath.IsAbs(d.Path) {
+		return fmt.Errorf("download path '%s' is not absolute", d.Path)
+	}
+	if d.Refresh <= 0 {
+		return errors.New("download requires a positive refresh period")
+	}
+	if _, err := d.mode(); err != nil {
+		return errors.Wrap(err, "while parsing mode")
+	}
+	_, err := buildHooks(d.Hooks)
+	return err
+}
+
+func (k Key) validate() error {
+	if k.Type != "tls" && k.Type != "ssh" {
+		return fmt.Errorf("unknown key type '%s'", k.Type)
+	}
+	if !filepath.IsAbs(k.Key) || !filepath.IsAbs(k.Cert) {
+		return errors.New("key and cert paths must be absolute")
+	}
+	if k.API == "" {
+		return errors.New("key requires an api")
+	}
+	if k.InAdvance <= 0 {
+		return errors.New("key requires a positive renewal margin")
+	}
+	if k.Type == "ssh" && k.RotateEvery != 0 {
+		return errors.New("ssh keys are not generated by the keyclient, so they cannot be rotated")
+	}
+	if k.RotateEvery < 0 {
+		return errors.New("rotation period cannot be negative")
+	}
+	_, err := buildHooks(k.Hooks)
+	return err
+}
+
+func (c *Config) Validate() error {
+	paths := map[string]bool{}
+	claim := func(path string) error {
+		if paths[path] {
+			return fmt.Errorf("path %s is managed more than once", path)
+		}
+		paths[path] = true
+		return nil
+	}
+	for _, d := range c.Downloads {
+		if err := d.validate(); err != nil {
+			return errors.Wrapf(err, "in download to %s", d.Path)
+		}
+		if err := claim(d.Path); err != nil {
+			return err
+		}
+	}
+	for _, k := range c.Keys {
+		if err := k.validate(); err != nil {
+			return errors.Wrapf(err, "in key %s", k.Key)
+		}
+		if err := claim(k.Key); err != nil {
+			return err
+		}
+		if err := claim(k.Cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Parse(data []byte) (*Config, error) {
+	config := &Config{}
+	err := yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing keyclient configuration")
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, errors.Wrap(err, "while validating keyclient configuration")
+	}
+	return config, nil
+}
+
+func (c *Config) Marshal() ([]byte, error) {
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(c)
+}
+
+// Converge runs the actions for each output. The configuration must already have been validated.
+func (c *Config) Converge(nac *actloop.NewActionContext) {
+	for _, d := range c.Downloads {
+		hooks, _ := buildHooks(d.Hooks)
+		mode, _ := d.mode()
+		switch d.Type {
+		case "authority":
+			download.DownloadAuthority(d.Name, d.Path, d.Refresh, hooks, nac)
+		case "static":
+			download.DownloadStatic(d.Name, d.Path, d.Refresh, hooks, nac)
+		case "api":
+			download.DownloadFromAPI(d.Name, d.Path, d.Refresh, mode, hooks, nac)
+		}
+	}
+	for _, k := range c.Keys {
+		hooks, _ := buildHooks(k.Hooks)
+		expect := keyreq.Expectations{Authority: k.Authority, Names: k.Names}
+		switch k.Type {
+		case "tls":
+			keygen.GenerateKey(k.Key, nac)
+			keyreq.RequestOrRenewTLSKey(k.Key, k.Cert, k.API, k.InAdvance, expect, hooks, nac)
+			keyreq.RotateTLSKey(k.Key, k.Cert, k.API, k.RotateEvery, expect, hooks, nac)
+		case "ssh":
+			keyreq.RequestOrRenewSSHKey(k.Key, k.Cert, k.API, k.InAdvance, expect, hooks, nac)
+		}
+	}
+}
+
+// ConvergeFrom loads the keyclient configuration from a file, and then converges each of the outputs it lists.
+func ConvergeFrom(path string, nac *actloop.NewActionContext) {
+	path = nac.State.Env.Path(path)
+	info := fmt.Sprintf("load keyclient configuration from %s", path)
+	nac.Checked(info)
+	nac.Schedule(info, path, time.Time{})
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		nac.Blocked(info, err)
+		return
+	} else if err != nil {
+		nac.Errored(info, err)
+		return
+	}
+	config, err := Parse(data)
+	if err != nil {
+		nac.Errored(info, err)
+		return
+	}
+	config.Converge(nac)
+}
@@ -0,0 +1,186 @@
+package outputs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+const sampleConfig = `
+downloads:
+  - type: authority
+    name: kubernetes
+    path: /etc/homeworld/authorities/kubernetes.pem
+    refresh: 24h
+    mode: "0644"
+    hooks:
+      - restart: kubelet.service
+  - type: api
+    name: get-local-config
+    path: /etc/homeworld/config/local.conf
+    refresh: 1h
+    mode: "0600"
+keys:
+  - type: tls
+    key: /etc/homeworld/keys/kubernetes-worker.key
+    cert: /etc/homeworld/keys/kubernetes-worker.pem
+    api: renew-kubernetes-worker
+    in-advance: 168h
+    rotate-every: 2160h
+    authority: /etc/homeworld/authorities/kubernetes.pem
+    names: ["(HOST_DNS)"]
+    hooks:
+      - restart: kubelet.service
+      - reload: ssh.service
+  - type: ssh
+    key: /etc/ssh/ssh_host_rsa_key.pub
+    cert: /etc/ssh/ssh_host_rsa_cert
+    api: grant-ssh-host
+    in-advance: 168h
+`
+
+func TestParse(t *testing.T) {
+	config, err := Parse([]byte(sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Downloads) != 2 || len(config.Keys) != 2 {
+		t.Fatalf("wrong number of outputs: %+v", config)
+	}
+	d := config.Downloads[0]
+	if d.Type != "authority" || d.Refresh != 24*time.Hour || len(d.Hooks) != 1 || d.Hooks[0].Restart != "kubelet.service" {
+		t.Errorf("wrong download: %+v", d)
+	}
+	if mode, err := config.Downloads[1].mode(); err != nil || mode != 0600 {
+		t.Errorf("wrong mode: %o (%v)", mode, err)
+	}
+	k := config.Keys[0]
+	if k.InAdvance != 7*24*time.Hour || k.RotateEvery != 90*24*time.Hour || len(k.Names) != 1 || len(k.Hooks) != 2 {
+		t.Errorf("wrong key: %+v", k)
+	}
+}
+
+func TestParse_Roundtrip(t *testing.T) {
+	config, err := Parse([]byte(sampleConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reparsed, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := reparsed.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("configuration changed after roundtrip:\n%s\nvs\n%s", data, again)
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	_, err := Parse([]byte("downloads: [\n"))
+	testutil.CheckError(t, err, "while parsing keyclient configuration")
+	_, err = Parse([]byte("uploads: []\n"))
+	testutil.CheckError(t, err, "field uploads not found")
+	_, err = Parse([]byte("keys:\n  - type: tls\n    command: [rm, -rf, /]\n"))
+	testutil.CheckError(t, err, "field command not found")
+}
+
+func TestValidate(t *testing.T) {
+	download := func(modify func(d *Download)) *Config {
+		d := Download{Type: "static", Name: "cluster.conf", Path: "/etc/homeworld/config/cluster.conf", Refresh: time.Hour, Mode: "0644"}
+		modify(&d)
+		return &Config{Downloads: []Download{d}}
+	}
+	key := func(modify func(k *Key)) *Config {
+		k := Key{Type: "tls", Key: "/etc/homeworld/keys/a.key", Cert: "/etc/homeworld/keys/a.pem", API: "renew-a", InAdvance: time.Hour}
+		modify(&k)
+		return &Config{Keys: []Key{k}}
+	}
+	for _, test := range []struct {
+		config *Config
+		err    string
+	}{
+		{download(func(d *Download) { d.Type = "ftp" }), "in download to /etc/homeworld/config/cluster.conf: unknown download type 'ftp'"},
+		{download(func(d *Download) { d.Name = "" }), "download requires a name"},
+		{download(func(d *Download) { d.Path = "cluster.conf" }), "download path 'cluster.conf' is not absolute"},
+		{download(func(d *Download) { d.Refresh = 0 }), "download requires a positive refresh period"},
+		{download(func(d *Download) { d.Mode = "0694" }), "while parsing mode"},
+		{download(func(d *Download) { d.Hooks = []Hook{{}} }), "hook must specify exactly one of restart or reload"},
+		{key(func(k *Key) { k.Type = "gpg" }), "in key /etc/homeworld/keys/a.key: unknown key type 'gpg'"},
+		{key(func(k *Key) { k.Cert = "a.pem" }), "key and cert paths must be absolute"},
+		{key(func(k *Key) { k.API = "" }), "key requires an api"},
+		{key(func(k *Key) { k.InAdvance = -time.Hour }), "key requires a positive renewal margin"},
+		{key(func(k *Key) { k.Type = "ssh"; k.RotateEvery = time.Hour }), "ssh keys are not generated by the keyclient"},
+		{key(func(k *Key) { k.RotateEvery = -time.Hour }), "rotation period cannot be negative"},
+		{key(func(k *Key) { k.Hooks = []Hook{{Restart: "sshd.service"}} }), "hooks cannot restart unit sshd.service"},
+		{key(func(k *Key) { k.Cert = k.Key }), "path /etc/homeworld/keys/a.key is managed more than once"},
+		{&Config{
+			Downloads: download(func(d *Download) { d.Path = "/etc/homeworld/keys/a.pem" }).Downloads,
+			Keys:      key(func(k *Key) {}).Keys,
+		}, "path /etc/homeworld/keys/a.pem is managed more than once"},
+	} {
+		testutil.CheckError(t, test.config.Validate(), test.err)
+	}
+	if err := download(func(d *Download) {}).Validate(); err != nil {
+		t.Errorf("expected valid download: %v", err)
+	}
+	if err := key(func(k *Key) {}).Validate(); err != nil {
+		t.Errorf("expected valid key: %v", err)
+	}
+}
+
+func TestHookBuild(t *testing.T) {
+	for _, test := range []struct {
+		hook Hook
+		name string
+	}{
+		{Hook{Restart: "etcd.service"}, "try-restart etcd.service"},
+		{Hook{Reload: "ssh.service"}, "try-reload-or-restart ssh.service"},
+	} {
+		built, err := test.hook.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if built.Name() != test.name {
+			t.Errorf("wrong hook: %s", built.Name())
+		}
+	}
+	for _, test := range []struct {
+		hook Hook
+		err  string
+	}{
+		{Hook{}, "hook must specify exactly one of restart or reload"},
+		{Hook{Restart: "etcd.service", Reload: "etcd.service"}, "hook must specify exactly one of restart or reload"},
+		{Hook{Restart: "reboot.target"}, "hooks cannot restart unit reboot.target"},
+		{Hook{Reload: "../../etc/evil.service"}, "hooks cannot reload unit ../../etc/evil.service"},
+	} {
+		_, err := test.hook.Build()
+		testutil.CheckError(t, err, test.err)
+	}
+}
+
+func TestRestartUnits(t *testing.T) {
+	hooks := RestartUnits("apiserver.service", "kube-ctrlmgr.service")
+	if len(hooks) != 2 || hooks[0].Restart != "apiserver.service" || hooks[1].Restart != "kube-ctrlmgr.service" {
+		t.Errorf("wrong hooks: %+v", hooks)
+	}
+	built, err := buildHooks(hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, hook := range built {
+		names = append(names, hook.Name())
+	}
+	if strings.Join(names, ",") != "try-restart apiserver.service,try-restart kube-ctrlmgr.service" {
+		t.Errorf("wrong built hooks: %v", names)
+	}
+}
@@ -0,0 +1,64 @@
+package reload
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+)
+
+// A Hook is an action taken after the keyclient installs a new file, so that the daemons that consume the file pick up
+// the new version. Hooks with the same name are considered to be the same hook, and are only run once even if multiple
+// files trigger them. Hooks act through the effects of the env. Only systemd units can be restarted or reloaded, because
+// hooks run as root on behalf of whatever configuration the keyclient was given.
+type Hook interface {
+	Name() string
+	Run(env hostenv.Env) error
+}
+
+func run(env hostenv.Env, argv ...string) error {
+	output, err := env.Effects.Run(argv)
+	if err != nil {
+		return errors.Wrapf(err, "while running %s (output: %q)", argv[0], strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+type unitHook struct {
+	verb string
+	unit string
+}
+
+// RestartUnit restarts a systemd unit, if it's running. Units that aren't installed on this node are skipped, so that
+// hooks can be declared for every node kind.
+func RestartUnit(unit string) Hook {
+	return unitHook{verb: "try-restart", unit: unit}
+}
+
+// ReloadUnit reloads a systemd unit (or restarts it, if it doesn't support reloading), if it's running.
+func ReloadUnit(unit string) Hook {
+	return unitHook{verb: "try-reload-or-restart", unit: unit}
+}
+
+func (u unitHook) Name() string {
+	return u.verb + " " + u.unit
+}
+
+func (u unitHook) isInstalled(env hostenv.Env) (bool, error) {
+	output, err := env.Effects.Run([]string{"systemctl", "show", "--property=LoadState", "--value", u.unit})
+	if err != nil {
+		return false, errors.Wrapf(err, "while checking state of unit %s", u.unit)
+	}
+	return strings.TrimSpace(string(output)) != "not-found", nil
+}
+
+func (u unitHook) Run(env hostenv.Env) error {
+	installed, err := u.isInstalled(env)
+	if err != nil {
+		return err
+	}
+	if !installed {
+		return nil
+	}
+	return run(env, "systemctl", u.verb, u.unit)
+}
@@ -0,0 +1,84 @@
+package reload
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+// notFoundEffects reports that every unit is missing when asked for its load state
+type notFoundEffects struct {
+	*hostenv.SimulatedEffects
+}
+
+func (n notFoundEffects) Run(argv []string) ([]byte, error) {
+	output, err := n.SimulatedEffects.Run(argv)
+	if err == nil && len(argv) > 1 && argv[1] == "show" {
+		return []byte("not-found\n"), nil
+	}
+	return output, err
+}
+
+func TestUnitHooks(t *testing.T) {
+	for _, test := range []struct {
+		hook Hook
+		name string
+		verb string
+	}{
+		{RestartUnit("etcd.service"), "try-restart etcd.service", "try-restart"},
+		{ReloadUnit("ssh.service"), "try-reload-or-restart ssh.service", "try-reload-or-restart"},
+	} {
+		if test.hook.Name() != test.name {
+			t.Errorf("wrong name %q", test.hook.Name())
+		}
+		effects := hostenv.NewSimulatedEffects()
+		env := hostenv.Relocated("/nonexistent")
+		env.Effects = effects
+		if err := test.hook.Run(env); err != nil {
+			t.Fatal(err)
+		}
+		unit := strings.Fields(test.name)[1]
+		expected := []string{
+			"run systemctl show --property=LoadState --value " + unit,
+			"run systemctl " + test.verb + " " + unit,
+		}
+		if log := effects.Log(); strings.Join(log, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("wrong effects: %v", log)
+		}
+	}
+}
+
+func TestUnitHooks_SameName(t *testing.T) {
+	if RestartUnit("etcd.service").Name() != RestartUnit("etcd.service").Name() {
+		t.Error("expected identical hooks to have the same name")
+	}
+	if RestartUnit("etcd.service").Name() == ReloadUnit("etcd.service").Name() {
+		t.Error("expected restart and reload hooks to be distinct")
+	}
+}
+
+func TestUnitHook_NotInstalled(t *testing.T) {
+	effects := notFoundEffects{hostenv.NewSimulatedEffects()}
+	env := hostenv.Relocated("/nonexistent")
+	env.Effects = effects
+	if err := RestartUnit("apiserver.service").Run(env); err != nil {
+		t.Fatal(err)
+	}
+	if log := effects.Log(); len(log) != 1 || !strings.HasPrefix(log[0], "run systemctl show") {
+		t.Errorf("expected missing unit to be skipped, not: %v", log)
+	}
+}
+
+func TestUnitHook_Failed(t *testing.T) {
+	effects := hostenv.NewSimulatedEffects()
+	env := hostenv.Relocated("/nonexistent")
+	env.Effects = effects
+	effects.FailRuns("systemctl try-restart")
+	err := RestartUnit("kubelet.service").Run(env)
+	testutil.CheckError(t, err, "while running systemctl (output: \"\"): simulated failure of systemctl try-restart kubelet.service")
+	effects.FailRuns("systemctl show")
+	err = RestartUnit("kubelet.service").Run(env)
+	testutil.CheckError(t, err, "while checking state of unit kubelet.service")
+}
@@ -1,38 +1,72 @@
 package setup
 
 import (
+	"fmt"
 	"github.com/pkg/errors"
 	"log"
-	"os/exec"
 	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/api"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/state"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/status"
+	"github.com/sipb/homeworld/platform/util/sdnotify"
 )
 
-// TODO: private key rotation, not just getting new certs
+func notifyReady(env hostenv.Env) func(*log.Logger) {
+	return func(logger *log.Logger) {
+		// tells systemd that we're done setting up
+		err := env.Effects.Notify(sdnotify.Ready)
+		if err != nil {
+			logger.Printf("failed to notify systemd of readiness: %v\n", err)
+		}
+	}
+}
 
-func notifyReady(logger *log.Logger) {
-	// tells systemd that we're done setting up
-	err := exec.Command("systemd-notify", "--ready").Run()
-	if err != nil {
-		logger.Printf("failed to notify systemd of readiness: %v\n", err)
+// if a single cycle takes longer than this, an action is assumed to be stuck, and the watchdog is allowed to expire
+const StallLimit = 15 * time.Minute
+
+// supervise reports the loop's status to systemd, and pings the watchdog for as long as the loop isn't stuck.
+func supervise(loop *actloop.ActLoop, env hostenv.Env, logger *log.Logger) {
+	healthy := func() error {
+		if loop.Status().Stalled(StallLimit) {
+			return fmt.Errorf("action loop has been stuck in a single cycle for more than %v", StallLimit)
+		}
+		return nil
 	}
+	sdnotify.Supervise(env.Effects.Notify, loop.Status().Summary, healthy, logger)
 }
 
-func LoadAndLaunchDefault(actions actloop.NewAction, logger *log.Logger) error {
-	ks, err := api.LoadDefaultKeyserver()
+// Load prepares an action loop and the client state it needs, without starting either.
+func Load(env hostenv.Env, actions actloop.NewAction, logger *log.Logger) (*actloop.ActLoop, *state.ClientState, error) {
+	ks, err := api.LoadKeyserver(env, logger)
 	if err != nil {
-		return errors.Wrap(err, "while preparing setup")
+		return nil, nil, errors.Wrap(err, "while preparing setup")
 	}
 
-	clientState, warning := state.NewClientState(ks)
+	clientState, warning := state.NewClientState(ks, env)
 	if warning != nil {
 		logger.Println(warning)
 	}
 
 	loop := actloop.NewActLoop(actions, logger)
-	go loop.Run(clientState, time.Second*2, time.Minute*5, notifyReady)
+	return &loop, clientState, nil
+}
+
+// LoadDefault prepares an action loop for this host, which may be relocated by the environment.
+func LoadDefault(actions actloop.NewAction, logger *log.Logger) (*actloop.ActLoop, *state.ClientState, error) {
+	return Load(hostenv.FromEnvironment(), actions, logger)
+}
+
+func LoadAndLaunchDefault(actions actloop.NewAction, logger *log.Logger) error {
+	loop, clientState, err := LoadDefault(actions, logger)
+	if err != nil {
+		return err
+	}
+	status.Launch(loop.Status(), clientState.Keyserver, logger)
+	// the loop wakes up earlier when an action is due or a managed file changes
+	go loop.Run(clientState, time.Second*2, time.Hour, notifyReady(clientState.Env))
+	go supervise(loop, clientState.Env, logger)
 	return nil
 }
@@ -2,6 +2,7 @@ package state
 
 import (
 	"crypto/tls"
+	"fmt"
 	"github.com/pkg/errors"
 	"io/ioutil"
 	"os"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/api/server"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
 	"github.com/sipb/homeworld/platform/util/fileutil"
 )
@@ -16,15 +18,22 @@ import (
 type ClientState struct {
 	Keyserver *server.Keyserver
 	Keygrant  *tls.Certificate
+	// every path used by the actions is relocated through Env
+	Env hostenv.Env
 
 	// entries are present here if an API was inaccessible because we weren't authorized for that particular API
 	// this lets us avoid constantly trying to request something from an API that isn't intended for us
 	RetryAt map[string]time.Time
+
+	// when the keyserver last accepted a check-in, and what it contained, apart from the time at which it was sent
+	LastCheckin        time.Time
+	LastCheckinContent string
 }
 
-func NewClientState(keyserver *server.Keyserver) (cs *ClientState, warning error) {
+func NewClientState(keyserver *server.Keyserver, env hostenv.Env) (cs *ClientState, warning error) {
 	cs = &ClientState{
 		Keyserver: keyserver,
+		Env:       env,
 		RetryAt:   make(map[string]time.Time),
 	}
 	warning = cs.ReloadKeygrantingCert()
@@ -37,18 +46,57 @@ func NewClientState(keyserver *server.Keyserver) (cs *ClientState, warning error
 // how frequently to recheck whether our access is denied, in case it changes
 const RetryAfter = time.Hour * 12
 
+// how far our clock may be from the keyserver's, if the keyserver doesn't report how far it backdates certificates
+const DefaultMaxClockSkew = 2 * time.Minute
+
+// the clock skew that is always tolerated, because measurements of skew are thrown off by network delays
+const MinMaxClockSkew = 10 * time.Second
+
+// MaxClockSkew computes how far our clock may be from the keyserver's before we stop requesting certificates, when the
+// keyserver backdates certificates by backdate. This is kept below the backdate, so that requests stop before issued
+// certificates would appear to be not yet valid.
+func MaxClockSkew(backdate time.Duration) time.Duration {
+	limit := backdate * 2 / 5
+	if limit < MinMaxClockSkew {
+		return MinMaxClockSkew
+	}
+	return limit
+}
+
+// CheckClock fails if the keyserver's clock was too far from ours when it last responded.
+func (s *ClientState) CheckClock() error {
+	if s.Keyserver == nil {
+		return nil
+	}
+	skew, known := s.Keyserver.ClockSkew()
+	if !known {
+		return nil
+	}
+	limit := DefaultMaxClockSkew
+	if backdate, reported := s.Keyserver.CertBackdate(); reported {
+		limit = MaxClockSkew(backdate)
+	}
+	if skew > limit {
+		return fmt.Errorf("local clock is %v behind the keyserver's clock, which is more than the limit of %v", skew, limit)
+	} else if skew < -limit {
+		return fmt.Errorf("local clock is %v ahead of the keyserver's clock, which is more than the limit of %v", -skew, limit)
+	}
+	return nil
+}
+
 func (s *ClientState) RetryFailed(api string) {
-	s.RetryAt[api] = time.Now().Add(RetryAfter)
+	s.RetryAt[api] = s.Env.Now().Add(RetryAfter)
 }
 
 func (s *ClientState) CanRetry(api string) bool {
 	retryAt, found := s.RetryAt[api]
-	return !found || time.Now().After(retryAt)
+	return !found || s.Env.Now().After(retryAt)
 }
 
 func (s *ClientState) ReloadKeygrantingCert() error {
-	if fileutil.Exists(paths.GrantingKeyPath) && fileutil.Exists(paths.GrantingCertPath) {
-		cert, err := tls.LoadX509KeyPair(paths.GrantingCertPath, paths.GrantingKeyPath)
+	keypath, certpath := s.Env.Path(paths.GrantingKeyPath), s.Env.Path(paths.GrantingCertPath)
+	if fileutil.Exists(keypath) && fileutil.Exists(certpath) {
+		cert, err := tls.LoadX509KeyPair(certpath, keypath)
 		if err != nil {
 			return errors.Wrap(err, "failed to reload keygranting certificate")
 		} else {
@@ -61,11 +109,12 @@ func (s *ClientState) ReloadKeygrantingCert() error {
 }
 
 func (s *ClientState) ReplaceKeygrantingCert(data []byte) error {
-	err := fileutil.EnsureIsFolder(path.Dir(paths.GrantingCertPath)) // TODO: unit test
+	certpath := s.Env.Path(paths.GrantingCertPath)
+	err := fileutil.EnsureIsFolder(path.Dir(certpath)) // TODO: unit test
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(paths.GrantingCertPath, data, os.FileMode(0644))
+	err = ioutil.WriteFile(certpath, data, os.FileMode(0644))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,171 @@
+package status
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+
+	"github.com/sipb/homeworld/platform/keysystem/api/endpoint"
+	"github.com/sipb/homeworld/platform/keysystem/api/server"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+)
+
+// the JSON status is only for local debugging, so it's only exposed on localhost
+const StatusAddress = "127.0.0.1:20558"
+
+// the metrics are scraped by prometheus on the supervisor
+const MetricsAddress = ":9106"
+
+var (
+	certExpiryDesc = prometheus.NewDesc(
+		"keysystem_keyclient_cert_expiry_timestamp_seconds",
+		"Time at which a certificate managed by the keyclient expires",
+		[]string{"path"}, nil,
+	)
+	certRenewDesc = prometheus.NewDesc(
+		"keysystem_keyclient_cert_renew_timestamp_seconds",
+		"Time at which the keyclient plans to renew a certificate",
+		[]string{"path"}, nil,
+	)
+	actionFailuresDesc = prometheus.NewDesc(
+		"keysystem_keyclient_action_failures_total",
+		"Number of times a keyclient action has failed",
+		[]string{"action"}, nil,
+	)
+	actionBlockedDesc = prometheus.NewDesc(
+		"keysystem_keyclient_action_blocked",
+		"Whether a keyclient action was blocked during the last cycle",
+		[]string{"action"}, nil,
+	)
+	pinMismatchDesc = prometheus.NewDesc(
+		"keysystem_keyclient_authority_pin_mismatch",
+		"Whether the keyserver offered an authority that did not match the pinned authority, without a valid rotation record",
+		[]string{"authority"}, nil,
+	)
+	loopStableDesc = prometheus.NewDesc(
+		"keysystem_keyclient_actloop_stable",
+		"Whether the last cycle of the keyclient action loop performed no actions",
+		nil, nil,
+	)
+	loopLastCycleDesc = prometheus.NewDesc(
+		"keysystem_keyclient_actloop_last_cycle_timestamp_seconds",
+		"Time at which the keyclient action loop last completed a cycle",
+		nil, nil,
+	)
+	keyserverRequestsDesc = prometheus.NewDesc(
+		"keysystem_keyclient_keyserver_requests_total",
+		"Number of keyclient requests served by a keyserver endpoint",
+		[]string{"endpoint"}, nil,
+	)
+	keyserverFailuresDesc = prometheus.NewDesc(
+		"keysystem_keyclient_keyserver_failures_total",
+		"Number of times a keyserver endpoint could not be reached",
+		[]string{"endpoint"}, nil,
+	)
+	keyserverClockSkewDesc = prometheus.NewDesc(
+		"keysystem_keyclient_keyserver_clock_skew_seconds",
+		"How far a keyserver endpoint's clock was ahead of the local clock when it last responded",
+		[]string{"endpoint"}, nil,
+	)
+)
+
+// Status is the JSON status document, which includes the keyservers along with the action loop's status.
+type Status struct {
+	actloop.LoopStatus
+	Keyservers   []endpoint.EndpointHealth `json:"keyservers"`
+	LastServedBy string                    `json:"last-served-by,omitempty"`
+}
+
+// collector generates metrics from a snapshot of the action loop's status at scrape time
+type collector struct {
+	status    *actloop.Status
+	keyserver *server.Keyserver
+}
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certExpiryDesc
+	ch <- certRenewDesc
+	ch <- actionFailuresDesc
+	ch <- actionBlockedDesc
+	ch <- pinMismatchDesc
+	ch <- loopStableDesc
+	ch <- loopLastCycleDesc
+	ch <- keyserverRequestsDesc
+	ch <- keyserverFailuresDesc
+	ch <- keyserverClockSkewDesc
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	for _, ep := range c.keyserver.Endpoints() {
+		ch <- prometheus.MustNewConstMetric(keyserverRequestsDesc, prometheus.CounterValue, float64(ep.Served), ep.BaseURL)
+		ch <- prometheus.MustNewConstMetric(keyserverFailuresDesc, prometheus.CounterValue, float64(ep.Failures), ep.BaseURL)
+		if ep.ClockSkew != nil {
+			ch <- prometheus.MustNewConstMetric(keyserverClockSkewDesc, prometheus.GaugeValue, ep.ClockSkew.Seconds(), ep.BaseURL)
+		}
+	}
+	snapshot := c.status.Snapshot()
+	if snapshot.LastCycle == nil {
+		// nothing has happened yet
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(loopStableDesc, prometheus.GaugeValue, boolToFloat(snapshot.Stable))
+	ch <- prometheus.MustNewConstMetric(loopLastCycleDesc, prometheus.GaugeValue, float64(snapshot.LastCycle.Unix()))
+	for _, action := range snapshot.Actions {
+		ch <- prometheus.MustNewConstMetric(actionFailuresDesc, prometheus.CounterValue, float64(action.Failures), action.Info)
+		ch <- prometheus.MustNewConstMetric(actionBlockedDesc, prometheus.GaugeValue, boolToFloat(len(action.BlockedBy) > 0), action.Info)
+		if action.Expires != nil {
+			ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue, float64(action.Expires.Unix()), action.CertPath)
+		}
+		if action.RenewAt != nil {
+			ch <- prometheus.MustNewConstMetric(certRenewDesc, prometheus.GaugeValue, float64(action.RenewAt.Unix()), action.CertPath)
+		}
+		if action.Authority != "" {
+			ch <- prometheus.MustNewConstMetric(pinMismatchDesc, prometheus.GaugeValue, boolToFloat(action.Mismatch != ""), action.Authority)
+		}
+	}
+}
+
+func StatusHandler(status *actloop.Status, keyserver *server.Keyserver) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		data, err := json.MarshalIndent(Status{
+			LoopStatus:   status.Snapshot(),
+			Keyservers:   keyserver.Endpoints(),
+			LastServedBy: keyserver.LastServed(),
+		}, "", "  ")
+		if err != nil {
+			http.Error(writer, "could not encode status", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		_, _ = writer.Write(data)
+	})
+}
+
+func MetricsHandler(status *actloop.Status, keyserver *server.Keyserver) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector{status: status, keyserver: keyserver})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func serve(address string, path string, handler http.Handler, logger *log.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	logger.Printf("serving keyclient %s on %s", path, address)
+	err := http.ListenAndServe(address, mux)
+	logger.Printf("stopped serving keyclient %s: %v", path, err)
+}
+
+// Launch starts serving the JSON status and prometheus metrics in the background.
+func Launch(status *actloop.Status, keyserver *server.Keyserver, logger *log.Logger) {
+	go serve(StatusAddress, "/status", StatusHandler(status, keyserver), logger)
+	go serve(MetricsAddress, "/metrics", MetricsHandler(status, keyserver), logger)
+}
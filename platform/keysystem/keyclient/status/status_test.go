@@ -0,0 +1,135 @@
+package status
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/api/server"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/state"
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/testkeyutil"
+)
+
+var now = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func prepKeyserver(t *testing.T) *server.Keyserver {
+	_, _, cert := testkeyutil.GenerateTLSRootPEMsForTests(t, "keyserver", nil, nil)
+	// nothing listens on this port, so every request fails over without being served
+	ks, err := server.NewKeyserver(cert, "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func runActions(t *testing.T, ks *server.Keyserver, actions actloop.NewAction) (*actloop.ActLoop, func()) {
+	dir, err := ioutil.TempDir("", "status-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := hostenv.Relocated(dir)
+	env.Clock = clock.NewFake(now)
+	cs, _ := state.NewClientState(ks, env) // the only possible warning is about the missing keygranting cert
+	loop := actloop.NewActLoop(actions, log.New(ioutil.Discard, "", 0))
+	if _, err := loop.RunOnce(cs, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	return &loop, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func sampleActions(nac *actloop.NewActionContext) {
+	nac.Checked("renew certificate")
+	nac.ReportCertificate("renew certificate", "/etc/homeworld/keys/kubernetes-worker.pem", now.Add(30*24*time.Hour), now.Add(20*24*time.Hour))
+	nac.Checked("download authority")
+	nac.ReportPin("download authority", "kubernetes", "SHA256:pinned", "SHA256:offered")
+	nac.Checked("failing action")
+	nac.Errored("failing action", errors.New("keyserver unreachable"))
+	nac.Checked("blocked action")
+	nac.Blocked("blocked action", errors.New("file does not yet exist"))
+}
+
+func scrape(t *testing.T, loop *actloop.ActLoop, ks *server.Keyserver) string {
+	recorder := httptest.NewRecorder()
+	MetricsHandler(loop.Status(), ks).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("unexpected status code %d", recorder.Code)
+	}
+	return recorder.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	ks := prepKeyserver(t)
+	if _, err := ks.GetStatic("cluster.conf"); err == nil {
+		t.Fatal("expected keyserver to be unreachable")
+	}
+	loop, cleanup := runActions(t, ks, sampleActions)
+	defer cleanup()
+	metrics := scrape(t, loop, ks)
+	for _, line := range []string{
+		`keysystem_keyclient_actloop_stable 1`,
+		`keysystem_keyclient_actloop_last_cycle_timestamp_seconds 1.546398245e+09`,
+		`keysystem_keyclient_cert_expiry_timestamp_seconds{path="/etc/homeworld/keys/kubernetes-worker.pem"} 1.548990245e+09`,
+		`keysystem_keyclient_cert_renew_timestamp_seconds{path="/etc/homeworld/keys/kubernetes-worker.pem"} 1.548126245e+09`,
+		`keysystem_keyclient_action_failures_total{action="failing action"} 1`,
+		`keysystem_keyclient_action_failures_total{action="renew certificate"} 0`,
+		`keysystem_keyclient_action_blocked{action="blocked action"} 1`,
+		`keysystem_keyclient_action_blocked{action="failing action"} 0`,
+		`keysystem_keyclient_authority_pin_mismatch{authority="kubernetes"} 1`,
+		`keysystem_keyclient_keyserver_requests_total{endpoint="https://127.0.0.1:1/"} 0`,
+		`keysystem_keyclient_keyserver_failures_total{endpoint="https://127.0.0.1:1/"} 1`,
+	} {
+		if !strings.Contains(metrics, "\n"+line+"\n") {
+			t.Errorf("missing metric: %s", line)
+		}
+	}
+	if strings.Contains(metrics, "keysystem_keyclient_keyserver_clock_skew_seconds") {
+		t.Error("clock skew reported without being measured")
+	}
+}
+
+func TestMetrics_BeforeFirstCycle(t *testing.T) {
+	ks := prepKeyserver(t)
+	loop := actloop.NewActLoop(sampleActions, log.New(ioutil.Discard, "", 0))
+	metrics := scrape(t, &loop, ks)
+	if strings.Contains(metrics, "keysystem_keyclient_actloop_") || strings.Contains(metrics, "keysystem_keyclient_action_") {
+		t.Errorf("loop metrics reported before any cycle:\n%s", metrics)
+	}
+	if !strings.Contains(metrics, `keysystem_keyclient_keyserver_failures_total{endpoint="https://127.0.0.1:1/"} 0`) {
+		t.Errorf("keyserver metrics missing before first cycle:\n%s", metrics)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	ks := prepKeyserver(t)
+	loop, cleanup := runActions(t, ks, sampleActions)
+	defer cleanup()
+	recorder := httptest.NewRecorder()
+	StatusHandler(loop.Status(), ks).ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	if recorder.Code != 200 || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response: %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	var status Status
+	if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.LastCycle == nil || !status.LastCycle.Equal(now) || !status.Stable || !status.Blocked {
+		t.Errorf("wrong loop status: %+v", status.LoopStatus)
+	}
+	if len(status.Actions) != 4 || status.Actions[0].Info != "blocked action" || status.Actions[2].LastError != "keyserver unreachable" {
+		t.Errorf("wrong actions: %+v", status.Actions)
+	}
+	if len(status.Keyservers) != 1 || status.Keyservers[0].BaseURL != "https://127.0.0.1:1/" || status.LastServedBy != "" {
+		t.Errorf("wrong keyservers: %+v (last served by %q)", status.Keyservers, status.LastServedBy)
+	}
+}
@@ -12,14 +12,14 @@ import (
 	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
 )
 
-func HandleRequest(principal string, request_data []byte) ([]byte, error) {
+func HandleRequest(principal string, request_data []byte, logger *log.Logger) ([]byte, error) {
 	requests := []reqtarget.Request{}
 	err := json.Unmarshal(request_data, &requests)
 	if err != nil {
 		return nil, err
 	}
 
-	_, rt, err := api.LoadDefaultKeyserverWithCert()
+	_, rt, err := api.LoadDefaultKeyserverWithCert(logger)
 	if err != nil {
 		return nil, err
 	}
@@ -41,7 +41,7 @@ func HandleRequest(principal string, request_data []byte) ([]byte, error) {
 	return json.Marshal(result)
 }
 
-func Process() error {
+func Process(logger *log.Logger) error {
 	kncCreds := os.Getenv("KNC_CREDS")
 
 	if kncCreds == "" {
@@ -56,7 +56,7 @@ func Process() error {
 		return errors.New("empty request")
 	}
 
-	result, err := HandleRequest(kncCreds, request_data)
+	result, err := HandleRequest(kncCreds, request_data, logger)
 	if err != nil {
 		return err
 	}
@@ -67,7 +67,7 @@ func Process() error {
 
 func main() {
 	logger := log.New(os.Stderr, "[keygateway] ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	err := Process()
+	err := Process(logger)
 	// TODO: verify that stderr does *not* get sent across knc
 	if err != nil {
 		logger.Fatal(err)
@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"os"
@@ -14,12 +15,23 @@ import (
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
 	"github.com/sipb/homeworld/platform/util/certutil"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/sealutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
 )
 
 const AuthorityBits = 4096
 
 func GenerateTLSSelfSignedCert(key *rsa.PrivateKey, name string) ([]byte, error) {
+	return generateTLSCert(key, name, AuthorityOptions{})
+}
+
+func generateTLSCert(key *rsa.PrivateKey, name string, options AuthorityOptions) ([]byte, error) {
 	issueat := time.Now()
+	notAfter := time.Unix(issueat.Unix()+86400*1000000, 0) // one million days in the future
+	if options.Validity != nil {
+		notAfter = issueat.Add(*options.Validity)
+	}
 
 	certTemplate := &x509.Certificate{
 		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
@@ -29,8 +41,12 @@ func GenerateTLSSelfSignedCert(key *rsa.PrivateKey, name string) ([]byte, error)
 		IsCA:                  true,
 		MaxPathLen:            1,
 
+		// RFC 5280 requires name constraints to be marked critical
+		PermittedDNSDomainsCritical: len(options.PermittedDomains) > 0,
+		PermittedDNSDomains:         options.PermittedDomains,
+
 		NotBefore: issueat,
-		NotAfter:  time.Unix(issueat.Unix()+86400*1000000, 0), // one million days in the future
+		NotAfter:  notAfter,
 
 		Subject: pkix.Name{CommonName: "homeworld-authority-" + name},
 	}
@@ -38,48 +54,293 @@ func GenerateTLSSelfSignedCert(key *rsa.PrivateKey, name string) ([]byte, error)
 	return certutil.FinishCertificate(certTemplate, certTemplate, key.Public(), key)
 }
 
-func GenerateKeys(dir string) error {
+// generateAuthority generates the private key and the certificate (or public key) of an authority, and seals the
+// private key with passphrase, unless it is nil.
+func generateAuthority(authority config.ConfigAuthority, options AuthorityOptions, passphrase []byte) (key []byte, cert []byte, err error) {
+	privkey, key, err := certutil.GenerateRSA(algorithmBits[options.Algorithm])
+	if err != nil {
+		return nil, nil, err
+	}
+	if passphrase != nil {
+		key, err = sealutil.Seal(key, passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	switch authority.Type {
+	case config.TLSAuthorityType:
+		// self-signed cert
+		cert, err = generateTLSCert(privkey, authority.Name, options)
+		if err != nil {
+			return nil, nil, err
+		}
+	case config.SSHAuthorityType:
+		// SSH authorities are just pubkeys
+		pkey, err := ssh.NewPublicKey(privkey.Public())
+		if err != nil {
+			return nil, nil, err
+		}
+		cert = ssh.MarshalAuthorizedKey(pkey)
+	default:
+		panic("invalid authority type in generateAuthority")
+	}
+	return key, cert, nil
+}
+
+func checkDirectory(dir string) error {
 	if info, err := os.Stat(dir); err != nil {
 		return err
 	} else if !info.IsDir() {
 		return errors.New("expected authority directory, not authority file")
 	}
+	return nil
+}
 
+// checkSealing makes sure that new keys in dir will be sealed in the same way as the keys already there: with
+// passphrase if they are sealed, and not at all if they are not. The passphrase must unseal every sealed key.
+func checkSealing(dir string, passphrase []byte) error {
+	if passphrase != nil && len(passphrase) == 0 {
+		return errors.New("empty passphrase")
+	}
 	for _, authority := range worldconfig.ListAuthorities() {
-		privkey, privkeybytes, err := certutil.GenerateRSA(AuthorityBits)
+		keyfile, _ := authority.Filenames()
+		key, err := ioutil.ReadFile(path.Join(dir, keyfile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !sealutil.IsSealed(key) {
+			if passphrase != nil {
+				return fmt.Errorf("key for authority %s is not sealed, so new keys cannot be sealed either", authority.Name)
+			}
+		} else if passphrase == nil {
+			return fmt.Errorf("key for authority %s is sealed, so new keys must be sealed with the same passphrase", authority.Name)
+		} else if _, err := sealutil.Unseal(key, passphrase); err != nil {
+			return fmt.Errorf("while unsealing key for authority %s: %v", authority.Name, err)
+		}
+	}
+	return nil
+}
+
+// GenerateKeys generates each authority in dir.
+func GenerateKeys(dir string) error {
+	return generateKeys(dir, nil)
+}
+
+// GenerateSealedKeys generates each authority in dir, like GenerateKeys, but seals each private key with passphrase.
+func GenerateSealedKeys(dir string, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errors.New("empty passphrase")
+	}
+	return generateKeys(dir, passphrase)
+}
+
+func generateKeys(dir string, passphrase []byte) error {
+	err := checkDirectory(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, authority := range worldconfig.ListAuthorities() {
+		key, cert, err := generateAuthority(authority, Options(nil).For(authority.Name), passphrase)
 		if err != nil {
 			return err
 		}
 		keyfile, certfile := authority.Filenames()
-		err = ioutil.WriteFile(path.Join(dir, keyfile), privkeybytes, os.FileMode(0600))
+		err = ioutil.WriteFile(path.Join(dir, keyfile), key, os.FileMode(0600))
 		if err != nil {
 			return err
 		}
-		switch authority.Type {
-		case config.TLSAuthorityType:
-			// self-signed cert
-			cert, err := GenerateTLSSelfSignedCert(privkey, authority.Name)
-			if err != nil {
-				return err
-			}
-			err = ioutil.WriteFile(path.Join(dir, certfile), cert, os.FileMode(0644))
-			if err != nil {
-				return err
-			}
-		case config.SSHAuthorityType:
-			// SSH authorities are just pubkeys
-			pkey, err := ssh.NewPublicKey(privkey.Public())
-			if err != nil {
-				return err
-			}
-			pubkey := ssh.MarshalAuthorizedKey(pkey)
-			err = ioutil.WriteFile(path.Join(dir, certfile), pubkey, os.FileMode(0644))
+		err = ioutil.WriteFile(path.Join(dir, certfile), cert, os.FileMode(0644))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GenerateMissingKeys generates each authority that is not yet in dir, and leaves the others alone. New private keys
+// are sealed with passphrase, which must be provided if and only if the existing keys are sealed. It returns the names
+// of the authorities that it generated.
+func GenerateMissingKeys(dir string, options Options, passphrase []byte) ([]string, error) {
+	err := checkDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSealing(dir, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []config.ConfigAuthority
+	for _, authority := range worldconfig.ListAuthorities() {
+		keyfile, certfile := authority.Filenames()
+		// an authority without a private key may be held by an external signer, so only its certificate counts
+		if fileutil.Exists(path.Join(dir, certfile)) {
+			continue
+		}
+		if fileutil.Exists(path.Join(dir, keyfile)) {
+			return nil, fmt.Errorf("found private key for authority %s, but not %s", authority.Name, certfile)
+		}
+		if fileutil.Exists(path.Join(dir, authority.RotationFilename())) {
+			return nil, fmt.Errorf("found rotation records for missing authority %s", authority.Name)
+		}
+		missing = append(missing, authority)
+	}
+
+	var generated []string
+	for _, authority := range missing {
+		key, cert, err := generateAuthority(authority, options.For(authority.Name), passphrase)
+		if err != nil {
+			return generated, err
+		}
+		keyfile, certfile := authority.Filenames()
+		// nothing is overwritten, even if another authority appeared in the meantime
+		err = fileutil.CreateFile(path.Join(dir, keyfile), key, os.FileMode(0600))
+		if err != nil {
+			return generated, err
+		}
+		err = fileutil.CreateFile(path.Join(dir, certfile), cert, os.FileMode(0644))
+		if err != nil {
+			return generated, err
+		}
+		generated = append(generated, authority.Name)
+	}
+	return generated, nil
+}
+
+// RegenerateKey replaces a single authority in dir with a newly generated version, and appends a record of the
+// rotation, signed by the previous version, so that nodes will accept the replacement. The previous private key is
+// discarded. The new private key is sealed with passphrase, as in GenerateMissingKeys. If the authority is not yet in
+// dir, it is generated without a rotation record. If an earlier regeneration of the authority was interrupted while its
+// replacement was being installed, that replacement is installed instead of generating another one.
+func RegenerateKey(dir string, name string, options Options, passphrase []byte) error {
+	authority, err := findAuthority(name)
+	if err != nil {
+		return err
+	}
+	err = checkDirectory(dir)
+	if err != nil {
+		return err
+	}
+	err = checkSealing(dir, passphrase)
+	if err != nil {
+		return err
+	}
+	finished, err := finishRegeneration(dir, authority)
+	if err != nil || finished {
+		return err
+	}
+	keyfile, certfile := authority.Filenames()
+	previous, err := ioutil.ReadFile(path.Join(dir, certfile))
+	rotate := !os.IsNotExist(err)
+	if rotate && err != nil {
+		return err
+	}
+	if !rotate && fileutil.Exists(path.Join(dir, keyfile)) {
+		return fmt.Errorf("found private key for authority %s, but not %s", name, certfile)
+	}
+	var previousKey *rsa.PrivateKey
+	if rotate {
+		previousKey, err = loadKey(dir, authority, passphrase)
+		if err != nil {
+			return fmt.Errorf("private key of authority %s is needed to sign the rotation record: %v", name, err)
+		}
+	}
+	key, cert, err := generateAuthority(authority, options.For(name), passphrase)
+	if err != nil {
+		return err
+	}
+	var rotations []byte
+	if rotate {
+		rotations, err = appendRotation(dir, authority, previous, previousKey, cert)
+		if err != nil {
+			return err
+		}
+	}
+	return writeAuthority(dir, authority, key, cert, rotations)
+}
+
+// loadKey loads the private key of an authority in dir, and unseals it with passphrase if it is sealed.
+func loadKey(dir string, authority config.ConfigAuthority, passphrase []byte) (*rsa.PrivateKey, error) {
+	keyfile, _ := authority.Filenames()
+	key, err := ioutil.ReadFile(path.Join(dir, keyfile))
+	if err != nil {
+		return nil, err
+	}
+	if sealutil.IsSealed(key) {
+		if passphrase == nil {
+			return nil, fmt.Errorf("key for authority %s is sealed, but no passphrase is available", authority.Name)
+		}
+		key, err = sealutil.Unseal(key, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return wraputil.LoadRSAKeyFromPEM(key)
+}
+
+// the replacement key, certificate, and rotation records of an authority are staged next to the current versions with
+// this suffix
+const stagingSuffix = ".next"
+
+// writeAuthority replaces the key and certificate of an authority in dir, along with its rotation records, unless
+// rotations is nil. All of them are staged before any is installed, so that if the replacement is interrupted,
+// finishRegeneration can complete it, instead of leaving a key that doesn't match its certificate, or a rotation record
+// that leads to a replacement that was never installed.
+func writeAuthority(dir string, authority config.ConfigAuthority, key []byte, cert []byte, rotations []byte) error {
+	keypath, certpath, rotationpath := stagingPaths(dir, authority)
+	err := fileutil.WriteAtomic(keypath+stagingSuffix, key, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	if rotations != nil {
+		err = fileutil.WriteAtomic(rotationpath+stagingSuffix, rotations, os.FileMode(0644))
+		if err != nil {
+			return err
+		}
+	}
+	// the staged certificate is written last, so that it is only present once the whole replacement is staged
+	err = fileutil.WriteAtomic(certpath+stagingSuffix, cert, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	return installStaged(keypath, certpath, rotationpath)
+}
+
+func stagingPaths(dir string, authority config.ConfigAuthority) (keypath string, certpath string, rotationpath string) {
+	keyfile, certfile := authority.Filenames()
+	return path.Join(dir, keyfile), path.Join(dir, certfile), path.Join(dir, authority.RotationFilename())
+}
+
+// installStaged moves the staged key, rotation records, and then certificate into place. If interrupted, the staged
+// certificate remains, and so installStaged can be run again.
+func installStaged(keypath string, certpath string, rotationpath string) error {
+	for _, staged := range []string{keypath, rotationpath} {
+		if fileutil.Exists(staged + stagingSuffix) {
+			err := fileutil.RenameAtomic(staged+stagingSuffix, staged)
 			if err != nil {
 				return err
 			}
-		default:
-			panic("invalid authority type in GenerateKeys")
 		}
 	}
-	return nil
+	return fileutil.RenameAtomic(certpath+stagingSuffix, certpath)
+}
+
+// finishRegeneration installs the replacement of an authority in dir, if an earlier regeneration was interrupted after
+// staging it, and reports whether it did. A replacement that was only partially staged is discarded, including its
+// rotation record, so that the retry does not leave a record that leads to a replacement that was never installed.
+func finishRegeneration(dir string, authority config.ConfigAuthority) (bool, error) {
+	keypath, certpath, rotationpath := stagingPaths(dir, authority)
+	if fileutil.Exists(certpath + stagingSuffix) {
+		return true, installStaged(keypath, certpath, rotationpath)
+	}
+	for _, staged := range []string{keypath, rotationpath} {
+		err := os.Remove(staged + stagingSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
 }
@@ -0,0 +1,160 @@
+package keygen
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/util/sealutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+// KeyState describes how the private key of an authority is stored.
+type KeyState string
+
+const (
+	KeyUnsealed KeyState = "unsealed"
+	KeySealed   KeyState = "sealed"
+	// the authority might be held by an external signer
+	KeyMissing KeyState = "missing"
+)
+
+// AuthorityInfo describes an authority found in an authority directory.
+type AuthorityInfo struct {
+	Name string
+	Type config.AuthorityType
+	// false if neither the certificate (or public key) nor the private key of the authority was found
+	Present bool
+	Key     KeyState
+	// empty if the public key is not an RSA key
+	Algorithm Algorithm
+	// the fingerprint that nodes pin, as computed by rotation.Fingerprint
+	Fingerprint string
+	// zero for SSH authorities, which do not expire
+	Expires          time.Time
+	PermittedDomains []string
+	Rotations        int
+}
+
+// Inventory describes each authority in dir, without needing to unseal any private keys.
+func Inventory(dir string) ([]AuthorityInfo, error) {
+	err := checkDirectory(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []AuthorityInfo
+	for _, authority := range worldconfig.ListAuthorities() {
+		info, err := inspectAuthority(dir, authority)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while inspecting authority %s", authority.Name)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func inspectAuthority(dir string, authority config.ConfigAuthority) (AuthorityInfo, error) {
+	info := AuthorityInfo{Name: authority.Name, Type: authority.Type, Key: KeyMissing}
+	keyfile, certfile := authority.Filenames()
+	key, err := ioutil.ReadFile(path.Join(dir, keyfile))
+	if err == nil {
+		info.Present = true
+		if sealutil.IsSealed(key) {
+			info.Key = KeySealed
+		} else {
+			info.Key = KeyUnsealed
+		}
+	} else if !os.IsNotExist(err) {
+		return AuthorityInfo{}, err
+	}
+	cert, err := ioutil.ReadFile(path.Join(dir, certfile))
+	if os.IsNotExist(err) {
+		if info.Present {
+			return AuthorityInfo{}, fmt.Errorf("found private key, but not %s", certfile)
+		}
+		return info, nil
+	} else if err != nil {
+		return AuthorityInfo{}, err
+	}
+	info.Present = true
+	info.Fingerprint, err = rotation.Fingerprint(cert)
+	if err != nil {
+		return AuthorityInfo{}, err
+	}
+	records, err := authority.LoadRotations(dir)
+	if err != nil {
+		return AuthorityInfo{}, err
+	}
+	info.Rotations = len(records)
+	switch authority.Type {
+	case config.TLSAuthorityType:
+		parsed, err := wraputil.LoadX509CertFromPEM(cert)
+		if err != nil {
+			return AuthorityInfo{}, err
+		}
+		info.Expires = parsed.NotAfter
+		info.PermittedDomains = parsed.PermittedDNSDomains
+		if public, ok := parsed.PublicKey.(*rsa.PublicKey); ok {
+			info.Algorithm = rsaAlgorithm(public)
+		}
+	case config.SSHAuthorityType:
+		pubkey, err := wraputil.ParseSSHTextPubkey(cert)
+		if err != nil {
+			return AuthorityInfo{}, err
+		}
+		if cryptoKey, ok := pubkey.(ssh.CryptoPublicKey); ok {
+			if public, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok {
+				info.Algorithm = rsaAlgorithm(public)
+			}
+		}
+	default:
+		panic("invalid authority type in inspectAuthority")
+	}
+	return info, nil
+}
+
+func rsaAlgorithm(public *rsa.PublicKey) Algorithm {
+	return Algorithm(fmt.Sprintf("rsa-%d", public.N.BitLen()))
+}
+
+// WriteInventory formats the result of Inventory as a table.
+func WriteInventory(out io.Writer, infos []AuthorityInfo) error {
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "AUTHORITY\tTYPE\tALGORITHM\tKEY\tEXPIRES\tFINGERPRINT\tROTATIONS\tPERMITTED DOMAINS")
+	for _, info := range infos {
+		kind := "tls"
+		if info.Type == config.SSHAuthorityType {
+			kind = "ssh"
+		}
+		if !info.Present {
+			fmt.Fprintf(tw, "%s\t%s\t-\tmissing\t-\t-\t-\t-\n", info.Name, kind)
+			continue
+		}
+		algorithm, expires, domains := string(info.Algorithm), "never", "any"
+		if algorithm == "" {
+			algorithm = "unknown"
+		}
+		if !info.Expires.IsZero() {
+			expires = info.Expires.UTC().Format("2006-01-02")
+		}
+		if info.Type == config.SSHAuthorityType {
+			domains = "-"
+		} else if len(info.PermittedDomains) > 0 {
+			domains = strings.Join(info.PermittedDomains, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			info.Name, kind, algorithm, info.Key, expires, info.Fingerprint, info.Rotations, domains)
+	}
+	return tw.Flush()
+}
@@ -1,16 +1,171 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 
 	"github.com/sipb/homeworld/platform/keysystem/keygen"
+	"github.com/sipb/homeworld/platform/util/fileutil"
 )
 
+const usage = `usage: keygen <authority-dir>
+  generates the authorities for a keyserver
+usage: keygen missing <authority-dir> <options-file> [<passphrase-file>]
+  generates only the authorities that are not yet in <authority-dir>, with the options for each authority
+usage: keygen regenerate <authority-dir> <authority-name> <options-file> [<passphrase-file>]
+  replaces a single authority in <authority-dir>, and records the rotation so that nodes will accept it
+usage: keygen inventory <authority-dir>
+  lists the type, algorithm, expiration, and fingerprint of each authority in <authority-dir>
+usage: keygen sealed <authority-dir> <passphrase-file>
+  generates the authorities for a keyserver, with their private keys sealed by the passphrase
+usage: keygen seal <authority-dir> <passphrase-file>
+  seals the private keys of the authorities in <authority-dir> with the passphrase
+usage: keygen reseal <authority-dir> <previous-passphrase-file> <passphrase-file>
+  changes the passphrase that the private keys of the authorities in <authority-dir> are sealed with
+usage: keygen export <authority-dir> <bundle-file> <shares> <threshold> [<passphrase-file>]
+  writes a recovery bundle for the authorities in <authority-dir>, and prints the shares needed to restore it
+usage: keygen import <bundle-file> <share-file> <authority-dir> [<passphrase-file>]
+  restores the authorities in a recovery bundle into <authority-dir>, given enough of its shares, one per line
+usage: keygen rotate <authority-dir> <authority-name> <previous-key> <previous-authority>
+  records that an authority in <authority-dir> replaces its previous version, so that nodes will accept it`
+
+func readPassphrase(logger *log.Logger, filename string) []byte {
+	passphrase, err := keygen.ReadPassphrase(filename)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return passphrase
+}
+
+func loadOptions(logger *log.Logger, filename string) keygen.Options {
+	options, err := keygen.LoadOptions(filename)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return options
+}
+
 func main() {
 	logger := log.New(os.Stderr, "[keygen] ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
+	if len(os.Args) == 6 && os.Args[1] == "rotate" {
+		err := keygen.SignRotation(os.Args[2], os.Args[3], os.Args[4], os.Args[5])
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Print("done signing rotation record.")
+		return
+	}
+	if (len(os.Args) == 4 || len(os.Args) == 5) && os.Args[1] == "missing" {
+		var passphrase []byte
+		if len(os.Args) == 5 {
+			passphrase = readPassphrase(logger, os.Args[4])
+		}
+		generated, err := keygen.GenerateMissingKeys(os.Args[2], loadOptions(logger, os.Args[3]), passphrase)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("done generating %d missing authorities: %v", len(generated), generated)
+		return
+	}
+	if (len(os.Args) == 5 || len(os.Args) == 6) && os.Args[1] == "regenerate" {
+		var passphrase []byte
+		if len(os.Args) == 6 {
+			passphrase = readPassphrase(logger, os.Args[5])
+		}
+		err := keygen.RegenerateKey(os.Args[2], os.Args[3], loadOptions(logger, os.Args[4]), passphrase)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("done regenerating authority %s.", os.Args[3])
+		return
+	}
+	if len(os.Args) == 3 && os.Args[1] == "inventory" {
+		infos, err := keygen.Inventory(os.Args[2])
+		if err != nil {
+			logger.Fatal(err)
+		}
+		err = keygen.WriteInventory(os.Stdout, infos)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) == 4 && os.Args[1] == "sealed" {
+		err := keygen.GenerateSealedKeys(os.Args[2], readPassphrase(logger, os.Args[3]))
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Print("done generating sealed keys.")
+		return
+	}
+	if len(os.Args) == 4 && os.Args[1] == "seal" {
+		err := keygen.SealKeys(os.Args[2], readPassphrase(logger, os.Args[3]))
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Print("done sealing keys.")
+		return
+	}
+	if len(os.Args) == 5 && os.Args[1] == "reseal" {
+		err := keygen.ResealKeys(os.Args[2], readPassphrase(logger, os.Args[3]), readPassphrase(logger, os.Args[4]))
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Print("done resealing keys.")
+		return
+	}
+	if (len(os.Args) == 6 || len(os.Args) == 7) && os.Args[1] == "export" {
+		shares, err := strconv.Atoi(os.Args[4])
+		if err != nil {
+			logger.Fatal(usage)
+		}
+		threshold, err := strconv.Atoi(os.Args[5])
+		if err != nil {
+			logger.Fatal(usage)
+		}
+		var passphrase []byte
+		if len(os.Args) == 7 {
+			passphrase = readPassphrase(logger, os.Args[6])
+		}
+		bundle, shareTexts, err := keygen.ExportRecovery(os.Args[2], passphrase, shares, threshold)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		err = fileutil.CreateFile(os.Args[3], bundle, os.FileMode(0600))
+		if err != nil {
+			logger.Fatal(err)
+		}
+		for _, share := range shareTexts {
+			fmt.Println(share)
+		}
+		logger.Printf("done exporting recovery bundle; any %d of these %d shares can restore it.", threshold, shares)
+		return
+	}
+	if (len(os.Args) == 5 || len(os.Args) == 6) && os.Args[1] == "import" {
+		bundle, err := ioutil.ReadFile(os.Args[2])
+		if err != nil {
+			logger.Fatal(err)
+		}
+		shareTexts, err := keygen.ReadShares(os.Args[3])
+		if err != nil {
+			logger.Fatal(err)
+		}
+		var passphrase []byte
+		if len(os.Args) == 6 {
+			passphrase = readPassphrase(logger, os.Args[5])
+		}
+		err = keygen.ImportRecovery(bundle, shareTexts, os.Args[4], passphrase)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Print("done restoring authorities.")
+		return
+	}
 	if len(os.Args) != 2 {
-		logger.Fatal("usage: keygen <authority-dir>\n  generates the authorities for a keyserver")
+		logger.Fatal(usage)
 	}
 	authorityDir := os.Args[1]
 	err := keygen.GenerateKeys(authorityDir)
@@ -0,0 +1,98 @@
+package keygen
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
+)
+
+// Algorithm names the kind of key that an authority is generated with.
+type Algorithm string
+
+// only RSA keys are supported, because the keyserver, its external signers, and rotation records all expect them
+const (
+	RSA2048 Algorithm = "rsa-2048"
+	RSA3072 Algorithm = "rsa-3072"
+	RSA4096 Algorithm = "rsa-4096"
+)
+
+const DefaultAlgorithm = RSA4096
+
+var algorithmBits = map[Algorithm]int{
+	RSA2048: 2048,
+	RSA3072: 3072,
+	RSA4096: 4096,
+}
+
+// AuthorityOptions controls how a single authority is generated.
+type AuthorityOptions struct {
+	// DefaultAlgorithm if not specified
+	Algorithm Algorithm `yaml:"algorithm"`
+	// how long the certificate of a TLS authority is valid; one million days if not specified. SSH authorities are
+	// only public keys, and so never expire.
+	Validity *time.Duration `yaml:"validity"`
+	// if specified, a TLS authority can only issue certificates for these DNS domains and their subdomains, which is
+	// enforced by a Name Constraints extension in its certificate. IP addresses are not constrained.
+	PermittedDomains []string `yaml:"permitted-domains"`
+}
+
+// Options controls how each authority is generated, by the name of the authority. Authorities that are not listed are
+// generated with the default options.
+type Options map[string]AuthorityOptions
+
+// LoadOptions loads options from a YAML file, which maps the name of each authority to its options under the
+// "authorities" key. An empty file, such as /dev/null, specifies the default options for every authority.
+func LoadOptions(filename string) (Options, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Authorities Options `yaml:"authorities"`
+	}
+	err = yaml.UnmarshalStrict(content, &file)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Authorities.validate()
+	if err != nil {
+		return nil, err
+	}
+	return file.Authorities, nil
+}
+
+func (o Options) validate() error {
+	for name, options := range o {
+		authority, err := findAuthority(name)
+		if err != nil {
+			return err
+		}
+		if options.Algorithm != "" && algorithmBits[options.Algorithm] == 0 {
+			return fmt.Errorf("unsupported algorithm %q for authority %s", options.Algorithm, name)
+		}
+		if authority.Type == config.SSHAuthorityType && (options.Validity != nil || options.PermittedDomains != nil) {
+			return fmt.Errorf("SSH authority %s cannot have a validity or permitted domains", name)
+		}
+		if options.Validity != nil && *options.Validity <= 0 {
+			return fmt.Errorf("validity of authority %s must be positive", name)
+		}
+		for _, domain := range options.PermittedDomains {
+			if domain == "" {
+				return fmt.Errorf("empty permitted domain for authority %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// For finds the options for an authority, with defaults filled in.
+func (o Options) For(name string) AuthorityOptions {
+	options := o[name]
+	if options.Algorithm == "" {
+		options.Algorithm = DefaultAlgorithm
+	}
+	return options
+}
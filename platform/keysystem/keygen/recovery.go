@@ -0,0 +1,284 @@
+package keygen
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/sealutil"
+	"github.com/sipb/homeworld/platform/util/shamirutil"
+)
+
+/*
+ * A recovery bundle holds a copy of every authority, so that the authorities can be restored if the supervisor's disk
+ * is lost. The bundle is sealed with a random key, which is split into shares, any threshold number of which can
+ * recover the key. The bundle can be stored anywhere convenient, while the shares are printed and handed to different
+ * administrators, so that no single administrator can recover the authorities alone.
+ *
+ * Each share is a single line of text, which only uses characters that can be encoded by QR codes in alphanumeric mode:
+ *   HWSHARE1-<bundle>-<threshold>-<share>-<checksum>
+ * where the bundle is a prefix of the SHA-256 hash of the bundle that the share unseals, the share is base32-encoded,
+ * and the checksum is a prefix of the SHA-256 hash of everything before it, so that transcription errors are noticed.
+ */
+
+const shareFormat = "HWSHARE1"
+
+const recoveryKeyBytes = 32
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type recoveryContents struct {
+	Files map[string][]byte `json:"files"`
+}
+
+func bundleID(bundle []byte) string {
+	hash := sha256.Sum256(bundle)
+	return fmt.Sprintf("%X", hash[:8])
+}
+
+func shareChecksum(text string) string {
+	hash := sha256.Sum256([]byte(text))
+	return fmt.Sprintf("%X", hash[:4])
+}
+
+func encodeShare(id string, threshold int, share []byte) string {
+	text := fmt.Sprintf("%s-%s-%d-%s", shareFormat, id, threshold, shareEncoding.EncodeToString(share))
+	return text + "-" + shareChecksum(text)
+}
+
+func decodeShare(text string) (id string, threshold int, share []byte, err error) {
+	parts := strings.Split(text, "-")
+	if len(parts) != 5 || parts[0] != shareFormat {
+		return "", 0, nil, errors.New("not a recovery share")
+	}
+	if shareChecksum(strings.Join(parts[:4], "-")) != parts[4] {
+		return "", 0, nil, errors.New("recovery share does not match its checksum; was it copied correctly?")
+	}
+	threshold, err = strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, nil, errors.New("invalid threshold in recovery share")
+	}
+	share, err = shareEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", 0, nil, errors.Wrap(err, "invalid recovery share")
+	}
+	return parts[1], threshold, share, nil
+}
+
+// ReadShares reads recovery shares from a file, such as /dev/stdin, one per line.
+func ReadShares(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var shares []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			shares = append(shares, line)
+		}
+	}
+	return shares, nil
+}
+
+// ExportRecovery creates a recovery bundle for the authorities in dir, and splits its key into the specified number of
+// shares, any threshold of which can unseal the bundle. If the authority keys are sealed, passphrase unseals them, so
+// that the bundle can be used without it.
+func ExportRecovery(dir string, passphrase []byte, shares int, threshold int) (bundle []byte, shareTexts []string, err error) {
+	contents := recoveryContents{Files: map[string][]byte{}}
+	for _, authority := range worldconfig.ListAuthorities() {
+		keyfile, certfile := authority.Filenames()
+		key, err := ioutil.ReadFile(path.Join(dir, keyfile))
+		if err != nil {
+			return nil, nil, err
+		}
+		if sealutil.IsSealed(key) {
+			if passphrase == nil {
+				return nil, nil, fmt.Errorf("key for authority %s is sealed, but no passphrase was provided", authority.Name)
+			}
+			key, err = sealutil.Unseal(key, passphrase)
+			if err != nil {
+				return nil, nil, fmt.Errorf("while unsealing key for authority %s: %v", authority.Name, err)
+			}
+		}
+		cert, err := ioutil.ReadFile(path.Join(dir, certfile))
+		if err != nil {
+			return nil, nil, err
+		}
+		// make sure that the bundle will be usable before anyone relies on it
+		_, err = authority.Parse(key, cert)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "while checking authority %s", authority.Name)
+		}
+		contents.Files[keyfile] = key
+		contents.Files[certfile] = cert
+		rotations, err := ioutil.ReadFile(path.Join(dir, authority.RotationFilename()))
+		if err == nil {
+			contents.Files[authority.RotationFilename()] = rotations
+		} else if !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+	}
+	data, err := json.Marshal(contents)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := make([]byte, recoveryKeyBytes)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	bundle, err = sealutil.Seal(data, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	split, err := shamirutil.Split(key, shares, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := bundleID(bundle)
+	for _, share := range split {
+		shareTexts = append(shareTexts, encodeShare(id, threshold, share))
+	}
+	return bundle, shareTexts, nil
+}
+
+func recoverKey(bundle []byte, shareTexts []string) ([]byte, error) {
+	id := bundleID(bundle)
+	threshold := 0
+	var shares [][]byte
+	for i, text := range shareTexts {
+		shareID, shareThreshold, share, err := decodeShare(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading share %d", i+1)
+		}
+		if shareID != id {
+			return nil, fmt.Errorf("share %d belongs to a different recovery bundle", i+1)
+		}
+		if threshold != 0 && shareThreshold != threshold {
+			return nil, fmt.Errorf("share %d has a different threshold from the other shares", i+1)
+		}
+		threshold = shareThreshold
+		shares = append(shares, share)
+	}
+	if len(shares) < threshold || len(shares) == 0 {
+		return nil, fmt.Errorf("%d shares are needed to recover the authorities, but only %d were provided", threshold, len(shares))
+	}
+	return shamirutil.Combine(shares)
+}
+
+// ImportRecovery restores the authorities in a recovery bundle into dir, using at least the threshold number of its
+// shares. Each authority is checked before any are restored, and no existing files are overwritten. Either every file is
+// restored, or none are. If passphrase is not nil, the restored authority keys are sealed with it.
+func ImportRecovery(bundle []byte, shareTexts []string, dir string, passphrase []byte) error {
+	recoveryKey, err := recoverKey(bundle, shareTexts)
+	if err != nil {
+		return err
+	}
+	data, err := sealutil.Unseal(bundle, recoveryKey)
+	if err != nil {
+		return errors.Wrap(err, "while unsealing recovery bundle")
+	}
+	contents := recoveryContents{}
+	err = json.Unmarshal(data, &contents)
+	if err != nil {
+		return errors.Wrap(err, "while decoding recovery bundle")
+	}
+	files := map[string][]byte{}
+	keyfiles := map[string]bool{}
+	for _, authority := range worldconfig.ListAuthorities() {
+		keyfile, certfile := authority.Filenames()
+		key, cert := contents.Files[keyfile], contents.Files[certfile]
+		if key == nil || cert == nil {
+			return fmt.Errorf("authority %s is missing from recovery bundle", authority.Name)
+		}
+		_, err := authority.Parse(key, cert)
+		if err != nil {
+			return errors.Wrapf(err, "while checking authority %s", authority.Name)
+		}
+		if passphrase != nil {
+			key, err = sealutil.Seal(key, passphrase)
+			if err != nil {
+				return err
+			}
+		}
+		files[keyfile] = key
+		keyfiles[keyfile] = true
+		files[certfile] = cert
+		if rotations, found := contents.Files[authority.RotationFilename()]; found {
+			records, err := rotation.Parse(rotations)
+			if err != nil {
+				return errors.Wrapf(err, "while checking rotation records for authority %s", authority.Name)
+			}
+			for _, record := range records {
+				if record.Authority != authority.Name {
+					return fmt.Errorf("rotation record for authority %s found in %s", record.Authority, authority.RotationFilename())
+				}
+			}
+			files[authority.RotationFilename()] = rotations
+		}
+	}
+	for filename := range contents.Files {
+		if files[filename] == nil {
+			return fmt.Errorf("unexpected file %s in recovery bundle", filename)
+		}
+	}
+	for filename := range files {
+		if fileutil.Exists(path.Join(dir, filename)) {
+			return fmt.Errorf("will not overwrite existing file %s", path.Join(dir, filename))
+		}
+	}
+	// everything is written elsewhere first, so that a failure partway through leaves nothing half-restored in dir
+	dir = path.Clean(dir)
+	err = fileutil.EnsureIsFolder(path.Dir(dir))
+	if err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(path.Dir(dir), "."+path.Base(dir)+".import")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging) // ignore failure: nothing more we can do
+	for filename, data := range files {
+		mode := os.FileMode(0644)
+		if keyfiles[filename] {
+			mode = os.FileMode(0600)
+		}
+		err = fileutil.WriteAtomic(path.Join(staging, filename), data, mode)
+		if err != nil {
+			return err
+		}
+	}
+	if !fileutil.Exists(dir) {
+		err = os.Chmod(staging, os.FileMode(0755))
+		if err != nil {
+			return err
+		}
+		return fileutil.RenameAtomic(staging, dir)
+	}
+	// the files already in dir are kept, so each restored file is linked in next to them, which also fails rather than
+	// overwriting a file that appeared in the meantime
+	var linked []string
+	for filename := range files {
+		err = os.Link(path.Join(staging, filename), path.Join(dir, filename))
+		if err != nil {
+			for _, restored := range linked {
+				os.Remove(path.Join(dir, restored)) // ignore failure: nothing more we can do
+			}
+			return err
+		}
+		linked = append(linked, filename)
+	}
+	return nil
+}
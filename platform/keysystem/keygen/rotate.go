@@ -0,0 +1,67 @@
+package keygen
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+func findAuthority(name string) (config.ConfigAuthority, error) {
+	for _, authority := range worldconfig.ListAuthorities() {
+		if authority.Name == name {
+			return authority, nil
+		}
+	}
+	return config.ConfigAuthority{}, fmt.Errorf("no such authority %s", name)
+}
+
+// SignRotation publishes the replacement of an authority, so that nodes will accept the new version of the authority
+// in dir instead of the previous version, whose private key and public authority are provided. The record is appended
+// to any rotation records already present in dir.
+func SignRotation(dir string, name string, previousKeyPath string, previousPath string) error {
+	authority, err := findAuthority(name)
+	if err != nil {
+		return err
+	}
+	previousKey, err := wraputil.LoadRSAKeyFromPath(previousKeyPath)
+	if err != nil {
+		return err
+	}
+	previous, err := ioutil.ReadFile(previousPath)
+	if err != nil {
+		return err
+	}
+	_, certfile := authority.Filenames()
+	next, err := ioutil.ReadFile(path.Join(dir, certfile))
+	if err != nil {
+		return err
+	}
+	data, err := appendRotation(dir, authority, previous, previousKey, next)
+	if err != nil {
+		return err
+	}
+	// a partially-written file would lose the records that were already present
+	return fileutil.WriteAtomic(path.Join(dir, authority.RotationFilename()), data, os.FileMode(0644))
+}
+
+// appendRotation encodes the rotation records already present for authority in dir, followed by a new record that
+// replaces previous with next.
+func appendRotation(dir string, authority config.ConfigAuthority, previous []byte, previousKey crypto.Signer, next []byte) ([]byte, error) {
+	record, err := rotation.Sign(authority.Name, previous, previousKey, next)
+	if err != nil {
+		return nil, err
+	}
+	records, err := authority.LoadRotations(dir)
+	if err != nil {
+		return nil, err
+	}
+	return rotation.Encode(append(records, *record))
+}
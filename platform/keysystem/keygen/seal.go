@@ -0,0 +1,71 @@
+package keygen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/sealutil"
+)
+
+// ReadPassphrase reads a passphrase from a file, such as /dev/stdin.
+func ReadPassphrase(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return sealutil.ParsePassphrase(data)
+}
+
+// resealKeys replaces each authority key in dir with the result of transform, which is passed the current key and
+// whether it is sealed. No key is replaced unless every key can be, and each key is replaced atomically, so that the
+// keyserver can load the authorities even if replacing them is interrupted.
+func resealKeys(dir string, transform func(name string, key []byte, sealed bool) ([]byte, error)) error {
+	replacements := map[string][]byte{}
+	for _, authority := range worldconfig.ListAuthorities() {
+		keyfile, _ := authority.Filenames()
+		key, err := ioutil.ReadFile(path.Join(dir, keyfile))
+		if err != nil {
+			return err
+		}
+		replacements[keyfile], err = transform(authority.Name, key, sealutil.IsSealed(key))
+		if err != nil {
+			return err
+		}
+	}
+	for keyfile, replacement := range replacements {
+		err := fileutil.WriteAtomic(path.Join(dir, keyfile), replacement, os.FileMode(0600))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SealKeys seals each authority key in dir with passphrase. Every key must currently be unsealed.
+func SealKeys(dir string, passphrase []byte) error {
+	return resealKeys(dir, func(name string, key []byte, sealed bool) ([]byte, error) {
+		if sealed {
+			return nil, fmt.Errorf("key for authority %s is already sealed", name)
+		}
+		return sealutil.Seal(key, passphrase)
+	})
+}
+
+// ResealKeys changes the passphrase that each authority key in dir is sealed with. Every key must currently be sealed
+// with the previous passphrase.
+func ResealKeys(dir string, previous []byte, passphrase []byte) error {
+	return resealKeys(dir, func(name string, key []byte, sealed bool) ([]byte, error) {
+		if !sealed {
+			return nil, fmt.Errorf("key for authority %s is not sealed", name)
+		}
+		key, err := sealutil.Unseal(key, previous)
+		if err != nil {
+			return nil, fmt.Errorf("while unsealing key for authority %s: %v", name, err)
+		}
+		return sealutil.Seal(key, passphrase)
+	})
+}
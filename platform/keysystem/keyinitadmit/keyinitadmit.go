@@ -12,17 +12,34 @@ import (
 
 	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
 	"github.com/sipb/homeworld/platform/keysystem/api/server"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
 	"github.com/sipb/homeworld/platform/util/wraputil"
 )
 
 func main() {
 	logger := log.New(os.Stderr, "[keyinitadmit] ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	if len(os.Args) != 2 {
-		logger.Fatal("usage: keyinitadmit <principal>\n  runs on the keyserver; requests a bootstrap token using privileged access")
+	if len(os.Args) != 2 && len(os.Args) != 3 {
+		logger.Fatal("usage: keyinitadmit <principal> [<tenant>]\n  runs on the keyserver; requests a bootstrap token using privileged access\n  the tenant must be specified if the keyserver hosts several clusters")
 	}
 	principal := os.Args[1]
-	ctx, err := worldconfig.GenerateConfig()
+	env := hostenv.FromEnvironment()
+	if len(os.Args) == 3 {
+		tenants, err := worldconfig.LoadTenants(env)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		found := false
+		for _, tenant := range tenants {
+			if tenant.Name == os.Args[2] {
+				env, found = tenant.Env(env), true
+			}
+		}
+		if !found {
+			logger.Fatalf("no such tenant: %s", os.Args[2])
+		}
+	}
+	ctx, err := worldconfig.GenerateConfig(env)
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -39,7 +56,12 @@ func main() {
 	if err != nil {
 		logger.Fatal(err)
 	}
-	ks, err := server.NewKeyserver(ctx.ClusterCA.GetPublicKey(), ctx.KeyserverDNS+":20557")
+	address := ctx.KeyserverDNS + ":20557"
+	if ctx.Follower != nil {
+		// only the leader grants bootstrap tokens, and the other keyservers copy them from it
+		address = ctx.Follower.Leader
+	}
+	ks, err := server.NewKeyserver(ctx.ClusterCA.GetPublicKey(), address)
 	if err != nil {
 		logger.Fatal(err)
 	}
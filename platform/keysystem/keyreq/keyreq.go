@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
 	"github.com/sipb/homeworld/platform/keysystem/api/server"
@@ -27,7 +28,8 @@ func get_keyserver(logger *log.Logger, authority_path string, keyserver_domain s
 		logger.Printf("while loading authority: %s", err)
 		os.Exit(ERR_INVALID_INVOCATION)
 	}
-	ks, err := server.NewKeyserver(authoritydata, keyserver_domain)
+	// several keyservers may be listed, separated by commas, in order of preference
+	ks, err := server.NewKeyserverWithFailover(authoritydata, strings.Split(keyserver_domain, ","))
 	if err != nil {
 		logger.Print(err)
 		os.Exit(ERR_INVALID_CONFIG)
@@ -215,6 +217,65 @@ func main() {
 			os.Exit(ERR_NO_ACCESS)
 		}
 		os.Stdout.WriteString(token + "\n")
+	case "inventory":
+		if len(os.Args) < 4 {
+			logger.Print("not enough parameters to keyreq inventory <authority-path> <keyserver-domain>")
+			os.Exit(ERR_INVALID_INVOCATION)
+		}
+		_, rt := auth_kerberos(logger, os.Args[2], os.Args[3])
+		inventory, err := reqtarget.SendRequest(rt, worldconfig.InventoryAPI, "")
+		if err != nil {
+			logger.Print(err)
+			os.Exit(ERR_NO_ACCESS)
+		}
+		os.Stdout.WriteString(inventory + "\n")
+	case "enrollments":
+		if len(os.Args) < 4 {
+			logger.Print("not enough parameters to keyreq enrollments <authority-path> <keyserver-domain>")
+			os.Exit(ERR_INVALID_INVOCATION)
+		}
+		_, rt := auth_kerberos(logger, os.Args[2], os.Args[3])
+		enrollments, err := reqtarget.SendRequest(rt, worldconfig.ListEnrollmentsAPI, "")
+		if err != nil {
+			logger.Print(err)
+			os.Exit(ERR_NO_ACCESS)
+		}
+		os.Stdout.WriteString(enrollments + "\n")
+	case "approve-enrollment":
+		if len(os.Args) < 5 {
+			logger.Print("not enough parameters to keyreq approve-enrollment <authority-path> <keyserver-domain> <id>")
+			os.Exit(ERR_INVALID_INVOCATION)
+		}
+		_, rt := auth_kerberos(logger, os.Args[2], os.Args[3])
+		hostname, err := reqtarget.SendRequest(rt, worldconfig.ApproveEnrollmentAPI, os.Args[4])
+		if err != nil {
+			logger.Print(err)
+			os.Exit(ERR_NO_ACCESS)
+		}
+		os.Stdout.WriteString("admitted " + hostname + "\n")
+	case "deny-enrollment":
+		if len(os.Args) < 5 {
+			logger.Print("not enough parameters to keyreq deny-enrollment <authority-path> <keyserver-domain> <id>")
+			os.Exit(ERR_INVALID_INVOCATION)
+		}
+		_, rt := auth_kerberos(logger, os.Args[2], os.Args[3])
+		_, err := reqtarget.SendRequest(rt, worldconfig.DenyEnrollmentAPI, os.Args[4])
+		if err != nil {
+			logger.Print(err)
+			os.Exit(ERR_NO_ACCESS)
+		}
+	case "decommission":
+		if len(os.Args) < 5 {
+			logger.Print("not enough parameters to keyreq decommission <authority-path> <keyserver-domain> <hostname>")
+			os.Exit(ERR_INVALID_INVOCATION)
+		}
+		_, rt := auth_kerberos(logger, os.Args[2], os.Args[3])
+		revoked, err := reqtarget.SendRequest(rt, worldconfig.DecommissionAPI, os.Args[4])
+		if err != nil {
+			logger.Print(err)
+			os.Exit(ERR_NO_ACCESS)
+		}
+		os.Stdout.WriteString(revoked + "\n")
 	default:
 		logger.Print("keyreq should only be used by scripts that already know how to invoke it")
 		os.Exit(ERR_INVALID_INVOCATION)
@@ -2,6 +2,7 @@ package account
 
 import (
 	"net"
+	"sync"
 )
 
 type Account struct {
@@ -13,9 +14,33 @@ type Account struct {
 
 type Group struct {
 	AllMembers []*Account
+	// only needed for members added while the keyserver is running
+	mutex sync.RWMutex
+}
+
+// AddMember adds an account to a group that may already be in use.
+func (g *Group) AddMember(ac *Account) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.AllMembers = append(g.AllMembers, ac)
+}
+
+// RemoveMember removes an account from a group that may already be in use.
+func (g *Group) RemoveMember(user string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var remaining []*Account
+	for _, member := range g.AllMembers {
+		if member.Principal != user {
+			remaining = append(remaining, member)
+		}
+	}
+	g.AllMembers = remaining
 }
 
 func (g *Group) HasMember(user string) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
 	for _, member := range g.AllMembers {
 		if member.Principal == user {
 			return true
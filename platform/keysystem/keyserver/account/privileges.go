@@ -1,11 +1,15 @@
 package account
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/inventory"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/revocation"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/token"
 )
 
@@ -75,11 +79,104 @@ func NewConfigurationPrivilege(contents string) Privilege {
 	}
 }
 
+// NewDynamicConfigurationPrivilege is like NewConfigurationPrivilege, but for contents that can change while the
+// keyserver is running.
+func NewDynamicConfigurationPrivilege(contents func() string) Privilege {
+	return func(_ *OperationContext, request string) (string, error) {
+		if len(request) != 0 {
+			return "", errors.New("expected empty request to configuration endpoint")
+		}
+		return contents(), nil
+	}
+}
+
 func NewFetchKeyPrivilege(static *authorities.TLSAuthority) Privilege {
 	return func(_ *OperationContext, request string) (string, error) {
 		if len(request) != 0 {
 			return "", errors.New("expected empty request to fetch-key endpoint")
 		}
-		return string(static.GetPrivateKey()), nil
+		key := static.GetPrivateKey()
+		if key == nil {
+			return "", errors.New("private key is held by an external signer, and cannot be fetched")
+		}
+		return string(key), nil
+	}
+}
+
+func NewCheckinPrivilege(inv *inventory.Inventory) Privilege {
+	return func(ctx *OperationContext, request string) (string, error) {
+		report, err := inventory.ParseReport(request)
+		if err != nil {
+			return "", err
+		}
+		return "", inv.Record(ctx.Account.Principal, report)
+	}
+}
+
+func NewInventoryPrivilege(inv *inventory.Inventory) Privilege {
+	return func(_ *OperationContext, request string) (string, error) {
+		if len(request) != 0 {
+			return "", errors.New("expected empty request to inventory endpoint")
+		}
+		data, err := json.Marshal(inv.Snapshot())
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+// NewMetricsPrivilege lets an account scrape the keyserver's metrics, which are served at /metrics rather than through
+// the API.
+func NewMetricsPrivilege() Privilege {
+	return func(_ *OperationContext, _ string) (string, error) {
+		return "", errors.New("metrics are served at /metrics, not through the API")
+	}
+}
+
+func NewListEnrollmentsPrivilege(queue *enrollment.Queue) Privilege {
+	return func(_ *OperationContext, request string) (string, error) {
+		if len(request) != 0 {
+			return "", errors.New("expected empty request to enrollment listing endpoint")
+		}
+		data, err := json.Marshal(queue.List())
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+func NewApproveEnrollmentPrivilege(queue *enrollment.Queue) Privilege {
+	return func(ctx *OperationContext, id string) (string, error) {
+		approved, err := queue.Approve(id, ctx.Account.Principal)
+		if err != nil {
+			return "", err
+		}
+		return approved.Request.Hostname, nil
+	}
+}
+
+func NewDenyEnrollmentPrivilege(queue *enrollment.Queue) Privilege {
+	return func(ctx *OperationContext, id string) (string, error) {
+		return "", queue.Deny(id, ctx.Account.Principal)
+	}
+}
+
+// NewDecommissionPrivilege removes the node named in the request from the cluster, and lists the certificates revoked.
+func NewDecommissionPrivilege(decommission func(hostname string) ([]revocation.Certificate, error)) Privilege {
+	return func(_ *OperationContext, hostname string) (string, error) {
+		if len(hostname) == 0 {
+			return "", errors.New("expected hostname in request to decommission endpoint")
+		}
+		revoked, err := decommission(hostname)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(revoked)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
 	}
 }
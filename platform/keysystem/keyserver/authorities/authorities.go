@@ -1,5 +1,11 @@
 package authorities
 
+import (
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
 /*
  * Roughly speaking, the point of this package is to abstract away the details of how different kinds of certificate
  * authorities actually work.
@@ -20,4 +26,9 @@ package authorities
 
 type Authority interface {
 	GetPublicKey() []byte
+	// SetClock changes the clock used to date issued certificates, which is only useful for simulation.
+	SetClock(clk clock.Clock)
+	// SetBackdate makes issued certificates valid starting this long before they are issued, so that they are accepted
+	// by nodes whose clocks are slightly behind.
+	SetBackdate(backdate time.Duration)
 }
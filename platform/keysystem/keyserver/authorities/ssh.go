@@ -2,6 +2,7 @@ package authorities
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
@@ -9,11 +10,27 @@ import (
 	"golang.org/x/crypto/ssh"
 	"math/big"
 	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
 )
 
 type SSHAuthority struct {
 	key    ssh.Signer
 	pubkey []byte
+	// nil to use the system clock
+	clock clock.Clock
+	// how long before issuance certificates become valid
+	backdate time.Duration
+}
+
+// SetClock changes the clock used to date issued certificates.
+func (d *SSHAuthority) SetClock(clk clock.Clock) {
+	d.clock = clk
+}
+
+// SetBackdate makes issued certificates valid starting this long before they are issued.
+func (d *SSHAuthority) SetBackdate(backdate time.Duration) {
+	d.backdate = backdate
 }
 
 func parseSingleSSHKey(data []byte) (ssh.PublicKey, error) {
@@ -44,6 +61,28 @@ func LoadSSHAuthority(keydata []byte, pubkeydata []byte) (Authority, error) {
 	if err != nil {
 		return nil, err
 	}
+	authority, err := newSSHAuthority(key, pubkey, pubkeydata)
+	if err != nil {
+		return nil, err
+	}
+	return authority, nil
+}
+
+// NewSSHAuthority creates a SSH authority whose private key is only available through signer, such as when the key is
+// held by an external signer.
+func NewSSHAuthority(signer crypto.Signer, pubkeydata []byte) (*SSHAuthority, error) {
+	pubkey, err := parseSingleSSHKey(pubkeydata)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		return nil, err
+	}
+	return newSSHAuthority(key, pubkey, pubkeydata)
+}
+
+func newSSHAuthority(key ssh.Signer, pubkey ssh.PublicKey, pubkeydata []byte) (*SSHAuthority, error) {
 	if !arePublicKeysEqual(pubkey, key.PublicKey()) {
 		return nil, fmt.Errorf("public SSH key does not match private SSH key: %s versus %s", pubkey.Marshal(), key.PublicKey().Marshal())
 	}
@@ -85,13 +124,14 @@ func (d *SSHAuthority) Sign(request string, ishost bool, lifespan time.Duration,
 		return "", err
 	}
 
+	issueAt := clock.Now(d.clock)
 	cert := &ssh.Certificate{
 		Key:             pubkey,
 		KeyId:           keyid,
 		Serial:          serialNumber.Uint64(),
 		CertType:        certType(ishost),
-		ValidAfter:      uint64(time.Now().Unix()),
-		ValidBefore:     uint64(time.Now().Add(lifespan).Unix()),
+		ValidAfter:      uint64(issueAt.Add(-d.backdate).Unix()),
+		ValidBefore:     uint64(issueAt.Add(lifespan).Unix()),
 		ValidPrincipals: principals,
 		Permissions: ssh.Permissions{
 			Extensions: map[string]string{
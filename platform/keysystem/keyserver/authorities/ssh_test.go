@@ -10,6 +10,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
 )
 
 const (
@@ -175,17 +177,39 @@ func TestSSHNegativeLifespan(t *testing.T) {
 	_, err = a.Sign(SSH_TEST2_PUBKEY, false, 0, "name", []string{"princ"})
 	if err == nil {
 		t.Error("Zero lifespan should have failed to sign")
-	} else if !strings.Contains(err.Error(), "Lifespan") {
+	} else if !strings.Contains(err.Error(), "lifespan") {
 		t.Error("Error should have talked about lifespans")
 	}
 	_, err = a.Sign(SSH_TEST2_PUBKEY, false, -time.Hour, "name", []string{"princ"})
 	if err == nil {
 		t.Error("Negative lifespan should have failed to sign")
-	} else if !strings.Contains(err.Error(), "Lifespan") {
+	} else if !strings.Contains(err.Error(), "lifespan") {
 		t.Error("Error should have talked about lifespans")
 	}
 }
 
+func TestSSHBackdate(t *testing.T) {
+	a := getSSHAuthority(t)
+	issueAt := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	a.SetClock(clock.NewFake(issueAt))
+	a.SetBackdate(5 * time.Minute)
+	s, err := a.Sign(SSH_TEST2_PUBKEY, false, time.Hour, "name", []string{"princ"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pubkey.(*ssh.Certificate)
+	if cert.ValidAfter != uint64(issueAt.Add(-5*time.Minute).Unix()) {
+		t.Errorf("Certificate not backdated: valid after %d", cert.ValidAfter)
+	}
+	if cert.ValidBefore != uint64(issueAt.Add(time.Hour).Unix()) {
+		t.Errorf("Backdating should not change expiration: valid before %d", cert.ValidBefore)
+	}
+}
+
 func TestSSHWildcard(t *testing.T) {
 	a := getSSHAuthority(t)
 	_, err := a.Sign(SSH_TEST2_PUBKEY, false, time.Minute, "name", []string{})
@@ -222,7 +246,7 @@ func (f *FakeSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
 func TestSSHSigningFailed(t *testing.T) {
 	a := &SSHAuthority{key: &FakeSigner{}, pubkey: []byte("fake")}
 	_, err := a.Sign(SSH_TEST2_PUBKEY, false, time.Minute, "name", []string{"princ"})
-	if err == nil || err.Error() != "Mocked failure" {
+	if err == nil || err.Error() != "mocked failure" {
 		t.Errorf("Expected mocked failure error, but got: %s", err)
 	}
 }
@@ -230,11 +254,11 @@ func TestSSHSigningFailed(t *testing.T) {
 func TestSSHInvalidSSHKeyToSign(t *testing.T) {
 	a := getSSHAuthority(t)
 	_, err := a.Sign("invalid key", false, time.Minute, "name", []string{"princ"})
-	if err == nil || err.Error() != "ssh: no key found" {
+	if err == nil || !strings.Contains(err.Error(), "ssh: no key found") {
 		t.Errorf("Expected no key found failure error, but got: %s", err)
 	}
 	_, err = a.Sign(SSH_TEST2_PUBKEY+"\nbad suffix", false, time.Minute, "name", []string{"princ"})
-	if err == nil || !strings.Contains(err.Error(), "Trailing data") {
+	if err == nil || !strings.Contains(err.Error(), "trailing data") {
 		t.Errorf("Expected no key found failure error, but got: %s", err)
 	}
 }
@@ -2,6 +2,7 @@ package authorities
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
@@ -13,15 +14,31 @@ import (
 
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/verifier"
 	"github.com/sipb/homeworld/platform/util/certutil"
+	"github.com/sipb/homeworld/platform/util/clock"
 	"github.com/sipb/homeworld/platform/util/wraputil"
 )
 
 type TLSAuthority struct {
 	// TODO: also support ECDSA or other newer algorithms
-	key         *rsa.PrivateKey
+	key crypto.Signer
+	// nil if the key is held by an external signer
 	keyEncoded  []byte
 	cert        *x509.Certificate
 	certEncoded []byte
+	// nil to use the system clock
+	clock clock.Clock
+	// how long before issuance certificates become valid
+	backdate time.Duration
+}
+
+// SetClock changes the clock used to date issued certificates and to check presented ones.
+func (t *TLSAuthority) SetClock(clk clock.Clock) {
+	t.clock = clk
+}
+
+// SetBackdate makes issued certificates valid starting this long before they are issued.
+func (t *TLSAuthority) SetBackdate(backdate time.Duration) {
+	t.backdate = backdate
 }
 
 func (t *TLSAuthority) Equal(authority *TLSAuthority) bool {
@@ -33,7 +50,17 @@ func LoadTLSAuthority(keydata []byte, certdata []byte) (Authority, error) {
 	if err != nil {
 		return nil, err
 	}
+	authority, err := NewTLSAuthority(privkey, certdata)
+	if err != nil {
+		return nil, err
+	}
+	authority.keyEncoded = keydata
+	return authority, nil
+}
 
+// NewTLSAuthority creates a TLS authority whose private key is only available through signer, such as when the key is
+// held by an external signer.
+func NewTLSAuthority(signer crypto.Signer, certdata []byte) (*TLSAuthority, error) {
 	cert, err := wraputil.LoadX509CertFromPEM(certdata)
 	if err != nil {
 		return nil, err
@@ -42,11 +69,12 @@ func LoadTLSAuthority(keydata []byte, certdata []byte) (Authority, error) {
 	if cert.PublicKeyAlgorithm != x509.RSA || !ok {
 		return nil, errors.New("expected RSA public key in certificate")
 	}
-	if pub.N.Cmp(privkey.N) != 0 {
+	signerPub, ok := signer.Public().(*rsa.PublicKey)
+	if !ok || pub.N.Cmp(signerPub.N) != 0 || pub.E != signerPub.E {
 		return nil, errors.New("mismatched RSA public and private keys")
 	}
 
-	return &TLSAuthority{key: privkey, keyEncoded: keydata, cert: cert, certEncoded: certdata}, nil
+	return &TLSAuthority{key: signer, cert: cert, certEncoded: certdata}, nil
 }
 
 func (t *TLSAuthority) ToCertPool() *x509.CertPool {
@@ -59,6 +87,7 @@ func (t *TLSAuthority) GetPublicKey() []byte {
 	return t.certEncoded
 }
 
+// GetPrivateKey returns the encoded private key of the authority, or nil if the key is held by an external signer.
 func (t *TLSAuthority) GetPrivateKey() []byte {
 	return t.keyEncoded
 }
@@ -80,8 +109,9 @@ func (t *TLSAuthority) Verify(request *http.Request) (string, error) {
 	}
 	firstCert := request.TLS.VerifiedChains[0][0]
 	chains, err := firstCert.Verify(x509.VerifyOptions{
-		Roots:     t.ToCertPool(),
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Roots:       t.ToCertPool(),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		CurrentTime: clock.Now(t.clock),
 	})
 	if len(chains) == 0 || err != nil {
 		return "", errors.Wrap(err, "certificate not valid under this authority")
@@ -100,7 +130,7 @@ func (t *TLSAuthority) Sign(request string, ishost bool, lifespan time.Duration,
 		return "", err
 	}
 
-	issueAt := time.Now()
+	issueAt := clock.Now(t.clock)
 
 	dnsNames, IPs := partitionDNSNamesAndIPs(names)
 
@@ -110,10 +140,8 @@ func (t *TLSAuthority) Sign(request string, ishost bool, lifespan time.Duration,
 
 		BasicConstraintsValid: true,
 		IsCA:                  false,
-		MaxPathLen:            0,
-		MaxPathLenZero:        true,
 
-		NotBefore: issueAt,
+		NotBefore: issueAt.Add(-t.backdate),
 		NotAfter:  issueAt.Add(lifespan),
 
 		Subject: pkix.Name{
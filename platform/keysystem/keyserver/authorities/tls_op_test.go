@@ -164,7 +164,7 @@ func TestTLSAuthority_VerifyWrongCert(t *testing.T) {
 	defer stop()
 
 	errtext := string(request(""))
-	if !strings.Contains(errtext, "Certificate not valid under this authority") {
+	if !strings.Contains(errtext, "certificate not valid under this authority") {
 		t.Errorf("Expected failure of cert, not: %s", errtext)
 	}
 }
@@ -275,7 +275,7 @@ func TestTLSAuthority_Sign_UserCert(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	cert, err := a.Sign(string(csr), false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"})
+	cert, err := a.Sign(string(csr), false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -298,7 +298,7 @@ func TestTLSAuthority_Sign_HostCert(t *testing.T) {
 		t.Fatalf("Could not create TLS authority: %s", err)
 	}
 
-	serverCert, err := serverCA.(*TLSAuthority).Sign(TLS_SERVER_CSR, true, time.Hour, "server-common-name", []string{"127.0.0.1"})
+	serverCert, err := serverCA.(*TLSAuthority).Sign(TLS_SERVER_CSR, true, time.Hour, "server-common-name", []string{"127.0.0.1"}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -331,7 +331,7 @@ func TestTLSAuthority_Sign_HostCert(t *testing.T) {
 
 func signAndLoad(t *testing.T, csr string, ishost bool, duration time.Duration, commonname string, names []string) *x509.Certificate {
 	a, _, _ := getTLSAuthority(t)
-	certpem, err := a.Sign(csr, ishost, duration, commonname, names)
+	certpem, err := a.Sign(csr, ishost, duration, commonname, names, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -358,6 +358,26 @@ func TestTLSAuthority_Sign_IssuedNow(t *testing.T) {
 	}
 }
 
+func TestTLSAuthority_Sign_Backdated(t *testing.T) {
+	a, _, _ := getTLSAuthority(t)
+	a.SetBackdate(5 * time.Minute)
+	certpem, err := a.Sign(TLS_CLIENT_CSR, false, time.Hour, "common-name-tc", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := wraputil.LoadX509CertFromPEM([]byte(certpem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta := time.Now().Add(-5 * time.Minute).Sub(c1.NotBefore)
+	if math.Abs(delta.Seconds()) > 1 {
+		t.Error("Certificate was not backdated")
+	}
+	if c1.NotAfter.Sub(c1.NotBefore) != time.Hour+5*time.Minute {
+		t.Error("Backdating should not change expiration")
+	}
+}
+
 func TestTLSAuthority_Sign_CorrectDuration(t *testing.T) {
 	for _, duration := range []time.Duration{time.Second, time.Second * 8, time.Minute, time.Minute * 16, time.Hour, time.Hour * 24, time.Hour * 10000} {
 		c1 := signAndLoad(t, TLS_CLIENT_CSR, false, duration, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"})
@@ -436,7 +456,7 @@ func TestTLSAuthority_Sign_CheckNames(t *testing.T) {
 
 func TestTLSAuthority_Sign_MalformedPEM(t *testing.T) {
 	a, _, _ := getTLSAuthority(t)
-	_, err := a.Sign("I'm literally not a PEM file", false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"})
+	_, err := a.Sign("I'm literally not a PEM file", false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"}, nil)
 	if err == nil {
 		t.Error("Expected error while signing malformed CSR")
 	} else if !strings.Contains(err.Error(), "PEM header") {
@@ -446,7 +466,7 @@ func TestTLSAuthority_Sign_MalformedPEM(t *testing.T) {
 
 func TestTLSAuthority_Sign_MalformedCSRBody(t *testing.T) {
 	a, _, _ := getTLSAuthority(t)
-	_, err := a.Sign(strings.Replace(TLS_CLIENT_CSR, "WMRQw", "Y", -1), false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"})
+	_, err := a.Sign(strings.Replace(TLS_CLIENT_CSR, "WMRQw", "Y", -1), false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"}, nil)
 	if err == nil {
 		t.Error("Expected error while signing malformed CSR")
 	} else if !strings.Contains(err.Error(), "asn1") {
@@ -456,7 +476,7 @@ func TestTLSAuthority_Sign_MalformedCSRBody(t *testing.T) {
 
 func TestTLSAuthority_Sign_MalformedCSR(t *testing.T) {
 	a, _, _ := getTLSAuthority(t)
-	_, err := a.Sign(strings.Replace(TLS_CLIENT_CSR, "Z", "Y", -1), false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"})
+	_, err := a.Sign(strings.Replace(TLS_CLIENT_CSR, "Z", "Y", -1), false, time.Hour, "common-name-tc", []string{"dns1.mit.edu", "18.181.123.456", "dns2.mit.edu", "18.181.123.789"}, nil)
 	if err == nil {
 		t.Error("Expected error while signing malformed CSR")
 	} else if !strings.Contains(err.Error(), "verification error") {
@@ -109,7 +109,8 @@ func TestParseTLSMalformedMiddleData(t *testing.T) {
 	_, err = LoadTLSAuthority(pemkey, []byte(scert[:100]+"AAAA"+scert[104:]))
 	if err == nil {
 		t.Errorf("Expected creation of TLS authority to be broken")
-	} else if !strings.Contains(err.Error(), "structure error") {
+	} else if !strings.Contains(err.Error(), "structure error") && !strings.Contains(err.Error(), "invalid RDNSequence") {
+		// newer versions of crypto/x509 report the same malformed structure by naming the field that failed to parse
 		t.Errorf("Incorrect error, instead of structure error: %s", err)
 	}
 }
@@ -169,7 +170,12 @@ func TestLoadPKCS8Key(t *testing.T) {
 	if !authority1.Equal(authority2) {
 		t.Error("PKCS8 authority is different from PKCS1 authority")
 	}
-	if !privateKeysEqual(authority1.key, authority2.key) {
+	key1, ok1 := authority1.key.(*rsa.PrivateKey)
+	key2, ok2 := authority2.key.(*rsa.PrivateKey)
+	if !ok1 || !ok2 {
+		t.Fatal("expected loaded authorities to hold RSA private keys")
+	}
+	if !privateKeysEqual(key1, key2) {
 		t.Errorf("PKCS8 key is different from PKCS1 key: %v versus %v", authority1.key, authority2.key)
 	}
 }
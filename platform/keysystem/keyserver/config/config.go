@@ -1,11 +1,16 @@
 package config
 
 import (
+	"crypto"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
 
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/util/sealutil"
 )
 
 type AuthorityType int
@@ -32,6 +37,11 @@ func (t ConfigAuthority) Filenames() (key string, cert string) {
 	}
 }
 
+// RotationFilename names the file that holds the rotation records that lead to the current version of the authority.
+func (t ConfigAuthority) RotationFilename() string {
+	return t.Name + ".rotations"
+}
+
 func TLSAuthority(name string) ConfigAuthority {
 	return ConfigAuthority{Type: TLSAuthorityType, Name: name}
 }
@@ -40,7 +50,12 @@ func SSHAuthority(name string) ConfigAuthority {
 	return ConfigAuthority{Type: SSHAuthorityType, Name: name}
 }
 
-func (a *ConfigAuthority) Load(dir string) (authorities.Authority, error) {
+// Passphrase provides the passphrase that unseals authority keys. It is only called if a sealed key is found.
+type Passphrase func() ([]byte, error)
+
+// Load loads the authority from dir. If its private key is sealed, it is unsealed with the passphrase, which may be nil
+// if no keys are expected to be sealed.
+func (a *ConfigAuthority) Load(dir string, passphrase Passphrase) (authorities.Authority, error) {
 	if dir == "" {
 		return nil, errors.New("empty directory path")
 	}
@@ -49,16 +64,84 @@ func (a *ConfigAuthority) Load(dir string) (authorities.Authority, error) {
 	if err != nil {
 		return nil, err
 	}
+	if sealutil.IsSealed(keydata) {
+		if passphrase == nil {
+			return nil, fmt.Errorf("key for authority %s is sealed, but no passphrase is available", a.Name)
+		}
+		pass, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		keydata, err = sealutil.Unseal(keydata, pass)
+		if err != nil {
+			return nil, fmt.Errorf("while unsealing key for authority %s: %v", a.Name, err)
+		}
+	}
+	certdata, err := ioutil.ReadFile(path.Join(dir, certfile))
+	if err != nil {
+		return nil, err
+	}
+	return a.Parse(keydata, certdata)
+}
+
+// LoadExternal loads the authority from dir, except for its private key, which is held by an external signer.
+func (a *ConfigAuthority) LoadExternal(dir string, key crypto.Signer) (authorities.Authority, error) {
+	if dir == "" {
+		return nil, errors.New("empty directory path")
+	}
+	_, certfile := a.Filenames()
 	certdata, err := ioutil.ReadFile(path.Join(dir, certfile))
 	if err != nil {
 		return nil, err
 	}
+	// the concrete types are kept until the error is checked, so that a failure is not returned as a non-nil Authority
+	switch a.Type {
+	case TLSAuthorityType:
+		authority, err := authorities.NewTLSAuthority(key, certdata)
+		if err != nil {
+			return nil, err
+		}
+		return authority, nil
+	case SSHAuthorityType:
+		authority, err := authorities.NewSSHAuthority(key, certdata)
+		if err != nil {
+			return nil, err
+		}
+		return authority, nil
+	default:
+		panic("invalid authority type in ConfigAuthority.LoadExternal")
+	}
+}
+
+// Parse loads the authority from the contents of its unsealed private key and its certificate or public key, and checks
+// that they match.
+func (a *ConfigAuthority) Parse(keydata []byte, certdata []byte) (authorities.Authority, error) {
 	switch a.Type {
 	case TLSAuthorityType:
 		return authorities.LoadTLSAuthority(keydata, certdata)
 	case SSHAuthorityType:
 		return authorities.LoadSSHAuthority(keydata, certdata)
 	default:
-		panic("invalid authority type in ConfigAuthority.Load")
+		panic("invalid authority type in ConfigAuthority.Parse")
+	}
+}
+
+// LoadRotations loads the rotation records for the authority, if any have been published.
+func (a *ConfigAuthority) LoadRotations(dir string) ([]rotation.Record, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, a.RotationFilename()))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	records, err := rotation.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Authority != a.Name {
+			return nil, fmt.Errorf("rotation record for authority %s found in %s", record.Authority, a.RotationFilename())
+		}
 	}
+	return records, nil
 }
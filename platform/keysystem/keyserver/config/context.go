@@ -5,7 +5,16 @@ import (
 	"fmt"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/account"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/inventory"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/reenroll"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/replication"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/revocation"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/verifier"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/util/clock"
+	"sync"
+	"time"
 )
 
 type StaticFile struct {
@@ -20,10 +29,52 @@ type Context struct {
 	ClusterCA               *authorities.TLSAuthority
 	StaticFiles             map[string]StaticFile
 	KeyserverDNS            string
+	// how long before issuance certificates become valid, which tells clients how far off their clocks may be
+	CertBackdate time.Duration
+	// records of past replacements of each authority, which let nodes accept the current versions
+	Rotations map[string][]rotation.Record
+	// nil if the keyserver does not keep track of node check-ins
+	Inventory *inventory.Inventory
+	// nil if nodes cannot re-enroll with their SSH host certificates
+	Reenroller *reenroll.Reenroller
+	// nil if nodes cannot enroll without being listed in setup.yaml
+	Enrollments *enrollment.Queue
+	// nil if nodes cannot be decommissioned
+	Revocations *revocation.Revocations
+	// nil if this keyserver is the leader, or the only keyserver
+	Follower *replication.Follower
+	// nil to use the system clock
+	Clock clock.Clock
+	// only needed for accounts added while the keyserver is running
+	accountsMutex sync.RWMutex
+}
+
+// AddAccount registers a new account while the keyserver may already be serving requests.
+func (ctx *Context) AddAccount(ac *account.Account) error {
+	ctx.accountsMutex.Lock()
+	defer ctx.accountsMutex.Unlock()
+	if _, found := ctx.Accounts[ac.Principal]; found {
+		return fmt.Errorf("account already exists for principal %s", ac.Principal)
+	}
+	ctx.Accounts[ac.Principal] = ac
+	return nil
+}
+
+// RemoveAccount unregisters an account while the keyserver may already be serving requests.
+func (ctx *Context) RemoveAccount(principal string) error {
+	ctx.accountsMutex.Lock()
+	defer ctx.accountsMutex.Unlock()
+	if _, found := ctx.Accounts[principal]; !found {
+		return fmt.Errorf("cannot find account for principal %s", principal)
+	}
+	delete(ctx.Accounts, principal)
+	return nil
 }
 
 func (ctx *Context) GetAccount(principal string) (*account.Account, error) {
+	ctx.accountsMutex.RLock()
 	ac, found := ctx.Accounts[principal]
+	ctx.accountsMutex.RUnlock()
 	if !found {
 		return nil, fmt.Errorf("cannot find account for principal %s", principal)
 	}
@@ -31,3 +31,43 @@ func TestContext_GetAccount(t *testing.T) {
 		t.Error("Expected error to talk about account name.")
 	}
 }
+
+func TestContext_AddAccount(t *testing.T) {
+	ctx := &Context{Accounts: map[string]*account.Account{}}
+	ac := &account.Account{Principal: "test-account"}
+	if err := ctx.AddAccount(ac); err != nil {
+		t.Fatal(err)
+	}
+	account_lookup, err := ctx.GetAccount("test-account")
+	if err != nil {
+		t.Error(err)
+	} else if ac != account_lookup {
+		t.Error("Account mismatch.")
+	}
+	err = ctx.AddAccount(&account.Account{Principal: "test-account"})
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("Expected error to talk about existing account, not %s.", err)
+	}
+}
+
+func TestContext_RemoveAccount(t *testing.T) {
+	ctx := &Context{Accounts: map[string]*account.Account{}}
+	if err := ctx.AddAccount(&account.Account{Principal: "test-account"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.RemoveAccount("test-account"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := ctx.GetAccount("test-account")
+	if err == nil {
+		t.Error("Expected error.")
+	}
+	err = ctx.RemoveAccount("test-account")
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "cannot find account") {
+		t.Errorf("Expected error to talk about missing account, not %s.", err)
+	}
+}
@@ -0,0 +1,333 @@
+package enrollment
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+)
+
+/*
+ * Nodes are normally only part of the cluster if they are listed in setup.yaml when the keyserver starts. Instead, a new
+ * machine can submit an enrollment request, which describes the node that it wants to become, along with the CSR for
+ * its keygranting certificate. Once an administrator approves the request, the node is admitted to the cluster, the
+ * keygranting certificate is issued, and the machine can pick it up with the ID of its request. Approved requests are
+ * persisted, so that their nodes remain part of the cluster across keyserver restarts.
+ */
+
+const (
+	Pending  = "pending"
+	Approved = "approved"
+	Denied   = "denied"
+)
+
+// limits how much unauthenticated clients can add to the queue before an administrator deals with it
+const MaxPending = 64
+
+// Request is submitted by a machine that wants to join the cluster.
+type Request struct {
+	Hostname string `json:"hostname"`
+	IP       string `json:"ip"`
+	Kind     string `json:"kind"`
+	// the CSR for the node's keygranting certificate
+	CSR string `json:"csr"`
+	// the fingerprint of the machine's SSH host key, which an administrator can compare against the machine's console
+	HostKeyFingerprint string `json:"host-key-fingerprint"`
+}
+
+// Validate checks that a request is well-formed. Whether it makes sense for the cluster is only checked on approval.
+func (r *Request) Validate() error {
+	if r.Hostname == "" {
+		return errors.New("enrollment request is missing a hostname")
+	}
+	if net.ParseIP(r.IP) == nil {
+		return fmt.Errorf("could not parse IP in enrollment request: %s", r.IP)
+	}
+	if r.Kind == "" {
+		return errors.New("enrollment request is missing the kind of node")
+	}
+	if r.CSR == "" {
+		return errors.New("enrollment request is missing a CSR")
+	}
+	if r.HostKeyFingerprint == "" {
+		return errors.New("enrollment request is missing a host key fingerprint")
+	}
+	return nil
+}
+
+// Enrollment is the keyserver's record of a single request.
+type Enrollment struct {
+	ID        string    `json:"id"`
+	Request   Request   `json:"request"`
+	Submitted time.Time `json:"submitted"`
+	State     string    `json:"state"`
+	// the administrator who approved or denied the request, and when
+	DecidedBy string     `json:"decided-by,omitempty"`
+	Decided   *time.Time `json:"decided,omitempty"`
+	// the keygranting certificate issued when the request was approved
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// Status is what the submitting machine can find out about its request.
+type Status struct {
+	State       string `json:"state"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// Queue keeps track of enrollment requests, and admits nodes once their requests are approved.
+type Queue struct {
+	// Admit adds the node described by an approved request to the cluster, and issues its keygranting certificate. It
+	// must be set before any request is approved, and is never called concurrently.
+	Admit func(request Request) (certificate string, err error)
+
+	mutex       sync.Mutex
+	enrollments map[string]*Enrollment
+	// where to persist the queue across keyserver restarts; empty to only keep it in memory
+	path  string
+	clock clock.Clock
+}
+
+// NewQueue creates an empty queue. If path is not empty, the queue is loaded from path, if it exists, and saved there
+// after every change.
+func NewQueue(path string, clk clock.Clock) (*Queue, error) {
+	q := &Queue{enrollments: map[string]*Enrollment{}, path: path, clock: clk}
+	if path != "" {
+		err := q.load()
+		if err != nil {
+			return nil, errors.Wrap(err, "while loading enrollment queue")
+		}
+	}
+	return q, nil
+}
+
+func (q *Queue) load() error {
+	data, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var enrollments []Enrollment
+	err = json.Unmarshal(data, &enrollments)
+	if err != nil {
+		return err
+	}
+	q.replace(enrollments)
+	return nil
+}
+
+// must be called with the mutex held
+func (q *Queue) replace(enrollments []Enrollment) {
+	q.enrollments = map[string]*Enrollment{}
+	for _, enrollment := range enrollments {
+		loaded := enrollment
+		q.enrollments[enrollment.ID] = &loaded
+	}
+}
+
+// saveWith persists the queue as it would be with updated recorded in it, replacing any enrollment with the same ID,
+// so that the change is only made in memory once it has been saved. Must be called with the mutex held.
+func (q *Queue) saveWith(updated Enrollment) error {
+	enrollments := q.list()
+	found := false
+	for i := range enrollments {
+		if enrollments[i].ID == updated.ID {
+			enrollments[i] = updated
+			found = true
+		}
+	}
+	if !found {
+		enrollments = append(enrollments, updated)
+	}
+	return q.write(enrollments)
+}
+
+func (q *Queue) write(enrollments []Enrollment) error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(enrollments, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = fileutil.EnsureIsFolder(path.Dir(q.path))
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(q.path, data, os.FileMode(0600))
+}
+
+// must be called with the mutex held
+func (q *Queue) list() []Enrollment {
+	enrollments := make([]Enrollment, 0, len(q.enrollments))
+	for _, enrollment := range q.enrollments {
+		enrollments = append(enrollments, *enrollment)
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		if !enrollments[i].Submitted.Equal(enrollments[j].Submitted) {
+			return enrollments[i].Submitted.Before(enrollments[j].Submitted)
+		}
+		return enrollments[i].ID < enrollments[j].ID
+	})
+	return enrollments
+}
+
+// List returns a copy of every request, in the order they were submitted.
+func (q *Queue) List() []Enrollment {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.list()
+}
+
+// Replace discards every request, and replaces them with the listed requests, such as when copying them from another
+// keyserver.
+func (q *Queue) Replace(enrollments []Enrollment) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	err := q.write(enrollments)
+	if err != nil {
+		return err
+	}
+	q.replace(enrollments)
+	return nil
+}
+
+// Approved lists the requests that have been approved, in the order they were submitted.
+func (q *Queue) Approved() []Request {
+	var requests []Request
+	for _, enrollment := range q.List() {
+		if enrollment.State == Approved {
+			requests = append(requests, enrollment.Request)
+		}
+	}
+	return requests
+}
+
+func generateID() (string, error) {
+	out := make([]byte, 12)
+	_, err := rand.Read(out)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// Submit adds a new request to the queue, and returns its ID.
+func (q *Queue) Submit(request Request) (string, error) {
+	err := request.Validate()
+	if err != nil {
+		return "", err
+	}
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	pending := 0
+	for _, enrollment := range q.enrollments {
+		if enrollment.State == Pending {
+			pending++
+		}
+	}
+	if pending >= MaxPending {
+		return "", errors.New("too many pending enrollment requests")
+	}
+	enrollment := Enrollment{
+		ID:        id,
+		Request:   request,
+		Submitted: clock.Now(q.clock),
+		State:     Pending,
+	}
+	err = q.saveWith(enrollment)
+	if err != nil {
+		return "", err
+	}
+	q.enrollments[id] = &enrollment
+	return id, nil
+}
+
+// Status reports on a request to the machine that submitted it.
+func (q *Queue) Status(id string) (*Status, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	enrollment, found := q.enrollments[id]
+	if !found {
+		return nil, fmt.Errorf("no such enrollment request %s", id)
+	}
+	return &Status{State: enrollment.State, Certificate: enrollment.Certificate}, nil
+}
+
+// must be called with the mutex held
+func (q *Queue) pending(id string) (*Enrollment, error) {
+	enrollment, found := q.enrollments[id]
+	if !found {
+		return nil, fmt.Errorf("no such enrollment request %s", id)
+	}
+	if enrollment.State != Pending {
+		return nil, fmt.Errorf("enrollment request %s was already %s", id, enrollment.State)
+	}
+	return enrollment, nil
+}
+
+// Approve admits the node described by a pending request, on behalf of the administrator admin.
+func (q *Queue) Approve(id string, admin string) (*Enrollment, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	enrollment, err := q.pending(id)
+	if err != nil {
+		return nil, err
+	}
+	if q.Admit == nil {
+		return nil, errors.New("no way to admit nodes has been configured")
+	}
+	certificate, err := q.Admit(enrollment.Request)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while admitting %s", enrollment.Request.Hostname)
+	}
+	now := clock.Now(q.clock)
+	approved := *enrollment
+	approved.State = Approved
+	approved.DecidedBy = admin
+	approved.Decided = &now
+	approved.Certificate = certificate
+	err = q.saveWith(approved)
+	if err != nil {
+		// the node has been admitted, but only until the keyserver restarts, after which the request is still pending
+		return nil, errors.Wrapf(err, "while recording approval of %s", enrollment.Request.Hostname)
+	}
+	*enrollment = approved
+	return &approved, nil
+}
+
+// Deny rejects a pending request, on behalf of the administrator admin.
+func (q *Queue) Deny(id string, admin string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	enrollment, err := q.pending(id)
+	if err != nil {
+		return err
+	}
+	now := clock.Now(q.clock)
+	denied := *enrollment
+	denied.State = Denied
+	denied.DecidedBy = admin
+	denied.Decided = &now
+	err = q.saveWith(denied)
+	if err != nil {
+		return err
+	}
+	*enrollment = denied
+	return nil
+}
@@ -0,0 +1,281 @@
+package enrollment
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+var start = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+var sampleRequest = Request{
+	Hostname:           "worker9",
+	IP:                 "10.0.0.9",
+	Kind:               "worker",
+	CSR:                "csr",
+	HostKeyFingerprint: "SHA256:abc",
+}
+
+func TestSubmit_Invalid(t *testing.T) {
+	q, err := NewQueue("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := sampleRequest
+	request.IP = "10.0.0"
+	_, err = q.Submit(request)
+	testutil.CheckError(t, err, "could not parse IP in enrollment request: 10.0.0")
+	request = sampleRequest
+	request.HostKeyFingerprint = ""
+	_, err = q.Submit(request)
+	testutil.CheckError(t, err, "missing a host key fingerprint")
+	if len(q.List()) != 0 {
+		t.Error("invalid requests were queued")
+	}
+}
+
+func TestApprove(t *testing.T) {
+	q, err := NewQueue("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var admitted []Request
+	q.Admit = func(request Request) (string, error) {
+		admitted = append(admitted, request)
+		return "cert", nil
+	}
+	id, err := q.Submit(sampleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := q.Status(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Pending || status.Certificate != "" {
+		t.Errorf("unexpected status before approval: %+v", status)
+	}
+	enrollment, err := q.Approve(id, "admin@EXAMPLE.COM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admitted) != 1 || admitted[0] != sampleRequest {
+		t.Errorf("wrong admissions: %+v", admitted)
+	}
+	if enrollment.DecidedBy != "admin@EXAMPLE.COM" || enrollment.Decided == nil || !enrollment.Decided.Equal(start) {
+		t.Errorf("wrong record of decision: %+v", enrollment)
+	}
+	status, err = q.Status(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Approved || status.Certificate != "cert" {
+		t.Errorf("unexpected status after approval: %+v", status)
+	}
+	_, err = q.Approve(id, "admin@EXAMPLE.COM")
+	testutil.CheckError(t, err, "enrollment request "+id+" was already approved")
+	if len(admitted) != 1 {
+		t.Error("node admitted twice")
+	}
+}
+
+func TestApprove_Failed(t *testing.T) {
+	q, err := NewQueue("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Admit = func(request Request) (string, error) {
+		return "", errors.New("hostname already in use")
+	}
+	id, err := q.Submit(sampleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.Approve(id, "admin@EXAMPLE.COM")
+	testutil.CheckError(t, err, "while admitting worker9: hostname already in use")
+	// the request can still be denied
+	status, err := q.Status(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Pending {
+		t.Errorf("request no longer pending after failed approval: %s", status.State)
+	}
+}
+
+func TestApprove_SaveFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrollment-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := NewQueue(path.Join(dir, "enrollments.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Admit = func(request Request) (string, error) {
+		return "cert", nil
+	}
+	id, err := q.Submit(sampleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the queue can no longer be saved, because its directory is a file
+	blocker := path.Join(dir, "blocker")
+	if err := ioutil.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	q.path = path.Join(blocker, "enrollments.json")
+	_, err = q.Approve(id, "admin@EXAMPLE.COM")
+	testutil.CheckError(t, err, "while recording approval of worker9")
+	testutil.CheckError(t, q.Deny(id, "admin@EXAMPLE.COM"), "not a directory")
+	_, err = q.Submit(sampleRequest)
+	testutil.CheckError(t, err, "not a directory")
+	// nothing changed in memory that wasn't saved
+	enrollments := q.List()
+	if len(enrollments) != 1 || enrollments[0].State != Pending || enrollments[0].Certificate != "" || enrollments[0].Decided != nil {
+		t.Errorf("unsaved changes kept in memory: %+v", enrollments)
+	}
+}
+
+func TestDeny(t *testing.T) {
+	q, err := NewQueue("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Admit = func(request Request) (string, error) {
+		t.Error("denied request was admitted")
+		return "", nil
+	}
+	id, err := q.Submit(sampleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Deny(id, "admin@EXAMPLE.COM"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.Approve(id, "admin@EXAMPLE.COM")
+	testutil.CheckError(t, err, "enrollment request "+id+" was already denied")
+	testutil.CheckError(t, q.Deny("nonexistent", "admin@EXAMPLE.COM"), "no such enrollment request nonexistent")
+	status, err := q.Status(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != Denied {
+		t.Errorf("wrong state after denial: %s", status.State)
+	}
+}
+
+func TestSubmit_Limit(t *testing.T) {
+	q, err := NewQueue("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	for i := 0; i < MaxPending; i++ {
+		last, err = q.Submit(sampleRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = q.Submit(sampleRequest)
+	testutil.CheckError(t, err, "too many pending enrollment requests")
+	// decided requests no longer count against the limit
+	if err := q.Deny(last, "admin@EXAMPLE.COM"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Submit(sampleRequest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrollment-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	qpath := path.Join(dir, "state", "enrollments.json")
+
+	fake := clock.NewFake(start)
+	q, err := NewQueue(qpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Admit = func(request Request) (string, error) {
+		return "cert", nil
+	}
+	approved, err := q.Submit(sampleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(time.Minute)
+	other := sampleRequest
+	other.Hostname = "worker10"
+	pending, err := q.Submit(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Approve(approved, "admin@EXAMPLE.COM"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewQueue(qpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollments := reloaded.List()
+	if len(enrollments) != 2 || enrollments[0].ID != approved || enrollments[1].ID != pending {
+		t.Fatalf("wrong enrollments after reload: %+v", enrollments)
+	}
+	if requests := reloaded.Approved(); len(requests) != 1 || requests[0] != sampleRequest {
+		t.Errorf("wrong approved requests after reload: %+v", requests)
+	}
+	status, err := reloaded.Status(approved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Certificate != "cert" {
+		t.Error("certificate not persisted")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	leader, err := NewQueue("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := leader.Submit(sampleRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := NewQueue("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sampleRequest
+	other.Hostname = "worker10"
+	if _, err := follower.Submit(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Replace(leader.List()); err != nil {
+		t.Fatal(err)
+	}
+	enrollments := follower.List()
+	if len(enrollments) != 1 || enrollments[0].ID != id || enrollments[0].Request != sampleRequest {
+		t.Fatalf("wrong enrollments after replacing: %+v", enrollments)
+	}
+	// the copy is independent of the original
+	if err := follower.Deny(id, "admin@EXAMPLE.COM"); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := leader.Status(id); err != nil || status.State != Pending {
+		t.Errorf("original request changed: %+v, %v", status, err)
+	}
+}
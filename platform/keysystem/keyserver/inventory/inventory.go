@@ -0,0 +1,195 @@
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+)
+
+// Certificate is a single certificate managed by a node's keyclient.
+type Certificate struct {
+	Path    string    `json:"path"`
+	Serial  string    `json:"serial"`
+	Expires time.Time `json:"expires"`
+}
+
+// Report is what a keyclient sends to the keyserver when it checks in.
+type Report struct {
+	Version      string        `json:"version"`
+	Time         time.Time     `json:"time"`
+	Certificates []Certificate `json:"certificates"`
+	Blocked      []string      `json:"blocked,omitempty"`
+}
+
+// Node is the inventory's record of a single node. Nodes that have never checked in have no report.
+type Node struct {
+	Principal string     `json:"principal"`
+	LastSeen  *time.Time `json:"last-seen,omitempty"`
+	// how far the node's clock was behind the keyserver's when it last checked in; negative if it was ahead
+	ClockSkew time.Duration `json:"clock-skew,omitempty"`
+	Report    *Report       `json:"report,omitempty"`
+}
+
+// Inventory keeps track of the last check-in from each node in the cluster.
+type Inventory struct {
+	mutex sync.Mutex
+	nodes map[string]*Node
+	// where to persist the inventory across keyserver restarts; empty to only keep it in memory
+	path  string
+	clock clock.Clock
+}
+
+// NewInventory creates an inventory for the listed principals, which are the only ones that may check in. If path is not
+// empty, the inventory is loaded from path, if it exists, and saved there after every check-in.
+func NewInventory(principals []string, path string, clk clock.Clock) (*Inventory, error) {
+	inv := &Inventory{nodes: map[string]*Node{}, path: path, clock: clk}
+	for _, principal := range principals {
+		inv.nodes[principal] = &Node{Principal: principal}
+	}
+	if path != "" {
+		err := inv.load()
+		if err != nil {
+			return nil, errors.Wrap(err, "while loading inventory")
+		}
+	}
+	return inv, nil
+}
+
+func (inv *Inventory) load() error {
+	data, err := ioutil.ReadFile(inv.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var nodes []Node
+	err = json.Unmarshal(data, &nodes)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		// nodes that have been removed from the cluster are dropped
+		if _, found := inv.nodes[node.Principal]; found {
+			loaded := node
+			inv.nodes[node.Principal] = &loaded
+		}
+	}
+	return nil
+}
+
+// must be called with the mutex held
+func (inv *Inventory) save() error {
+	if inv.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(inv.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	err = fileutil.EnsureIsFolder(path.Dir(inv.path))
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(inv.path, data, os.FileMode(0600))
+}
+
+// ParseReport decodes and validates a report sent by a keyclient.
+func ParseReport(data string) (*Report, error) {
+	report := &Report{}
+	err := json.Unmarshal([]byte(data), report)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding check-in report")
+	}
+	if report.Time.IsZero() {
+		return nil, errors.New("check-in report is missing the node's time")
+	}
+	for _, cert := range report.Certificates {
+		if cert.Path == "" {
+			return nil, errors.New("check-in report includes a certificate without a path")
+		}
+	}
+	return report, nil
+}
+
+// Add allows a new principal to check in, such as for a node that enrolled while the keyserver was running.
+func (inv *Inventory) Add(principal string) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	if _, found := inv.nodes[principal]; !found {
+		inv.nodes[principal] = &Node{Principal: principal}
+	}
+}
+
+// Remove stops keeping track of a principal, such as for a node that was decommissioned, and returns its last record.
+func (inv *Inventory) Remove(principal string) (*Node, error) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	node, found := inv.nodes[principal]
+	if !found {
+		return nil, fmt.Errorf("principal %s is not part of the inventory", principal)
+	}
+	delete(inv.nodes, principal)
+	return node, inv.save()
+}
+
+// Record stores a report from a node, along with when it was received.
+func (inv *Inventory) Record(principal string, report *Report) error {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	node, found := inv.nodes[principal]
+	if !found {
+		return fmt.Errorf("principal %s is not part of the inventory", principal)
+	}
+	now := clock.Now(inv.clock)
+	node.LastSeen = &now
+	node.ClockSkew = now.Sub(report.Time)
+	node.Report = report
+	return inv.save()
+}
+
+// must be called with the mutex held
+func (inv *Inventory) snapshot() []Node {
+	nodes := make([]Node, 0, len(inv.nodes))
+	for _, node := range inv.nodes {
+		nodes = append(nodes, *node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Principal < nodes[j].Principal
+	})
+	return nodes
+}
+
+// Snapshot returns a copy of the record of every node, sorted by principal.
+func (inv *Inventory) Snapshot() []Node {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+	return inv.snapshot()
+}
+
+// Now returns the current time according to the inventory's clock.
+func (inv *Inventory) Now() time.Time {
+	return clock.Now(inv.clock)
+}
+
+// Stale lists the certificates in a node's last report that have expired, or will expire within margin, as of now.
+func (n Node) Stale(now time.Time, margin time.Duration) []Certificate {
+	if n.Report == nil {
+		return nil
+	}
+	var stale []Certificate
+	for _, cert := range n.Report.Certificates {
+		if cert.Expires.Before(now.Add(margin)) {
+			stale = append(stale, cert)
+		}
+	}
+	return stale
+}
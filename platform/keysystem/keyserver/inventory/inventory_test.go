@@ -0,0 +1,193 @@
+package inventory
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+var start = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestParseReport(t *testing.T) {
+	report, err := ParseReport(`{"version": "v1", "time": "2019-01-02T03:04:00Z", "certificates": [{"path": "/etc/a.pem", "serial": "1f", "expires": "2019-02-01T00:00:00Z"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Version != "v1" || !report.Time.Equal(start.Add(-5*time.Second)) {
+		t.Error("wrong report fields")
+	}
+	if len(report.Certificates) != 1 || report.Certificates[0].Serial != "1f" {
+		t.Error("wrong certificates")
+	}
+}
+
+func TestParseReport_Invalid(t *testing.T) {
+	_, err := ParseReport("not json")
+	testutil.CheckError(t, err, "while decoding check-in report")
+	_, err = ParseReport(`{"version": "v1"}`)
+	testutil.CheckError(t, err, "missing the node's time")
+	_, err = ParseReport(`{"time": "2019-01-02T03:04:00Z", "certificates": [{"serial": "1f"}]}`)
+	testutil.CheckError(t, err, "certificate without a path")
+}
+
+func TestRecord(t *testing.T) {
+	fake := clock.NewFake(start)
+	inv, err := NewInventory([]string{"b.example.com", "a.example.com"}, "", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inv.Record("a.example.com", &Report{Version: "v1", Time: start.Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := inv.Snapshot()
+	if len(nodes) != 2 || nodes[0].Principal != "a.example.com" || nodes[1].Principal != "b.example.com" {
+		t.Fatal("wrong nodes in inventory")
+	}
+	if nodes[0].LastSeen == nil || !nodes[0].LastSeen.Equal(start) || nodes[0].ClockSkew != time.Minute {
+		t.Error("wrong record of check-in")
+	}
+	if nodes[1].LastSeen != nil || nodes[1].Report != nil {
+		t.Error("expected no record for node that hasn't checked in")
+	}
+}
+
+func TestRecord_Unknown(t *testing.T) {
+	inv, err := NewInventory([]string{"a.example.com"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inv.Record("c.example.com", &Report{Time: start})
+	testutil.CheckError(t, err, "principal c.example.com is not part of the inventory")
+}
+
+func TestAdd(t *testing.T) {
+	inv, err := NewInventory([]string{"a.example.com"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.Add("c.example.com")
+	if err := inv.Record("c.example.com", &Report{Time: start}); err != nil {
+		t.Fatal(err)
+	}
+	// adding an existing principal keeps its record
+	inv.Add("c.example.com")
+	nodes := inv.Snapshot()
+	if len(nodes) != 2 || nodes[1].Principal != "c.example.com" || nodes[1].Report == nil {
+		t.Errorf("wrong nodes in inventory: %+v", nodes)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	inv, err := NewInventory([]string{"a.example.com", "b.example.com"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &Report{Time: start, Certificates: []Certificate{{Path: "/etc/homeworld/keys/keygrant.pem", Serial: "1f"}}}
+	if err := inv.Record("b.example.com", report); err != nil {
+		t.Fatal(err)
+	}
+	node, err := inv.Remove("b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Report != report {
+		t.Error("last report not returned")
+	}
+	if nodes := inv.Snapshot(); len(nodes) != 1 || nodes[0].Principal != "a.example.com" {
+		t.Errorf("wrong nodes in inventory: %+v", nodes)
+	}
+	err = inv.Record("b.example.com", report)
+	testutil.CheckError(t, err, "principal b.example.com is not part of the inventory")
+	_, err = inv.Remove("b.example.com")
+	testutil.CheckError(t, err, "principal b.example.com is not part of the inventory")
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	invpath := path.Join(dir, "state", "inventory.json")
+
+	fake := clock.NewFake(start)
+	inv, err := NewInventory([]string{"a.example.com", "b.example.com"}, invpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, principal := range []string{"a.example.com", "b.example.com"} {
+		err = inv.Record(principal, &Report{Version: "v1", Time: start})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b has been removed from the cluster, and c has been added
+	reloaded, err := NewInventory([]string{"a.example.com", "c.example.com"}, invpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := reloaded.Snapshot()
+	if len(nodes) != 2 || nodes[0].Principal != "a.example.com" || nodes[1].Principal != "c.example.com" {
+		t.Fatal("wrong nodes in reloaded inventory")
+	}
+	if nodes[0].Report == nil || nodes[0].Report.Version != "v1" || !nodes[0].LastSeen.Equal(start) {
+		t.Error("check-in not preserved")
+	}
+	if nodes[1].LastSeen != nil {
+		t.Error("unexpected check-in for new node")
+	}
+}
+
+func TestStale(t *testing.T) {
+	node := Node{Report: &Report{Certificates: []Certificate{
+		{Path: "/expired.pem", Expires: start.Add(-time.Hour)},
+		{Path: "/expiring.pem", Expires: start.Add(time.Hour)},
+		{Path: "/fresh.pem", Expires: start.Add(30 * 24 * time.Hour)},
+	}}}
+	stale := node.Stale(start, StaleMargin)
+	if len(stale) != 2 || stale[0].Path != "/expired.pem" || stale[1].Path != "/expiring.pem" {
+		t.Errorf("wrong stale certificates: %v", stale)
+	}
+	if len(Node{}.Stale(start, StaleMargin)) != 0 {
+		t.Error("expected no stale certificates without a report")
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	fake := clock.NewFake(start)
+	inv, err := NewInventory([]string{"a.example.com", "b.example.com"}, "", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inv.Record("a.example.com", &Report{
+		Time:         start,
+		Certificates: []Certificate{{Path: "/expired.pem", Expires: start.Add(-time.Hour)}},
+		Blocked:      []string{"waiting"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	MetricsHandler(inv).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expect := range []string{
+		`keysystem_keyserver_node_checked_in{node="a.example.com"} 1`,
+		`keysystem_keyserver_node_checked_in{node="b.example.com"} 0`,
+		`keysystem_keyserver_node_stale_certs{node="a.example.com"} 1`,
+		`keysystem_keyserver_node_blocked_actions{node="a.example.com"} 1`,
+		`keysystem_keyserver_nodes_never_checked_in 1`,
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("expected metrics to include %s", expect)
+		}
+	}
+}
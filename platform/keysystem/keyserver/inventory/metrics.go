@@ -0,0 +1,92 @@
+package inventory
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// keyclients renew certificates at least a day before they expire, so a certificate this close to expiring means that
+// its node has stopped renewing it
+const StaleMargin = 12 * time.Hour
+
+var (
+	lastSeenDesc = prometheus.NewDesc(
+		"keysystem_keyserver_node_last_seen_timestamp_seconds",
+		"Time at which a node last checked in with the keyserver",
+		[]string{"node"}, nil,
+	)
+	checkedInDesc = prometheus.NewDesc(
+		"keysystem_keyserver_node_checked_in",
+		"Whether a node has ever checked in with the keyserver",
+		[]string{"node"}, nil,
+	)
+	clockSkewDesc = prometheus.NewDesc(
+		"keysystem_keyserver_node_clock_skew_seconds",
+		"How far a node's clock was behind the keyserver's when it last checked in",
+		[]string{"node"}, nil,
+	)
+	certExpiryDesc = prometheus.NewDesc(
+		"keysystem_keyserver_node_cert_expiry_timestamp_seconds",
+		"Time at which a certificate reported by a node expires",
+		[]string{"node", "path"}, nil,
+	)
+	staleCertsDesc = prometheus.NewDesc(
+		"keysystem_keyserver_node_stale_certs",
+		"Number of certificates reported by a node that have expired or are about to expire",
+		[]string{"node"}, nil,
+	)
+	blockedDesc = prometheus.NewDesc(
+		"keysystem_keyserver_node_blocked_actions",
+		"Number of keyclient actions that a node reported as blocked",
+		[]string{"node"}, nil,
+	)
+	neverSeenDesc = prometheus.NewDesc(
+		"keysystem_keyserver_nodes_never_checked_in",
+		"Number of nodes that have never checked in, which usually means that they were never bootstrapped",
+		nil, nil,
+	)
+)
+
+type collector struct {
+	inventory *Inventory
+}
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastSeenDesc
+	ch <- checkedInDesc
+	ch <- clockSkewDesc
+	ch <- certExpiryDesc
+	ch <- staleCertsDesc
+	ch <- blockedDesc
+	ch <- neverSeenDesc
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	now := c.inventory.Now()
+	neverSeen := 0
+	for _, node := range c.inventory.Snapshot() {
+		if node.LastSeen == nil {
+			neverSeen++
+			ch <- prometheus.MustNewConstMetric(checkedInDesc, prometheus.GaugeValue, 0, node.Principal)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(checkedInDesc, prometheus.GaugeValue, 1, node.Principal)
+		ch <- prometheus.MustNewConstMetric(lastSeenDesc, prometheus.GaugeValue, float64(node.LastSeen.Unix()), node.Principal)
+		ch <- prometheus.MustNewConstMetric(clockSkewDesc, prometheus.GaugeValue, node.ClockSkew.Seconds(), node.Principal)
+		ch <- prometheus.MustNewConstMetric(staleCertsDesc, prometheus.GaugeValue, float64(len(node.Stale(now, StaleMargin))), node.Principal)
+		ch <- prometheus.MustNewConstMetric(blockedDesc, prometheus.GaugeValue, float64(len(node.Report.Blocked)), node.Principal)
+		for _, cert := range node.Report.Certificates {
+			ch <- prometheus.MustNewConstMetric(certExpiryDesc, prometheus.GaugeValue, float64(cert.Expires.Unix()), node.Principal, cert.Path)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(neverSeenDesc, prometheus.GaugeValue, float64(neverSeen))
+}
+
+// MetricsHandler exports the inventory to prometheus.
+func MetricsHandler(inv *Inventory) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector{inventory: inv})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
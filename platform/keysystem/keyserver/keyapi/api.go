@@ -3,6 +3,7 @@ package keyapi
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"io/ioutil"
@@ -13,8 +14,14 @@ import (
 
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/account"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/inventory"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/operation"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/reenroll"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/verifier"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/util/clock"
 	"github.com/sipb/homeworld/platform/util/csrutil"
 	"github.com/sipb/homeworld/platform/util/netutil"
 )
@@ -22,9 +29,16 @@ import (
 type Keyserver interface {
 	HandleAPIRequest(writer http.ResponseWriter, request *http.Request) error
 	HandlePubRequest(writer http.ResponseWriter, authorityName string) error
+	HandleRotationRequest(writer http.ResponseWriter, authorityName string) error
 	HandleStaticRequest(writer http.ResponseWriter, staticName string) error
+	HandleMetricsRequest(writer http.ResponseWriter, request *http.Request) error
+	HandleReenrollChallenge(writer http.ResponseWriter, principal string) error
+	HandleReenrollRequest(writer http.ResponseWriter, request *http.Request) error
+	HandleEnrollRequest(writer http.ResponseWriter, request *http.Request) error
+	HandleEnrollStatus(writer http.ResponseWriter, id string) error
 	GetClientCAs() *x509.CertPool
 	GetValidServerCert(_ *tls.ClientHelloInfo) (*tls.Certificate, error)
+	GetCertBackdate() time.Duration
 }
 
 type ConfiguredKeyserver struct {
@@ -47,7 +61,27 @@ func verifyAccountIP(account *account.Account, request *http.Request) error {
 	return nil
 }
 
+func verifyNotRevoked(context *config.Context, principal string, request *http.Request) error {
+	if context.Revocations == nil {
+		return nil
+	}
+	if context.Revocations.IsDecommissioned(principal) {
+		return fmt.Errorf("principal has been decommissioned: %s", principal)
+	}
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 && len(request.TLS.VerifiedChains[0]) > 0 {
+		serial := request.TLS.VerifiedChains[0][0].SerialNumber.Text(16)
+		if context.Revocations.IsRevoked(serial) {
+			return fmt.Errorf("certificate %s for %s has been revoked", serial, principal)
+		}
+	}
+	return nil
+}
+
 func attemptAuthentication(context *config.Context, request *http.Request) (*account.Account, error) {
+	if context.Follower != nil && context.TokenVerifier.HasAttempt(request) {
+		// the leader would not find out that a token was claimed here until the next copy, and could accept it again
+		return nil, fmt.Errorf("bootstrap tokens can only be claimed at the leader keyserver at %s", context.Follower.Leader)
+	}
 	verifiers := []verifier.Verifier{context.TokenVerifier, context.AuthenticationAuthority}
 
 	for _, verif := range verifiers {
@@ -56,6 +90,10 @@ func attemptAuthentication(context *config.Context, request *http.Request) (*acc
 			if err != nil {
 				return nil, err
 			}
+			err = verifyNotRevoked(context, principal, request)
+			if err != nil {
+				return nil, err
+			}
 			ac, err := context.GetAccount(principal)
 			if err != nil {
 				return nil, err
@@ -77,6 +115,10 @@ func (k *ConfiguredKeyserver) GetClientCAs() *x509.CertPool {
 	return k.Context.AuthenticationAuthority.ToCertPool()
 }
 
+func (k *ConfiguredKeyserver) GetCertBackdate() time.Duration {
+	return k.Context.CertBackdate
+}
+
 const RenewalMargin = time.Minute * 5
 const ValidityInterval = time.Hour * 24
 
@@ -84,7 +126,7 @@ func (k *ConfiguredKeyserver) GetValidServerCert(_ *tls.ClientHelloInfo) (*tls.C
 	k.CertLock.Lock()
 	defer k.CertLock.Unlock()
 
-	if k.ServerCert != nil && time.Now().Add(RenewalMargin).Before(k.ServerCert.Leaf.NotAfter) {
+	if k.ServerCert != nil && clock.Now(k.Context.Clock).Add(RenewalMargin).Before(k.ServerCert.Leaf.NotAfter) {
 		// we still have a valid certificate, so use that
 		return k.ServerCert, nil
 	}
@@ -137,6 +179,19 @@ func (k *ConfiguredKeyserver) HandlePubRequest(writer http.ResponseWriter, autho
 	return err
 }
 
+// HandleRotationRequest lists the records of past replacements of an authority, which may be empty.
+func (k *ConfiguredKeyserver) HandleRotationRequest(writer http.ResponseWriter, authorityName string) error {
+	if k.Context.Authorities[authorityName] == nil {
+		return fmt.Errorf("no such authority %s", authorityName)
+	}
+	data, err := rotation.Encode(k.Context.Rotations[authorityName])
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
 func (k *ConfiguredKeyserver) HandleStaticRequest(writer http.ResponseWriter, staticName string) error {
 	file, found := k.Context.StaticFiles[staticName]
 	if !found || file.Filepath == "" {
@@ -149,3 +204,137 @@ func (k *ConfiguredKeyserver) HandleStaticRequest(writer http.ResponseWriter, st
 	_, err = writer.Write(contents)
 	return err
 }
+
+// HandleMetricsRequest exports the inventory of node check-ins to prometheus, which must authenticate with a client
+// certificate for an account that may scrape metrics.
+func (k *ConfiguredKeyserver) HandleMetricsRequest(writer http.ResponseWriter, request *http.Request) error {
+	if k.Context.Inventory == nil {
+		return errors.New("no inventory of nodes is kept by this keyserver")
+	}
+	if k.Context.TokenVerifier.HasAttempt(request) || k.Context.AuthenticationAuthority == nil ||
+		!k.Context.AuthenticationAuthority.HasAttempt(request) {
+		return errors.New("metrics can only be scraped with a client certificate")
+	}
+	ac, err := attemptAuthentication(k.Context, request)
+	if err != nil {
+		return err
+	}
+	// checked directly instead of invoked, so that each scrape doesn't fill the logs
+	if _, found := ac.Privileges[worldconfig.ScrapeMetricsAPI]; !found {
+		return &operation.OperationForbiddenError{
+			Principal: ac.Principal,
+			API:       worldconfig.ScrapeMetricsAPI,
+		}
+	}
+	inventory.MetricsHandler(k.Context.Inventory).ServeHTTP(writer, request)
+	return nil
+}
+
+// HandleReenrollChallenge issues a challenge for the node with the account principal to sign in order to re-enroll.
+func (k *ConfiguredKeyserver) HandleReenrollChallenge(writer http.ResponseWriter, principal string) error {
+	if k.Context.Reenroller == nil {
+		return errors.New("re-enrollment is not enabled on this keyserver")
+	}
+	// only accounts get challenges, so that each challenge takes up space for an existing account
+	_, err := k.Context.GetAccount(principal)
+	if err != nil {
+		return err
+	}
+	challenge, err := k.Context.Reenroller.Challenge(principal)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write([]byte(challenge))
+	return err
+}
+
+// HandleReenrollRequest issues a new keygranting certificate to a node that proves possession of its SSH host key,
+// subject to the same restrictions as any other request from the node's account.
+func (k *ConfiguredKeyserver) HandleReenrollRequest(writer http.ResponseWriter, request *http.Request) error {
+	if k.Context.Reenroller == nil {
+		return errors.New("re-enrollment is not enabled on this keyserver")
+	}
+	requestBody, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+	rr := &reenroll.Request{}
+	err = json.Unmarshal(requestBody, rr)
+	if err != nil {
+		return errors.Wrap(err, "while decoding re-enrollment request")
+	}
+	err = k.Context.Reenroller.Verify(rr)
+	if err != nil {
+		return errors.Wrapf(err, "while verifying re-enrollment of %s", rr.Principal)
+	}
+	ac, err := k.Context.GetAccount(rr.Principal)
+	if err != nil {
+		return err
+	}
+	if ac.DisableDirectAuth {
+		return fmt.Errorf("account has disabled direct authentication: %s", rr.Principal)
+	}
+	err = verifyAccountIP(ac, request)
+	if err != nil {
+		return err
+	}
+	result, err := operation.InvokeAPIOperation(&account.OperationContext{Account: ac}, k.Context, k.Context.Reenroller.API, rr.CSR, k.Logger)
+	if err != nil {
+		return err
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(response)
+	return err
+}
+
+// HandleEnrollRequest queues a request from a new machine to join the cluster, and responds with the request's ID.
+func (k *ConfiguredKeyserver) HandleEnrollRequest(writer http.ResponseWriter, request *http.Request) error {
+	if k.Context.Enrollments == nil {
+		return errors.New("enrollment is not enabled on this keyserver")
+	}
+	if k.Context.Follower != nil {
+		// the request would be discarded the next time that the leader's state is copied
+		return fmt.Errorf("enrollment requests must be submitted to the leader keyserver at %s", k.Context.Follower.Leader)
+	}
+	requestBody, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+	er := enrollment.Request{}
+	err = json.Unmarshal(requestBody, &er)
+	if err != nil {
+		return errors.Wrap(err, "while decoding enrollment request")
+	}
+	id, err := k.Context.Enrollments.Submit(er)
+	if err != nil {
+		return errors.Wrapf(err, "while submitting enrollment request for %s", er.Hostname)
+	}
+	k.Logger.Printf("Queued enrollment request %s for %s (%s) with host key %s", id, er.Hostname, er.IP, er.HostKeyFingerprint)
+	response, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(response)
+	return err
+}
+
+// HandleEnrollStatus reports whether an enrollment request has been decided, along with the keygranting certificate
+// issued if it was approved.
+func (k *ConfiguredKeyserver) HandleEnrollStatus(writer http.ResponseWriter, id string) error {
+	if k.Context.Enrollments == nil {
+		return errors.New("enrollment is not enabled on this keyserver")
+	}
+	status, err := k.Context.Enrollments.Status(id)
+	if err != nil {
+		return err
+	}
+	response, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(response)
+	return err
+}
@@ -17,7 +17,13 @@ import (
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/account"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/inventory"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/operation"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/replication"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/revocation"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/verifier"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
 	"github.com/sipb/homeworld/platform/util/testkeyutil"
 	"github.com/sipb/homeworld/platform/util/wraputil"
 )
@@ -96,7 +102,7 @@ func TestAttemptAuthentication_NoAuthentication(t *testing.T) {
 	_, err = attemptAuthentication(&gctx, request)
 	if err == nil {
 		t.Error("Expected error")
-	} else if !strings.Contains(err.Error(), "No authentication method") {
+	} else if !strings.Contains(err.Error(), "no authentication method") {
 		t.Error("Wrong error.")
 	}
 }
@@ -142,7 +148,7 @@ func TestAttemptAuthentication_TokenAuth_Fail(t *testing.T) {
 	_, err = attemptAuthentication(&gctx, request)
 	if err == nil {
 		t.Error("Expected error.")
-	} else if !strings.Contains(err.Error(), "Unrecognized token") {
+	} else if !strings.Contains(err.Error(), "unrecognized token") {
 		t.Errorf("Wrong error: %s", err.Error())
 	}
 }
@@ -163,7 +169,7 @@ func TestAttemptAuthentication_MissingAccount_Token(t *testing.T) {
 	_, err = attemptAuthentication(&gctx, request)
 	if err == nil {
 		t.Error("Expected error.")
-	} else if !strings.Contains(err.Error(), "Cannot find account") {
+	} else if !strings.Contains(err.Error(), "cannot find account") {
 		t.Errorf("Wrong error: %s", err)
 	}
 }
@@ -220,7 +226,7 @@ const (
 )
 
 func prepCertAuth(t *testing.T, gctx *config.Context) *http.Request {
-	certstr, err := gctx.AuthenticationAuthority.Sign(TLS_CLIENT_CSR, false, time.Minute, "test-user", []string{})
+	certstr, err := gctx.AuthenticationAuthority.Sign(TLS_CLIENT_CSR, false, time.Minute, "test-user", []string{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -268,7 +274,7 @@ func TestAttemptAuthentication_MissingAccount_Cert(t *testing.T) {
 	_, err = attemptAuthentication(&gctx, prepCertAuth(t, &gctx))
 	if err == nil {
 		t.Error("Expected error.")
-	} else if !strings.Contains(err.Error(), "Cannot find account") {
+	} else if !strings.Contains(err.Error(), "cannot find account") {
 		t.Errorf("Wrong error: %s", err)
 	}
 }
@@ -317,6 +323,91 @@ func TestAttemptAuthentication_InvalidIP_Cert(t *testing.T) {
 	}
 }
 
+func TestAttemptAuthentication_Revoked_Cert(t *testing.T) {
+	keydata, _, certdata := testkeyutil.GenerateTLSRootPEMsForTests(t, "test-ca", nil, nil)
+	authority, err := authorities.LoadTLSAuthority(keydata, certdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations, err := revocation.NewRevocations("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gctx := config.Context{
+		TokenVerifier:           verifier.NewTokenVerifier(),
+		AuthenticationAuthority: authority.(*authorities.TLSAuthority),
+		Accounts: map[string]*account.Account{
+			"test-user": {Principal: "test-user"},
+		},
+		Revocations: revocations,
+	}
+	request := prepCertAuth(t, &gctx)
+	if _, err := attemptAuthentication(&gctx, request); err != nil {
+		t.Fatal(err)
+	}
+	cert := request.TLS.VerifiedChains[0][0]
+	_, err = revocations.Decommission("other-user", []revocation.Certificate{{Serial: cert.SerialNumber.Text(16), Expires: cert.NotAfter}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = attemptAuthentication(&gctx, request)
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "has been revoked") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestAttemptAuthentication_Follower_Token(t *testing.T) {
+	gctx := config.Context{
+		TokenVerifier: verifier.NewTokenVerifier(),
+		Accounts: map[string]*account.Account{
+			"test-user": {Principal: "test-user"},
+		},
+		Follower: &replication.Follower{Leader: "leader.example.com:20557"},
+	}
+	tok := gctx.TokenVerifier.Registry.GrantToken("test-user", time.Minute)
+	request := httptest.NewRequest("GET", "/test", nil)
+	request.Header.Set(verifier.TokenHeader, tok)
+	_, err := attemptAuthentication(&gctx, request)
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "only be claimed at the leader keyserver at leader.example.com:20557") {
+		t.Errorf("Wrong error: %s", err)
+	}
+	// the token is left for the leader to accept
+	if scoped, err := gctx.TokenVerifier.Registry.LookupToken(tok); err != nil {
+		t.Error(err)
+	} else if scoped.IsClaimed() {
+		t.Error("token claimed by follower")
+	}
+}
+
+func TestAttemptAuthentication_Decommissioned_Token(t *testing.T) {
+	revocations, err := revocation.NewRevocations("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gctx := config.Context{
+		TokenVerifier: verifier.NewTokenVerifier(),
+		Accounts: map[string]*account.Account{
+			"test-user": {Principal: "test-user"},
+		},
+		Revocations: revocations,
+	}
+	if _, err := revocations.Decommission("test-user", nil); err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("GET", "/test", nil)
+	request.Header.Set(verifier.TokenHeader, gctx.TokenVerifier.Registry.GrantToken("test-user", time.Minute))
+	_, err = attemptAuthentication(&gctx, request)
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "has been decommissioned") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
 func TestConfiguredKeyserver_GetClientCAs(t *testing.T) {
 	keydata, _, certdata := testkeyutil.GenerateTLSRootPEMsForTests(t, "test-ca", nil, nil)
 	authority, err := authorities.LoadTLSAuthority(keydata, certdata)
@@ -336,17 +427,27 @@ func TestConfiguredKeyserver_GetClientCAs(t *testing.T) {
 	}
 }
 
-func TestConfiguredKeyserver_GetServerCert(t *testing.T) {
+func TestConfiguredKeyserver_GetValidServerCert(t *testing.T) {
 	keydata, _, cdata := testkeyutil.GenerateTLSRootPEMsForTests(t, "test-ca", nil, nil)
 	authority, err := authorities.LoadTLSAuthority(keydata, cdata)
 	if err != nil {
 		t.Fatal(err)
 	}
-	ks := &ConfiguredKeyserver{ServerCert: authority.(*authorities.TLSAuthority).ToHTTPSCert()}
-	if len(ks.GetServerCert().Certificate) != 1 {
+	pair := authority.(*authorities.TLSAuthority).ToHTTPSCert()
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// still valid, so it is served without signing a new one
+	ks := &ConfiguredKeyserver{Context: &config.Context{}, ServerCert: &pair}
+	servercert, err := ks.GetValidServerCert(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servercert.Certificate) != 1 {
 		t.Fatal("Wrong number of certs")
 	}
-	certdata := ks.GetServerCert().Certificate[0]
+	certdata := servercert.Certificate[0]
 	refdata, err := wraputil.LoadSinglePEMBlock(cdata, []string{"CERTIFICATE"})
 	if err != nil {
 		t.Error(err)
@@ -357,7 +458,7 @@ func TestConfiguredKeyserver_GetServerCert(t *testing.T) {
 
 func TestConfiguredKeyserver_HandleStaticRequest(t *testing.T) {
 	ks := &ConfiguredKeyserver{Context: &config.Context{StaticFiles: map[string]config.StaticFile{
-		"testa.txt": {Filename: "testa.txt", Filepath: "../config/testdir/testa.txt"},
+		"testa.txt": {Filepath: "../config/testdir/testa.txt"},
 	}}}
 	recorder := httptest.NewRecorder()
 	err := ks.HandleStaticRequest(recorder, "testa.txt")
@@ -386,14 +487,14 @@ func TestConfiguredKeyserver_HandleStaticRequest_NonexistentEntry(t *testing.T)
 	err := ks.HandleStaticRequest(nil, "testa.txt")
 	if err == nil {
 		t.Error("Expected error.")
-	} else if !strings.Contains(err.Error(), "No such static file") {
+	} else if !strings.Contains(err.Error(), "no such static file") {
 		t.Error("Wrong error.")
 	}
 }
 
 func TestConfiguredKeyserver_HandleStaticRequest_NonexistentFile(t *testing.T) {
 	ks := &ConfiguredKeyserver{Context: &config.Context{StaticFiles: map[string]config.StaticFile{
-		"testa.txt": {Filename: "testa.txt", Filepath: "../config/testdir/nonexistent.txt"},
+		"testa.txt": {Filepath: "../config/testdir/nonexistent.txt"},
 	}}}
 	err := ks.HandleStaticRequest(nil, "testa.txt")
 	if err == nil {
@@ -408,7 +509,153 @@ func TestConfiguredKeyserver_HandlePubRequest_NoAuthority(t *testing.T) {
 	err := ks.HandlePubRequest(nil, "grant")
 	if err == nil {
 		t.Error("Expected error.")
-	} else if !strings.Contains(err.Error(), "No such authority") {
+	} else if !strings.Contains(err.Error(), "no such authority") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestConfiguredKeyserver_HandleRotationRequest_NoAuthority(t *testing.T) {
+	ks := &ConfiguredKeyserver{Context: &config.Context{}}
+	err := ks.HandleRotationRequest(nil, "grant")
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "no such authority") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestConfiguredKeyserver_HandleRotationRequest_NoRotations(t *testing.T) {
+	keydata, _, certdata := testkeyutil.GenerateTLSRootPEMsForTests(t, "test-ca", nil, nil)
+	authority, err := authorities.LoadTLSAuthority(keydata, certdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &ConfiguredKeyserver{Context: &config.Context{Authorities: map[string]authorities.Authority{"grant": authority}}}
+	recorder := httptest.NewRecorder()
+	err = ks.HandleRotationRequest(recorder, "grant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Body.String() != "[]" {
+		t.Errorf("Expected empty list of rotations, not %s", recorder.Body.String())
+	}
+}
+
+func TestConfiguredKeyserver_HandleMetricsRequest_NoInventory(t *testing.T) {
+	ks := &ConfiguredKeyserver{Context: &config.Context{}}
+	err := ks.HandleMetricsRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "no inventory of nodes") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func prepMetricsKeyserver(t *testing.T, privileges map[string]account.Privilege) *ConfiguredKeyserver {
+	keydata, _, certdata := testkeyutil.GenerateTLSRootPEMsForTests(t, "test-ca", nil, nil)
+	authority, err := authorities.LoadTLSAuthority(keydata, certdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := inventory.NewInventory([]string{"a.example.com"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ConfiguredKeyserver{Context: &config.Context{
+		TokenVerifier:           verifier.NewTokenVerifier(),
+		AuthenticationAuthority: authority.(*authorities.TLSAuthority),
+		Accounts: map[string]*account.Account{
+			"test-user": {Principal: "test-user", Privileges: privileges},
+		},
+		Inventory: inv,
+	}}
+}
+
+func TestConfiguredKeyserver_HandleMetricsRequest(t *testing.T) {
+	ks := prepMetricsKeyserver(t, map[string]account.Privilege{worldconfig.ScrapeMetricsAPI: account.NewMetricsPrivilege()})
+	recorder := httptest.NewRecorder()
+	err := ks.HandleMetricsRequest(recorder, prepCertAuth(t, ks.Context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(recorder.Body.String(), "keysystem_keyserver_nodes_never_checked_in 1") {
+		t.Error("Expected node to be reported as never checked in.")
+	}
+}
+
+func TestConfiguredKeyserver_HandleMetricsRequest_Unauthenticated(t *testing.T) {
+	ks := prepMetricsKeyserver(t, map[string]account.Privilege{worldconfig.ScrapeMetricsAPI: account.NewMetricsPrivilege()})
+	err := ks.HandleMetricsRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "only be scraped with a client certificate") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestConfiguredKeyserver_HandleMetricsRequest_Token(t *testing.T) {
+	ks := prepMetricsKeyserver(t, map[string]account.Privilege{worldconfig.ScrapeMetricsAPI: account.NewMetricsPrivilege()})
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	request.Header.Set(verifier.TokenHeader, ks.Context.TokenVerifier.Registry.GrantToken("test-user", time.Minute))
+	err := ks.HandleMetricsRequest(httptest.NewRecorder(), request)
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "only be scraped with a client certificate") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestConfiguredKeyserver_HandleMetricsRequest_Forbidden(t *testing.T) {
+	ks := prepMetricsKeyserver(t, map[string]account.Privilege{})
+	err := ks.HandleMetricsRequest(httptest.NewRecorder(), prepCertAuth(t, ks.Context))
+	if err == nil {
+		t.Error("Expected error.")
+	} else if _, ok := err.(*operation.OperationForbiddenError); !ok {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestConfiguredKeyserver_HandleEnrollRequest_Disabled(t *testing.T) {
+	ks := &ConfiguredKeyserver{Context: &config.Context{}}
+	err := ks.HandleEnrollRequest(httptest.NewRecorder(), httptest.NewRequest("POST", "/enroll", nil))
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "enrollment is not enabled") {
+		t.Errorf("Wrong error: %s", err)
+	}
+}
+
+func TestConfiguredKeyserver_HandleEnrollRequest(t *testing.T) {
+	queue, err := enrollment.NewQueue("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &ConfiguredKeyserver{Context: &config.Context{Enrollments: queue}, Logger: log.New(ioutil.Discard, "", 0)}
+	body := `{"hostname": "worker9", "ip": "10.0.0.9", "kind": "worker", "csr": "csr", "host-key-fingerprint": "SHA256:abc"}`
+	recorder := httptest.NewRecorder()
+	err = ks.HandleEnrollRequest(recorder, httptest.NewRequest("POST", "/enroll", strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollments := queue.List()
+	if len(enrollments) != 1 || enrollments[0].Request.Hostname != "worker9" {
+		t.Fatalf("Wrong enrollments: %+v", enrollments)
+	}
+	if recorder.Body.String() != "\""+enrollments[0].ID+"\"" {
+		t.Errorf("Wrong response: %s", recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	err = ks.HandleEnrollStatus(recorder, enrollments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Body.String() != `{"state":"pending"}` {
+		t.Errorf("Wrong status: %s", recorder.Body.String())
+	}
+	err = ks.HandleEnrollStatus(httptest.NewRecorder(), "nonexistent")
+	if err == nil {
+		t.Error("Expected error.")
+	} else if !strings.Contains(err.Error(), "no such enrollment request") {
 		t.Errorf("Wrong error: %s", err)
 	}
 }
@@ -457,7 +704,7 @@ func TestConfiguredKeyserver_HandleAPIRequest_Unauthed(t *testing.T) {
 	err := ks.HandleAPIRequest(recorder, request)
 	if err == nil {
 		t.Error("Expected error")
-	} else if !strings.Contains(err.Error(), "No authentication method found in request") {
+	} else if !strings.Contains(err.Error(), "no authentication method found in request") {
 		t.Errorf("Wrong error: %s", err)
 	}
 	if logrecord.String() != "" {
@@ -486,7 +733,7 @@ func TestConfiguredKeyserver_HandleAPIRequest_NoSuchGrant(t *testing.T) {
 	err := ks.HandleAPIRequest(recorder, request)
 	if err == nil {
 		t.Error("Expected error")
-	} else if !strings.Contains(err.Error(), "could not find API request") {
+	} else if !strings.Contains(err.Error(), "does not have access to API call test-api") {
 		t.Errorf("Wrong error: %s", err)
 	}
 	if logrecord.String() != "" {
@@ -3,19 +3,27 @@ package keyapi
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"github.com/pkg/errors"
 	"log"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/sipb/homeworld/platform/keysystem/api/endpoint"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/keygen"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/operation"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/replication"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
 	"github.com/sipb/homeworld/platform/util/certutil"
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/sdnotify"
 )
 
 const TemporaryCertificateBits = keygen.AuthorityBits
 
-func apiToHTTP(ks Keyserver, logger *log.Logger) http.Handler {
+func apiToHTTP(ks Keyserver, clk clock.Clock, logger *log.Logger) http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/apirequest", func(writer http.ResponseWriter, request *http.Request) {
@@ -38,6 +46,14 @@ func apiToHTTP(ks Keyserver, logger *log.Logger) http.Handler {
 		}
 	})
 
+	mux.HandleFunc("/rotation/", func(writer http.ResponseWriter, request *http.Request) {
+		err := ks.HandleRotationRequest(writer, request.URL.Path[len("/rotation/"):])
+		if err != nil {
+			logger.Printf("Rotation request failed with error: %s", err)
+			http.Error(writer, "Request processing failed: "+err.Error(), http.StatusNotFound)
+		}
+	})
+
 	mux.HandleFunc("/static/", func(writer http.ResponseWriter, request *http.Request) {
 		err := ks.HandleStaticRequest(writer, request.URL.Path[len("/static/"):])
 		if err != nil {
@@ -46,11 +62,65 @@ func apiToHTTP(ks Keyserver, logger *log.Logger) http.Handler {
 		}
 	})
 
-	return mux
+	mux.HandleFunc("/reenroll/challenge/", func(writer http.ResponseWriter, request *http.Request) {
+		err := ks.HandleReenrollChallenge(writer, request.URL.Path[len("/reenroll/challenge/"):])
+		if err != nil {
+			logger.Printf("Re-enrollment challenge failed with error: %s", err)
+			http.Error(writer, "Request processing failed: "+err.Error(), http.StatusNotFound)
+		}
+	})
+
+	mux.HandleFunc("/reenroll", func(writer http.ResponseWriter, request *http.Request) {
+		err := ks.HandleReenrollRequest(writer, request)
+		if err != nil {
+			logger.Printf("Re-enrollment request failed with error: %s", err)
+			if _, ok := err.(*operation.OperationForbiddenError); ok {
+				http.Error(writer, "Particular operation forbidden.", http.StatusForbidden)
+			} else {
+				http.Error(writer, "Request processing failed. See server logs for details.", http.StatusBadRequest)
+			}
+		}
+	})
+
+	mux.HandleFunc("/enroll", func(writer http.ResponseWriter, request *http.Request) {
+		err := ks.HandleEnrollRequest(writer, request)
+		if err != nil {
+			logger.Printf("Enrollment request failed with error: %s", err)
+			http.Error(writer, "Request processing failed. See server logs for details.", http.StatusBadRequest)
+		}
+	})
+
+	mux.HandleFunc("/enroll/", func(writer http.ResponseWriter, request *http.Request) {
+		err := ks.HandleEnrollStatus(writer, request.URL.Path[len("/enroll/"):])
+		if err != nil {
+			logger.Printf("Enrollment status request failed with error: %s", err)
+			http.Error(writer, "Request processing failed: "+err.Error(), http.StatusNotFound)
+		}
+	})
+
+	mux.HandleFunc("/metrics", func(writer http.ResponseWriter, request *http.Request) {
+		err := ks.HandleMetricsRequest(writer, request)
+		if err != nil {
+			logger.Printf("Metrics request failed with error: %s", err)
+			if _, ok := err.(*operation.OperationForbiddenError); ok {
+				http.Error(writer, "Particular operation forbidden.", http.StatusForbidden)
+			} else {
+				http.Error(writer, "Request processing failed. See server logs for details.", http.StatusBadRequest)
+			}
+		}
+	})
+
+	// every response includes the keyserver's time, and how far it backdates certificates, so that clients can tell
+	// whether their clocks are accurate enough to use the certificates
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(endpoint.ServerTimeHeader, clock.Now(clk).Format(time.RFC3339Nano))
+		writer.Header().Set(endpoint.CertBackdateHeader, ks.GetCertBackdate().String())
+		mux.ServeHTTP(writer, request)
+	})
 }
 
-func LoadConfiguredKeyserver(logger *log.Logger) (Keyserver, error) {
-	ctx, err := worldconfig.GenerateConfig()
+func LoadConfiguredKeyserver(env hostenv.Env, logger *log.Logger) (*ConfiguredKeyserver, error) {
+	ctx, err := worldconfig.GenerateConfig(env)
 	if err != nil {
 		return nil, err
 	}
@@ -63,28 +133,176 @@ func LoadConfiguredKeyserver(logger *log.Logger) (Keyserver, error) {
 	return &ConfiguredKeyserver{Context: ctx, ServerKey: serverKey, Logger: logger}, nil
 }
 
-// addr: ":20557"
-func Run(addr string, logger *log.Logger) (func(), chan error, error) {
-	ks, err := LoadConfiguredKeyserver(logger)
+// listen uses the socket passed by systemd socket activation, if any, or otherwise opens a new one on addr.
+func listen(addr string) (net.Listener, error) {
+	listeners, err := sdnotify.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 1 {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, fmt.Errorf("expected at most one activated socket, not %d", len(listeners))
+	} else if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// LoadTenants loads a keyserver for each cluster hosted by this keyserver, keyed by the server name that selects it,
+// which is the name of the cluster's supervisor. If this keyserver hosts a single cluster, there is only one.
+func LoadTenants(env hostenv.Env, logger *log.Logger) (map[string]*ConfiguredKeyserver, error) {
+	tenants, err := worldconfig.LoadTenants(env)
+	if err != nil {
+		return nil, err
+	}
+	if tenants == nil {
+		ks, err := LoadConfiguredKeyserver(env, logger)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]*ConfiguredKeyserver{ks.Context.KeyserverDNS: ks}, nil
+	}
+	keyservers := map[string]*ConfiguredKeyserver{}
+	for _, tenant := range tenants {
+		tenantLogger := log.New(logger.Writer(), logger.Prefix()+"["+tenant.Name+"] ", logger.Flags())
+		ks, err := LoadConfiguredKeyserver(tenant.Env(env), tenantLogger)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while loading tenant %s", tenant.Name)
+		}
+		name := ks.Context.KeyserverDNS
+		if _, found := keyservers[name]; found {
+			return nil, fmt.Errorf("tenant %s is served under the same name as another tenant: %s", tenant.Name, name)
+		}
+		keyservers[name] = ks
+	}
+	return keyservers, nil
+}
+
+// Run starts the keyserver on addr (such as ":20557"), unless it was passed a listening socket by systemd. Once it is
+// running, it reports its status to systemd, and pings the watchdog for as long as it can still issue its own
+// certificates.
+func Run(addr string, env hostenv.Env, logger *log.Logger) (func(), chan error, error) {
+	keyservers, err := LoadTenants(env, logger)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	server := &http.Server{
-		Addr:    addr,
-		Handler: apiToHTTP(ks, logger),
-		TLSConfig: &tls.Config{
+	ln, err := listen(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tenants := map[string]Keyserver{}
+	for name, ks := range keyservers {
+		tenants[name] = ks
+	}
+	stop, cherr := ServeTenants(tenants, ln, env.Clock, logger)
+	status := func() string {
+		return "serving on " + ln.Addr().String()
+	}
+	healthy := func() error {
+		for name, ks := range keyservers {
+			if _, err := ks.GetValidServerCert(nil); err != nil {
+				return errors.Wrapf(err, "while issuing certificate for %s", name)
+			}
+		}
+		return nil
+	}
+	go sdnotify.Supervise(env.Effects.Notify, status, healthy, logger)
+	for _, ks := range keyservers {
+		if follower := ks.Context.Follower; follower != nil {
+			stopFollowing := follow(follower, ks.Logger)
+			stopServing := stop
+			stop = func() {
+				stopFollowing()
+				stopServing()
+			}
+		}
+	}
+	return stop, cherr, nil
+}
+
+// follow periodically copies the leader's state to a follower keyserver, until the returned function is called.
+func follow(follower *replication.Follower, logger *log.Logger) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(replication.Interval)
+		defer ticker.Stop()
+		for {
+			err := follower.Sync()
+			if err != nil {
+				logger.Printf("Could not copy state from leader keyserver: %s", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// tenantFor finds the tenant that a client selected by requesting serverName. A lone keyserver is served under any
+// server name, so that clusters that don't share a keyserver can keep connecting to it by IP address.
+func tenantFor(tenants map[string]Keyserver, serverName string) (string, error) {
+	if len(tenants) == 1 {
+		for name := range tenants {
+			return name, nil
+		}
+	}
+	if _, found := tenants[serverName]; !found {
+		return "", fmt.Errorf("no cluster is served under the name %q", serverName)
+	}
+	return serverName, nil
+}
+
+// Serve accepts TLS connections for the keyserver on an already-open listener. Handshakes check certificate validity
+// against clk, which may be nil to use the system clock.
+func Serve(ks Keyserver, ln net.Listener, clk clock.Clock, logger *log.Logger) (func(), chan error) {
+	return ServeTenants(map[string]Keyserver{"": ks}, ln, clk, logger)
+}
+
+// ServeTenants accepts TLS connections for several keyservers on one listener, like Serve. Each keyserver is keyed by the
+// server name that clients request to select it, and only accepts client certificates issued by its own authority.
+func ServeTenants(tenants map[string]Keyserver, ln net.Listener, clk clock.Clock, logger *log.Logger) (func(), chan error) {
+	configs := map[string]*tls.Config{}
+	handlers := map[string]http.Handler{}
+	for name, ks := range tenants {
+		configs[name] = &tls.Config{
 			ClientAuth:     tls.VerifyClientCertIfGiven,
 			ClientCAs:      ks.GetClientCAs(),
 			GetCertificate: ks.GetValidServerCert,
 			MinVersion:     tls.VersionTLS12,
 			NextProtos:     []string{"http/1.1", "h2"},
-		},
+			Time: func() time.Time {
+				return clock.Now(clk)
+			},
+		}
+		handlers[name] = apiToHTTP(ks, clk, logger)
 	}
-
-	ln, err := net.Listen("tcp", server.Addr)
-	if err != nil {
-		return nil, nil, err
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			// the same name that selected which client certificates the handshake accepted
+			name, err := tenantFor(tenants, request.TLS.ServerName)
+			if err != nil {
+				logger.Printf("Request failed with error: %s", err)
+				http.Error(writer, "Request processing failed: "+err.Error(), http.StatusNotFound)
+				return
+			}
+			handlers[name].ServeHTTP(writer, request)
+		}),
+		TLSConfig: &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				name, err := tenantFor(tenants, hello.ServerName)
+				if err != nil {
+					return nil, err
+				}
+				return configs[name], nil
+			},
+		},
 	}
 
 	cherr := make(chan error)
@@ -94,5 +312,5 @@ func Run(addr string, logger *log.Logger) (func(), chan error, error) {
 		cherr <- server.Serve(tlsListener)
 	}()
 
-	return func() { server.Shutdown(context.Background()) }, cherr, nil
+	return func() { server.Shutdown(context.Background()) }, cherr
 }
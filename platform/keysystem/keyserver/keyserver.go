@@ -3,9 +3,10 @@ package main
 import (
 	"log"
 	"os"
-	"os/exec"
 
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/keyapi"
+	"github.com/sipb/homeworld/platform/util/sdnotify"
 )
 
 func main() {
@@ -13,11 +14,12 @@ func main() {
 	if len(os.Args) != 1 {
 		logger.Fatalln("usage: keyserver")
 	}
-	_, onstop, err := keyapi.Run(":20557", logger)
+	env := hostenv.FromEnvironment()
+	_, onstop, err := keyapi.Run(":20557", env, logger)
 	if err != nil {
 		logger.Fatal(err)
 	}
-	err = exec.Command("systemd-notify", "--ready").Run()
+	err = env.Effects.Notify(sdnotify.Ready)
 	if err != nil {
 		logger.Fatal("failed to notify systemd of readiness: %v\n", err)
 	}
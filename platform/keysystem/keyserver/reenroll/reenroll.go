@@ -0,0 +1,187 @@
+package reenroll
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+/*
+ * A node that has been powered off for longer than the lifetime of its keygranting certificate can't renew it, and
+ * would otherwise need an administrator to issue a new bootstrap token. Instead, it can re-enroll by proving that it
+ * still holds the SSH host key that the keyserver certified for it: it fetches a one-time challenge, and signs that
+ * challenge, along with the CSR for its new keygranting certificate, using its SSH host key.
+ */
+
+// how long a node has to answer a challenge
+const ChallengeLifespan = 5 * time.Minute
+
+// Request is sent by a node to re-enroll.
+type Request struct {
+	// the principal of the node's account, which must be one of the principals of its SSH host certificate
+	Principal string `json:"principal"`
+	// the node's SSH host certificate, in authorized_keys format
+	Certificate string `json:"certificate"`
+	Challenge   string `json:"challenge"`
+	// the CSR for the new keygranting certificate
+	CSR string `json:"csr"`
+	// an SSH signature of SignedData by the node's SSH host key, in wire format
+	Signature []byte `json:"signature"`
+}
+
+// SignedData is the data that a node signs with its SSH host key, which binds the CSR to the challenge.
+func SignedData(challenge string, csr string) []byte {
+	hash := sha256.Sum256([]byte(csr))
+	return []byte(fmt.Sprintf("homeworld reenrollment\x00%s\x00%x", challenge, hash))
+}
+
+// Policy determines which nodes are allowed to re-enroll.
+type Policy struct {
+	// how long after a node's SSH host certificate expires it can still be used to re-enroll
+	Grace time.Duration
+}
+
+type challenge struct {
+	challenge string
+	expires   time.Time
+}
+
+type Reenroller struct {
+	// the API invoked on behalf of the node's account once it has proven its identity
+	API           string
+	policy        Policy
+	hostAuthority ssh.PublicKey
+	mutex         sync.Mutex
+	// the outstanding challenge for each principal; requesting another replaces it, so that unauthenticated clients
+	// can't use up memory or crowd out other nodes' challenges
+	challenges map[string]challenge
+	// nil to use the system clock
+	clock clock.Clock
+}
+
+// NewReenroller accepts SSH host certificates issued by hostAuthority as proof of identity, and then invokes api.
+func NewReenroller(api string, hostAuthority []byte, policy Policy, clk clock.Clock) (*Reenroller, error) {
+	pubkey, err := wraputil.ParseSSHTextPubkey(hostAuthority)
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing ssh host authority")
+	}
+	if policy.Grace < 0 {
+		return nil, fmt.Errorf("invalid negative grace period for re-enrollment: %v", policy.Grace)
+	}
+	return &Reenroller{
+		API:           api,
+		policy:        policy,
+		hostAuthority: pubkey,
+		challenges:    map[string]challenge{},
+		clock:         clk,
+	}, nil
+}
+
+// must be called with the mutex held
+func (r *Reenroller) expireChallenges(now time.Time) {
+	for principal, outstanding := range r.challenges {
+		if now.After(outstanding.expires) {
+			delete(r.challenges, principal)
+		}
+	}
+}
+
+// Challenge generates a new challenge for the node claiming to be principal, which can be used once, within
+// ChallengeLifespan. Only the latest challenge for each principal can be used. The caller is responsible for checking
+// that principal names an account, so that the number of outstanding challenges stays bounded.
+func (r *Reenroller) Challenge(principal string) (string, error) {
+	out := make([]byte, 32)
+	_, err := rand.Read(out)
+	if err != nil {
+		return "", err
+	}
+	generated := base64.RawURLEncoding.EncodeToString(out)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := clock.Now(r.clock)
+	r.expireChallenges(now)
+	r.challenges[principal] = challenge{challenge: generated, expires: now.Add(ChallengeLifespan)}
+	return generated, nil
+}
+
+func (r *Reenroller) claimChallenge(principal string, claimed string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := clock.Now(r.clock)
+	r.expireChallenges(now)
+	outstanding, found := r.challenges[principal]
+	if !found || subtle.ConstantTimeCompare([]byte(outstanding.challenge), []byte(claimed)) != 1 {
+		return errors.New("unrecognized or expired re-enrollment challenge")
+	}
+	delete(r.challenges, principal)
+	return nil
+}
+
+func (r *Reenroller) checkCertificate(principal string, cert *ssh.Certificate) error {
+	if cert.CertType != ssh.HostCert {
+		return errors.New("re-enrollment requires a host certificate")
+	}
+	if !bytes.Equal(cert.SignatureKey.Marshal(), r.hostAuthority.Marshal()) {
+		return errors.New("host certificate was not issued by the ssh host authority")
+	}
+	now := clock.Now(r.clock)
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	if now.Before(validAfter) {
+		return fmt.Errorf("host certificate is not valid until %v", validAfter)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && !now.Before(validBefore.Add(r.policy.Grace)) {
+		return fmt.Errorf("host certificate expired at %v, which is more than %v ago", validBefore, r.policy.Grace)
+	}
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), r.hostAuthority.Marshal())
+		},
+		// the validity period has already been checked, including the grace period, so only the signature and the
+		// principal remain to be checked
+		Clock: func() time.Time {
+			return validAfter
+		},
+	}
+	return checker.CheckCert(principal, cert)
+}
+
+// Verify checks that a re-enrollment request proves possession of a host key certified for the requested principal.
+func (r *Reenroller) Verify(request *Request) error {
+	err := r.claimChallenge(request.Principal, request.Challenge)
+	if err != nil {
+		return err
+	}
+	pubkey, err := wraputil.ParseSSHTextPubkey([]byte(request.Certificate))
+	if err != nil {
+		return errors.Wrap(err, "while parsing host certificate")
+	}
+	cert, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return errors.New("found public key instead of host certificate")
+	}
+	err = r.checkCertificate(request.Principal, cert)
+	if err != nil {
+		return err
+	}
+	signature := &ssh.Signature{}
+	err = ssh.Unmarshal(request.Signature, signature)
+	if err != nil {
+		return errors.Wrap(err, "while parsing signature")
+	}
+	err = cert.Key.Verify(SignedData(request.Challenge, request.CSR), signature)
+	if err != nil {
+		return errors.Wrap(err, "invalid signature by host key")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package reenroll
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+var start = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+const principal = "node.example.com"
+
+func generateSigner(t *testing.T) ssh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+type fixture struct {
+	authority  ssh.Signer
+	hostkey    ssh.Signer
+	clock      *clock.Fake
+	reenroller *Reenroller
+}
+
+func newFixture(t *testing.T, grace time.Duration) *fixture {
+	f := &fixture{authority: generateSigner(t), hostkey: generateSigner(t), clock: clock.NewFake(start)}
+	reenroller, err := NewReenroller("renew-keygrant", ssh.MarshalAuthorizedKey(f.authority.PublicKey()), Policy{Grace: grace}, f.clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.reenroller = reenroller
+	return f
+}
+
+func (f *fixture) certify(t *testing.T, certType uint32, principals []string, lifespan time.Duration) string {
+	cert := &ssh.Certificate{
+		Key:             f.hostkey.PublicKey(),
+		CertType:        certType,
+		ValidAfter:      uint64(start.Unix()),
+		ValidBefore:     uint64(start.Add(lifespan).Unix()),
+		ValidPrincipals: principals,
+	}
+	err := cert.SignCert(rand.Reader, f.authority)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(ssh.MarshalAuthorizedKey(cert))
+}
+
+func (f *fixture) request(t *testing.T, cert string) *Request {
+	challenge, err := f.reenroller.Challenge(principal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &Request{Principal: principal, Certificate: cert, Challenge: challenge, CSR: "csr"}
+	signature, err := f.hostkey.Sign(rand.Reader, SignedData(challenge, request.CSR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Signature = ssh.Marshal(signature)
+	return request
+}
+
+func TestVerify(t *testing.T) {
+	f := newFixture(t, 0)
+	request := f.request(t, f.certify(t, ssh.HostCert, []string{principal}, time.Hour))
+	if err := f.reenroller.Verify(request); err != nil {
+		t.Fatal(err)
+	}
+	// challenges can only be used once
+	testutil.CheckError(t, f.reenroller.Verify(request), "unrecognized or expired re-enrollment challenge")
+}
+
+func TestVerify_ExpiredChallenge(t *testing.T) {
+	f := newFixture(t, 0)
+	request := f.request(t, f.certify(t, ssh.HostCert, []string{principal}, time.Hour))
+	f.clock.Advance(ChallengeLifespan + time.Second)
+	testutil.CheckError(t, f.reenroller.Verify(request), "unrecognized or expired re-enrollment challenge")
+}
+
+func TestVerify_GracePeriod(t *testing.T) {
+	f := newFixture(t, 24*time.Hour)
+	cert := f.certify(t, ssh.HostCert, []string{principal}, time.Hour)
+	f.clock.Advance(12 * time.Hour)
+	if err := f.reenroller.Verify(f.request(t, cert)); err != nil {
+		t.Error(err)
+	}
+	f.clock.Advance(24 * time.Hour)
+	testutil.CheckError(t, f.reenroller.Verify(f.request(t, cert)), "which is more than 24h0m0s ago")
+}
+
+func TestVerify_Expired(t *testing.T) {
+	f := newFixture(t, 0)
+	cert := f.certify(t, ssh.HostCert, []string{principal}, time.Hour)
+	f.clock.Advance(2 * time.Hour)
+	testutil.CheckError(t, f.reenroller.Verify(f.request(t, cert)), "host certificate expired")
+}
+
+func TestVerify_WrongAuthority(t *testing.T) {
+	f := newFixture(t, 0)
+	cert := f.certify(t, ssh.HostCert, []string{principal}, time.Hour)
+	f.authority = generateSigner(t)
+	f.reenroller.hostAuthority = f.authority.PublicKey()
+	testutil.CheckError(t, f.reenroller.Verify(f.request(t, cert)), "not issued by the ssh host authority")
+}
+
+func TestVerify_UserCert(t *testing.T) {
+	f := newFixture(t, 0)
+	cert := f.certify(t, ssh.UserCert, []string{principal}, time.Hour)
+	testutil.CheckError(t, f.reenroller.Verify(f.request(t, cert)), "re-enrollment requires a host certificate")
+}
+
+func TestVerify_WrongPrincipal(t *testing.T) {
+	f := newFixture(t, 0)
+	cert := f.certify(t, ssh.HostCert, []string{"other.example.com"}, time.Hour)
+	testutil.CheckError(t, f.reenroller.Verify(f.request(t, cert)), "not in the set of valid principals")
+}
+
+func TestVerify_SubstitutedCSR(t *testing.T) {
+	f := newFixture(t, 0)
+	request := f.request(t, f.certify(t, ssh.HostCert, []string{principal}, time.Hour))
+	request.CSR = "another csr"
+	testutil.CheckError(t, f.reenroller.Verify(request), "invalid signature by host key")
+}
+
+func TestChallenge_OnePerPrincipal(t *testing.T) {
+	f := newFixture(t, 0)
+	cert := f.certify(t, ssh.HostCert, []string{principal}, time.Hour)
+	stale := f.request(t, cert)
+	current := f.request(t, cert)
+	if len(f.reenroller.challenges) != 1 {
+		t.Errorf("expected one outstanding challenge, not %d", len(f.reenroller.challenges))
+	}
+	// requesting another challenge replaces the earlier one
+	testutil.CheckError(t, f.reenroller.Verify(stale), "unrecognized or expired re-enrollment challenge")
+	if err := f.reenroller.Verify(current); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChallenge_OtherPrincipal(t *testing.T) {
+	f := newFixture(t, 0)
+	request := f.request(t, f.certify(t, ssh.HostCert, []string{principal}, time.Hour))
+	if _, err := f.reenroller.Challenge("other.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// challenges for other principals neither displace this one nor can be used in its place
+	request.Principal = "other.example.com"
+	testutil.CheckError(t, f.reenroller.Verify(request), "unrecognized or expired re-enrollment challenge")
+	request.Principal = principal
+	if err := f.reenroller.Verify(request); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChallenge_Expiry(t *testing.T) {
+	f := newFixture(t, 0)
+	if _, err := f.reenroller.Challenge(principal); err != nil {
+		t.Fatal(err)
+	}
+	f.clock.Advance(ChallengeLifespan + time.Second)
+	if _, err := f.reenroller.Challenge("other.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := f.reenroller.challenges[principal]; found || len(f.reenroller.challenges) != 1 {
+		t.Errorf("expired challenge not discarded: %v", f.reenroller.challenges)
+	}
+}
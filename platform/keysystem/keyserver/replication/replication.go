@@ -0,0 +1,197 @@
+package replication
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
+	"github.com/sipb/homeworld/platform/keysystem/api/server"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/account"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/revocation"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/token"
+	"github.com/sipb/homeworld/platform/util/certutil"
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/csrutil"
+)
+
+/*
+ * A cluster can have several supervisors, each of which runs a keyserver. The keyservers share the same authorities, so
+ * any of them can issue certificates, but only the leader changes the cluster's mutable state: it grants bootstrap
+ * tokens, accepts enrollment requests, and decommissions nodes. The other keyservers are followers, which periodically
+ * copy that state from the leader, so that they can keep serving the cluster if the leader is lost.
+ *
+ * Followers copy bootstrap tokens, but refuse to accept them, because the leader would not find out that a token had
+ * been claimed until the follower next copied its state, and could accept the same token again in the meantime. Nodes
+ * can therefore only be bootstrapped while the leader is reachable.
+ */
+
+// how often followers copy the leader's state
+const Interval = 30 * time.Second
+
+// how long the certificates that followers use to authenticate to the leader are valid
+const CertificateLifespan = 10 * time.Minute
+
+// the size of the keys that followers use to authenticate to the leader
+const KeyBits = 2048
+
+// State is the mutable state that followers copy from the leader.
+type State struct {
+	Tokens      []token.Record          `json:"tokens"`
+	Revocations revocation.State        `json:"revocations"`
+	Enrollments []enrollment.Enrollment `json:"enrollments"`
+}
+
+// Request is sent by a follower to copy the leader's state.
+type Request struct {
+	// the tokens that the follower has seen claimed
+	Claimed []string `json:"claimed"`
+}
+
+// Replicated is the part of a keyserver's state that is the same across keyservers.
+type Replicated struct {
+	Tokens      *token.TokenRegistry
+	Revocations *revocation.Revocations
+	Enrollments *enrollment.Queue
+}
+
+// Capture copies the replicated state.
+func (r Replicated) Capture() *State {
+	return &State{
+		Tokens:      r.Tokens.Export(),
+		Revocations: r.Revocations.Export(),
+		Enrollments: r.Enrollments.List(),
+	}
+}
+
+// Apply replaces the replicated state with a copy.
+func (r Replicated) Apply(state *State) error {
+	r.Tokens.Import(state.Tokens)
+	err := r.Revocations.Replace(state.Revocations)
+	if err != nil {
+		return err
+	}
+	return r.Enrollments.Replace(state.Enrollments)
+}
+
+// NewLeaderPrivilege lets followers copy the leader's state.
+func NewLeaderPrivilege(r Replicated) account.Privilege {
+	return func(_ *account.OperationContext, param string) (string, error) {
+		request := Request{}
+		err := json.Unmarshal([]byte(param), &request)
+		if err != nil {
+			return "", errors.Wrap(err, "while decoding replication request")
+		}
+		r.Tokens.MarkClaimed(request.Claimed)
+		data, err := json.Marshal(r.Capture())
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+}
+
+// Follower copies the leader's state to a follower.
+type Follower struct {
+	Replicated
+	// the address of the leader's keyserver
+	Leader string
+	// called after each copy, to bring anything derived from the replicated state up to date
+	OnSync func() error
+
+	// the API that lets followers copy the leader's state
+	api string
+	// the principal of the follower's supervisor, which it authenticates to the leader as
+	principal   string
+	keygranting *authorities.TLSAuthority
+	clusterCA   []byte
+	key         []byte
+	// only one copy at a time
+	mutex sync.Mutex
+	// nil to use the system clock
+	clock clock.Clock
+}
+
+// NewFollower prepares to copy state from the leader at the specified address, by authenticating as principal with a
+// certificate issued by keygranting, and then invoking api. The leader's keyserver certificate must be issued by the
+// cluster CA.
+func NewFollower(r Replicated, leader string, api string, principal string, keygranting *authorities.TLSAuthority, clusterCA []byte, clk clock.Clock) (*Follower, error) {
+	_, key, err := certutil.GenerateRSA(KeyBits)
+	if err != nil {
+		return nil, errors.Wrap(err, "while generating replication key")
+	}
+	return &Follower{
+		Replicated:  r,
+		Leader:      leader,
+		api:         api,
+		principal:   principal,
+		keygranting: keygranting,
+		clusterCA:   clusterCA,
+		key:         key,
+		clock:       clk,
+	}, nil
+}
+
+func (f *Follower) authenticate() (reqtarget.RequestTarget, error) {
+	csr, err := csrutil.BuildTLSCSR(f.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := f.keygranting.Sign(string(csr), false, CertificateLifespan, f.principal, nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "while issuing replication certificate")
+	}
+	pair, err := tls.X509KeyPair([]byte(cert), f.key)
+	if err != nil {
+		return nil, err
+	}
+	ks, err := server.NewKeyserver(f.clusterCA, f.Leader)
+	if err != nil {
+		return nil, err
+	}
+	return ks.WithClock(f.clock).AuthenticateWithCert(pair)
+}
+
+// Fetch copies the leader's state, without applying it.
+func (f *Follower) Fetch() (*State, error) {
+	rt, err := f.authenticate()
+	if err != nil {
+		return nil, err
+	}
+	request, err := json.Marshal(Request{Claimed: f.Tokens.Claimed()})
+	if err != nil {
+		return nil, err
+	}
+	response, err := reqtarget.SendRequest(rt, f.api, string(request))
+	if err != nil {
+		return nil, errors.Wrapf(err, "while contacting leader keyserver at %s", f.Leader)
+	}
+	state := &State{}
+	err = json.Unmarshal([]byte(response), state)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding replicated state")
+	}
+	return state, nil
+}
+
+// Sync copies the leader's state and applies it. If the leader can't be reached, the follower keeps its current state.
+func (f *Follower) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	state, err := f.Fetch()
+	if err != nil {
+		return err
+	}
+	err = f.Apply(state)
+	if err != nil {
+		return errors.Wrap(err, "while applying replicated state")
+	}
+	if f.OnSync != nil {
+		return f.OnSync()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package replication
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/revocation"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/token"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func newReplicated(t *testing.T) Replicated {
+	revocations, err := revocation.NewRevocations("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollments, err := enrollment.NewQueue("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Replicated{Tokens: token.NewTokenRegistry(), Revocations: revocations, Enrollments: enrollments}
+}
+
+func TestLeaderPrivilege(t *testing.T) {
+	leader := newReplicated(t)
+	follower := newReplicated(t)
+
+	first := leader.Tokens.GrantToken("worker1.example.com", time.Hour)
+	second := leader.Tokens.GrantToken("worker2.example.com", time.Hour)
+	if _, err := leader.Revocations.Decommission("worker3.example.com", []revocation.Certificate{{Serial: "1f", Expires: time.Now().Add(time.Hour)}}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := leader.Enrollments.Submit(enrollment.Request{Hostname: "worker9", IP: "10.0.0.9", Kind: "worker", CSR: "csr", HostKeyFingerprint: "SHA256:abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower.Tokens.Import(leader.Tokens.Export())
+	if tok, err := follower.Tokens.LookupToken(first); err != nil {
+		t.Fatal(err)
+	} else if err := tok.Claim(); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := json.Marshal(Request{Claimed: follower.Tokens.Claimed()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := NewLeaderPrivilege(leader)(nil, string(request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &State{}
+	if err := json.Unmarshal([]byte(response), state); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Apply(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leader finds out about tokens claimed on the follower
+	if tok, err := leader.Tokens.LookupToken(first); err != nil {
+		t.Fatal(err)
+	} else if err := tok.Claim(); err == nil {
+		t.Error("token claimed on the follower could be claimed on the leader")
+	}
+	if tok, err := follower.Tokens.LookupToken(second); err != nil {
+		t.Fatal(err)
+	} else if tok.Subject != "worker2.example.com" {
+		t.Errorf("wrong token subject: %s", tok.Subject)
+	}
+	if !follower.Revocations.IsDecommissioned("worker3.example.com") || !follower.Revocations.IsRevoked("1f") {
+		t.Error("revocations not copied")
+	}
+	if status, err := follower.Enrollments.Status(id); err != nil {
+		t.Error(err)
+	} else if status.State != enrollment.Pending {
+		t.Errorf("wrong enrollment state: %s", status.State)
+	}
+}
+
+func TestLeaderPrivilege_Invalid(t *testing.T) {
+	_, err := NewLeaderPrivilege(newReplicated(t))(nil, "{")
+	testutil.CheckError(t, err, "while decoding replication request")
+}
@@ -0,0 +1,302 @@
+package revocation
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+/*
+ * When a node is decommissioned, its principal is no longer allowed to be part of the cluster, even if it is still
+ * listed in setup.yaml, and every certificate that the keyserver issued to it, or that it last reported holding, is
+ * revoked. Issued and revoked certificates are forgotten once they expire, since they can no longer be used anyway.
+ *
+ * Only the keyserver refuses to accept revoked certificates, for authentication. Nothing else in the cluster checks
+ * revocations, so the client certificates that the apiserver and etcd accept are issued with short lifetimes instead,
+ * and stop working soon after they are revoked. SSH host certificates remain valid until they expire.
+ */
+
+// Certificate is an issued or revoked certificate, identified by its serial number in hexadecimal.
+type Certificate struct {
+	Serial    string `json:"serial"`
+	Principal string `json:"principal"`
+	// where the node keeps the certificate, if it reported it
+	Path string `json:"path"`
+	// the API through which the certificate was issued, if the keyserver recorded it
+	API     string    `json:"api,omitempty"`
+	Expires time.Time `json:"expires"`
+	Revoked time.Time `json:"revoked"`
+}
+
+// Describe finds the serial number and expiration of a TLS certificate (in PEM format) or an SSH certificate (in
+// authorized_keys format), as issued by the keyserver.
+func Describe(cert []byte) (Certificate, error) {
+	if wraputil.IsPEMBlock(cert) {
+		parsed, err := wraputil.LoadX509CertFromPEM(cert)
+		if err != nil {
+			return Certificate{}, err
+		}
+		return Certificate{Serial: parsed.SerialNumber.Text(16), Expires: parsed.NotAfter}, nil
+	}
+	pubkey, err := wraputil.ParseSSHTextPubkey(cert)
+	if err != nil {
+		return Certificate{}, err
+	}
+	parsed, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return Certificate{}, errors.New("found public key instead of certificate")
+	}
+	return Certificate{Serial: fmt.Sprintf("%x", parsed.Serial), Expires: time.Unix(int64(parsed.ValidBefore), 0)}, nil
+}
+
+// State is everything that the revocations keep track of, so that it can be copied to another keyserver.
+type State struct {
+	// principals of decommissioned nodes, with when they were decommissioned
+	Decommissioned map[string]time.Time `json:"decommissioned"`
+	Certificates   []Certificate        `json:"certificates"`
+	// certificates issued to nodes, which have not yet been revoked
+	Issued []Certificate `json:"issued"`
+}
+
+// Revocations keeps track of the certificates issued to each node, and of decommissioned nodes and their revoked
+// certificates.
+type Revocations struct {
+	mutex          sync.Mutex
+	decommissioned map[string]time.Time
+	certificates   map[string]Certificate
+	issued         map[string]Certificate
+	// where to persist the revocations across keyserver restarts; empty to only keep them in memory
+	path  string
+	clock clock.Clock
+}
+
+// NewRevocations creates an empty set of revocations. If path is not empty, the revocations are loaded from path, if it
+// exists, and saved there after every change.
+func NewRevocations(path string, clk clock.Clock) (*Revocations, error) {
+	r := &Revocations{
+		decommissioned: map[string]time.Time{},
+		certificates:   map[string]Certificate{},
+		issued:         map[string]Certificate{},
+		path:           path,
+		clock:          clk,
+	}
+	if path != "" {
+		err := r.load()
+		if err != nil {
+			return nil, errors.Wrap(err, "while loading revocations")
+		}
+	}
+	return r, nil
+}
+
+func (r *Revocations) load() error {
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	loaded := State{}
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return err
+	}
+	r.replace(loaded)
+	return nil
+}
+
+// must be called with the mutex held
+func (r *Revocations) replace(s State) {
+	r.decommissioned = map[string]time.Time{}
+	for principal, when := range s.Decommissioned {
+		r.decommissioned[principal] = when
+	}
+	r.certificates = map[string]Certificate{}
+	for _, cert := range s.Certificates {
+		r.certificates[cert.Serial] = cert
+	}
+	r.issued = map[string]Certificate{}
+	for _, cert := range s.Issued {
+		r.issued[cert.Serial] = cert
+	}
+}
+
+// must be called with the mutex held
+func (r *Revocations) export() State {
+	decommissioned := map[string]time.Time{}
+	for principal, when := range r.decommissioned {
+		decommissioned[principal] = when
+	}
+	return State{Decommissioned: decommissioned, Certificates: r.list(), Issued: sorted(r.issued)}
+}
+
+// must be called with the mutex held
+func (r *Revocations) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.export(), "", "  ")
+	if err != nil {
+		return err
+	}
+	err = fileutil.EnsureIsFolder(path.Dir(r.path))
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteAtomic(r.path, data, os.FileMode(0600))
+}
+
+// must be called with the mutex held
+func (r *Revocations) expire(now time.Time) {
+	for _, certificates := range []map[string]Certificate{r.certificates, r.issued} {
+		for serial, cert := range certificates {
+			if now.After(cert.Expires) {
+				delete(certificates, serial)
+			}
+		}
+	}
+}
+
+// must be called with the mutex held
+func (r *Revocations) list() []Certificate {
+	return sorted(r.certificates)
+}
+
+func sorted(certificates map[string]Certificate) []Certificate {
+	certs := make([]Certificate, 0, len(certificates))
+	for _, cert := range certificates {
+		certs = append(certs, cert)
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		if certs[i].Principal != certs[j].Principal {
+			return certs[i].Principal < certs[j].Principal
+		}
+		return certs[i].Serial < certs[j].Serial
+	})
+	return certs
+}
+
+// RecordIssued records that a certificate was issued to principal, so that it will be revoked if principal is
+// decommissioned.
+func (r *Revocations) RecordIssued(principal string, cert Certificate) error {
+	if cert.Serial == "" {
+		return fmt.Errorf("cannot record certificate issued through %s without a serial number", cert.API)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire(clock.Now(r.clock))
+	cert.Principal = principal
+	r.issued[cert.Serial] = cert
+	return r.save()
+}
+
+// Decommission records that principal is no longer part of the cluster, and revokes every certificate recorded as
+// issued to it, along with the listed certificates, such as those that it reported holding. The revoked certificates
+// are returned with their revocation times filled in, sorted by serial number.
+func (r *Revocations) Decommission(principal string, certs []Certificate) ([]Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := clock.Now(r.clock)
+	r.expire(now)
+	revoking := map[string]Certificate{}
+	for serial, cert := range r.issued {
+		if cert.Principal == principal {
+			revoking[serial] = cert
+		}
+	}
+	for _, cert := range certs {
+		if cert.Serial == "" {
+			return nil, fmt.Errorf("cannot revoke certificate %s without a serial number", cert.Path)
+		}
+		if issued, found := revoking[cert.Serial]; found {
+			cert.API = issued.API
+		}
+		cert.Principal = principal
+		revoking[cert.Serial] = cert
+	}
+	r.decommissioned[principal] = now
+	revoked := sorted(revoking)
+	for i := range revoked {
+		revoked[i].Revoked = now
+		r.certificates[revoked[i].Serial] = revoked[i]
+		delete(r.issued, revoked[i].Serial)
+	}
+	return revoked, r.save()
+}
+
+// Reinstate allows a decommissioned principal to be part of the cluster again. Its revoked certificates stay revoked.
+func (r *Revocations) Reinstate(principal string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, found := r.decommissioned[principal]; !found {
+		return nil
+	}
+	delete(r.decommissioned, principal)
+	return r.save()
+}
+
+// IsDecommissioned reports whether principal has been decommissioned.
+func (r *Revocations) IsDecommissioned(principal string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, found := r.decommissioned[principal]
+	return found
+}
+
+// IsRevoked reports whether the certificate with the specified serial number, in hexadecimal, has been revoked.
+func (r *Revocations) IsRevoked(serial string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, found := r.certificates[serial]
+	return found
+}
+
+// List returns every revoked certificate that has not yet expired, sorted by principal and serial number.
+func (r *Revocations) List() []Certificate {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire(clock.Now(r.clock))
+	return r.list()
+}
+
+// Export returns a copy of every decommissioned principal, revoked certificate, and issued certificate.
+func (r *Revocations) Export() State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.expire(clock.Now(r.clock))
+	return r.export()
+}
+
+// Replace discards every revocation, and replaces them with those in s, such as when copying them from another keyserver.
+// Certificates recorded as issued are kept, because they may have been issued by this keyserver, and are revoked if s
+// decommissions the principal that they were issued to.
+func (r *Revocations) Replace(s State) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	issued := r.issued
+	r.replace(s)
+	for serial, cert := range issued {
+		if _, revoked := r.certificates[serial]; revoked {
+			continue
+		}
+		if when, found := r.decommissioned[cert.Principal]; found {
+			cert.Revoked = when
+			r.certificates[serial] = cert
+		} else {
+			r.issued[serial] = cert
+		}
+	}
+	r.expire(clock.Now(r.clock))
+	return r.save()
+}
@@ -0,0 +1,302 @@
+package revocation
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+var start = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func sampleCertificates() []Certificate {
+	return []Certificate{
+		{Serial: "1f", Path: "/etc/homeworld/keys/keygrant.pem", Expires: start.Add(24 * time.Hour)},
+		{Serial: "2a", Path: "/etc/homeworld/keys/kubernetes-worker.pem", Expires: start.Add(time.Hour)},
+	}
+}
+
+func TestDecommission(t *testing.T) {
+	r, err := NewRevocations("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.IsDecommissioned("worker1.example.com") {
+		t.Error("principal decommissioned too early")
+	}
+	revoked, err := r.Decommission("worker1.example.com", sampleCertificates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 {
+		t.Fatalf("wrong number of revoked certificates: %d", len(revoked))
+	}
+	for _, cert := range revoked {
+		if cert.Principal != "worker1.example.com" || !cert.Revoked.Equal(start) {
+			t.Errorf("revoked certificate not filled in: %+v", cert)
+		}
+	}
+	if !r.IsDecommissioned("worker1.example.com") {
+		t.Error("principal not decommissioned")
+	}
+	if r.IsDecommissioned("worker2.example.com") {
+		t.Error("wrong principal decommissioned")
+	}
+	if !r.IsRevoked("1f") || !r.IsRevoked("2a") {
+		t.Error("certificates not revoked")
+	}
+	if r.IsRevoked("3b") {
+		t.Error("unrelated certificate revoked")
+	}
+}
+
+func TestDecommission_NoSerial(t *testing.T) {
+	r, err := NewRevocations("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.Decommission("worker1.example.com", []Certificate{{Path: "/etc/homeworld/keys/keygrant.pem"}})
+	testutil.CheckError(t, err, "cannot revoke certificate /etc/homeworld/keys/keygrant.pem without a serial number")
+}
+
+func TestReinstate(t *testing.T) {
+	r, err := NewRevocations("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reinstate("worker1.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decommission("worker1.example.com", sampleCertificates()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reinstate("worker1.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if r.IsDecommissioned("worker1.example.com") {
+		t.Error("principal not reinstated")
+	}
+	if !r.IsRevoked("1f") {
+		t.Error("certificates should stay revoked after reinstating")
+	}
+}
+
+func TestList_Expires(t *testing.T) {
+	fake := clock.NewFake(start)
+	r, err := NewRevocations("", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decommission("worker1.example.com", sampleCertificates()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decommission("master1.example.com", []Certificate{{Serial: "0c", Expires: start.Add(time.Hour)}}); err != nil {
+		t.Fatal(err)
+	}
+	certs := r.List()
+	if len(certs) != 3 || certs[0].Serial != "0c" || certs[1].Serial != "1f" || certs[2].Serial != "2a" {
+		t.Fatalf("wrong revoked certificates: %+v", certs)
+	}
+	fake.Advance(2 * time.Hour)
+	certs = r.List()
+	if len(certs) != 1 || certs[0].Serial != "1f" {
+		t.Fatalf("expired certificates not forgotten: %+v", certs)
+	}
+	if !r.IsDecommissioned("master1.example.com") {
+		t.Error("principal should stay decommissioned after its certificates expire")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rpath := path.Join(dir, "state", "revocations.json")
+
+	fake := clock.NewFake(start)
+	r, err := NewRevocations(rpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decommission("worker1.example.com", sampleCertificates()); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewRevocations(rpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.IsDecommissioned("worker1.example.com") {
+		t.Error("decommissioned principal not persisted")
+	}
+	certs := reloaded.List()
+	if len(certs) != 2 || certs[0].Serial != "1f" || certs[0].Path != "/etc/homeworld/keys/keygrant.pem" || !certs[0].Expires.Equal(start.Add(24*time.Hour)) {
+		t.Errorf("wrong revoked certificates after reload: %+v", certs)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	leader, err := NewRevocations("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Decommission("worker1.example.com", sampleCertificates()); err != nil {
+		t.Fatal(err)
+	}
+	follower, err := NewRevocations("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := follower.Decommission("worker2.example.com", []Certificate{{Serial: "0c", Expires: start.Add(time.Hour)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Replace(leader.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if !follower.IsDecommissioned("worker1.example.com") || !follower.IsRevoked("1f") || !follower.IsRevoked("2a") {
+		t.Error("revocations not copied")
+	}
+	if follower.IsDecommissioned("worker2.example.com") || follower.IsRevoked("0c") {
+		t.Error("previous revocations not discarded")
+	}
+	// the copy is independent of the original
+	if err := follower.Reinstate("worker1.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !leader.IsDecommissioned("worker1.example.com") {
+		t.Error("original revocations changed")
+	}
+}
+
+func TestDecommission_Issued(t *testing.T) {
+	fake := clock.NewFake(start)
+	r, err := NewRevocations("", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RecordIssued("worker1.example.com", Certificate{Serial: "1f", API: "renew-keygrant", Expires: start.Add(24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	// never reported by the node, such as when it was issued after the node last checked in
+	if err := r.RecordIssued("worker1.example.com", Certificate{Serial: "3b", API: "sign-ssh-host-key", Expires: start.Add(24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RecordIssued("worker2.example.com", Certificate{Serial: "4d", API: "renew-keygrant", Expires: start.Add(24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if r.IsRevoked("1f") || r.IsRevoked("3b") {
+		t.Error("issued certificates revoked too early")
+	}
+	revoked, err := r.Decommission("worker1.example.com", sampleCertificates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 3 || revoked[0].Serial != "1f" || revoked[1].Serial != "2a" || revoked[2].Serial != "3b" {
+		t.Fatalf("wrong revoked certificates: %+v", revoked)
+	}
+	if revoked[0].API != "renew-keygrant" || revoked[0].Path != "/etc/homeworld/keys/keygrant.pem" {
+		t.Errorf("recorded and reported details not merged: %+v", revoked[0])
+	}
+	if revoked[2].API != "sign-ssh-host-key" || revoked[2].Principal != "worker1.example.com" || !revoked[2].Revoked.Equal(start) {
+		t.Errorf("recorded certificate not filled in: %+v", revoked[2])
+	}
+	if !r.IsRevoked("3b") {
+		t.Error("recorded certificate not revoked")
+	}
+	if r.IsRevoked("4d") {
+		t.Error("certificate issued to another principal revoked")
+	}
+	if issued := r.Export().Issued; len(issued) != 1 || issued[0].Serial != "4d" {
+		t.Errorf("wrong issued certificates remaining: %+v", issued)
+	}
+	fake.Advance(48 * time.Hour)
+	if issued := r.Export().Issued; len(issued) != 0 {
+		t.Errorf("expired issued certificates not forgotten: %+v", issued)
+	}
+}
+
+func TestRecordIssued_NoSerial(t *testing.T) {
+	r, err := NewRevocations("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.RecordIssued("worker1.example.com", Certificate{API: "renew-keygrant"})
+	testutil.CheckError(t, err, "cannot record certificate issued through renew-keygrant without a serial number")
+}
+
+func TestPersistence_Issued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rpath := path.Join(dir, "revocations.json")
+
+	fake := clock.NewFake(start)
+	r, err := NewRevocations(rpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RecordIssued("worker1.example.com", Certificate{Serial: "3b", API: "sign-ssh-host-key", Expires: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := NewRevocations(rpath, fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := reloaded.Decommission("worker1.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].Serial != "3b" || revoked[0].API != "sign-ssh-host-key" {
+		t.Errorf("issued certificates not persisted: %+v", revoked)
+	}
+}
+
+func TestReplace_KeepsIssued(t *testing.T) {
+	leader, err := NewRevocations("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leader.Decommission("worker1.example.com", sampleCertificates()); err != nil {
+		t.Fatal(err)
+	}
+	follower, err := NewRevocations("", clock.NewFake(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.RecordIssued("worker1.example.com", Certificate{Serial: "1f", Expires: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.RecordIssued("worker2.example.com", Certificate{Serial: "4d", Expires: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Replace(leader.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.RecordIssued("worker1.example.com", Certificate{Serial: "5e", Expires: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Replace(leader.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if issued := follower.Export().Issued; len(issued) != 1 || issued[0].Serial != "4d" {
+		t.Errorf("wrong issued certificates kept: %+v", issued)
+	}
+	// issued only by the follower, but still revoked once the leader decommissions its principal
+	if !follower.IsRevoked("5e") {
+		t.Error("locally issued certificate not revoked")
+	}
+}
+
+func TestDescribe_SSH(t *testing.T) {
+	_, err := Describe([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJsGlXjRwHxUKnWGyHHr9kmDgTdDWbp8w3yk6W8iL4iI"))
+	testutil.CheckError(t, err, "found public key instead of certificate")
+}
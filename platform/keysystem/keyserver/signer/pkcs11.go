@@ -0,0 +1,257 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"github.com/pkg/errors"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// the DER encoding of the DigestInfo that precedes each digest in a PKCS #1 v1.5 signature, as in crypto/rsa
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// the PKCS #11 hash mechanism and mask generation function for each hash, for RSA-PSS signatures
+var pssMechanisms = map[crypto.Hash][2]uint{
+	crypto.SHA1:   {pkcs11.CKM_SHA_1, pkcs11.CKG_MGF1_SHA1},
+	crypto.SHA224: {pkcs11.CKM_SHA224, pkcs11.CKG_MGF1_SHA224},
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// a PKCS #11 module can only be initialized once per process, so it is shared between every key that it holds
+var modules = struct {
+	sync.Mutex
+	loaded map[string]*loadedModule
+}{loaded: map[string]*loadedModule{}}
+
+type loadedModule struct {
+	ctx   *pkcs11.Ctx
+	users int
+}
+
+func loadModule(module string) (*pkcs11.Ctx, error) {
+	modules.Lock()
+	defer modules.Unlock()
+	if loaded, found := modules.loaded[module]; found {
+		loaded.users++
+		return loaded.ctx, nil
+	}
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("could not load PKCS #11 module %s", module)
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+		return nil, errors.Wrap(err, "while initializing PKCS #11 module")
+	}
+	modules.loaded[module] = &loadedModule{ctx: ctx, users: 1}
+	return ctx, nil
+}
+
+func unloadModule(module string) error {
+	modules.Lock()
+	defer modules.Unlock()
+	loaded := modules.loaded[module]
+	loaded.users--
+	if loaded.users > 0 {
+		return nil
+	}
+	delete(modules.loaded, module)
+	err := loaded.ctx.Finalize()
+	loaded.ctx.Destroy()
+	return err
+}
+
+// PKCS11 is a crypto.Signer for a RSA key held by a PKCS #11 token, such as a hardware security module.
+type PKCS11 struct {
+	module  string
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	public  *rsa.PublicKey
+	// a PKCS #11 session can only perform one operation at a time
+	mutex sync.Mutex
+}
+
+// Ensure *PKCS11 implements crypto.Signer
+var _ crypto.Signer = (*PKCS11)(nil)
+
+func findSlot(ctx *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, err
+		}
+		// labels are padded with spaces by some tokens
+		if strings.TrimRight(info.Label, " ") == tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no PKCS #11 token labeled %q", tokenLabel)
+}
+
+// logging in applies to every session with the token, so another key on the same token may have logged in already
+func login(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, pin string) error {
+	err := ctx.Login(session, pkcs11.CKU_USER, pin)
+	if code, ok := err.(pkcs11.Error); ok && code == pkcs11.CKR_USER_ALREADY_LOGGED_IN {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "while logging into PKCS #11 token")
+	}
+	return nil
+}
+
+func findKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, keyLabel string) (pkcs11.ObjectHandle, error) {
+	err := ctx.FindObjectsInit(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+	})
+	if err != nil {
+		return 0, err
+	}
+	objects, _, err := ctx.FindObjects(session, 2)
+	if err != nil {
+		ctx.FindObjectsFinal(session) // ignore failure: the search already failed
+		return 0, err
+	}
+	err = ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, err
+	}
+	if len(objects) != 1 {
+		return 0, fmt.Errorf("expected one RSA private key labeled %q on PKCS #11 token, but found %d", keyLabel, len(objects))
+	}
+	return objects[0], nil
+}
+
+// OpenPKCS11 loads the PKCS #11 module, logs into the token with the specified label, and finds the RSA private key
+// with the specified label. The session remains open until Close is called.
+func OpenPKCS11(module string, tokenLabel string, pin string, keyLabel string) (*PKCS11, error) {
+	ctx, err := loadModule(module)
+	if err != nil {
+		return nil, err
+	}
+	p := &PKCS11{module: module, ctx: ctx}
+	err = p.open(tokenLabel, pin, keyLabel)
+	if err != nil {
+		if p.session != 0 {
+			ctx.CloseSession(p.session) // ignore failure: opening the key already failed
+		}
+		unloadModule(module) // ignore failure: opening the key already failed
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PKCS11) open(tokenLabel string, pin string, keyLabel string) error {
+	slot, err := findSlot(p.ctx, tokenLabel)
+	if err != nil {
+		return err
+	}
+	p.session, err = p.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return err
+	}
+	err = login(p.ctx, p.session, pin)
+	if err != nil {
+		return err
+	}
+	p.key, err = findKey(p.ctx, p.session, keyLabel)
+	if err != nil {
+		return err
+	}
+	attributes, err := p.ctx.GetAttributeValue(p.session, p.key, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return errors.Wrap(err, "while reading public key from PKCS #11 token")
+	}
+	p.public = &rsa.PublicKey{N: &big.Int{}}
+	for _, attribute := range attributes {
+		switch attribute.Type {
+		case pkcs11.CKA_MODULUS:
+			p.public.N.SetBytes(attribute.Value)
+		case pkcs11.CKA_PUBLIC_EXPONENT:
+			p.public.E = int(new(big.Int).SetBytes(attribute.Value).Int64())
+		}
+	}
+	if p.public.N.Sign() == 0 || p.public.E == 0 {
+		return errors.New("PKCS #11 token did not provide the public key")
+	}
+	return nil
+}
+
+func (p *PKCS11) Public() crypto.PublicKey {
+	return p.public
+}
+
+// Sign signs digest on the token. The token chooses its own randomness for RSA-PSS signatures, so rand is ignored.
+func (p *PKCS11) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if len(digest) != hash.Size() {
+		return nil, errors.New("digest does not match hash function")
+	}
+	var mechanism *pkcs11.Mechanism
+	var message []byte
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		mechanisms, found := pssMechanisms[hash]
+		if !found {
+			return nil, fmt.Errorf("unsupported hash function for RSA-PSS: %v", hash)
+		}
+		saltLength := pss.SaltLength
+		if saltLength == rsa.PSSSaltLengthAuto || saltLength == rsa.PSSSaltLengthEqualsHash {
+			saltLength = hash.Size()
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, pkcs11.NewPSSParams(mechanisms[0], mechanisms[1], uint(saltLength)))
+		message = digest
+	} else {
+		prefix, found := digestInfoPrefixes[hash]
+		if !found {
+			return nil, fmt.Errorf("unsupported hash function for PKCS #1 v1.5: %v", hash)
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		message = append(append([]byte{}, prefix...), digest...)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err := p.ctx.SignInit(p.session, []*pkcs11.Mechanism{mechanism}, p.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "while signing on PKCS #11 token")
+	}
+	signature, err := p.ctx.Sign(p.session, message)
+	if err != nil {
+		return nil, errors.Wrap(err, "while signing on PKCS #11 token")
+	}
+	return signature, nil
+}
+
+// Close closes the session, and unloads the PKCS #11 module if no other keys are using it.
+func (p *PKCS11) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err := p.ctx.CloseSession(p.session)
+	err2 := unloadModule(p.module)
+	if err == nil {
+		err = err2
+	}
+	return err
+}
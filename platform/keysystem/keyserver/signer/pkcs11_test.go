@@ -0,0 +1,73 @@
+package signer
+
+import (
+	"github.com/miekg/pkcs11"
+	"testing"
+)
+
+func withPKCS11Session(t *testing.T, module string, token string, pin string, action func(ctx *pkcs11.Ctx, session pkcs11.SessionHandle)) {
+	ctx, err := loadModule(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unloadModule(module)
+	slot, err := findSlot(ctx, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.CloseSession(session)
+	if err := login(ctx, session, pin); err != nil {
+		t.Fatal(err)
+	}
+	action(ctx, session)
+}
+
+func generatePKCS11Key(t *testing.T, module string, token string, pin string, label string) {
+	withPKCS11Session(t, module, token, pin, func(ctx *pkcs11.Ctx, session pkcs11.SessionHandle) {
+		_, _, err := ctx.GenerateKeyPair(session,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+				pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+				pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			},
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+				pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func destroyPKCS11Key(t *testing.T, module string, token string, pin string, label string) {
+	withPKCS11Session(t, module, token, pin, func(ctx *pkcs11.Ctx, session pkcs11.SessionHandle) {
+		if err := ctx.FindObjectsInit(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, label)}); err != nil {
+			t.Fatal(err)
+		}
+		objects, _, err := ctx.FindObjects(session, 10)
+		ctx.FindObjectsFinal(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range objects {
+			if err := ctx.DestroyObject(session, object); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Handler serves the named keys to the clients of a signing daemon.
+func Handler(keys map[string]crypto.Signer, logger *log.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys/", func(writer http.ResponseWriter, request *http.Request) {
+		path := strings.TrimPrefix(request.URL.EscapedPath(), "/keys/")
+		sign := strings.HasSuffix(path, "/sign")
+		name, err := url.PathUnescape(strings.TrimSuffix(path, "/sign"))
+		if err != nil {
+			http.Error(writer, "Malformed key name.", http.StatusBadRequest)
+			return
+		}
+		key, found := keys[name]
+		if !found {
+			http.Error(writer, "No such key.", http.StatusNotFound)
+			return
+		}
+		if sign && request.Method == http.MethodPost {
+			signature, err := signRequest(key, request)
+			if err != nil {
+				logger.Printf("signing with %s failed: %v", name, err)
+				http.Error(writer, "Signing failed: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(writer, SignResponse{Signature: signature}, logger)
+		} else if !sign && request.Method == http.MethodGet {
+			der, err := x509.MarshalPKIXPublicKey(key.Public())
+			if err != nil {
+				http.Error(writer, "Could not encode public key.", http.StatusInternalServerError)
+				return
+			}
+			_, err = writer.Write(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+			if err != nil {
+				logger.Printf("could not write public key for %s: %v", name, err)
+			}
+		} else {
+			http.Error(writer, "Unsupported request.", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func signRequest(key crypto.Signer, request *http.Request) ([]byte, error) {
+	signRequest := SignRequest{}
+	err := json.NewDecoder(request.Body).Decode(&signRequest)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(rand.Reader, signRequest.Digest, signRequest.Options())
+}
+
+func writeJSON(writer http.ResponseWriter, value interface{}, logger *log.Logger) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		http.Error(writer, "Could not encode response.", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_, err = writer.Write(data)
+	if err != nil {
+		logger.Printf("could not write response: %v", err)
+	}
+}
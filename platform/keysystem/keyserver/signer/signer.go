@@ -0,0 +1,157 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+ * An external signer holds the private key of an authority outside of the keyserver process, so that compromising the
+ * network-facing keyserver does not reveal the key: the keyserver can only ask for signatures while it is running.
+ *
+ * The keyserver can use a key held by a PKCS #11 token, such as a hardware security module, or a key held by a signing
+ * daemon, such as keysigner, that it reaches over a Unix socket. The daemon speaks HTTP over the socket:
+ *   GET  /keys/<name>       returns the public key of the named key, PKIX-encoded, in PEM
+ *   POST /keys/<name>/sign  signs the digest in a JSON SignRequest, and returns a JSON SignResponse
+ * There is no other authentication, so the permissions of the socket must only allow the keyserver to connect.
+ */
+
+// SignRequest asks for a signature over a digest, with the options that would be passed to crypto.Signer.Sign.
+type SignRequest struct {
+	Digest []byte      `json:"digest"`
+	Hash   crypto.Hash `json:"hash"`
+	// set for RSA-PSS signatures, and omitted for PKCS #1 v1.5 signatures
+	PSSSaltLength *int `json:"pss-salt-length,omitempty"`
+}
+
+type SignResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// Options converts the request into the options for crypto.Signer.Sign.
+func (r SignRequest) Options() crypto.SignerOpts {
+	if r.PSSSaltLength != nil {
+		return &rsa.PSSOptions{SaltLength: *r.PSSSaltLength, Hash: r.Hash}
+	}
+	return r.Hash
+}
+
+// how long to wait for the signing daemon, which may itself be waiting on a hardware token
+const RequestTimeout = 30 * time.Second
+
+// Remote is a crypto.Signer for a key held by a signing daemon.
+type Remote struct {
+	name   string
+	client *http.Client
+	public crypto.PublicKey
+}
+
+// Ensure *Remote implements crypto.Signer
+var _ crypto.Signer = (*Remote)(nil)
+
+func keyURL(name string) string {
+	return "http://signer/keys/" + url.PathEscape(name)
+}
+
+// Dial connects to the signing daemon listening on socket, and fetches the public key of the named key.
+func Dial(socket string, name string) (*Remote, error) {
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+		Timeout: RequestTimeout,
+	}
+	response, err := client.Get(keyURL(name))
+	if err != nil {
+		return nil, errors.Wrapf(err, "while fetching public key %s from signer", name)
+	}
+	body, err := readResponse(response)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while fetching public key %s from signer", name)
+	}
+	block, _ := pem.Decode(body)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("signer returned malformed public key for %s", name)
+	}
+	public, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while parsing public key %s from signer", name)
+	}
+	return &Remote{name: name, client: client, public: public}, nil
+}
+
+func readResponse(response *http.Response) ([]byte, error) {
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signer returned status %d: %s", response.StatusCode, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+func (r *Remote) Public() crypto.PublicKey {
+	return r.public
+}
+
+// Sign asks the signing daemon for a signature, which is verified before it is returned. The daemon chooses its own
+// randomness for RSA-PSS signatures, so rand is ignored.
+func (r *Remote) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	request := SignRequest{Digest: digest, Hash: opts.HashFunc()}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		saltLength := pss.SaltLength
+		request.PSSSaltLength = &saltLength
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := r.client.Post(keyURL(r.name)+"/sign", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "while signing with %s", r.name)
+	}
+	body, err := readResponse(response)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while signing with %s", r.name)
+	}
+	result := SignResponse{}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	// a signature that does not verify would only be noticed later by whoever it was issued to
+	err = verify(r.public, digest, request, result.Signature)
+	if err != nil {
+		return nil, errors.Wrapf(err, "signer returned invalid signature for %s", r.name)
+	}
+	return result.Signature, nil
+}
+
+func verify(public crypto.PublicKey, digest []byte, request SignRequest, signature []byte) error {
+	pub, ok := public.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("only RSA keys are supported")
+	}
+	if request.PSSSaltLength != nil {
+		return rsa.VerifyPSS(pub, request.Hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+	}
+	return rsa.VerifyPKCS1v15(pub, request.Hash, digest, signature)
+}
@@ -0,0 +1,241 @@
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
+	"github.com/sipb/homeworld/platform/util/csrutil"
+	"github.com/sipb/homeworld/platform/util/testkeyutil"
+	"github.com/sipb/homeworld/platform/util/testutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+func launchSigner(t *testing.T, keys map[string]crypto.Signer) (string, func()) {
+	dir, err := ioutil.TempDir("", "signer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := path.Join(dir, "signer.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: Handler(keys, log.New(os.Stderr, "[signer] ", 0))}
+	go server.Serve(ln)
+	return socket, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func checkSignatures(t *testing.T, signer crypto.Signer, public *rsa.PublicKey) {
+	digest := sha256.Sum256([]byte("test message"))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature); err != nil {
+		t.Error(err)
+	}
+	signature, err = signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: 16, Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPSS(public, crypto.SHA256, digest[:], signature, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	key, _ := testkeyutil.GenerateTLSRootForTests(t, "test-ca", nil, nil)
+	socket, cleanup := launchSigner(t, map[string]crypto.Signer{"test-ca": key})
+	defer cleanup()
+
+	remote, err := Dial(socket, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, ok := remote.Public().(*rsa.PublicKey)
+	if !ok || public.N.Cmp(key.N) != 0 || public.E != key.E {
+		t.Fatal("wrong public key from signer")
+	}
+	checkSignatures(t, remote, &key.PublicKey)
+}
+
+func TestRemote_NoSuchKey(t *testing.T) {
+	key, _ := testkeyutil.GenerateTLSRootForTests(t, "test-ca", nil, nil)
+	socket, cleanup := launchSigner(t, map[string]crypto.Signer{"test-ca": key})
+	defer cleanup()
+
+	_, err := Dial(socket, "other-ca")
+	testutil.CheckError(t, err, "signer returned status 404: No such key.")
+}
+
+func TestRemote_NoSigner(t *testing.T) {
+	_, err := Dial("/nonexistent/signer.sock", "test-ca")
+	testutil.CheckError(t, err, "while fetching public key test-ca from signer")
+}
+
+type wrongSigner struct {
+	crypto.Signer
+	wrong crypto.Signer
+}
+
+func (w wrongSigner) Sign(rand_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return w.wrong.Sign(rand_, digest, opts)
+}
+
+func TestRemote_InvalidSignature(t *testing.T) {
+	key, _ := testkeyutil.GenerateTLSRootForTests(t, "test-ca", nil, nil)
+	otherKey, _ := testkeyutil.GenerateTLSRootForTests(t, "other-ca", nil, nil)
+	socket, cleanup := launchSigner(t, map[string]crypto.Signer{"test-ca": wrongSigner{Signer: key, wrong: otherKey}})
+	defer cleanup()
+
+	remote, err := Dial(socket, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("test message"))
+	_, err = remote.Sign(rand.Reader, digest[:], crypto.SHA256)
+	testutil.CheckError(t, err, "signer returned invalid signature for test-ca")
+}
+
+func TestRemote_TLSAuthority(t *testing.T) {
+	keyPEM, _, certPEM := testkeyutil.GenerateTLSRootPEMsForTests(t, "test-ca", nil, nil)
+	key, err := wraputil.LoadRSAKeyFromPEM(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, cleanup := launchSigner(t, map[string]crypto.Signer{"test-ca": key})
+	defer cleanup()
+	remote, err := Dial(socket, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authority, err := authorities.NewTLSAuthority(remote, certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authority.GetPrivateKey() != nil {
+		t.Error("private key should not be available from an external signer")
+	}
+	clientKeyPEM, _, _ := testkeyutil.GenerateTLSRootPEMsForTests(t, "client", nil, nil)
+	csr, err := csrutil.BuildTLSCSR(clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := authority.Sign(string(csr), false, time.Hour, "client", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := wraputil.LoadX509CertFromPEM([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: authority.ToCertPool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, _, otherCertPEM := testkeyutil.GenerateTLSRootPEMsForTests(t, "other-ca", nil, nil)
+	_, err = authorities.NewTLSAuthority(remote, otherCertPEM)
+	testutil.CheckError(t, err, "mismatched RSA public and private keys")
+}
+
+func TestRemote_SSHAuthority(t *testing.T) {
+	key, _ := testkeyutil.GenerateTLSRootForTests(t, "ssh-ca", nil, nil)
+	socket, cleanup := launchSigner(t, map[string]crypto.Signer{"ssh-ca": key})
+	defer cleanup()
+	remote, err := Dial(socket, "ssh-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPubkey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authority, err := authorities.NewSSHAuthority(remote, ssh.MarshalAuthorizedKey(caPubkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey, _ := testkeyutil.GenerateTLSRootForTests(t, "user", nil, nil)
+	userPubkey, err := ssh.NewPublicKey(&userKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := authority.Sign(string(ssh.MarshalAuthorizedKey(userPubkey)), false, time.Hour, "user", []string{"root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		t.Fatal("expected SSH certificate")
+	}
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), caPubkey.Marshal())
+		},
+	}
+	if err := checker.CheckCert("root", cert); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPKCS11(t *testing.T) {
+	// this is tested against a token such as SoftHSM's, if one is configured:
+	//   softhsm2-util --init-token --free --label homeworld-test --pin 1234 --so-pin 1234
+	//   HOMEWORLD_TEST_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so HOMEWORLD_TEST_PKCS11_TOKEN=homeworld-test \
+	//     HOMEWORLD_TEST_PKCS11_PIN=1234 go test
+	module := os.Getenv("HOMEWORLD_TEST_PKCS11_MODULE")
+	token := os.Getenv("HOMEWORLD_TEST_PKCS11_TOKEN")
+	pin := os.Getenv("HOMEWORLD_TEST_PKCS11_PIN")
+	if module == "" || token == "" || pin == "" {
+		t.Skip("no PKCS #11 token configured for testing")
+	}
+	label := "homeworld-test-" + strings.Replace(time.Now().Format("150405.000000000"), ".", "", 1)
+	generatePKCS11Key(t, module, token, pin, label)
+	defer destroyPKCS11Key(t, module, token, pin, label)
+
+	p, err := OpenPKCS11(module, token, pin, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := p.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	public, ok := p.Public().(*rsa.PublicKey)
+	if !ok {
+		t.Fatal("expected RSA public key")
+	}
+	checkSignatures(t, p, public)
+
+	_, err = OpenPKCS11(module, token, pin, label+"-missing")
+	testutil.CheckError(t, err, "but found 0")
+	_, err = OpenPKCS11(module, token+"-missing", pin, label)
+	testutil.CheckError(t, err, "no PKCS #11 token labeled")
+}
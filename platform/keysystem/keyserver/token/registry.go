@@ -2,15 +2,19 @@ package token
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/token/scoped"
+	"github.com/sipb/homeworld/platform/util/clock"
 )
 
 type TokenRegistry struct {
 	mutex   sync.Mutex
 	byToken map[string]scoped.ScopedToken
+	// determines when tokens expire; nil to use the system clock
+	Clock clock.Clock
 }
 
 func (r *TokenRegistry) LookupToken(token string) (scoped.ScopedToken, error) {
@@ -47,11 +51,73 @@ func (r *TokenRegistry) expireOldEntries() {
 
 func (r *TokenRegistry) GrantToken(subject string, lifespan time.Duration) string {
 	r.expireOldEntries()
-	token := scoped.GenerateToken(subject, lifespan)
+	token := scoped.GenerateToken(subject, lifespan, r.Clock)
 	r.addToken(token)
 	return token.Token
 }
 
+// Record describes a token, so that it can be copied to another keyserver.
+type Record struct {
+	Token   string    `json:"token"`
+	Subject string    `json:"subject"`
+	Expires time.Time `json:"expires"`
+	Claimed bool      `json:"claimed,omitempty"`
+}
+
+// Export lists every token that has not yet expired, sorted by token.
+func (r *TokenRegistry) Export() []Record {
+	r.expireOldEntries()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	records := make([]Record, 0, len(r.byToken))
+	for _, tok := range r.byToken {
+		records = append(records, Record{Token: tok.Token, Subject: tok.Subject, Expires: tok.Expires(), Claimed: tok.IsClaimed()})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Token < records[j].Token
+	})
+	return records
+}
+
+// Import replaces every token with the listed tokens. Tokens that have already been claimed here remain claimed, even if
+// they have not been claimed according to the records.
+func (r *TokenRegistry) Import(records []Record) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	byToken := make(map[string]scoped.ScopedToken)
+	for _, record := range records {
+		claimed := record.Claimed
+		if existing, found := r.byToken[record.Token]; found && existing.IsClaimed() {
+			claimed = true
+		}
+		byToken[record.Token] = scoped.RestoreToken(record.Token, record.Subject, record.Expires, claimed, r.Clock)
+	}
+	r.byToken = byToken
+}
+
+// Claimed lists the tokens that have been claimed and have not yet expired.
+func (r *TokenRegistry) Claimed() []string {
+	var claimed []string
+	for _, record := range r.Export() {
+		if record.Claimed {
+			claimed = append(claimed, record.Token)
+		}
+	}
+	return claimed
+}
+
+// MarkClaimed records that the listed tokens were claimed elsewhere, such as on another keyserver. Unknown tokens are
+// ignored.
+func (r *TokenRegistry) MarkClaimed(tokens []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, token := range tokens {
+		if tok, found := r.byToken[token]; found {
+			tok.MarkClaimed()
+		}
+	}
+}
+
 func NewTokenRegistry() *TokenRegistry {
 	return &TokenRegistry{byToken: make(map[string]scoped.ScopedToken)}
 }
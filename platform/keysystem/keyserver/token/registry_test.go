@@ -0,0 +1,64 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
+)
+
+var start = time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestExportImport(t *testing.T) {
+	fake := clock.NewFake(start)
+	leader := NewTokenRegistry()
+	leader.Clock = fake
+	first := leader.GrantToken("worker1.example.com", time.Hour)
+	second := leader.GrantToken("worker2.example.com", 2*time.Hour)
+	if tok, err := leader.LookupToken(first); err != nil {
+		t.Fatal(err)
+	} else if err := tok.Claim(); err != nil {
+		t.Fatal(err)
+	}
+
+	follower := NewTokenRegistry()
+	follower.Clock = fake
+	follower.Import(leader.Export())
+	if _, err := follower.LookupToken(first); err != nil {
+		t.Error(err)
+	}
+	tok, err := follower.LookupToken(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Subject != "worker2.example.com" || !tok.Expires().Equal(start.Add(2*time.Hour)) {
+		t.Errorf("wrong token copied: %s expiring at %v", tok.Subject, tok.Expires())
+	}
+	if claimed := follower.Claimed(); len(claimed) != 1 || claimed[0] != first {
+		t.Errorf("wrong claimed tokens: %v", claimed)
+	}
+
+	// a token claimed on the follower stays claimed until the leader finds out about it
+	if err := tok.Claim(); err != nil {
+		t.Fatal(err)
+	}
+	follower.Import(leader.Export())
+	if tok, err := follower.LookupToken(second); err != nil {
+		t.Fatal(err)
+	} else if err := tok.Claim(); err == nil {
+		t.Error("token could be claimed twice")
+	}
+	leader.MarkClaimed(follower.Claimed())
+	if tok, err := leader.LookupToken(second); err != nil {
+		t.Fatal(err)
+	} else if err := tok.Claim(); err == nil {
+		t.Error("token claimed on the follower could be claimed on the leader")
+	}
+
+	// expired tokens are not copied
+	fake.Advance(90 * time.Minute)
+	follower.Import(leader.Export())
+	if _, err := follower.LookupToken(first); err == nil {
+		t.Error("expired token copied")
+	}
+}
@@ -7,31 +7,59 @@ import (
 	"errors"
 	"sync"
 	"time"
+
+	"github.com/sipb/homeworld/platform/util/clock"
 )
 
+type claimState struct {
+	mutex   sync.Mutex
+	claimed bool
+}
+
 type ScopedToken struct {
 	Token   string
 	Subject string
 	expires time.Time
-	claimed *sync.Once
+	claim   *claimState
+	clock   clock.Clock
 }
 
 func (t ScopedToken) HasExpired() bool {
-	return time.Now().After(t.expires)
+	return clock.Now(t.clock).After(t.expires)
+}
+
+// Expires returns when the token stops being valid.
+func (t ScopedToken) Expires() time.Time {
+	return t.expires
 }
 
 func (t ScopedToken) Claim() error {
 	if t.HasExpired() {
 		return errors.New("cannot claim expired token")
 	}
-	hasClaimed := false
-	t.claimed.Do(func() { hasClaimed = true })
-	if !hasClaimed {
+	t.claim.mutex.Lock()
+	defer t.claim.mutex.Unlock()
+	if t.claim.claimed {
 		return errors.New("token already claimed")
 	}
+	t.claim.claimed = true
 	return nil
 }
 
+// IsClaimed reports whether the token has already been used.
+func (t ScopedToken) IsClaimed() bool {
+	t.claim.mutex.Lock()
+	defer t.claim.mutex.Unlock()
+	return t.claim.claimed
+}
+
+// MarkClaimed records that the token was used elsewhere, such as on another keyserver.
+func (t ScopedToken) MarkClaimed() {
+	t.claim.mutex.Lock()
+	defer t.claim.mutex.Unlock()
+	t.claim.claimed = true
+}
+
 func generateTokenID() string {
 	out := make([]byte, 15)
 	_, err := rand.Read(out)
@@ -44,6 +72,12 @@ func generateTokenID() string {
 	return hash + base64.RawStdEncoding.EncodeToString(hashSha256[:])[0:2]
 }
 
-func GenerateToken(subject string, duration time.Duration) ScopedToken {
-	return ScopedToken{generateTokenID(), subject, time.Now().Add(duration), &sync.Once{}}
+// GenerateToken creates a token that expires after duration has passed on clk, which may be nil to use the system clock.
+func GenerateToken(subject string, duration time.Duration, clk clock.Clock) ScopedToken {
+	return RestoreToken(generateTokenID(), subject, clock.Now(clk).Add(duration), false, clk)
+}
+
+// RestoreToken recreates a token that was generated elsewhere, such as by another keyserver.
+func RestoreToken(token string, subject string, expires time.Time, claimed bool, clk clock.Clock) ScopedToken {
+	return ScopedToken{token, subject, expires, &claimState{claimed: claimed}, clk}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/signer"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/util/sdnotify"
+	"github.com/sipb/homeworld/platform/util/sealutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+const usage = `usage: keysigner <socket> <authority-dir> [<passphrase-file>]
+  signs with the authority keys in <authority-dir> on behalf of the keyserver, which connects to <socket>
+  sealed keys are unsealed with the passphrase in <passphrase-file>, or else in the authority-passphrase credential`
+
+// checkKeyDirectory makes sure that no other user, such as the keyserver, can read the keys in dir.
+func checkKeyDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("authority directory %s must only be accessible to the keysigner, but has mode %v", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// readPassphrase reads the passphrase from filename, if provided, or else from the systemd credential that
+// keysigner.service provides. The passphrase is nil if there is no such credential, or it was left empty.
+func readPassphrase(filename string) ([]byte, error) {
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return sealutil.ParsePassphrase(data)
+	}
+	credentials := os.Getenv("CREDENTIALS_DIRECTORY")
+	if credentials == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path.Join(credentials, worldconfig.AuthorityPassphraseCredential))
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return sealutil.ParsePassphrase(data)
+}
+
+// loadKeys loads each authority key found in dir, which need not include every authority.
+func loadKeys(dir string, passphrase []byte) (map[string]crypto.Signer, error) {
+	keys := map[string]crypto.Signer{}
+	for _, authority := range worldconfig.ListAuthorities() {
+		keyfile, _ := authority.Filenames()
+		data, err := ioutil.ReadFile(path.Join(dir, keyfile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if sealutil.IsSealed(data) {
+			if passphrase == nil {
+				return nil, fmt.Errorf("key for authority %s is sealed, but no passphrase was provided", authority.Name)
+			}
+			data, err = sealutil.Unseal(data, passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("while unsealing key for authority %s: %v", authority.Name, err)
+			}
+		}
+		key, err := wraputil.LoadRSAKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("while loading key for authority %s: %v", authority.Name, err)
+		}
+		keys[authority.Name] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no authority keys found in %s", dir)
+	}
+	return keys, nil
+}
+
+func main() {
+	logger := log.New(os.Stderr, "[keysigner] ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
+	if len(os.Args) != 3 && len(os.Args) != 4 {
+		logger.Fatal(usage)
+	}
+	socket, dir := os.Args[1], os.Args[2]
+	passphraseFile := ""
+	if len(os.Args) == 4 {
+		passphraseFile = os.Args[3]
+	}
+	passphrase, err := readPassphrase(passphraseFile)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	err = checkKeyDirectory(dir)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	keys, err := loadKeys(dir, passphrase)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	// a socket left behind by a previous run would prevent listening
+	err = os.Remove(socket)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Fatal(err)
+	}
+	// anyone who can connect to the socket can request signatures, so only the keysigner and the members of its group,
+	// which should only be the keyserver, may
+	syscall.Umask(0117)
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	for name := range keys {
+		logger.Printf("signing with authority %s", name)
+	}
+	err = sdnotify.Notify(sdnotify.Ready)
+	if err != nil {
+		logger.Fatalf("failed to notify systemd of readiness: %v", err)
+	}
+	logger.Fatal(http.Serve(ln, signer.Handler(keys, logger)))
+}
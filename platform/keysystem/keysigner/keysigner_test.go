@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func TestCheckKeyDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysigner-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkKeyDirectory(dir); err != nil {
+		t.Error(err)
+	}
+	// such as a directory that the keyserver could read through the keysigner group
+	if err := os.Chmod(dir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckError(t, checkKeyDirectory(dir), "must only be accessible to the keysigner")
+	testutil.CheckError(t, checkKeyDirectory(path.Join(dir, "nonexistent")), "no such file or directory")
+}
+
+func TestReadPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysigner-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+	credential := path.Join(dir, worldconfig.AuthorityPassphraseCredential)
+
+	os.Unsetenv("CREDENTIALS_DIRECTORY")
+	if passphrase, err := readPassphrase(""); err != nil || passphrase != nil {
+		t.Errorf("expected no passphrase, not %q (%v)", passphrase, err)
+	}
+	os.Setenv("CREDENTIALS_DIRECTORY", dir)
+	if passphrase, err := readPassphrase(""); err != nil || passphrase != nil {
+		t.Errorf("expected no passphrase without a credential, not %q (%v)", passphrase, err)
+	}
+	// the default that keysigner.service provides when no passphrase was placed
+	if err := ioutil.WriteFile(credential, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if passphrase, err := readPassphrase(""); err != nil || passphrase != nil {
+		t.Errorf("expected no passphrase from an empty credential, not %q (%v)", passphrase, err)
+	}
+	if err := ioutil.WriteFile(credential, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if passphrase, err := readPassphrase(""); err != nil || string(passphrase) != "correct horse" {
+		t.Errorf("wrong passphrase from credential %q (%v)", passphrase, err)
+	}
+	// an explicit passphrase file takes precedence, and must exist
+	explicit := path.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(explicit, []byte("battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if passphrase, err := readPassphrase(explicit); err != nil || string(passphrase) != "battery staple" {
+		t.Errorf("wrong passphrase from file %q (%v)", passphrase, err)
+	}
+	_, err = readPassphrase(path.Join(dir, "nonexistent"))
+	testutil.CheckError(t, err, "no such file or directory")
+}
@@ -0,0 +1,202 @@
+package rotation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+/*
+ * Nodes pin the authorities that they download on first use, and refuse to install a different authority afterwards,
+ * so that a compromised or misconfigured keyserver cannot silently substitute its own authorities. When an authority
+ * is deliberately replaced, the administrator publishes a rotation record on the keyserver. A rotation record is
+ * signed by the authority being replaced and contains the replacement, so a node can follow a chain of rotation
+ * records from the authority that it pinned to the one that the keyserver now offers, even if it missed some of the
+ * rotations in between.
+ */
+
+type Record struct {
+	Authority string `json:"authority"`
+	// the fingerprint of the authority being replaced
+	Previous string `json:"previous"`
+	// the replacement authority, in the same format as it is downloaded
+	Next      string `json:"next"`
+	Signature []byte `json:"signature"`
+}
+
+// publicKey extracts the public key of an authority, which is either a PEM-encoded TLS certificate or an SSH public key.
+func publicKey(authority []byte) (crypto.PublicKey, error) {
+	if wraputil.IsPEMBlock(authority) {
+		cert, err := wraputil.LoadX509CertFromPEM(authority)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	pubkey, err := wraputil.ParseSSHTextPubkey(authority)
+	if err != nil {
+		return nil, err
+	}
+	cryptoKey, ok := pubkey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("ssh authority does not have a usable public key")
+	}
+	return cryptoKey.CryptoPublicKey(), nil
+}
+
+// Fingerprint identifies an authority by a hash of its public key, so that reissuing a TLS authority's certificate with
+// the same key does not count as a change.
+func Fingerprint(authority []byte) (string, error) {
+	key, err := publicKey(authority)
+	if err != nil {
+		return "", errors.Wrap(err, "while parsing authority")
+	}
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:]), nil
+}
+
+func (r *Record) signedData() []byte {
+	return []byte(fmt.Sprintf("homeworld authority rotation\x00%s\x00%s\x00%s", r.Authority, r.Previous, r.Next))
+}
+
+// Sign produces a record that replaces the previous authority with the next authority, using the previous authority's
+// private key.
+func Sign(authority string, previous []byte, signer crypto.Signer, next []byte) (*Record, error) {
+	previousKey, err := publicKey(previous)
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing previous authority")
+	}
+	if !publicKeysEqual(previousKey, signer.Public()) {
+		return nil, errors.New("signing key does not match previous authority")
+	}
+	previousFingerprint, err := Fingerprint(previous)
+	if err != nil {
+		return nil, err
+	}
+	_, err = Fingerprint(next)
+	if err != nil {
+		return nil, errors.Wrap(err, "while checking next authority")
+	}
+	record := &Record{Authority: authority, Previous: previousFingerprint, Next: string(next)}
+	hash := sha256.Sum256(record.signedData())
+	record.Signature, err = signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		return nil, errors.Wrap(err, "while signing rotation record")
+	}
+	return record, nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	ader, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bder, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ader, bder)
+}
+
+// Verify checks that the record was signed by the previous authority, and is for the named authority.
+func (r *Record) Verify(authority string, previous []byte) error {
+	if r.Authority != authority {
+		return fmt.Errorf("rotation record is for authority %s, not %s", r.Authority, authority)
+	}
+	previousFingerprint, err := Fingerprint(previous)
+	if err != nil {
+		return err
+	}
+	if r.Previous != previousFingerprint {
+		return fmt.Errorf("rotation record replaces %s, not %s", r.Previous, previousFingerprint)
+	}
+	key, err := publicKey(previous)
+	if err != nil {
+		return err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("only RSA authorities can sign rotation records")
+	}
+	hash := sha256.Sum256(r.signedData())
+	err = rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], r.Signature)
+	if err != nil {
+		return errors.Wrap(err, "invalid signature on rotation record")
+	}
+	return nil
+}
+
+// Follow finds a chain of records that leads from the pinned authority to the offered authority, and fails if there
+// is none. Every chain is searched, so a record that leads nowhere, such as one left by an abandoned rotation, does not
+// hide another record that does lead to the offered authority.
+func Follow(authority string, pinned []byte, records []Record, offered []byte) error {
+	target, err := Fingerprint(offered)
+	if err != nil {
+		return err
+	}
+	start, err := Fingerprint(pinned)
+	if err != nil {
+		return err
+	}
+	// each authority is searched from at most once, so this always terminates
+	reached := map[string]bool{start: true}
+	pending := [][]byte{pinned}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		fingerprint, err := Fingerprint(current)
+		if err != nil {
+			return err
+		}
+		if fingerprint == target {
+			return nil
+		}
+		for _, record := range records {
+			if record.Verify(authority, current) != nil {
+				continue
+			}
+			next, err := Fingerprint([]byte(record.Next))
+			if err != nil {
+				// cannot lead anywhere
+				continue
+			}
+			if !reached[next] {
+				reached[next] = true
+				pending = append(pending, []byte(record.Next))
+			}
+		}
+	}
+	return fmt.Errorf("no valid rotation record leads from %s to %s", start, target)
+}
+
+// Parse loads a list of rotation records.
+func Parse(data []byte) ([]Record, error) {
+	var records []Record
+	err := json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding rotation records")
+	}
+	return records, nil
+}
+
+// Encode formats a list of rotation records for publishing on the keyserver.
+func Encode(records []Record) ([]byte, error) {
+	if records == nil {
+		records = []Record{}
+	}
+	return json.MarshalIndent(records, "", "  ")
+}
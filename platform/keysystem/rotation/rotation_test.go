@@ -0,0 +1,200 @@
+package rotation
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func tlsAuthority(t *testing.T, key *rsa.PrivateKey, serial int64) []byte {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "homeworld-authority-test"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func sshAuthority(t *testing.T, key *rsa.PrivateKey) []byte {
+	pubkey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.MarshalAuthorizedKey(pubkey)
+}
+
+func TestFingerprint_SameKey(t *testing.T) {
+	key := generateKey(t)
+	fp1, err := Fingerprint(tlsAuthority(t, key, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp2, err := Fingerprint(tlsAuthority(t, key, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp1 != fp2 {
+		t.Error("reissued certificate should have the same fingerprint")
+	}
+	fp3, err := Fingerprint(tlsAuthority(t, generateKey(t), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp1 == fp3 {
+		t.Error("different keys should have different fingerprints")
+	}
+}
+
+func TestFingerprint_Invalid(t *testing.T) {
+	_, err := Fingerprint([]byte("not an authority"))
+	testutil.CheckError(t, err, "while parsing authority")
+}
+
+func TestSignVerify_TLS(t *testing.T) {
+	oldKey := generateKey(t)
+	old, next := tlsAuthority(t, oldKey, 1), tlsAuthority(t, generateKey(t), 2)
+	record, err := Sign("clusterca", old, oldKey, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := record.Verify("clusterca", old); err != nil {
+		t.Error(err)
+	}
+	testutil.CheckError(t, record.Verify("kubernetes", old), "rotation record is for authority clusterca, not kubernetes")
+	testutil.CheckError(t, record.Verify("clusterca", next), "rotation record replaces")
+}
+
+func TestSignVerify_SSH(t *testing.T) {
+	oldKey := generateKey(t)
+	old, next := sshAuthority(t, oldKey), sshAuthority(t, generateKey(t))
+	record, err := Sign("ssh-user", old, oldKey, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := record.Verify("ssh-user", old); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSign_WrongKey(t *testing.T) {
+	old, next := sshAuthority(t, generateKey(t)), sshAuthority(t, generateKey(t))
+	_, err := Sign("ssh-user", old, generateKey(t), next)
+	testutil.CheckError(t, err, "signing key does not match previous authority")
+}
+
+func TestVerify_Tampered(t *testing.T) {
+	oldKey := generateKey(t)
+	old := sshAuthority(t, oldKey)
+	record, err := Sign("ssh-user", old, oldKey, sshAuthority(t, generateKey(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Next = string(sshAuthority(t, generateKey(t)))
+	testutil.CheckError(t, record.Verify("ssh-user", old), "invalid signature on rotation record")
+}
+
+func TestFollow(t *testing.T) {
+	key1, key2, key3 := generateKey(t), generateKey(t), generateKey(t)
+	auth1, auth2, auth3 := sshAuthority(t, key1), sshAuthority(t, key2), sshAuthority(t, key3)
+	record12, err := Sign("ssh-user", auth1, key1, auth2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record23, err := Sign("ssh-user", auth2, key2, auth3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// records are accepted in any order
+	data, err := Encode([]Record{*record23, *record12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Follow("ssh-user", auth1, records, auth3); err != nil {
+		t.Error(err)
+	}
+	if err := Follow("ssh-user", auth2, records, auth3); err != nil {
+		t.Error(err)
+	}
+	if err := Follow("ssh-user", auth3, nil, auth3); err != nil {
+		t.Error(err)
+	}
+	err = Follow("ssh-user", auth3, records, auth1)
+	testutil.CheckError(t, err, "no valid rotation record leads from")
+	err = Follow("ssh-user", auth1, records[:1], auth3)
+	testutil.CheckError(t, err, "no valid rotation record leads from")
+}
+
+func TestFollow_DeadEnd(t *testing.T) {
+	key1, key2, key3, key4 := generateKey(t), generateKey(t), generateKey(t), generateKey(t)
+	auth1, auth2, auth3, auth4 := sshAuthority(t, key1), sshAuthority(t, key2), sshAuthority(t, key3), sshAuthority(t, key4)
+	// left by a rotation to auth2 that was abandoned, and then retried with auth3
+	abandoned, err := Sign("ssh-user", auth1, key1, auth2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record13, err := Sign("ssh-user", auth1, key1, auth3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record34, err := Sign("ssh-user", auth3, key3, auth4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []Record{*abandoned, *record13, *record34}
+	if err := Follow("ssh-user", auth1, records, auth4); err != nil {
+		t.Error(err)
+	}
+	if err := Follow("ssh-user", auth1, records, auth2); err != nil {
+		t.Error(err)
+	}
+	err = Follow("ssh-user", auth2, records, auth4)
+	testutil.CheckError(t, err, "no valid rotation record leads from")
+}
+
+func TestFollow_Cycle(t *testing.T) {
+	key1, key2, key3 := generateKey(t), generateKey(t), generateKey(t)
+	auth1, auth2, auth3 := sshAuthority(t, key1), sshAuthority(t, key2), sshAuthority(t, key3)
+	record12, err := Sign("ssh-user", auth1, key1, auth2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record21, err := Sign("ssh-user", auth2, key2, auth1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Follow("ssh-user", auth1, []Record{*record12, *record21}, auth3)
+	testutil.CheckError(t, err, "no valid rotation record leads from")
+}
+
+func TestParse_Invalid(t *testing.T) {
+	_, err := Parse([]byte("not json"))
+	testutil.CheckError(t, err, "while decoding rotation records")
+}
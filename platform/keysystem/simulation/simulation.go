@@ -0,0 +1,462 @@
+package simulation
+
+/*
+ * This package runs a complete keysystem inside a single process, for testing: a real keyserver, loaded from generated
+ * authorities and a synthetic setup.yaml, and one keyclient per node, each converging the same state as it would in
+ * production, but in its own relocated root with simulated side effects. Clusters with several supervisors also run a
+ * follower keyserver for each additional supervisor, which copies the leader's state once per convergence pass.
+ *
+ * Everything that checks or assigns validity periods uses the cluster's fake clock, so weeks of renewals and rotations
+ * can be simulated in seconds by advancing it between convergence passes. Each node sees the cluster's clock through its
+ * own skew, so that nodes with inaccurate clocks can be simulated as well.
+ */
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/api"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/state"
+	"github.com/sipb/homeworld/platform/keysystem/keygen"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/account"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/keyapi"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/util/certutil"
+	"github.com/sipb/homeworld/platform/util/clock"
+	"github.com/sipb/homeworld/platform/util/fileutil"
+)
+
+const ExternalDomain = "sim.example.com"
+const SupervisorHostname = "supervisor"
+const AdminPrincipal = "admin@SIM.EXAMPLE.COM"
+
+// every node connects from the loopback address, so that is the address that the keyserver expects for each of them
+const NodeIP = "127.0.0.1"
+
+// how long the bootstrap tokens issued to simulated nodes remain valid
+const BootstrapTokenLifespan = time.Hour
+
+// the keyserver's own certificate is issued for its address, rather than for the supervisor's hostname, so that the
+// simulation doesn't depend on name resolution
+const keyserverAddress = "127.0.0.1"
+
+// the most cycles that a single convergence pass will run before giving up on a node stabilizing
+const MaxCycles = 50
+
+// nodeClock is a node's view of the cluster's clock, which may be off by a fixed amount.
+type nodeClock struct {
+	mutex sync.Mutex
+	base  clock.Clock
+	skew  time.Duration
+}
+
+func (n *nodeClock) Now() time.Time {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.base.Now().Add(n.skew)
+}
+
+// Node is a simulated cluster node, running a keyclient in its own root.
+type Node struct {
+	Hostname string
+	Kind     string
+	Env      hostenv.Env
+	State    *state.ClientState
+	Loop     *actloop.ActLoop
+	// an offline node's keyclient doesn't run during convergence passes, as if the node were powered off
+	Offline bool
+	clock   *nodeClock
+}
+
+// SetClockSkew makes the node's clock run ahead of the cluster's clock by skew, or behind it if skew is negative.
+func (n *Node) SetClockSkew(skew time.Duration) {
+	n.clock.mutex.Lock()
+	defer n.clock.mutex.Unlock()
+	n.clock.skew = skew
+}
+
+// Follower is a keyserver on an additional supervisor, which follows the leader keyserver.
+type Follower struct {
+	Hostname  string
+	Keyserver *keyapi.ConfiguredKeyserver
+	address   string
+	stop      func()
+}
+
+// Stop shuts down the follower keyserver.
+func (f *Follower) Stop() {
+	if f.stop != nil {
+		f.stop()
+		f.stop = nil
+	}
+}
+
+// Cluster is a keyserver and the keyclients on each node of a simulated cluster.
+type Cluster struct {
+	Clock *clock.Fake
+	Dir   string
+	// the leader keyserver
+	Keyserver *keyapi.ConfiguredKeyserver
+	Followers []*Follower
+	Nodes     []*Node
+	logger    *log.Logger
+	address   string
+	stop      func()
+}
+
+func writeFile(env hostenv.Env, filepath string, contents []byte, mode os.FileMode) error {
+	filepath = env.Path(filepath)
+	err := fileutil.EnsureIsFolder(path.Dir(filepath))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath, contents, mode)
+}
+
+func buildSetup(followers int, kinds []string) *worldconfig.SpireSetup {
+	setup := &worldconfig.SpireSetup{
+		Nodes: []*worldconfig.SpireNode{{Hostname: SupervisorHostname, IP: NodeIP, Kind: worldconfig.Supervisor}},
+	}
+	for i := 0; i < followers; i++ {
+		hostname := fmt.Sprintf("%s%d", SupervisorHostname, i+2)
+		setup.Nodes = append(setup.Nodes, &worldconfig.SpireNode{Hostname: hostname, IP: NodeIP, Kind: worldconfig.Supervisor})
+	}
+	for i, kind := range kinds {
+		setup.Nodes = append(setup.Nodes, &worldconfig.SpireNode{Hostname: fmt.Sprintf("%s%d", kind, i+1), IP: NodeIP, Kind: kind})
+	}
+	setup.Cluster.ExternalDomain = ExternalDomain
+	setup.Cluster.InternalDomain = "cluster.local"
+	setup.Cluster.KerberosRealm = "SIM.EXAMPLE.COM"
+	setup.Cluster.AllowEnrollment = true
+	setup.RootAdmins = []string{AdminPrincipal}
+	setup.Addresses.ServiceAPI = "172.28.0.1"
+	return setup
+}
+
+func writeKeyserverConfig(env hostenv.Env, setup *worldconfig.SpireSetup) error {
+	data, err := yaml.Marshal(setup)
+	if err != nil {
+		return err
+	}
+	err = writeFile(env, paths.SpireSetupPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return writeFile(env, worldconfig.ClusterConfigPath, []byte("CLUSTER_DOMAIN=cluster.local\n"), 0644)
+}
+
+func (c *Cluster) prepareKeyserver(env hostenv.Env, setup *worldconfig.SpireSetup) error {
+	err := writeKeyserverConfig(env, setup)
+	if err != nil {
+		return err
+	}
+	authorities := env.Path(worldconfig.AuthorityKeyDirectory)
+	err = fileutil.EnsureIsFolder(authorities)
+	if err != nil {
+		return err
+	}
+	return keygen.GenerateKeys(authorities)
+}
+
+// prepareFollower prepares a keyserver with copies of the leader's authorities, as spire would upload them.
+func (c *Cluster) prepareFollower(env hostenv.Env, leader hostenv.Env, setup *worldconfig.SpireSetup) error {
+	err := writeKeyserverConfig(env, setup)
+	if err != nil {
+		return err
+	}
+	authorities := leader.Path(worldconfig.AuthorityKeyDirectory)
+	files, err := ioutil.ReadDir(authorities)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(path.Join(authorities, file.Name()))
+		if err != nil {
+			return err
+		}
+		err = writeFile(env, path.Join(worldconfig.AuthorityKeyDirectory, file.Name()), data, file.Mode())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startKeyserver loads the keyserver configuration and starts serving it on a loopback port.
+func (c *Cluster) startKeyserver(env hostenv.Env) (*keyapi.ConfiguredKeyserver, string, func(), error) {
+	ctx, err := worldconfig.GenerateConfig(env)
+	if err != nil {
+		return nil, "", nil, errors.Wrap(err, "while loading keyserver configuration")
+	}
+	ctx.KeyserverDNS = keyserverAddress
+	if ctx.Follower != nil {
+		ctx.Follower.Leader = c.address
+	}
+	_, serverKey, err := certutil.GenerateRSA(keyapi.TemporaryCertificateBits)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	ks := &keyapi.ConfiguredKeyserver{Context: ctx, ServerKey: serverKey, Logger: c.logger}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(keyserverAddress, "0"))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	stop, cherr := keyapi.Serve(ks, ln, c.Clock, c.logger)
+	go func() {
+		c.logger.Printf("keyserver stopped: %v", <-cherr)
+	}()
+	return ks, ln.Addr().String(), stop, nil
+}
+
+// startFollower prepares and starts the keyserver on an additional supervisor.
+func (c *Cluster) startFollower(hostname string, leader hostenv.Env, setup *worldconfig.SpireSetup) error {
+	env := hostenv.Relocated(path.Join(c.Dir, "keyserver-"+hostname))
+	env.Clock = c.Clock
+	err := env.Effects.SetHostname(hostname)
+	if err != nil {
+		return err
+	}
+	err = c.prepareFollower(env, leader, setup)
+	if err != nil {
+		return errors.Wrapf(err, "while preparing follower keyserver on %s", hostname)
+	}
+	f := &Follower{Hostname: hostname}
+	f.Keyserver, f.address, f.stop, err = c.startKeyserver(env)
+	if err != nil {
+		return err
+	}
+	c.Followers = append(c.Followers, f)
+	return nil
+}
+
+// keyserverDomain lists every keyserver, leader first, as keyserver.domain would.
+func (c *Cluster) keyserverDomain() string {
+	keyservers := []string{c.address}
+	for _, f := range c.Followers {
+		keyservers = append(keyservers, f.address)
+	}
+	return strings.Join(keyservers, "\n") + "\n"
+}
+
+const SSHHostKeyBits = 2048
+
+func generateSSHHostKey() (privkey []byte, pubkey []byte, err error) {
+	key, privkey, err := certutil.GenerateRSA(SSHHostKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	sshPubkey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	return privkey, ssh.MarshalAuthorizedKey(sshPubkey), nil
+}
+
+// prepareNode prepares a machine's root the way that its installation would, and loads its keyclient.
+func (c *Cluster) prepareNode(hostname string, kind string) (*Node, error) {
+	env := hostenv.Relocated(path.Join(c.Dir, hostname))
+	nc := &nodeClock{base: c.Clock}
+	env.Clock = nc
+	err := writeFile(env, paths.KeyserverDomainPath, []byte(c.keyserverDomain()), 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFile(env, paths.KeyserverTLSCert, c.Keyserver.Context.ClusterCA.GetPublicKey(), 0644)
+	if err != nil {
+		return nil, err
+	}
+	hostkey, hostpub, err := generateSSHHostKey()
+	if err != nil {
+		return nil, err
+	}
+	err = writeFile(env, paths.SSHHostKeyPath, hostkey, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFile(env, paths.SSHHostKeyPath+".pub", hostpub, 0644)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{Hostname: hostname, Kind: kind, Env: env, clock: nc}
+	ks, err := api.LoadKeyserver(env, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	n.State, _ = state.NewClientState(ks, env) // the only possible warning is about the missing keygranting cert
+	loop := actloop.NewActLoop(worldconfig.ConvergeState, c.logger)
+	n.Loop = &loop
+	return n, nil
+}
+
+// addNode prepares a node listed in the setup, and gives it a bootstrap token.
+func (c *Cluster) addNode(node *worldconfig.SpireNode) error {
+	n, err := c.prepareNode(node.Hostname, node.Kind)
+	if err != nil {
+		return err
+	}
+	c.Nodes = append(c.Nodes, n)
+	return c.Bootstrap(n)
+}
+
+// AddMachine prepares a worker that isn't listed in the setup, and has no bootstrap token, so that it can only join the
+// cluster by enrolling.
+func (c *Cluster) AddMachine(hostname string) (*Node, error) {
+	n, err := c.prepareNode(hostname, worldconfig.Worker)
+	if err != nil {
+		return nil, err
+	}
+	c.Nodes = append(c.Nodes, n)
+	return n, nil
+}
+
+// NewCluster creates a cluster under dir, which must already exist, with a supervisor node and one node of each of the
+// listed kinds. The keyserver is started, and each node is given a bootstrap token, but no keyclient has run yet.
+func NewCluster(dir string, logger *log.Logger, kinds ...string) (*Cluster, error) {
+	return NewReplicatedCluster(dir, logger, 0, kinds...)
+}
+
+// NewReplicatedCluster creates a cluster like NewCluster, but with the specified number of additional supervisors, each
+// running a keyserver that follows the first supervisor's.
+func NewReplicatedCluster(dir string, logger *log.Logger, followers int, kinds ...string) (*Cluster, error) {
+	c := &Cluster{Dir: dir, logger: logger}
+	setup := buildSetup(followers, kinds)
+	ksEnv := hostenv.Relocated(path.Join(dir, "keyserver"))
+	err := ksEnv.Effects.SetHostname(SupervisorHostname)
+	if err != nil {
+		return nil, err
+	}
+	err = c.prepareKeyserver(ksEnv, setup)
+	if err != nil {
+		return nil, errors.Wrap(err, "while preparing keyserver")
+	}
+	// the generated authorities are only valid from the current time
+	c.Clock = clock.NewFake(time.Now())
+	ksEnv.Clock = c.Clock
+	c.Keyserver, c.address, c.stop, err = c.startKeyserver(ksEnv)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range setup.Nodes {
+		if node.IsSupervisor() && node.Hostname != SupervisorHostname {
+			err = c.startFollower(node.Hostname, ksEnv, setup)
+			if err != nil {
+				c.Stop()
+				return nil, err
+			}
+		}
+	}
+	for _, node := range setup.Nodes {
+		err = c.addNode(node)
+		if err != nil {
+			c.Stop()
+			return nil, errors.Wrapf(err, "while preparing node %s", node.Hostname)
+		}
+	}
+	return c, nil
+}
+
+// StopLeader shuts down the leader keyserver, so that the keyclients can only reach the followers, if any.
+func (c *Cluster) StopLeader() {
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+	}
+}
+
+// Stop shuts down every keyserver, so that the keyclients can no longer reach any of them.
+func (c *Cluster) Stop() {
+	c.StopLeader()
+	for _, f := range c.Followers {
+		f.Stop()
+	}
+}
+
+// Node finds the node with the specified hostname, or nil if there is none.
+func (c *Cluster) Node(hostname string) *Node {
+	for _, node := range c.Nodes {
+		if node.Hostname == hostname {
+			return node
+		}
+	}
+	return nil
+}
+
+// Bootstrap issues a new bootstrap token to a node, as an administrator would with keyinitadmit.
+func (c *Cluster) Bootstrap(node *Node) error {
+	token := c.Keyserver.Context.TokenVerifier.Registry.GrantToken(node.Hostname+"."+ExternalDomain, BootstrapTokenLifespan)
+	return writeFile(node.Env, paths.BootstrapTokenPath, []byte(token+"\n"), 0600)
+}
+
+// Admin performs an operation on the keyserver as a root admin, as keyreq would after authenticating with Kerberos.
+func (c *Cluster) Admin(api string, param string) (string, error) {
+	admin, err := c.Keyserver.Context.GetAccount(AdminPrincipal)
+	if err != nil {
+		return "", err
+	}
+	privilege, found := admin.Privileges[api]
+	if !found {
+		return "", fmt.Errorf("no privilege for %s", api)
+	}
+	return privilege(&account.OperationContext{Account: admin}, param)
+}
+
+// Converge has each running follower copy the leader's state, and then runs a single convergence pass on every online
+// node, and fails if any of them didn't stabilize.
+func (c *Cluster) Converge() error {
+	for _, f := range c.Followers {
+		if f.stop == nil {
+			continue
+		}
+		err := f.Keyserver.Context.Follower.Sync()
+		if err != nil {
+			// just like a real follower, keep serving from the last copy of the leader's state
+			c.logger.Printf("%s could not follow leader: %v", f.Hostname, err)
+		}
+	}
+	var unstable []string
+	for _, node := range c.Nodes {
+		if node.Offline {
+			continue
+		}
+		stable, err := node.Loop.RunOnce(node.State, 0, MaxCycles)
+		if err != nil {
+			return errors.Wrapf(err, "while converging %s", node.Hostname)
+		}
+		if !stable {
+			unstable = append(unstable, node.Hostname)
+		}
+	}
+	if len(unstable) > 0 {
+		return fmt.Errorf("nodes did not stabilize: %s", strings.Join(unstable, ", "))
+	}
+	return nil
+}
+
+// Advance moves the clock forward by duration in increments of step, and runs a convergence pass after each increment.
+func (c *Cluster) Advance(duration time.Duration, step time.Duration) error {
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += step {
+		if step > duration-elapsed {
+			step = duration - elapsed
+		}
+		c.Clock.Advance(step)
+		err := c.Converge()
+		if err != nil {
+			return errors.Wrapf(err, "at %v", c.Clock.Now())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1422 @@
+package simulation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/api/reqtarget"
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/enroll"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/keyreq"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/oneshot"
+	"github.com/sipb/homeworld/platform/keysystem/keygen"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/account"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/inventory"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/keyapi"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/revocation"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/signer"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/util/certutil"
+	"github.com/sipb/homeworld/platform/util/csrutil"
+	"github.com/sipb/homeworld/platform/util/sealutil"
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+func launchCluster(t *testing.T) (*Cluster, func()) {
+	return launchReplicatedCluster(t, 0)
+}
+
+func launchReplicatedCluster(t *testing.T, followers int) (*Cluster, func()) {
+	dir, err := ioutil.TempDir("", "simulation-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+	if testing.Verbose() {
+		logger = log.New(os.Stderr, "[simulation] ", log.Ltime)
+	}
+	cluster, err := NewReplicatedCluster(dir, logger, followers, worldconfig.Worker, worldconfig.Master)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return cluster, func() {
+		cluster.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func checkNodes(t *testing.T, cluster *Cluster, expected int) {
+	for _, node := range cluster.Nodes {
+		out := &bytes.Buffer{}
+		if code := oneshot.Check(node.Env, out); code != expected {
+			t.Errorf("check on %s exited with %d instead of %d:\n%s", node.Hostname, code, expected, out.String())
+		}
+	}
+}
+
+func grantingExpiration(t *testing.T, node *Node) time.Time {
+	cert, err := ioutil.ReadFile(node.Env.Path(paths.GrantingCertPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiration, err := certutil.CheckTLSCertExpiration(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expiration
+}
+
+func checkNodeDirectory(t *testing.T, cluster *Cluster) {
+	for _, node := range cluster.Nodes {
+		hosts, err := ioutil.ReadFile(node.Env.Path(paths.HostsPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		knownHosts, err := ioutil.ReadFile(node.Env.Path(paths.KnownHostsPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, other := range cluster.Nodes {
+			dns := other.Hostname + "." + ExternalDomain
+			if !strings.Contains(string(hosts), NodeIP+"\t"+dns+" "+other.Hostname+"\n") {
+				t.Errorf("no entry for %s in /etc/hosts on %s:\n%s", other.Hostname, node.Hostname, hosts)
+			}
+			if !strings.Contains(string(knownHosts), dns+","+other.Hostname+","+NodeIP) {
+				t.Errorf("no entry for %s in ssh_known_hosts on %s:\n%s", other.Hostname, node.Hostname, knownHosts)
+			}
+		}
+		if !strings.HasPrefix(string(knownHosts), "# BEGIN homeworld nodes") || strings.Count(string(knownHosts), "@cert-authority ") != 1 {
+			t.Errorf("unexpected ssh_known_hosts on %s:\n%s", node.Hostname, knownHosts)
+		}
+	}
+}
+
+func checkInventory(t *testing.T, cluster *Cluster) {
+	now := cluster.Clock.Now()
+	nodes := cluster.Keyserver.Context.Inventory.Snapshot()
+	if len(nodes) != len(cluster.Nodes) {
+		t.Fatalf("expected %d nodes in inventory, not %d", len(cluster.Nodes), len(nodes))
+	}
+	for _, node := range nodes {
+		if node.LastSeen == nil || node.Report == nil {
+			t.Errorf("node %s never checked in", node.Principal)
+			continue
+		}
+		if now.Sub(*node.LastSeen) > worldconfig.CheckinInterval+time.Minute || node.ClockSkew != 0 {
+			t.Errorf("node %s last checked in at %v with skew %v", node.Principal, node.LastSeen, node.ClockSkew)
+		}
+		if len(node.Report.Certificates) == 0 || len(node.Report.Blocked) != 0 {
+			t.Errorf("unexpected report from %s: %+v", node.Principal, node.Report)
+		}
+		for _, cert := range node.Report.Certificates {
+			if cert.Serial == "" {
+				t.Errorf("no serial reported for %s on %s", cert.Path, node.Principal)
+			}
+		}
+		if stale := node.Stale(now, inventory.StaleMargin); len(stale) != 0 {
+			t.Errorf("node %s reported stale certificates: %+v", node.Principal, stale)
+		}
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+
+	// bootstrap
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+	checkNodeDirectory(t, cluster)
+	checkInventory(t, cluster)
+	worker := cluster.Node("worker1")
+	if worker == nil {
+		t.Fatal("no worker node")
+	}
+	initial := grantingExpiration(t, worker)
+
+	// renew: two months is long enough for every certificate to be renewed at least once
+	if err := cluster.Advance(60*worldconfig.OneDay, 12*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+	if renewed := grantingExpiration(t, worker); !renewed.After(initial.Add(30 * worldconfig.OneDay)) {
+		t.Errorf("keygranting certificate was not renewed: expires %v, originally %v", renewed, initial)
+	}
+	checkInventory(t, cluster)
+
+	// expire: without the keyserver, nothing can be renewed
+	cluster.Stop()
+	cluster.Clock.Advance(60 * worldconfig.OneDay)
+	checkNodes(t, cluster, oneshot.ExitFailed)
+}
+
+func TestBootstrap_ExpiredToken(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+
+	cluster.Clock.Advance(BootstrapTokenLifespan + time.Minute)
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range cluster.Nodes {
+		if node.State.Keygrant != nil {
+			t.Errorf("node %s bootstrapped with an expired token", node.Hostname)
+		}
+	}
+
+	// a fresh token lets the node join
+	worker := cluster.Node("worker1")
+	if err := cluster.Bootstrap(worker); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Advance(time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if worker.State.Keygrant == nil {
+		t.Error("node did not bootstrap with a fresh token")
+	}
+}
+
+func TestReenrollment(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	worker := cluster.Node("worker1")
+	if worker == nil {
+		t.Fatal("no worker node")
+	}
+
+	// longer than the keygranting certificate lasts, but not the ssh host certificate
+	worker.Offline = true
+	if err := cluster.Advance(45*worldconfig.OneDay, worldconfig.OneDay); err != nil {
+		t.Fatal(err)
+	}
+	if expiration := grantingExpiration(t, worker); expiration.After(cluster.Clock.Now()) {
+		t.Fatalf("keygranting certificate did not expire while offline: expires %v", expiration)
+	}
+
+	// the node proves possession of its ssh host key instead of needing a new bootstrap token
+	worker.Offline = false
+	if err := cluster.Advance(time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if expiration := grantingExpiration(t, worker); !expiration.After(cluster.Clock.Now().Add(30 * worldconfig.OneDay)) {
+		t.Errorf("node did not re-enroll: keygranting certificate expires %v", expiration)
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+}
+
+func TestEnrollment(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	machine, err := cluster.AddMachine("worker9")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the machine asks to join, but has to wait for an administrator
+	if err := enroll.RequestEnrollment(machine.Env, machine.Hostname, NodeIP, worldconfig.Worker); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	queue := cluster.Keyserver.Context.Enrollments
+	enrollments := queue.List()
+	if len(enrollments) != 1 || enrollments[0].State != enrollment.Pending || enrollments[0].Request.Hostname != "worker9" {
+		t.Fatalf("unexpected enrollments: %+v", enrollments)
+	}
+	if !strings.HasPrefix(enrollments[0].Request.HostKeyFingerprint, "SHA256:") {
+		t.Errorf("wrong host key fingerprint: %s", enrollments[0].Request.HostKeyFingerprint)
+	}
+	if machine.State.Keygrant != nil {
+		t.Fatal("machine joined without approval")
+	}
+
+	// once approved, the machine picks up its keygranting certificate, and the rest of the cluster learns about it
+	if _, err := queue.Approve(enrollments[0].ID, "admin@SIM.EXAMPLE.COM"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Advance(2*time.Hour, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if machine.State.Keygrant == nil {
+		t.Fatal("machine did not join after approval")
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+	checkNodeDirectory(t, cluster)
+	checkInventory(t, cluster)
+
+	// and the node remains part of the cluster when the keyserver restarts
+	ctx, err := worldconfig.GenerateConfig(hostenv.Relocated(path.Join(cluster.Dir, "keyserver")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.GetAccount("worker9." + ExternalDomain); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecommission(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	worker := cluster.Node("worker1")
+	if worker == nil {
+		t.Fatal("no worker node")
+	}
+	// the keygranting certificate has been reported to the keyserver
+	if err := cluster.Advance(worldconfig.CheckinInterval, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if worker.State.Keygrant == nil {
+		t.Fatal("worker did not join")
+	}
+	keygrant := *worker.State.Keygrant
+
+	if _, err := cluster.Admin(worldconfig.DecommissionAPI, "master2"); err == nil || !strings.Contains(err.Error(), "only workers") {
+		t.Errorf("expected refusal to decommission a master, not %v", err)
+	}
+	result, err := cluster.Admin(worldconfig.DecommissionAPI, "worker1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var revoked []revocation.Certificate
+	if err := json.Unmarshal([]byte(result), &revoked); err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(keygrant.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := leaf.SerialNumber.Text(16)
+	found := false
+	for _, cert := range revoked {
+		if cert.Serial == serial && cert.Path == worker.Env.Path(paths.GrantingCertPath) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("keygranting certificate %s not revoked: %+v", serial, revoked)
+	}
+	// certificates are revoked because the keyserver recorded issuing them, even those the node never reported
+	issuedThrough := map[string]bool{}
+	for _, cert := range revoked {
+		issuedThrough[cert.API] = true
+	}
+	for _, api := range []string{worldconfig.RenewKeygrantAPI, worldconfig.SignSSHHostKeyAPI, worldconfig.SignKubernetesWorkerAPI} {
+		if !issuedThrough[api] {
+			t.Errorf("certificate issued through %s not revoked: %+v", api, revoked)
+		}
+	}
+
+	// the node can no longer authenticate to the keyserver, even though its certificate has not expired
+	rt, err := worker.State.Keyserver.AuthenticateWithCert(keygrant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reqtarget.SendRequest(rt, worldconfig.NodeDirectoryAPI, ""); err == nil {
+		t.Error("decommissioned node could still authenticate")
+	}
+
+	// the rest of the cluster forgets about the node
+	worker.Offline = true
+	var remaining []*Node
+	for _, node := range cluster.Nodes {
+		if node != worker {
+			remaining = append(remaining, node)
+		}
+	}
+	cluster.Nodes = remaining
+	if err := cluster.Advance(2*time.Hour, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+	checkNodeDirectory(t, cluster)
+	checkInventory(t, cluster)
+	for _, node := range cluster.Nodes {
+		hosts, err := ioutil.ReadFile(node.Env.Path(paths.HostsPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(hosts), "worker1") {
+			t.Errorf("decommissioned node still in /etc/hosts on %s:\n%s", node.Hostname, hosts)
+		}
+	}
+
+	// and the node stays out of the cluster when the keyserver restarts, even though it is still in setup.yaml
+	ctx, err := worldconfig.GenerateConfig(hostenv.Relocated(path.Join(cluster.Dir, "keyserver")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.GetAccount("worker1." + ExternalDomain); err == nil {
+		t.Error("decommissioned node has an account after restart")
+	}
+	if !ctx.Revocations.IsRevoked(serial) {
+		t.Error("revocation not persisted")
+	}
+}
+
+func TestKeyserverFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchReplicatedCluster(t, 1)
+	defer cleanup()
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	follower := cluster.Followers[0]
+	if node := cluster.Node(follower.Hostname); node == nil || node.State.Keygrant == nil {
+		t.Fatal("second supervisor did not join")
+	}
+
+	// a machine enrolls and a worker is decommissioned through the leader, and the follower copies both changes
+	machine, err := cluster.AddMachine("worker9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enroll.RequestEnrollment(machine.Env, machine.Hostname, NodeIP, worldconfig.Worker); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	enrollments := cluster.Keyserver.Context.Enrollments.List()
+	if len(enrollments) != 1 {
+		t.Fatalf("unexpected enrollments: %+v", enrollments)
+	}
+	if _, err := cluster.Keyserver.Context.Enrollments.Approve(enrollments[0].ID, AdminPrincipal); err != nil {
+		t.Fatal(err)
+	}
+	worker := cluster.Node("worker1")
+	if _, err := cluster.Admin(worldconfig.DecommissionAPI, worker.Hostname); err != nil {
+		t.Fatal(err)
+	}
+	worker.Offline = true
+	if err := cluster.Advance(2*time.Hour, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if machine.State.Keygrant == nil {
+		t.Fatal("machine did not join after approval")
+	}
+	ctx := follower.Keyserver.Context
+	if _, err := ctx.GetAccount("worker9." + ExternalDomain); err != nil {
+		t.Errorf("follower did not learn about enrolled node: %v", err)
+	}
+	if _, err := ctx.GetAccount("worker1." + ExternalDomain); err == nil {
+		t.Error("follower still has an account for decommissioned node")
+	}
+	if !ctx.Revocations.IsDecommissioned("worker1." + ExternalDomain) {
+		t.Error("follower did not learn about decommissioned node")
+	}
+
+	// the follower refuses to change the cluster's membership itself
+	admin, err := ctx.GetAccount(AdminPrincipal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, api := range []string{"bootstrap", worldconfig.ApproveEnrollmentAPI, worldconfig.DecommissionAPI} {
+		if _, err := admin.Privileges[api](&account.OperationContext{Account: admin}, "worker2"); err == nil || !strings.Contains(err.Error(), "leader") {
+			t.Errorf("expected follower to refuse %s, not %v", api, err)
+		}
+	}
+
+	// once the leader is lost, the remaining nodes keep renewing their certificates through the follower
+	expirations := map[string]time.Time{}
+	for _, node := range cluster.Nodes {
+		if node != worker {
+			expirations[node.Hostname] = grantingExpiration(t, node)
+		}
+	}
+	cluster.StopLeader()
+	if err := cluster.Advance(41*worldconfig.OneDay, 12*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range cluster.Nodes {
+		if node == worker {
+			continue
+		}
+		if expiration := grantingExpiration(t, node); !expiration.After(expirations[node.Hostname]) {
+			t.Errorf("keygranting certificate on %s was not renewed: expires %v", node.Hostname, expiration)
+		}
+	}
+}
+
+// fetchFromTenant downloads the keygranting authority from a keyserver shared by several clusters, selecting the tenant
+// by serverName, and only trusting a server certificate issued by the expected cluster's CA.
+func fetchFromTenant(address string, serverName string, expected *Cluster, cert *tls.Certificate) (string, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		// the keyserver's certificate is issued for its address, rather than for the tenant's name
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			_, err = leaf.Verify(x509.VerifyOptions{
+				Roots:       expected.Keyserver.Context.ClusterCA.ToCertPool(),
+				CurrentTime: expected.Clock.Now(),
+			})
+			return err
+		},
+	}
+	if cert != nil {
+		// always present the certificate, even if the keyserver asks for one from a different authority
+		config.GetClientCertificate = func(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	response, err := client.Get("https://" + address + "/pub/" + worldconfig.KeygrantingAuthority)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", response.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+func TestSharedKeyserver(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	staging, cleanupStaging := launchCluster(t)
+	defer cleanupStaging()
+	production, cleanupProduction := launchCluster(t)
+	defer cleanupProduction()
+	for _, cluster := range []*Cluster{staging, production} {
+		if err := cluster.Converge(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stagingCert := staging.Node("worker1").State.Keygrant
+	productionCert := production.Node("worker1").State.Keygrant
+	if stagingCert == nil || productionCert == nil {
+		t.Fatal("workers did not join")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants := map[string]keyapi.Keyserver{"staging.test": staging.Keyserver, "production.test": production.Keyserver}
+	// a real shared keyserver has one clock; production's was started last, so certificates from either cluster are valid
+	stop, _ := keyapi.ServeTenants(tenants, ln, production.Clock, production.logger)
+	defer stop()
+	address := ln.Addr().String()
+
+	// each tenant is served its own cluster, and accepts its own nodes
+	for _, tenant := range []struct {
+		name    string
+		cluster *Cluster
+		cert    *tls.Certificate
+	}{{"staging.test", staging, stagingCert}, {"production.test", production, productionCert}} {
+		expected := string(tenant.cluster.Keyserver.Context.AuthenticationAuthority.GetPublicKey())
+		for _, cert := range []*tls.Certificate{nil, tenant.cert} {
+			authority, err := fetchFromTenant(address, tenant.name, tenant.cluster, cert)
+			if err != nil {
+				t.Errorf("could not reach %s: %v", tenant.name, err)
+			} else if authority != expected {
+				t.Errorf("wrong keygranting authority from %s", tenant.name)
+			}
+		}
+	}
+
+	// but never the other cluster's nodes
+	if _, err := fetchFromTenant(address, "production.test", production, stagingCert); err == nil {
+		t.Error("production accepted a staging node")
+	}
+	if _, err := fetchFromTenant(address, "staging.test", staging, productionCert); err == nil {
+		t.Error("staging accepted a production node")
+	}
+	// and connections must name a tenant
+	if _, err := fetchFromTenant(address, "", staging, nil); err == nil {
+		t.Error("connection without a server name was accepted")
+	}
+	if _, err := fetchFromTenant(address, "other.test", staging, nil); err == nil {
+		t.Error("connection to an unknown tenant was accepted")
+	}
+}
+
+// loadKeyserverConfig loads the keyserver configuration afresh, as a restarted keyserver would.
+func loadKeyserverConfig(cluster *Cluster) (*config.Context, error) {
+	env := hostenv.Relocated(path.Join(cluster.Dir, "keyserver"))
+	if err := env.Effects.SetHostname(SupervisorHostname); err != nil {
+		return nil, err
+	}
+	return worldconfig.GenerateConfig(env)
+}
+
+func TestSealedAuthorities(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	ksAuthorities := path.Join(cluster.Dir, "keyserver", worldconfig.AuthorityKeyDirectory)
+	passphraseFile := path.Join(cluster.Dir, "keyserver", worldconfig.AuthorityPassphrasePath)
+
+	if err := keygen.SealKeys(ksAuthorities, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	for _, authority := range worldconfig.ListAuthorities() {
+		keyfile, _ := authority.Filenames()
+		data, err := ioutil.ReadFile(path.Join(ksAuthorities, keyfile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sealutil.IsSealed(data) {
+			t.Errorf("key for authority %s was not sealed", authority.Name)
+		}
+	}
+	if err := keygen.SealKeys(ksAuthorities, []byte("correct horse")); err == nil {
+		t.Error("expected sealed keys not to be sealed again")
+	}
+
+	// without a passphrase, nobody answers the prompt, so the keyserver cannot start
+	if _, err := loadKeyserverConfig(cluster); err == nil {
+		t.Error("expected sealed authorities not to load without a passphrase")
+	}
+
+	if err := os.MkdirAll(path.Dir(passphraseFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(passphraseFile, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := loadKeyserverConfig(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, authority := range cluster.Keyserver.Context.Authorities {
+		if !bytes.Equal(ctx.Authorities[name].GetPublicKey(), authority.GetPublicKey()) {
+			t.Errorf("unsealed authority %s does not match the original", name)
+		}
+	}
+
+	// once the keys are resealed, the previous passphrase no longer unseals them
+	if err := keygen.ResealKeys(ksAuthorities, []byte("wrong horse"), []byte("battery staple")); err == nil {
+		t.Error("expected keys not to be resealed with the wrong passphrase")
+	}
+	if err := keygen.ResealKeys(ksAuthorities, []byte("correct horse"), []byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyserverConfig(cluster); err == nil {
+		t.Error("expected resealed authorities not to load with the previous passphrase")
+	}
+	if err := ioutil.WriteFile(passphraseFile, []byte("battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyserverConfig(cluster); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExternalSigner(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	ksRoot := path.Join(cluster.Dir, "keyserver")
+	ksAuthorities := path.Join(ksRoot, worldconfig.AuthorityKeyDirectory)
+	socket := "/run/homeworld/keysigner/keysigner.sock"
+
+	// move the keys of one TLS authority and one SSH authority into a signing daemon
+	keys := map[string]crypto.Signer{}
+	for _, name := range []string{worldconfig.KubernetesAuthority, worldconfig.SSHUserAuthority} {
+		authority := config.TLSAuthority(name)
+		if name == worldconfig.SSHUserAuthority {
+			authority = config.SSHAuthority(name)
+		}
+		keyfile, _ := authority.Filenames()
+		data, err := ioutil.ReadFile(path.Join(ksAuthorities, keyfile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name], err = wraputil.LoadRSAKeyFromPEM(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(path.Join(ksAuthorities, keyfile)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(path.Dir(path.Join(ksRoot, socket)), 0700); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", path.Join(ksRoot, socket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: signer.Handler(keys, log.New(ioutil.Discard, "", 0))}
+	go server.Serve(ln)
+	defer server.Close()
+
+	signers := fmt.Sprintf("signers:\n  - authority: %s\n    socket: %s\n  - authority: %s\n    socket: %s\n",
+		worldconfig.KubernetesAuthority, socket, worldconfig.SSHUserAuthority, socket)
+	if err := ioutil.WriteFile(path.Join(ksRoot, worldconfig.SignersPath), []byte(signers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := loadKeyserverConfig(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, authority := range cluster.Keyserver.Context.Authorities {
+		if !bytes.Equal(ctx.Authorities[name].GetPublicKey(), authority.GetPublicKey()) {
+			t.Errorf("authority %s does not match the original", name)
+		}
+	}
+
+	// certificates issued through the signer are valid under the original authority
+	kubernetes := ctx.Authorities[worldconfig.KubernetesAuthority].(*authorities.TLSAuthority)
+	if kubernetes.GetPrivateKey() != nil {
+		t.Error("private key should not be available from an external signer")
+	}
+	_, keyPEM, err := certutil.GenerateRSA(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := csrutil.BuildTLSCSR(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := kubernetes.Sign(string(csr), false, time.Hour, "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := wraputil.LoadX509CertFromPEM([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := cluster.Keyserver.Context.Authorities[worldconfig.KubernetesAuthority].(*authorities.TLSAuthority)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:       original.ToCertPool(),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		CurrentTime: cluster.Clock.Now(),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the keyserver cannot start without its signer
+	server.Close()
+	if _, err := loadKeyserverConfig(cluster); err == nil {
+		t.Error("expected keyserver not to start without its signer")
+	}
+
+	// nodes fetch the service account key, so it cannot be held by a signer
+	signers = fmt.Sprintf("signers:\n  - authority: %s\n    socket: %s\n", worldconfig.ServiceAccountAuthority, socket)
+	if err := ioutil.WriteFile(path.Join(ksRoot, worldconfig.SignersPath), []byte(signers), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadKeyserverConfig(cluster); err == nil {
+		t.Error("expected service account authority not to be held by a signer")
+	}
+}
+
+func TestRecoveryBundle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	ksAuthorities := path.Join(cluster.Dir, "keyserver", worldconfig.AuthorityKeyDirectory)
+	if err := keygen.SealKeys(ksAuthorities, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := keygen.ExportRecovery(ksAuthorities, nil, 5, 3); err == nil {
+		t.Error("expected sealed authorities not to be exported without a passphrase")
+	}
+	bundle, shares, err := keygen.ExportRecovery(ksAuthorities, []byte("correct horse"), 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("wrong number of shares: %d", len(shares))
+	}
+	for _, share := range shares {
+		for _, c := range share {
+			if !strings.ContainsRune("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ $%*+-./:", c) {
+				t.Errorf("share cannot be encoded by a QR code in alphanumeric mode: %q", share)
+				break
+			}
+		}
+	}
+
+	restored := path.Join(cluster.Dir, "restored")
+	if err := keygen.ImportRecovery(bundle, shares[:2], restored, nil); err == nil {
+		t.Error("expected authorities not to be restored from fewer shares than the threshold")
+	}
+	mistyped := strings.Replace(shares[0], "-", "-0", 1)
+	if err := keygen.ImportRecovery(bundle, []string{mistyped, shares[1], shares[2]}, restored, nil); err == nil {
+		t.Error("expected mistyped share to be rejected")
+	}
+	_, otherShares, err := keygen.ExportRecovery(ksAuthorities, []byte("correct horse"), 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keygen.ImportRecovery(bundle, []string{otherShares[0], shares[1], shares[2]}, restored, nil); err == nil {
+		t.Error("expected share of a different bundle to be rejected")
+	}
+
+	if err := keygen.ImportRecovery(bundle, []string{shares[4], shares[1], shares[3]}, restored, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, authority := range worldconfig.ListAuthorities() {
+		loaded, err := authority.Load(restored, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(loaded.GetPublicKey(), cluster.Keyserver.Context.Authorities[authority.Name].GetPublicKey()) {
+			t.Errorf("restored authority %s does not match the original", authority.Name)
+		}
+	}
+	if err := keygen.ImportRecovery(bundle, shares[:3], restored, nil); err == nil {
+		t.Error("expected restored authorities not to be overwritten")
+	}
+
+	// an existing directory keeps its other files, and gains nothing if any restored file would be overwritten
+	existing, conflicting := path.Join(cluster.Dir, "existing"), path.Join(cluster.Dir, "conflicting")
+	_, certfile := worldconfig.ListAuthorities()[0].Filenames()
+	for _, d := range []string{existing, conflicting} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(existing, "README"), []byte("authorities\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(conflicting, certfile), []byte("unrelated\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := keygen.ImportRecovery(bundle, shares[:3], existing, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worldconfig.ListAuthorities()[0].Load(existing, nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path.Join(existing, "README")); err != nil {
+		t.Error(err)
+	}
+	if err := keygen.ImportRecovery(bundle, shares[:3], conflicting, nil); err == nil {
+		t.Error("expected existing file not to be overwritten")
+	}
+	if entries, err := ioutil.ReadDir(conflicting); err != nil || len(entries) != 1 {
+		t.Errorf("failed restore left files behind: %v", err)
+	}
+	entries, err := ioutil.ReadDir(cluster.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("staging directory %s left behind", entry.Name())
+		}
+	}
+}
+
+func issueClusterCert(t *testing.T, dir string, name string) *x509.Certificate {
+	clusterCA := config.TLSAuthority(worldconfig.ClusterCAAuthority)
+	loaded, err := clusterCA.Load(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority := loaded.(*authorities.TLSAuthority)
+	_, keydata, err := certutil.GenerateRSA(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := csrutil.BuildTLSCSR(keydata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := authority.Sign(string(csr), true, time.Hour, name, []string{name}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := wraputil.LoadX509CertFromPEM([]byte(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIncrementalKeygen(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	ksAuthorities := path.Join(cluster.Dir, "keyserver", worldconfig.AuthorityKeyDirectory)
+	optionsFile := path.Join(cluster.Dir, "keygen.yaml")
+	options := fmt.Sprintf(`authorities:
+  clusterca:
+    algorithm: rsa-2048
+    validity: 8760h
+    permitted-domains: [%s, homeworld.private]
+`, ExternalDomain)
+	if err := ioutil.WriteFile(optionsFile, []byte(options), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := keygen.LoadOptions(optionsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []string{
+		"authorities:\n  nonexistent: {}\n",
+		"authorities:\n  clusterca: {algorithm: dsa-1024}\n",
+		"authorities:\n  ssh-user: {validity: 24h}\n",
+	} {
+		if err := ioutil.WriteFile(optionsFile, []byte(invalid), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keygen.LoadOptions(optionsFile); err == nil {
+			t.Errorf("expected options to be rejected: %q", invalid)
+		}
+	}
+
+	// nothing is missing from a freshly generated directory
+	generated, err := keygen.GenerateMissingKeys(ksAuthorities, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 0 {
+		t.Errorf("expected no authorities to be generated, but generated %v", generated)
+	}
+
+	keyfile, certfile := config.TLSAuthority(worldconfig.ClusterCAAuthority).Filenames()
+	for _, filename := range []string{keyfile, certfile} {
+		if err := os.Remove(path.Join(ksAuthorities, filename)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := keygen.GenerateMissingKeys(ksAuthorities, opts, []byte("correct horse")); err == nil {
+		t.Error("expected new keys not to be sealed when the existing keys are not")
+	}
+	generated, err = keygen.GenerateMissingKeys(ksAuthorities, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 1 || generated[0] != worldconfig.ClusterCAAuthority {
+		t.Fatalf("expected only the cluster CA to be generated, but generated %v", generated)
+	}
+
+	// the regenerated cluster CA can only issue certificates for the permitted domains
+	permitted := issueClusterCert(t, ksAuthorities, "homeworld.private")
+	forbidden := issueClusterCert(t, ksAuthorities, "www.example.org")
+	caCert, err := wraputil.LoadX509FromPath(path.Join(ksAuthorities, certfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := time.Until(caCert.NotAfter); remaining > 8760*time.Hour || remaining < 8759*time.Hour {
+		t.Errorf("wrong validity for cluster CA: expires at %v", caCert.NotAfter)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	verify := x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	if _, err := permitted.Verify(verify); err != nil {
+		t.Error(err)
+	}
+	if _, err := forbidden.Verify(verify); err == nil {
+		t.Error("expected certificate outside of the permitted domains to be rejected")
+	}
+
+	// regenerating an authority publishes a rotation to it, so that nodes will accept it
+	_, pubfile := config.SSHAuthority(worldconfig.SSHUserAuthority).Filenames()
+	original, err := ioutil.ReadFile(path.Join(ksAuthorities, pubfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keygen.RegenerateKey(ksAuthorities, "nonexistent", opts, nil); err == nil {
+		t.Error("expected nonexistent authority not to be regenerated")
+	}
+	if err := keygen.RegenerateKey(ksAuthorities, worldconfig.SSHUserAuthority, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := ioutil.ReadFile(path.Join(ksAuthorities, pubfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(original, replacement) {
+		t.Fatal("authority was not regenerated")
+	}
+	ctx, err := loadKeyserverConfig(cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := ctx.Rotations[worldconfig.SSHUserAuthority]
+	if err := rotation.Follow(worldconfig.SSHUserAuthority, original, records, replacement); err != nil {
+		t.Error(err)
+	}
+
+	infos, err := keygen.Inventory(ksAuthorities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(worldconfig.ListAuthorities()) {
+		t.Fatalf("wrong number of authorities in inventory: %d", len(infos))
+	}
+	for _, info := range infos {
+		if !info.Present || info.Key != keygen.KeyUnsealed {
+			t.Errorf("wrong state for authority %s: present %v, key %s", info.Name, info.Present, info.Key)
+		}
+		expected, err := rotation.Fingerprint(ctx.Authorities[info.Name].GetPublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Fingerprint != expected {
+			t.Errorf("wrong fingerprint for authority %s", info.Name)
+		}
+		switch info.Name {
+		case worldconfig.ClusterCAAuthority:
+			if info.Algorithm != keygen.RSA2048 || len(info.PermittedDomains) != 2 || !info.Expires.Equal(caCert.NotAfter) {
+				t.Errorf("wrong inventory for cluster CA: %+v", info)
+			}
+		case worldconfig.SSHUserAuthority:
+			if info.Algorithm != keygen.RSA4096 || info.Rotations != 1 || !info.Expires.IsZero() {
+				t.Errorf("wrong inventory for SSH user CA: %+v", info)
+			}
+		}
+	}
+	var table bytes.Buffer
+	if err := keygen.WriteInventory(&table, infos); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(table.String(), ExternalDomain+",homeworld.private") {
+		t.Errorf("permitted domains missing from inventory:\n%s", table.String())
+	}
+}
+
+func copyFile(t *testing.T, source string, dest string) {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dest, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegenerateKey_Interrupted(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates several RSA keys")
+	}
+	dir, err := ioutil.TempDir("", "regenerate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authority := config.SSHAuthority(worldconfig.SSHUserAuthority)
+	keyfile, pubfile := authority.Filenames()
+	opts := keygen.Options{worldconfig.SSHUserAuthority: {Algorithm: keygen.RSA2048}}
+	original, replaced := path.Join(dir, "original"), path.Join(dir, "replaced")
+	for _, d := range []string{original, replaced} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := keygen.RegenerateKey(original, worldconfig.SSHUserAuthority, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	// regenerate a copy of the authority, to find what an interrupted regeneration would have staged
+	copyFile(t, path.Join(original, keyfile), path.Join(replaced, keyfile))
+	copyFile(t, path.Join(original, pubfile), path.Join(replaced, pubfile))
+	if err := keygen.RegenerateKey(replaced, worldconfig.SSHUserAuthority, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted after the replacement key was installed, but before its rotation record and public key were
+	copyFile(t, path.Join(replaced, authority.RotationFilename()), path.Join(original, authority.RotationFilename()+".next"))
+	copyFile(t, path.Join(replaced, keyfile), path.Join(original, keyfile))
+	copyFile(t, path.Join(replaced, pubfile), path.Join(original, pubfile+".next"))
+	if err := keygen.RegenerateKey(original, worldconfig.SSHUserAuthority, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{keyfile, pubfile, authority.RotationFilename()} {
+		expected, err := ioutil.ReadFile(path.Join(replaced, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ioutil.ReadFile(path.Join(original, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(expected, actual) {
+			t.Errorf("interrupted regeneration did not install the staged %s", filename)
+		}
+	}
+	for _, filename := range []string{pubfile, authority.RotationFilename()} {
+		if _, err := os.Stat(path.Join(original, filename+".next")); !os.IsNotExist(err) {
+			t.Errorf("staged %s left behind: %v", filename, err)
+		}
+	}
+
+	// interrupted before the replacement was completely staged, so it is discarded and generated again, without
+	// leaving behind a rotation record that leads to the discarded replacement
+	abandoned := path.Join(dir, "abandoned")
+	if err := os.Mkdir(abandoned, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{keyfile, pubfile, authority.RotationFilename()} {
+		copyFile(t, path.Join(original, filename), path.Join(abandoned, filename))
+	}
+	if err := keygen.RegenerateKey(abandoned, worldconfig.SSHUserAuthority, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	copyFile(t, path.Join(abandoned, keyfile), path.Join(original, keyfile+".next"))
+	copyFile(t, path.Join(abandoned, authority.RotationFilename()), path.Join(original, authority.RotationFilename()+".next"))
+	if err := keygen.RegenerateKey(original, worldconfig.SSHUserAuthority, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range []string{keyfile, authority.RotationFilename()} {
+		if _, err := os.Stat(path.Join(original, filename+".next")); !os.IsNotExist(err) {
+			t.Errorf("partially staged %s left behind: %v", filename, err)
+		}
+	}
+	previous, err := ioutil.ReadFile(path.Join(replaced, pubfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := ioutil.ReadFile(path.Join(original, pubfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(previous, next) {
+		t.Fatal("authority was not regenerated")
+	}
+	records, err := authority.LoadRotations(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotation.Follow(worldconfig.SSHUserAuthority, previous, records, next); err != nil {
+		t.Error(err)
+	}
+	if infos, err := keygen.Inventory(original); err != nil {
+		t.Error(err)
+	} else {
+		for _, info := range infos {
+			if info.Name == worldconfig.SSHUserAuthority && info.Rotations != 2 {
+				t.Errorf("expected two rotations, not %d", info.Rotations)
+			}
+		}
+	}
+}
+
+func clockBlocked(node *Node) bool {
+	for _, action := range node.Loop.Status().Snapshot().Actions {
+		for _, blocker := range action.BlockedBy {
+			if strings.Contains(blocker, "behind the keyserver's clock") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestClockSkew(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	worker := cluster.Node("worker1")
+	if worker == nil {
+		t.Fatal("no worker node")
+	}
+	// the authorities only become valid when they are generated, so a slow clock needs time to catch up to them
+	cluster.Clock.Advance(10 * time.Minute)
+
+	// certificates are backdated, so a node that is slightly behind can use them as soon as they are issued
+	worker.SetClockSkew(-time.Minute)
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+	if clockBlocked(worker) {
+		t.Error("node blocked by a skew within the limit")
+	}
+
+	// a node that is too far behind notices the next time it talks to the keyserver
+	worker.SetClockSkew(-3 * time.Minute)
+	if err := cluster.Advance(time.Hour, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !clockBlocked(worker) {
+		t.Error("node not blocked by a skew beyond the limit")
+	}
+	for _, node := range cluster.Keyserver.Context.Inventory.Snapshot() {
+		if node.Principal != worker.Hostname+"."+ExternalDomain {
+			continue
+		}
+		if node.ClockSkew < 2*time.Minute || node.Report == nil || len(node.Report.Blocked) == 0 {
+			t.Errorf("keyserver did not notice skew: %v, %+v", node.ClockSkew, node.Report)
+		}
+	}
+
+	// and recovers once its clock is fixed
+	worker.SetClockSkew(0)
+	if err := cluster.Advance(time.Hour, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if clockBlocked(worker) {
+		t.Error("node still blocked after its clock was fixed")
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+}
+
+func pinMismatch(node *Node, authority string) string {
+	for _, action := range node.Loop.Status().Snapshot().Actions {
+		if action.Authority == authority {
+			return action.Mismatch
+		}
+	}
+	return ""
+}
+
+func TestAuthorityPinning(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	worker := cluster.Node("worker1")
+	if worker == nil {
+		t.Fatal("no worker node")
+	}
+	original, err := ioutil.ReadFile(worker.Env.Path("/etc/ssh/ssh_user_ca.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// prepare a replacement for the ssh-user authority, along with a record of the rotation signed by the original
+	ksContext := cluster.Keyserver.Context
+	ksAuthorities := path.Join(cluster.Dir, "keyserver", worldconfig.AuthorityKeyDirectory)
+	replacementDir := path.Join(cluster.Dir, "replacement")
+	if err := os.Mkdir(replacementDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	key, keydata, err := certutil.GenerateRSA(keygen.AuthorityBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacementAuthority := config.SSHAuthority(worldconfig.SSHUserAuthority)
+	keyfile, pubfile := replacementAuthority.Filenames()
+	if err := ioutil.WriteFile(path.Join(replacementDir, keyfile), keydata, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(replacementDir, pubfile), ssh.MarshalAuthorizedKey(pubkey), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = keygen.SignRotation(replacementDir, worldconfig.SSHUserAuthority, path.Join(ksAuthorities, keyfile), path.Join(ksAuthorities, pubfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement, err := replacementAuthority.Load(replacementDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := replacementAuthority.LoadRotations(replacementDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a keyserver that offers a different authority without a rotation record is not trusted
+	ksContext.Authorities[worldconfig.SSHUserAuthority] = replacement
+	if err := cluster.Advance(8*24*time.Hour, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	current, err := ioutil.ReadFile(worker.Env.Path("/etc/ssh/ssh_user_ca.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(current, original) {
+		t.Error("pinned authority was replaced without a rotation record")
+	}
+	if pinMismatch(worker, worldconfig.SSHUserAuthority) == "" {
+		t.Error("pin mismatch not reported")
+	}
+
+	// but once the rotation is published, the replacement is accepted
+	ksContext.Rotations[worldconfig.SSHUserAuthority] = records
+	if err := cluster.Advance(24*time.Hour, 12*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	current, err = ioutil.ReadFile(worker.Env.Path("/etc/ssh/ssh_user_ca.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(current, replacement.GetPublicKey()) {
+		t.Error("rotated authority was not installed")
+	}
+	if mismatch := pinMismatch(worker, worldconfig.SSHUserAuthority); mismatch != "" {
+		t.Errorf("pin mismatch still reported after rotation: %s", mismatch)
+	}
+	pinned, err := ioutil.ReadFile(path.Join(worker.Env.Path(paths.AuthorityPinDirectory), worldconfig.SSHUserAuthority))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pinned, replacement.GetPublicKey()) {
+		t.Error("pin not updated after rotation")
+	}
+}
+
+func checkKeyPair(t *testing.T, node *Node, keypath string, certpath string) []byte {
+	key, err := ioutil.ReadFile(node.Env.Path(keypath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ioutil.ReadFile(node.Env.Path(certpath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		t.Errorf("mismatched key and certificate at %s: %v", keypath, err)
+	}
+	return key
+}
+
+func TestKeyRotation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("generates many RSA keys")
+	}
+	cluster, cleanup := launchCluster(t)
+	defer cleanup()
+	if err := cluster.Converge(); err != nil {
+		t.Fatal(err)
+	}
+	worker := cluster.Node("worker1")
+	if worker == nil {
+		t.Fatal("no worker node")
+	}
+	keypath, certpath := worker.Env.Path(paths.KubernetesWorkerKey), worker.Env.Path(paths.KubernetesWorkerCert)
+	original := checkKeyPair(t, worker, paths.KubernetesWorkerKey, paths.KubernetesWorkerCert)
+
+	// resume a rotation interrupted after generating the replacement key, but before a certificate was issued for it
+	_, replacement, err := certutil.GenerateRSA(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keypath+keyreq.NextSuffix, replacement, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stale, err := ioutil.ReadFile(certpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certpath+keyreq.NextSuffix, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// hooks don't run again within HookInterval of their last run
+	if err := cluster.Advance(actloop.HookInterval, actloop.HookInterval); err != nil {
+		t.Fatal(err)
+	}
+	rotated := checkKeyPair(t, worker, paths.KubernetesWorkerKey, paths.KubernetesWorkerCert)
+	if !bytes.Equal(rotated, replacement) {
+		t.Error("interrupted rotation did not install the replacement key")
+	}
+	if bytes.Equal(rotated, original) {
+		t.Error("key was not rotated")
+	}
+	for _, leftover := range []string{keypath + keyreq.NextSuffix, certpath + keyreq.NextSuffix} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s left behind after rotation: %v", leftover, err)
+		}
+	}
+	if info, err := os.Lstat(keypath); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("key was not installed through its versioned directory: %v", err)
+	}
+
+	// roll back a rotation when the daemon using the key cannot be restarted with it
+	effects := worker.Env.Effects.(*hostenv.SimulatedEffects)
+	effects.FailRuns("systemctl try-restart kubelet.service")
+	if err := keyreq.RequestRotation(keypath); err != nil {
+		t.Fatal(err)
+	}
+	if err := cluster.Advance(actloop.HookInterval, actloop.HookInterval); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(checkKeyPair(t, worker, paths.KubernetesWorkerKey, paths.KubernetesWorkerCert), rotated) {
+		t.Fatal("key was not rotated on request")
+	}
+	if err := cluster.Advance(time.Duration(actloop.HookAttempts-1)*actloop.HookInterval, actloop.HookInterval); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checkKeyPair(t, worker, paths.KubernetesWorkerKey, paths.KubernetesWorkerCert), rotated) {
+		t.Error("rotated key was not rolled back after its hook kept failing")
+	}
+	if _, err := os.Stat(keypath + keyreq.RotateRequestSuffix); !os.IsNotExist(err) {
+		t.Errorf("rotation request not consumed: %v", err)
+	}
+
+	// the rolled-back key stays in place once the daemon can be restarted again
+	effects.FailRuns()
+	if err := cluster.Advance(time.Hour, 30*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(checkKeyPair(t, worker, paths.KubernetesWorkerKey, paths.KubernetesWorkerCert), rotated) {
+		t.Error("rolled-back key was replaced")
+	}
+	checkNodes(t, cluster, oneshot.ExitOK)
+}
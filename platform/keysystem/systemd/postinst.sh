@@ -0,0 +1,26 @@
+#!/bin/sh
+set -e
+
+case "$1" in
+    configure)
+        # the keyserver and keysigner run as their own users, so that neither can read the other's keys, and the
+        # keyserver can only reach the keysigner through its socket, as a member of the keysigner group
+        adduser --system --group --no-create-home --home /nonexistent keysigner
+        adduser --system --group --no-create-home --home /nonexistent keyserver
+    ;;
+
+    abort-upgrade|abort-remove|abort-deconfigure)
+    ;;
+
+    *)
+        echo "postinst called with unknown argument \`$1'" >&2
+        exit 1
+    ;;
+esac
+
+# dh_installdeb will replace this with shell code automatically
+# generated by other debhelper scripts.
+
+#DEBHELPER#
+
+exit 0
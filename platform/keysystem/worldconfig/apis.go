@@ -17,8 +17,12 @@ const ClusterConfStatic = "cluster.conf"
 
 const BootstrapKeyserverTokenAPI = "bootstrap-keyinit"
 const RenewKeygrantAPI = "renew-keygrant"
+const ReenrollKeygrantAPI = "reenroll-keygrant"
 const ImpersonateKerberosAPI = "auth-to-kerberos"
 const LocalConfAPI = "get-local-config"
+const KeyclientConfigAPI = "get-keyclient-config"
+const NodeDirectoryAPI = "get-node-directory"
+const CheckinAPI = "report-checkin"
 
 const FetchServiceAccountKeyAPI = "fetch-serviceaccount-key"
 const SignKubernetesWorkerAPI = "grant-kubernetes-worker"
@@ -35,3 +39,11 @@ const SignEtcdClientAPI = "grant-etcd-client"
 const AccessSSHAPI = "access-ssh"
 const AccessEtcdAPI = "access-etcd"
 const AccessKubernetesAPI = "access-kubernetes"
+
+const InventoryAPI = "get-inventory"
+const ListEnrollmentsAPI = "list-enrollments"
+const ApproveEnrollmentAPI = "approve-enrollment"
+const DenyEnrollmentAPI = "deny-enrollment"
+const DecommissionAPI = "decommission-node"
+const ReplicateAPI = "replicate-state"
+const ScrapeMetricsAPI = "scrape-metrics"
@@ -4,17 +4,46 @@ import (
 	"time"
 
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/bootstrap"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/checkin"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/clockcheck"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/download"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/enroll"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/hostname"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/hosts"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/keygen"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/keyreq"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/actions/reenroll"
 	"github.com/sipb/homeworld/platform/keysystem/keyclient/actloop"
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/outputs"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
 )
 
 const OneDay = 24 * time.Hour
 const OneWeek = 7 * OneDay
 
+// how often to replace each private key that the keyclient generates; zero disables rotation
+const KeyRotationPeriod = 90 * OneDay
+
+// how long kubelet, kube-proxy, and etcd client certificates remain valid. neither the apiserver nor etcd checks the
+// keyserver's revocations, so these are kept short, so that a decommissioned node loses access soon after it is removed.
+const ClientCertLifetime = 2 * OneDay
+
+// how long before expiration to renew client certificates; this is how long the keyservers can be unreachable before
+// kubelet, kube-proxy, and etcd clients are affected
+const ClientCertInAdvance = OneDay
+
+const ClusterCAPath = "/usr/local/share/ca-certificates/extra/cluster.tls.crt"
+const EtcdServerCAPath = "/etc/homeworld/authorities/etcd-server.pem"
+const EtcdClientCAPath = "/etc/homeworld/authorities/etcd-client.pem"
+
+// how often to report this node's state to the keyserver's inventory, if nothing has changed
+const CheckinInterval = 15 * time.Minute
+
+// the names that the keyserver includes in each certificate that identifies a particular node
+var nodeNames = []string{"(HOST_DNS)", "(HOST_NODE)", "(HOST_IP)"}
+
+// ConvergeState handles the actions that the keyclient needs to get itself running, and then the outputs listed in the
+// keyclient configuration for this node.
 func ConvergeState(nac *actloop.NewActionContext) {
 	keygen.GenerateKey(
 		paths.GrantingKeyPath,
@@ -24,28 +53,16 @@ func ConvergeState(nac *actloop.NewActionContext) {
 		RenewKeygrantAPI,
 		nac,
 	)
-	download.DownloadAuthority(
-		KubernetesAuthority,
-		paths.KubernetesCAPath,
-		OneDay,
-		nac,
-	)
-	download.DownloadAuthority(
-		ClusterCAAuthority,
-		"/usr/local/share/ca-certificates/extra/cluster.tls.crt",
-		OneDay,
+	enroll.Enroll(
+		paths.SSHHostKeyPath+".pub",
 		nac,
 	)
-	download.DownloadAuthority(
-		SSHUserAuthority,
-		"/etc/ssh/ssh_user_ca.pub",
-		OneWeek, // allow a week for mistakes to be noticed on this one
+	reenroll.Reenroll(
+		paths.SSHHostKeyPath,
+		paths.SSHHostCertPath,
 		nac,
 	)
-	download.DownloadStatic(
-		ClusterConfStatic,
-		paths.ClusterConfPath,
-		OneDay,
+	clockcheck.CheckClock(
 		nac,
 	)
 	download.DownloadFromAPI(
@@ -53,119 +70,158 @@ func ConvergeState(nac *actloop.NewActionContext) {
 		paths.LocalConfPath,
 		OneDay,
 		0644,
+		nil,
 		nac,
 	)
 	hostname.ReloadHostnameFrom(
 		paths.LocalConfPath,
 		nac,
 	)
-	download.DownloadAuthority(
-		ServiceAccountAuthority,
-		"/etc/homeworld/keys/serviceaccount.pem",
-		OneDay,
-		nac,
-	)
-	download.DownloadAuthority(
-		EtcdClientAuthority,
-		"/etc/homeworld/authorities/etcd-client.pem",
-		OneDay,
-		nac,
-	)
-	download.DownloadAuthority(
-		EtcdServerAuthority,
-		"/etc/homeworld/authorities/etcd-server.pem",
-		OneDay,
-		nac,
-	)
 	download.DownloadFromAPI(
-		FetchServiceAccountKeyAPI,
-		"/etc/homeworld/keys/serviceaccount.key",
+		KeyclientConfigAPI,
+		paths.KeyclientConfigPath,
 		OneDay,
-		0600,
+		0644,
+		nil,
 		nac,
 	)
 	TLSKey(
-		"/etc/homeworld/keyclient/granting.key",
-		"/etc/homeworld/keyclient/granting.pem",
+		paths.GrantingKeyPath,
+		paths.GrantingCertPath,
 		RenewKeygrantAPI,
 		2*OneWeek, // renew two weeks before expiration
+		KeyRotationPeriod,
+		keyreq.Expectations{}, // the keygranting authority is never distributed
 		nac,
 	)
-	keyreq.RequestOrRenewSSHKey(
-		"/etc/ssh/ssh_host_rsa_key.pub",
-		"/etc/ssh/ssh_host_rsa_cert",
-		SignSSHHostKeyAPI,
-		OneWeek, // renew one week before expiration
-		nac,
-	)
-	TLSKey(
-		// for master nodes, worker nodes (both for kubelet), and supervisor nodes (for prometheus)
-		paths.KubernetesWorkerKey,
-		paths.KubernetesWorkerCert,
-		SignKubernetesWorkerAPI,
-		OneWeek, // renew one week before expiration
-		nac,
-	)
-	TLSKey(
-		// for supervisor nodes; needed for kube-state-metrics and setup-queue
-		paths.KubernetesSupervisorKey,
-		paths.KubernetesSupervisorCert,
-		SignKubernetesSupervisorAPI,
-		OneWeek, // renew one week before expiration
-		nac,
-	)
-	TLSKey(
-		"/etc/homeworld/ssl/homeworld.private.key",
-		"/etc/homeworld/ssl/homeworld.private.pem",
-		SignRegistryHostAPI,
-		OneWeek, // renew one week before expiration
-		nac,
-	)
-	TLSKey(
-		paths.KubernetesMasterKey,
-		paths.KubernetesMasterCert,
-		SignKubernetesMasterAPI,
-		OneWeek, // renew one week before expiration
-		nac,
-	)
-	TLSKey(
-		paths.KubernetesCtrlMgrKey,
-		paths.KubernetesCtrlMgrCert,
-		SignKubernetesCtrlMgrAPI,
-		OneWeek, // renew one week before expiration
+	outputs.ConvergeFrom(
+		paths.KeyclientConfigPath,
 		nac,
 	)
-	TLSKey(
-		paths.KubernetesProxyKey,
-		paths.KubernetesProxyCert,
-		SignKubernetesProxyAPI,
-		OneWeek, // renew one week before expiration
+	hosts.MaintainHosts(
+		paths.NodeDirectoryPath,
+		paths.HostsPath,
 		nac,
 	)
-	TLSKey(
-		paths.KubernetesSchedulerKey,
-		paths.KubernetesSchedulerCert,
-		SignKubernetesSchedulerAPI,
-		OneWeek, // renew one week before expiration
-		nac,
-	)
-	TLSKey(
-		"/etc/homeworld/keys/etcd-server.key",
-		"/etc/homeworld/keys/etcd-server.pem",
-		SignEtcdServerAPI,
-		OneWeek, // renew one week before expiration
+	hosts.MaintainKnownHosts(
+		paths.NodeDirectoryPath,
+		paths.SSHHostCAPath,
+		paths.KnownHostsPath,
 		nac,
 	)
-	TLSKey(
-		"/etc/homeworld/keys/etcd-client.key",
-		"/etc/homeworld/keys/etcd-client.pem",
-		SignEtcdClientAPI,
-		OneWeek, // renew one week before expiration
+	checkin.CheckIn(
+		CheckinAPI,
+		CheckinInterval,
 		nac,
 	)
 }
 
-func TLSKey(key string, cert string, api string, inadvance time.Duration, nac *actloop.NewActionContext) {
+func TLSKey(key string, cert string, api string, inadvance time.Duration, rotateEvery time.Duration, expect keyreq.Expectations, nac *actloop.NewActionContext) {
 	keygen.GenerateKey(key, nac)
-	keyreq.RequestOrRenewTLSKey(key, cert, api, inadvance, nac)
+	keyreq.RequestOrRenewTLSKey(key, cert, api, inadvance, expect, nil, nac)
+	keyreq.RotateTLSKey(key, cert, api, rotateEvery, expect, nil, nac)
+}
+
+// GenerateKeyclientConfig lists the files that the keyclient on a node should maintain, which must correspond to the
+// grants in GrantsForNodeAccount.
+func GenerateKeyclientConfig(node *SpireNode) *outputs.Config {
+	config := &outputs.Config{}
+
+	authority := func(name string, path string, refresh time.Duration, hooks []outputs.Hook) {
+		config.Downloads = append(config.Downloads, outputs.Download{
+			Type: "authority", Name: name, Path: path, Refresh: refresh, Mode: "0644", Hooks: hooks,
+		})
+	}
+	tlsKeyRenewedAt := func(inadvance time.Duration, key string, cert string, api string, authority string, names []string, hooks []outputs.Hook) {
+		config.Keys = append(config.Keys, outputs.Key{
+			Type: "tls", Key: key, Cert: cert, API: api,
+			InAdvance:   inadvance,
+			RotateEvery: KeyRotationPeriod,
+			Authority:   authority,
+			Names:       names,
+			Hooks:       hooks,
+		})
+	}
+	tlsKey := func(key string, cert string, api string, authority string, names []string, hooks []outputs.Hook) {
+		tlsKeyRenewedAt(OneWeek, key, cert, api, authority, names, hooks) // renew one week before expiration
+	}
+	clientKey := func(key string, cert string, api string, authority string, names []string, hooks []outputs.Hook) {
+		tlsKeyRenewedAt(ClientCertInAdvance, key, cert, api, authority, names, hooks)
+	}
+
+	// ALL NODES
+
+	var kubernetesUnits []string
+	if node.IsSupervisor() {
+		kubernetesUnits = []string{"kube-state-metrics.service", "prometheus.service"}
+	} else {
+		kubernetesUnits = []string{"kubelet.service", "kube-proxy.service"}
+	}
+	if node.IsMaster() {
+		kubernetesUnits = append(kubernetesUnits, "apiserver.service", "kube-ctrlmgr.service", "kube-scheduler.service")
+	}
+	authority(KubernetesAuthority, paths.KubernetesCAPath, OneDay, outputs.RestartUnits(kubernetesUnits...))
+	authority(ClusterCAAuthority, ClusterCAPath, OneDay, outputs.RestartUnits("keyclient-update-ca.service"))
+	// allow a week for mistakes to be noticed on this one; sshd reads it for each connection
+	authority(SSHUserAuthority, "/etc/ssh/ssh_user_ca.pub", OneWeek, nil)
+	config.Downloads = append(config.Downloads, outputs.Download{
+		Type: "static", Name: ClusterConfStatic, Path: paths.ClusterConfPath, Refresh: OneDay, Mode: "0644",
+	})
+	// used to maintain /etc/hosts and ssh_known_hosts, where new nodes should show up promptly
+	authority(SSHHostAuthority, paths.SSHHostCAPath, OneDay, nil)
+	config.Downloads = append(config.Downloads, outputs.Download{
+		Type: "api", Name: NodeDirectoryAPI, Path: paths.NodeDirectoryPath, Refresh: time.Hour, Mode: "0644",
+	})
+	config.Keys = append(config.Keys, outputs.Key{
+		Type: "ssh", Key: paths.SSHHostKeyPath + ".pub", Cert: paths.SSHHostCertPath, API: SignSSHHostKeyAPI,
+		InAdvance: OneWeek, // renew one week before expiration
+		Names:     nodeNames,
+		Hooks:     []outputs.Hook{{Reload: "ssh.service"}},
+	})
+
+	// SUPERVISOR NODES
+
+	if node.IsSupervisor() {
+		// needed for kube-state-metrics, prometheus, and setup-queue
+		tlsKey(paths.KubernetesSupervisorKey, paths.KubernetesSupervisorCert, SignKubernetesSupervisorAPI,
+			paths.KubernetesCAPath, nil, outputs.RestartUnits("kube-state-metrics.service", "prometheus.service"))
+		tlsKey("/etc/homeworld/ssl/homeworld.private.key", "/etc/homeworld/ssl/homeworld.private.pem", SignRegistryHostAPI,
+			ClusterCAPath, []string{"homeworld.private"}, outputs.RestartUnits("docker-registry.service"))
+	}
+
+	// KUBERNETES NODES
+
+	if !node.IsSupervisor() {
+		clientKey(paths.KubernetesWorkerKey, paths.KubernetesWorkerCert, SignKubernetesWorkerAPI,
+			paths.KubernetesCAPath, nodeNames, outputs.RestartUnits("kubelet.service"))
+		clientKey(paths.KubernetesProxyKey, paths.KubernetesProxyCert, SignKubernetesProxyAPI,
+			paths.KubernetesCAPath, nil, outputs.RestartUnits("kube-proxy.service"))
+	}
+
+	// MASTER NODES
+
+	if node.IsMaster() {
+		authority(ServiceAccountAuthority, "/etc/homeworld/keys/serviceaccount.pem", OneDay, nil)
+		authority(EtcdClientAuthority, EtcdClientCAPath, OneDay, outputs.RestartUnits("etcd.service"))
+		authority(EtcdServerAuthority, EtcdServerCAPath, OneDay,
+			outputs.RestartUnits("etcd.service", "apiserver.service", "etcd-metrics-exporter.service"))
+		config.Downloads = append(config.Downloads, outputs.Download{
+			Type: "api", Name: FetchServiceAccountKeyAPI, Path: "/etc/homeworld/keys/serviceaccount.key",
+			Refresh: OneDay, Mode: "0600",
+			Hooks: outputs.RestartUnits("apiserver.service", "kube-ctrlmgr.service"),
+		})
+
+		tlsKey(paths.KubernetesMasterKey, paths.KubernetesMasterCert, SignKubernetesMasterAPI,
+			paths.KubernetesCAPath, append([]string{"kubernetes"}, nodeNames...), outputs.RestartUnits("apiserver.service"))
+		tlsKey(paths.KubernetesCtrlMgrKey, paths.KubernetesCtrlMgrCert, SignKubernetesCtrlMgrAPI,
+			paths.KubernetesCAPath, nil, outputs.RestartUnits("kube-ctrlmgr.service"))
+		tlsKey(paths.KubernetesSchedulerKey, paths.KubernetesSchedulerCert, SignKubernetesSchedulerAPI,
+			paths.KubernetesCAPath, nil, outputs.RestartUnits("kube-scheduler.service"))
+		tlsKey("/etc/homeworld/keys/etcd-server.key", "/etc/homeworld/keys/etcd-server.pem", SignEtcdServerAPI,
+			EtcdServerCAPath, nodeNames, outputs.RestartUnits("etcd.service"))
+		clientKey("/etc/homeworld/keys/etcd-client.key", "/etc/homeworld/keys/etcd-client.pem", SignEtcdClientAPI,
+			EtcdClientCAPath, nodeNames, outputs.RestartUnits("apiserver.service", "etcd-metrics-exporter.service"))
+	}
+
+	return config
 }
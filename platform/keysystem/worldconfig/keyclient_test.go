@@ -0,0 +1,131 @@
+package worldconfig
+
+import (
+	"testing"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyclient/outputs"
+	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+)
+
+func managedPaths(config *outputs.Config) map[string]bool {
+	managed := map[string]bool{}
+	for _, d := range config.Downloads {
+		managed[d.Path] = true
+	}
+	for _, k := range config.Keys {
+		managed[k.Key] = true
+		managed[k.Cert] = true
+	}
+	return managed
+}
+
+func TestGenerateKeyclientConfig(t *testing.T) {
+	for _, test := range []struct {
+		kind     string
+		expected []string
+		absent   []string
+	}{
+		{Supervisor,
+			[]string{paths.KubernetesSupervisorCert, "/etc/homeworld/ssl/homeworld.private.pem", paths.SSHHostCertPath, paths.NodeDirectoryPath},
+			[]string{paths.KubernetesWorkerCert, paths.KubernetesMasterCert, "/etc/homeworld/keys/etcd-server.pem"}},
+		{Worker,
+			[]string{paths.KubernetesWorkerCert, paths.KubernetesProxyCert, paths.SSHHostCertPath, ClusterCAPath},
+			[]string{paths.KubernetesSupervisorCert, paths.KubernetesMasterCert, "/etc/homeworld/keys/serviceaccount.key"}},
+		{Master,
+			[]string{paths.KubernetesWorkerCert, paths.KubernetesMasterCert, paths.KubernetesSchedulerCert,
+				"/etc/homeworld/keys/etcd-server.pem", "/etc/homeworld/keys/etcd-client.pem", "/etc/homeworld/keys/serviceaccount.key"},
+			[]string{paths.KubernetesSupervisorCert, "/etc/homeworld/ssl/homeworld.private.pem"}},
+	} {
+		config := GenerateKeyclientConfig(&SpireNode{Hostname: "node1", Kind: test.kind})
+		if err := config.Validate(); err != nil {
+			t.Errorf("invalid configuration for %s: %v", test.kind, err)
+			continue
+		}
+		managed := managedPaths(config)
+		for _, path := range test.expected {
+			if !managed[path] {
+				t.Errorf("%s does not manage %s", test.kind, path)
+			}
+		}
+		for _, path := range test.absent {
+			if managed[path] {
+				t.Errorf("%s unexpectedly manages %s", test.kind, path)
+			}
+		}
+	}
+}
+
+func TestGenerateKeyclientConfig_Roundtrip(t *testing.T) {
+	config := GenerateKeyclientConfig(&SpireNode{Hostname: "node1", Kind: Master})
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := outputs.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Downloads) != len(config.Downloads) || len(parsed.Keys) != len(config.Keys) {
+		t.Errorf("outputs lost in roundtrip: %d/%d downloads, %d/%d keys",
+			len(parsed.Downloads), len(config.Downloads), len(parsed.Keys), len(config.Keys))
+	}
+}
+
+func TestGenerateKeyclientConfig_Hooks(t *testing.T) {
+	config := GenerateKeyclientConfig(&SpireNode{Hostname: "node1", Kind: Master})
+	restarts := map[string][]string{}
+	for _, k := range config.Keys {
+		for _, hook := range k.Hooks {
+			restarts[k.Cert] = append(restarts[k.Cert], hook.Restart+hook.Reload)
+		}
+	}
+	for _, d := range config.Downloads {
+		for _, hook := range d.Hooks {
+			restarts[d.Path] = append(restarts[d.Path], hook.Restart+hook.Reload)
+		}
+	}
+	for path, unit := range map[string]string{
+		paths.KubernetesMasterCert:            "apiserver.service",
+		"/etc/homeworld/keys/etcd-server.pem": "etcd.service",
+		paths.SSHHostCertPath:                 "ssh.service",
+		ClusterCAPath:                         "keyclient-update-ca.service",
+	} {
+		found := false
+		for _, restarted := range restarts[path] {
+			if restarted == unit {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s to restart or reload %s, not %v", path, unit, restarts[path])
+		}
+	}
+}
+
+func TestGenerateKeyclientConfig_NodeNames(t *testing.T) {
+	config := GenerateKeyclientConfig(&SpireNode{Hostname: "node1", Kind: Worker})
+	for _, k := range config.Keys {
+		if k.Cert == paths.KubernetesWorkerCert {
+			if len(k.Names) != 3 || k.Names[0] != "(HOST_DNS)" || k.Authority != paths.KubernetesCAPath {
+				t.Errorf("wrong expectations for worker cert: %+v", k)
+			}
+			return
+		}
+	}
+	t.Error("worker cert not found")
+}
+
+func TestGenerateKeyclientConfig_ClientCertRenewal(t *testing.T) {
+	if ClientCertInAdvance >= ClientCertLifetime {
+		t.Fatalf("client certificates would be renewed continuously: %v in advance of %v", ClientCertInAdvance, ClientCertLifetime)
+	}
+	clientCerts := map[string]bool{
+		paths.KubernetesWorkerCert: true, paths.KubernetesProxyCert: true, "/etc/homeworld/keys/etcd-client.pem": true,
+	}
+	config := GenerateKeyclientConfig(&SpireNode{Hostname: "node1", Kind: Master})
+	for _, k := range config.Keys {
+		if clientCerts[k.Cert] != (k.InAdvance == ClientCertInAdvance) {
+			t.Errorf("wrong renewal for %s: %v in advance", k.Cert, k.InAdvance)
+		}
+	}
+}
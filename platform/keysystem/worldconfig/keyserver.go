@@ -2,15 +2,28 @@ package worldconfig
 
 import (
 	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/account"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/authorities"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/config"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/inventory"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/reenroll"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/replication"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/revocation"
 	"github.com/sipb/homeworld/platform/keysystem/keyserver/verifier"
+	"github.com/sipb/homeworld/platform/keysystem/rotation"
 	"github.com/sipb/homeworld/platform/keysystem/worldconfig/paths"
+	"github.com/sipb/homeworld/platform/util/sealutil"
 )
 
 type Groups struct {
@@ -18,7 +31,7 @@ type Groups struct {
 	Nodes            *account.Group
 }
 
-func GenerateAccounts(context *config.Context, conf *SpireSetup, auth Authorities) {
+func GenerateAccounts(context *config.Context, conf *SpireSetup, auth Authorities, replicated replication.Replicated) Groups {
 	var accounts []*account.Account
 
 	groups := Groups{
@@ -37,6 +50,10 @@ func GenerateAccounts(context *config.Context, conf *SpireSetup, auth Authoritie
 
 		groups.Nodes.AllMembers = append(groups.Nodes.AllMembers, acc)
 		acc.Privileges = GrantsForNodeAccount(context, conf, groups, auth, acc, node)
+		if node.IsSupervisor() && context.Follower == nil {
+			// lets the keyservers on the other supervisors follow this one
+			acc.Privileges[ReplicateAPI] = replication.NewLeaderPrivilege(replicated)
+		}
 	}
 
 	// metrics principal used by homeworld-ssh-checker
@@ -50,7 +67,7 @@ func GenerateAccounts(context *config.Context, conf *SpireSetup, auth Authoritie
 		}
 		accounts = append(accounts, acc)
 		groups.KerberosAccounts.AllMembers = append(groups.KerberosAccounts.AllMembers, acc)
-		acc.Privileges = GrantsForRootAdminAccount(context, groups, auth, acc)
+		acc.Privileges = GrantsForRootAdminAccount(context, conf, groups, auth, acc)
 	}
 
 	// if we don't have any root admins, this means that kerberos authentication is disabled, and we shouldn't add this
@@ -75,6 +92,205 @@ func GenerateAccounts(context *config.Context, conf *SpireSetup, auth Authoritie
 	for _, ac := range accounts {
 		context.Accounts[ac.Principal] = ac
 	}
+	return groups
+}
+
+// AdmitNode adds a worker to the cluster while the keyserver is running, as described by an approved enrollment request,
+// and issues its keygranting certificate.
+func AdmitNode(context *config.Context, conf *SpireSetup, groups Groups, auth Authorities, request enrollment.Request) (string, error) {
+	node, err := conf.EnrolledNode(request)
+	if err != nil {
+		return "", err
+	}
+	if conf.FindNode(node.Hostname) != nil {
+		return "", fmt.Errorf("a node named %s already exists", node.Hostname)
+	}
+	acc := newNodeAccount(context, conf, groups, auth, node)
+	// sign first, so that an invalid CSR doesn't leave a node behind without a way to join
+	cert, err := acc.Privileges[RenewKeygrantAPI](&account.OperationContext{Account: acc}, request.CSR)
+	if err != nil {
+		return "", err
+	}
+	if context.Revocations != nil {
+		// a machine that was decommissioned under this name has been explicitly approved to rejoin
+		err = context.Revocations.Reinstate(acc.Principal)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = joinCluster(context, conf, groups, node, acc)
+	if err != nil {
+		return "", err
+	}
+	return cert, nil
+}
+
+// DecommissionNode removes a worker from the cluster while the keyserver is running: its account is removed, every
+// certificate issued to it (and any others that it last reported holding) is revoked, and it is dropped from the node
+// directory. The node stays out of the cluster across keyserver restarts, even if it is still listed in setup.yaml.
+// Only the keyserver checks revocations, but the node's kubelet and kube-proxy certificates are short-lived (see
+// ClientCertLifetime), so it loses access to the apiserver once they expire; its SSH host certificate remains valid
+// until it expires.
+func DecommissionNode(context *config.Context, conf *SpireSetup, groups Groups, hostname string) ([]revocation.Certificate, error) {
+	node := conf.FindNode(hostname)
+	if node == nil {
+		return nil, fmt.Errorf("no node named %s", hostname)
+	}
+	if !node.IsWorker() {
+		// supervisors and masters are part of the cluster's configuration in ways that can't change while it's running
+		return nil, fmt.Errorf("only workers can be decommissioned, not %s nodes", node.Kind)
+	}
+	principal := node.DNS()
+	var certs []revocation.Certificate
+	if context.Inventory != nil {
+		for _, record := range context.Inventory.Snapshot() {
+			if record.Principal != principal || record.Report == nil {
+				continue
+			}
+			for _, cert := range record.Report.Certificates {
+				// certificates that the node has not yet received have no serial numbers
+				if cert.Serial != "" {
+					certs = append(certs, revocation.Certificate{Serial: cert.Serial, Path: cert.Path, Expires: cert.Expires})
+				}
+			}
+		}
+	}
+	// revoke first, so that the node can't authenticate even if removing it fails partway through
+	revoked, err := context.Revocations.Decommission(principal, certs)
+	if err != nil {
+		return nil, err
+	}
+	err = leaveCluster(context, conf, groups, node)
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// FollowLeader brings a follower keyserver's view of the cluster's membership up to date after it copies the leader's
+// state: nodes that enrolled through the leader are added, and nodes that the leader decommissioned are removed.
+func FollowLeader(context *config.Context, conf *SpireSetup, groups Groups, auth Authorities) error {
+	for _, request := range context.Follower.Enrollments.Approved() {
+		node, err := conf.EnrolledNode(request)
+		if err != nil {
+			return errors.Wrapf(err, "while loading enrolled node %s", request.Hostname)
+		}
+		if conf.FindNode(node.Hostname) != nil || context.Revocations.IsDecommissioned(node.DNS()) {
+			continue
+		}
+		err = joinCluster(context, conf, groups, node, newNodeAccount(context, conf, groups, auth, node))
+		if err != nil {
+			return err
+		}
+	}
+	for _, node := range conf.ListNodes() {
+		if node.IsWorker() && context.Revocations.IsDecommissioned(node.DNS()) {
+			err := leaveCluster(context, conf, groups, node)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newNodeAccount creates the account for a node that is joining the cluster while the keyserver is running.
+func newNodeAccount(context *config.Context, conf *SpireSetup, groups Groups, auth Authorities, node *SpireNode) *account.Account {
+	acc := &account.Account{
+		Principal: node.DNS(),
+		LimitIP:   node.NetIP(),
+	}
+	acc.Privileges = GrantsForNodeAccount(context, conf, groups, auth, acc, node)
+	return acc
+}
+
+// joinCluster adds a node and its account to the cluster while the keyserver is running.
+func joinCluster(context *config.Context, conf *SpireSetup, groups Groups, node *SpireNode, acc *account.Account) error {
+	err := conf.AddNode(node)
+	if err != nil {
+		return err
+	}
+	err = context.AddAccount(acc)
+	if err != nil {
+		return err
+	}
+	groups.Nodes.AddMember(acc)
+	if context.Inventory != nil {
+		context.Inventory.Add(acc.Principal)
+	}
+	return nil
+}
+
+// leaveCluster removes a node and its account from the cluster while the keyserver is running.
+func leaveCluster(context *config.Context, conf *SpireSetup, groups Groups, node *SpireNode) error {
+	principal := node.DNS()
+	err := context.RemoveAccount(principal)
+	if err != nil {
+		return err
+	}
+	groups.Nodes.RemoveMember(principal)
+	err = conf.RemoveNode(node.Hostname)
+	if err != nil {
+		return err
+	}
+	if context.Inventory != nil {
+		_, err = context.Inventory.Remove(principal)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaderOnly wraps a privilege that changes the cluster's mutable state, so that it is refused by follower keyservers,
+// whose state would be overwritten by the leader's.
+func leaderOnly(c *config.Context, privilege account.Privilege) account.Privilege {
+	if c.Follower == nil {
+		return privilege
+	}
+	return func(_ *account.OperationContext, _ string) (string, error) {
+		return "", fmt.Errorf("this keyserver follows the leader keyserver at %s, which must be used instead", c.Follower.Leader)
+	}
+}
+
+// the APIs through which nodes are issued certificates
+var nodeCertificateAPIs = []string{
+	RenewKeygrantAPI,
+	ReenrollKeygrantAPI,
+	SignSSHHostKeyAPI,
+	SignKubernetesMasterAPI,
+	SignEtcdServerAPI,
+	SignRegistryHostAPI,
+	SignKubernetesSupervisorAPI,
+	SignKubernetesWorkerAPI,
+	SignKubernetesProxyAPI,
+	SignKubernetesCtrlMgrAPI,
+	SignKubernetesSchedulerAPI,
+	SignEtcdClientAPI,
+}
+
+// recordIssued records each certificate that privilege issues to principal, so that it is revoked if principal is
+// decommissioned. A certificate that can't be recorded is not handed out.
+func recordIssued(c *config.Context, principal string, api string, privilege account.Privilege) account.Privilege {
+	if c.Revocations == nil {
+		return privilege
+	}
+	return func(ctx *account.OperationContext, param string) (string, error) {
+		cert, err := privilege(ctx, param)
+		if err != nil {
+			return "", err
+		}
+		issued, err := revocation.Describe([]byte(cert))
+		if err != nil {
+			return "", errors.Wrap(err, "while recording issued certificate")
+		}
+		issued.API = api
+		err = c.Revocations.RecordIssued(principal, issued)
+		if err != nil {
+			return "", errors.Wrap(err, "while recording issued certificate")
+		}
+		return cert, nil
+	}
 }
 
 type Authorities struct {
@@ -101,7 +317,7 @@ func ListAuthorities() []config.ConfigAuthority {
 	}
 }
 
-func GrantsForRootAdminAccount(c *config.Context, groups Groups, auth Authorities, ac *account.Account) map[string]account.Privilege {
+func GrantsForRootAdminAccount(c *config.Context, conf *SpireSetup, groups Groups, auth Authorities, ac *account.Account) map[string]account.Privilege {
 	var grants = map[string]account.Privilege{}
 
 	// ADMIN ACCESS TO THE RUNNING CLUSTER
@@ -123,9 +339,23 @@ func GrantsForRootAdminAccount(c *config.Context, groups Groups, auth Authoritie
 		},
 	)
 
+	// MONITORING OF THE CLUSTER
+
+	grants[InventoryAPI] = account.NewInventoryPrivilege(c.Inventory)
+
 	// MEMBERSHIP IN THE CLUSTER
 
-	grants["bootstrap"] = account.NewBootstrapPrivilege(groups.Nodes, time.Hour, c.TokenVerifier.Registry)
+	grants["bootstrap"] = leaderOnly(c, account.NewBootstrapPrivilege(groups.Nodes, time.Hour, c.TokenVerifier.Registry))
+	if c.Enrollments != nil {
+		grants[ListEnrollmentsAPI] = account.NewListEnrollmentsPrivilege(c.Enrollments)
+		grants[ApproveEnrollmentAPI] = leaderOnly(c, account.NewApproveEnrollmentPrivilege(c.Enrollments))
+		grants[DenyEnrollmentAPI] = leaderOnly(c, account.NewDenyEnrollmentPrivilege(c.Enrollments))
+	}
+	if c.Revocations != nil {
+		grants[DecommissionAPI] = leaderOnly(c, account.NewDecommissionPrivilege(func(hostname string) ([]revocation.Certificate, error) {
+			return DecommissionNode(c, conf, groups, hostname)
+		}))
+	}
 
 	return grants
 }
@@ -138,7 +368,23 @@ HOST_NODE=` + node.Hostname + `
 HOST_DNS=` + node.DNS() + `
 HOST_IP=` + node.IP + `
 SCHEDULE_WORK=` + strconv.FormatBool(scheduleWork) + `
-KIND=` + node.Kind
+KIND=` + node.Kind + `
+RACK=` + node.Rack + `
+FAILURE_ZONE=` + node.FailureZone + `
+HARDWARE_CLASS=` + node.HardwareClass + `
+NODE_LABELS=` + FormatLabels(node.KubernetesLabels()) + `
+NODE_TAINTS=` + strings.Join(node.Taints, ",")
+}
+
+// GenerateNodeDirectory lists every node in the cluster, in the format of /etc/hosts.
+func GenerateNodeDirectory(conf *SpireSetup) string {
+	conf.nodesMutex.RLock()
+	defer conf.nodesMutex.RUnlock()
+	lines := []string{"# generated automatically by keyserver"}
+	for _, node := range conf.Nodes {
+		lines = append(lines, node.IP+" "+node.DNS()+" "+node.Hostname)
+	}
+	return strings.Join(lines, "\n") + "\n"
 }
 
 func GrantsForNodeAccount(c *config.Context, conf *SpireSetup, groups Groups, auth Authorities, ac *account.Account, node *SpireNode) map[string]account.Privilege {
@@ -148,16 +394,36 @@ func GrantsForNodeAccount(c *config.Context, conf *SpireSetup, groups Groups, au
 	// MEMBERSHIP IN THE CLUSTER
 
 	if node.IsSupervisor() {
-		grants[BootstrapKeyserverTokenAPI] = account.NewBootstrapPrivilege(groups.Nodes, time.Hour, c.TokenVerifier.Registry)
+		grants[BootstrapKeyserverTokenAPI] = leaderOnly(c, account.NewBootstrapPrivilege(groups.Nodes, time.Hour, c.TokenVerifier.Registry))
 		grants[ImpersonateKerberosAPI] = account.NewImpersonatePrivilege(c.GetAccount, groups.KerberosAccounts)
 	}
 
 	grants[RenewKeygrantAPI] = account.NewTLSGrantPrivilege(auth.Keygranting, false, OneDay*40, ac.Principal, nil, nil)
+	if conf.AllowReenrollment() {
+		// only invoked once the node has proven possession of its SSH host key; see reenroll.Reenroller
+		grants[ReenrollKeygrantAPI] = account.NewTLSGrantPrivilege(auth.Keygranting, false, OneDay*40, ac.Principal, nil, nil)
+	}
+	grants[CheckinAPI] = account.NewCheckinPrivilege(c.Inventory)
+	if node.IsSupervisor() {
+		// prometheus scrapes the keyservers with the supervisor's keygranting certificate
+		grants[ScrapeMetricsAPI] = account.NewMetricsPrivilege()
+	}
 
 	// CONFIGURATION ENDPOINT
 
 	grants[LocalConfAPI] = account.NewConfigurationPrivilege(GenerateLocalConf(conf, node))
 
+	keyclientConfig, err := GenerateKeyclientConfig(node).Marshal()
+	if err != nil {
+		// the keyclient configuration only depends on constants and the node's kind, so this is a programming error
+		panic(err)
+	}
+	grants[KeyclientConfigAPI] = account.NewConfigurationPrivilege(string(keyclientConfig))
+	// changes as nodes enroll
+	grants[NodeDirectoryAPI] = account.NewDynamicConfigurationPrivilege(func() string {
+		return GenerateNodeDirectory(conf)
+	})
+
 	// SERVER CERTIFICATES
 
 	grants[SignSSHHostKeyAPI] = account.NewSSHGrantPrivilege(
@@ -215,7 +481,7 @@ func GrantsForNodeAccount(c *config.Context, conf *SpireSetup, groups Groups, au
 		)
 	} else {
 		grants[SignKubernetesWorkerAPI] = account.NewTLSGrantPrivilege(
-			auth.Kubernetes, true, 30*OneDay, "system:node:"+node.Hostname,
+			auth.Kubernetes, true, ClientCertLifetime, "system:node:"+node.Hostname,
 			[]string{
 				node.DNS(),
 				node.Hostname,
@@ -226,7 +492,7 @@ func GrantsForNodeAccount(c *config.Context, conf *SpireSetup, groups Groups, au
 			},
 		)
 		grants[SignKubernetesProxyAPI] = account.NewTLSGrantPrivilege(
-			auth.Kubernetes, false, 30*OneDay, "system:kube-proxy", nil, nil,
+			auth.Kubernetes, false, ClientCertLifetime, "system:kube-proxy", nil, nil,
 		)
 	}
 
@@ -237,7 +503,7 @@ func GrantsForNodeAccount(c *config.Context, conf *SpireSetup, groups Groups, au
 		grants[SignKubernetesSchedulerAPI] = account.NewTLSGrantPrivilege(
 			auth.Kubernetes, false, 30*OneDay, "system:kube-scheduler", nil, nil,
 		)
-		grants[SignEtcdClientAPI] = account.NewTLSGrantPrivilege(auth.EtcdClient, false, 30*OneDay, "etcd-client-"+node.Hostname,
+		grants[SignEtcdClientAPI] = account.NewTLSGrantPrivilege(auth.EtcdClient, false, ClientCertLifetime, "etcd-client-"+node.Hostname,
 			[]string{
 				node.DNS(),
 				node.Hostname,
@@ -248,6 +514,12 @@ func GrantsForNodeAccount(c *config.Context, conf *SpireSetup, groups Groups, au
 		grants[FetchServiceAccountKeyAPI] = account.NewFetchKeyPrivilege(auth.ServiceAccount)
 	}
 
+	for _, api := range nodeCertificateAPIs {
+		if grant, found := grants[api]; found {
+			grants[api] = recordIssued(c, ac.Principal, api, grant)
+		}
+	}
+
 	return grants
 }
 
@@ -267,9 +539,110 @@ func ValidateStaticFiles(context *config.Context) error {
 
 const AuthorityKeyDirectory = "/etc/homeworld/keyserver/authorities/"
 const ClusterConfigPath = "/etc/homeworld/keyserver/static/cluster.conf"
+const InventoryPath = "/var/lib/homeworld/keyserver/inventory.json"
+const EnrollmentsPath = "/var/lib/homeworld/keyserver/enrollments.json"
+const RevocationsPath = "/var/lib/homeworld/keyserver/revocations.json"
+
+// sealed authority keys are unsealed with a passphrase from a systemd credential by this name, if the keyserver was
+// started with one
+const AuthorityPassphraseCredential = "authority-passphrase"
+
+// or otherwise from this file, which is kept on a tmpfs so that the passphrase is never stored alongside the keys
+const AuthorityPassphrasePath = "/run/homeworld/keyserver/authority-passphrase"
+
+// AuthorityPassphrase finds the passphrase that unseals authority keys, the first time that one is needed: from the
+// systemd credential, or else from the passphrase file, or else by asking an administrator through systemd's password
+// agents.
+func AuthorityPassphrase(env hostenv.Env) config.Passphrase {
+	var passphrase []byte
+	return func() ([]byte, error) {
+		if passphrase == nil {
+			found, err := findAuthorityPassphrase(env)
+			if err != nil {
+				return nil, err
+			}
+			passphrase = found
+		}
+		return passphrase, nil
+	}
+}
+
+func findAuthorityPassphrase(env hostenv.Env) ([]byte, error) {
+	var sources []string
+	if credentials := os.Getenv("CREDENTIALS_DIRECTORY"); credentials != "" {
+		sources = append(sources, path.Join(credentials, AuthorityPassphraseCredential))
+	}
+	sources = append(sources, env.Path(AuthorityPassphrasePath))
+	for _, source := range sources {
+		data, err := ioutil.ReadFile(source)
+		if err == nil && len(data) == 0 {
+			// such as the credential that keyserver.service provides when no passphrase was placed for it
+			continue
+		} else if err == nil {
+			return sealutil.ParsePassphrase(data)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	// only standard output, so that any warnings printed by systemd-ask-password can't end up in the passphrase
+	data, err := env.Effects.Output([]string{"systemd-ask-password", "--id=homeworld-keyserver:authorities", "Passphrase for keyserver authorities:"})
+	if err != nil {
+		return nil, errors.Wrap(err, "while asking for passphrase for keyserver authorities")
+	}
+	return sealutil.ParsePassphrase(data)
+}
 
-func GenerateConfig() (*config.Context, error) {
-	conf, err := LoadSpireSetup(paths.SpireSetupPath)
+func loadAuthority(env hostenv.Env, authority config.ConfigAuthority, passphrase config.Passphrase, signers map[string]ExternalSigner) (authorities.Authority, error) {
+	external, found := signers[authority.Name]
+	if !found {
+		return authority.Load(env.Path(AuthorityKeyDirectory), passphrase)
+	}
+	key, err := external.Open(env)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while opening external signer for authority %s", authority.Name)
+	}
+	return authority.LoadExternal(env.Path(AuthorityKeyDirectory), key)
+}
+
+// GenerateConfig loads the keyserver configuration from the files under the env's root.
+func GenerateConfig(env hostenv.Env) (*config.Context, error) {
+	conf, err := LoadSpireSetup(env.Path(paths.SpireSetupPath))
+	if err != nil {
+		return nil, err
+	}
+	// nodes that enrolled earlier remain part of the cluster, even if enrollment has since been disabled
+	enrollments, err := enrollment.NewQueue(env.Path(EnrollmentsPath), env.Clock)
+	if err != nil {
+		return nil, err
+	}
+	for _, request := range enrollments.Approved() {
+		node, err := conf.EnrolledNode(request)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while loading enrolled node %s", request.Hostname)
+		}
+		// if a node has since been added to setup.yaml, that takes precedence
+		if conf.FindNode(node.Hostname) == nil {
+			conf.Nodes = append(conf.Nodes, node)
+		}
+	}
+	revocations, err := revocation.NewRevocations(env.Path(RevocationsPath), env.Clock)
+	if err != nil {
+		return nil, err
+	}
+	// decommissioned nodes stay out of the cluster, even if they are still listed in setup.yaml, until they enroll again
+	var remaining []*SpireNode
+	for _, node := range conf.Nodes {
+		if !revocations.IsDecommissioned(node.DNS()) {
+			remaining = append(remaining, node)
+		}
+	}
+	conf.Nodes = remaining
+	hostname, err := env.Effects.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	// each supervisor's keyserver presents a certificate for its own name
+	local, err := conf.LocalSupervisor(hostname)
 	if err != nil {
 		return nil, err
 	}
@@ -278,24 +651,40 @@ func GenerateConfig() (*config.Context, error) {
 		TokenVerifier: verifier.NewTokenVerifier(),
 		StaticFiles: map[string]config.StaticFile{
 			ClusterConfStatic: {
-				Filepath: ClusterConfigPath,
+				Filepath: env.Path(ClusterConfigPath),
 			},
 		},
 		Authorities: map[string]authorities.Authority{},
+		Rotations:   map[string][]rotation.Record{},
 		Accounts:    map[string]*account.Account{},
 
-		KeyserverDNS: conf.Supervisor().DNS(),
+		KeyserverDNS: local.DNS(),
+		CertBackdate: conf.CertBackdate(),
+		Revocations:  revocations,
+		Clock:        env.Clock,
 	}
+	context.TokenVerifier.Registry.Clock = env.Clock
 	err = ValidateStaticFiles(context)
 	if err != nil {
 		return nil, err
 	}
+	passphrase := AuthorityPassphrase(env)
+	signers, err := LoadExternalSigners(env)
+	if err != nil {
+		return nil, err
+	}
 	for _, authority := range ListAuthorities() {
-		loaded, err := authority.Load(AuthorityKeyDirectory)
+		loaded, err := loadAuthority(env, authority, passphrase, signers)
 		if err != nil {
 			return nil, err
 		}
+		loaded.SetClock(env.Clock)
+		loaded.SetBackdate(conf.CertBackdate())
 		context.Authorities[authority.Name] = loaded
+		context.Rotations[authority.Name], err = authority.LoadRotations(env.Path(AuthorityKeyDirectory))
+		if err != nil {
+			return nil, err
+		}
 	}
 	auth := Authorities{
 		Keygranting:    context.Authorities[KeygrantingAuthority].(*authorities.TLSAuthority),
@@ -309,6 +698,44 @@ func GenerateConfig() (*config.Context, error) {
 	}
 	context.AuthenticationAuthority = auth.Keygranting
 	context.ClusterCA = auth.ClusterCA
-	GenerateAccounts(context, conf, auth)
+	var principals []string
+	for _, node := range conf.Nodes {
+		principals = append(principals, node.DNS())
+	}
+	context.Inventory, err = inventory.NewInventory(principals, env.Path(InventoryPath), env.Clock)
+	if err != nil {
+		return nil, err
+	}
+	if conf.AllowReenrollment() {
+		policy := reenroll.Policy{Grace: conf.Cluster.ReenrollmentGrace}
+		context.Reenroller, err = reenroll.NewReenroller(ReenrollKeygrantAPI, auth.SshHost.GetPublicKey(), policy, env.Clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conf.Cluster.AllowEnrollment {
+		context.Enrollments = enrollments
+	}
+	replicated := replication.Replicated{
+		Tokens:      context.TokenVerifier.Registry,
+		Revocations: revocations,
+		Enrollments: enrollments,
+	}
+	if leader := conf.Leader(); local != leader {
+		address := net.JoinHostPort(leader.DNS(), strconv.Itoa(paths.KeyserverPort))
+		context.Follower, err = replication.NewFollower(replicated, address, ReplicateAPI, local.DNS(), auth.Keygranting, auth.ClusterCA.GetPublicKey(), env.Clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	groups := GenerateAccounts(context, conf, auth, replicated)
+	if context.Follower != nil {
+		context.Follower.OnSync = func() error {
+			return FollowLeader(context, conf, groups, auth)
+		}
+	}
+	enrollments.Admit = func(request enrollment.Request) (string, error) {
+		return AdmitNode(context, conf, groups, auth, request)
+	}
 	return context, nil
 }
@@ -1,18 +1,39 @@
 package paths
 
 import (
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
 	"strings"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
 )
 
 const KeyserverTLSCert = "/etc/homeworld/keyclient/keyservertls.pem"
 const GrantingKeyPath = "/etc/homeworld/keyclient/granting.key"
 const GrantingCertPath = "/etc/homeworld/keyclient/granting.pem"
 const BootstrapTokenPath = "/etc/homeworld/keyclient/bootstrap.token"
+const EnrollmentPath = "/etc/homeworld/keyclient/enrollment.json"
 const SpireSetupPath = "/etc/homeworld/config/setup.yaml"
 
+// held while the keyclient runs its actions, so that the daemon and one-shot commands never run them at the same time
+const KeyclientLockPath = "/run/lock/homeworld-keyclient.lock"
+
+// the authorities that this node trusts, as they were when first downloaded or last legitimately rotated
+const AuthorityPinDirectory = "/etc/homeworld/keyclient/pins/"
+
 const ClusterConfPath = "/etc/homeworld/config/cluster.conf"
 const LocalConfPath = "/etc/homeworld/config/local.conf"
+const KeyclientConfigPath = "/etc/homeworld/config/keyclient.yaml"
+const NodeDirectoryPath = "/etc/homeworld/config/nodes.conf"
+
+const SSHHostCAPath = "/etc/homeworld/authorities/ssh-host.pub"
+const SSHHostKeyPath = "/etc/ssh/ssh_host_rsa_key"
+const SSHHostCertPath = "/etc/ssh/ssh_host_rsa_cert"
+const HostsPath = "/etc/hosts"
+const KnownHostsPath = "/etc/ssh/ssh_known_hosts"
 
 const KubernetesCAPath = "/etc/homeworld/authorities/kubernetes.pem"
 const KubernetesMasterKey = "/etc/homeworld/keys/kubernetes-master.key"
@@ -28,10 +49,66 @@ const KubernetesProxyCert = "/etc/homeworld/keys/kubernetes-proxy.pem"
 const KubernetesSchedulerKey = "/etc/homeworld/keys/kubernetes-scheduler.key"
 const KubernetesSchedulerCert = "/etc/homeworld/keys/kubernetes-scheduler.pem"
 
-func GetKeyserver() (string, error) {
-	keyserver, err := ioutil.ReadFile("/etc/homeworld/config/keyserver.domain")
+const KeyserverDomainPath = "/etc/homeworld/config/keyserver.domain"
+const KeyserverPort = 20557
+
+// lookupSRV is replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// GetKeyservers lists the keyservers that can be contacted, in order of preference. Each line of keyserver.domain names
+// either a single keyserver, as "host" or "host:port", or an SRV record to look up, as "srv <name>". Blank lines and
+// lines starting with '#' are ignored. SRV records that cannot be looked up are logged and skipped, so that the other
+// keyservers can still be reached.
+func GetKeyservers(env hostenv.Env, logger *log.Logger) ([]string, error) {
+	contents, err := ioutil.ReadFile(env.Path(KeyserverDomainPath))
+	if err != nil {
+		return nil, err
+	}
+	var keyservers []string
+	var failures []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] == "srv" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid srv line in %s: '%s'", KeyserverDomainPath, line)
+			}
+			// LookupSRV returns the records sorted by priority and randomized by weight, which is the order we want
+			_, records, err := lookupSRV("", "", fields[1])
+			if err != nil {
+				logger.Printf("skipping keyservers at %s: %v", fields[1], err)
+				failures = append(failures, fields[1])
+				continue
+			}
+			for _, record := range records {
+				host := strings.TrimSuffix(record.Target, ".")
+				keyservers = append(keyservers, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+			}
+		} else if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid line in %s: '%s'", KeyserverDomainPath, line)
+		} else if _, _, err := net.SplitHostPort(line); err == nil {
+			keyservers = append(keyservers, line)
+		} else {
+			keyservers = append(keyservers, net.JoinHostPort(line, strconv.Itoa(KeyserverPort)))
+		}
+	}
+	if len(keyservers) == 0 && len(failures) > 0 {
+		return nil, fmt.Errorf("could not look up any keyservers listed in %s: %v", KeyserverDomainPath, failures)
+	}
+	if len(keyservers) == 0 {
+		return nil, fmt.Errorf("no keyservers listed in %s", KeyserverDomainPath)
+	}
+	return keyservers, nil
+}
+
+// GetKeyserver returns the most preferred keyserver listed by GetKeyservers.
+func GetKeyserver(env hostenv.Env, logger *log.Logger) (string, error) {
+	keyservers, err := GetKeyservers(env, logger)
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(string(keyserver)) + ":20557", nil
+	return keyservers[0], nil
 }
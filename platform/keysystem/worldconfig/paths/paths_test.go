@@ -0,0 +1,106 @@
+package paths
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func prepKeyserverDomain(t *testing.T, contents string) (hostenv.Env, func()) {
+	dir, err := ioutil.TempDir("", "paths-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := hostenv.Relocated(dir)
+	if err := os.MkdirAll(path.Dir(env.Path(KeyserverDomainPath)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(env.Path(KeyserverDomainPath), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return env, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func fakeSRV(records map[string][]*net.SRV) func() {
+	original := lookupSRV
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		found, ok := records[name]
+		if !ok {
+			return "", nil, errors.New("no such host")
+		}
+		return name, found, nil
+	}
+	return func() {
+		lookupSRV = original
+	}
+}
+
+func TestGetKeyservers(t *testing.T) {
+	env, cleanup := prepKeyserverDomain(t, "# keyservers\nkeyserver1\n\nkeyserver2:1234\nsrv _keyserver._tcp.example.com\n")
+	defer cleanup()
+	defer fakeSRV(map[string][]*net.SRV{
+		"_keyserver._tcp.example.com": {{Target: "keyserver3.example.com.", Port: 20557}},
+	})()
+	keyservers, err := GetKeyservers(env, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"keyserver1:20557", "keyserver2:1234", "keyserver3.example.com:20557"}
+	if strings.Join(keyservers, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong keyservers: %v", keyservers)
+	}
+}
+
+func TestGetKeyservers_SkipsFailedLookup(t *testing.T) {
+	env, cleanup := prepKeyserverDomain(t, "srv _keyserver._tcp.missing.example.com\nsrv _keyserver._tcp.example.com\nkeyserver1\n")
+	defer cleanup()
+	defer fakeSRV(map[string][]*net.SRV{
+		"_keyserver._tcp.example.com": {{Target: "keyserver2.example.com.", Port: 20557}},
+	})()
+	buf := bytes.NewBuffer(nil)
+	keyservers, err := GetKeyservers(env, log.New(buf, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keyservers, ",") != "keyserver2.example.com:20557,keyserver1:20557" {
+		t.Errorf("wrong keyservers: %v", keyservers)
+	}
+	if !strings.Contains(buf.String(), "skipping keyservers at _keyserver._tcp.missing.example.com: no such host") {
+		t.Errorf("failed lookup not logged: %s", buf.String())
+	}
+}
+
+func TestGetKeyservers_AllLookupsFailed(t *testing.T) {
+	env, cleanup := prepKeyserverDomain(t, "srv _keyserver._tcp.missing.example.com\n")
+	defer cleanup()
+	defer fakeSRV(nil)()
+	_, err := GetKeyservers(env, log.New(ioutil.Discard, "", 0))
+	testutil.CheckError(t, err, "could not look up any keyservers listed in /etc/homeworld/config/keyserver.domain: [_keyserver._tcp.missing.example.com]")
+}
+
+func TestGetKeyservers_Invalid(t *testing.T) {
+	for _, contents := range []string{"", "# nothing\n", "srv\n", "srv a b\n", "keyserver1 keyserver2\n"} {
+		env, cleanup := prepKeyserverDomain(t, contents)
+		_, err := GetKeyservers(env, log.New(ioutil.Discard, "", 0))
+		if err == nil {
+			t.Errorf("expected error for %q", contents)
+		}
+		cleanup()
+	}
+}
+
+func TestGetKeyservers_Missing(t *testing.T) {
+	_, err := GetKeyservers(hostenv.Relocated("/nonexistent"), log.New(ioutil.Discard, "", 0))
+	testutil.CheckError(t, err, "no such file or directory")
+}
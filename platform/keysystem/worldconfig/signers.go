@@ -0,0 +1,93 @@
+package worldconfig
+
+import (
+	"crypto"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/signer"
+)
+
+// if this file exists, it lists the authorities whose private keys are held by external signers, rather than loaded
+// from the authority key directory
+const SignersPath = "/etc/homeworld/keyserver/signers.yaml"
+
+// ExternalSigner holds the private key of an authority outside of the keyserver process. Exactly one of Socket and PKCS11
+// must be set.
+type ExternalSigner struct {
+	Authority string `yaml:"authority"`
+	// the Unix socket of a signing daemon, such as keysigner, which holds the key under the name of the authority
+	Socket string        `yaml:"socket,omitempty"`
+	PKCS11 *PKCS11Signer `yaml:"pkcs11,omitempty"`
+}
+
+// PKCS11Signer identifies a key held by a PKCS #11 token, such as a hardware security module.
+type PKCS11Signer struct {
+	Module string `yaml:"module"`
+	Token  string `yaml:"token"`
+	// the label of the key on the token, which defaults to the name of the authority
+	Label   string `yaml:"label,omitempty"`
+	PINFile string `yaml:"pin-file"`
+}
+
+// Open connects to the external signer.
+func (s ExternalSigner) Open(env hostenv.Env) (crypto.Signer, error) {
+	if s.PKCS11 == nil {
+		return signer.Dial(env.Path(s.Socket), s.Authority)
+	}
+	pin, err := ioutil.ReadFile(env.Path(s.PKCS11.PINFile))
+	if err != nil {
+		return nil, err
+	}
+	label := s.PKCS11.Label
+	if label == "" {
+		label = s.Authority
+	}
+	return signer.OpenPKCS11(s.PKCS11.Module, s.PKCS11.Token, strings.TrimSpace(string(pin)), label)
+}
+
+// LoadExternalSigners finds the external signers for authorities, by the names of the authorities.
+func LoadExternalSigners(env hostenv.Env) (map[string]ExternalSigner, error) {
+	content, err := ioutil.ReadFile(env.Path(SignersPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Signers []ExternalSigner `yaml:"signers"`
+	}
+	err = yaml.UnmarshalStrict(content, &config)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, authority := range ListAuthorities() {
+		known[authority.Name] = true
+	}
+	signers := map[string]ExternalSigner{}
+	for _, s := range config.Signers {
+		if !known[s.Authority] {
+			return nil, fmt.Errorf("no such authority %q in %s", s.Authority, SignersPath)
+		}
+		// nodes fetch the private key of this authority, so the keyserver must have it
+		if s.Authority == ServiceAccountAuthority {
+			return nil, fmt.Errorf("the private key of authority %s cannot be held by an external signer", s.Authority)
+		}
+		if _, found := signers[s.Authority]; found {
+			return nil, fmt.Errorf("duplicate signer for authority %s in %s", s.Authority, SignersPath)
+		}
+		if (s.Socket == "") == (s.PKCS11 == nil) {
+			return nil, fmt.Errorf("signer for authority %s must specify exactly one of a socket and a PKCS #11 token", s.Authority)
+		}
+		if s.PKCS11 != nil && (s.PKCS11.Module == "" || s.PKCS11.Token == "" || s.PKCS11.PINFile == "") {
+			return nil, fmt.Errorf("PKCS #11 signer for authority %s must specify a module, a token, and a PIN file", s.Authority)
+		}
+		signers[s.Authority] = s
+	}
+	return signers, nil
+}
@@ -6,6 +6,13 @@ import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sipb/homeworld/platform/keysystem/keyserver/enrollment"
 )
 
 const Supervisor = "supervisor"
@@ -18,6 +25,13 @@ type SpireNode struct {
 	netIP    net.IP
 	setup    *SpireSetup
 	Kind     string
+
+	// optional scheduling metadata, passed through local.conf to the kubelet
+	Rack          string
+	FailureZone   string `yaml:"failure-zone"`
+	HardwareClass string `yaml:"hardware-class"`
+	Labels        map[string]string
+	Taints        []string
 }
 
 func (s *SpireNode) IsSupervisor() bool {
@@ -44,26 +58,258 @@ func (s *SpireNode) NetIP() net.IP {
 	return s.netIP
 }
 
+const RackLabel = "homeworld.private/rack"
+const FailureZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+const HardwareClassLabel = "homeworld.private/hardware-class"
+
+// KubernetesLabels returns the explicit labels for this node, plus the labels derived from its rack, failure zone, and
+// hardware class.
+func (s *SpireNode) KubernetesLabels() map[string]string {
+	labels := map[string]string{}
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	if s.Rack != "" {
+		labels[RackLabel] = s.Rack
+	}
+	if s.FailureZone != "" {
+		labels[FailureZoneLabel] = s.FailureZone
+	}
+	if s.HardwareClass != "" {
+		labels[HardwareClassLabel] = s.HardwareClass
+	}
+	return labels
+}
+
+// these patterns match the kubernetes syntax for label keys and values, which also ensures that they are safe to
+// include unquoted in local.conf, which is sourced by shell scripts.
+var labelNamePattern = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+var labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+var taintEffects = map[string]bool{
+	"NoSchedule":       true,
+	"PreferNoSchedule": true,
+	"NoExecute":        true,
+}
+
+func validateLabelKey(key string) error {
+	name := key
+	if slash := strings.IndexByte(key, '/'); slash != -1 {
+		prefix := key[:slash]
+		name = key[slash+1:]
+		if len(prefix) > 253 || !labelPrefixPattern.MatchString(prefix) {
+			return fmt.Errorf("invalid prefix in label key: %s", key)
+		}
+	}
+	if name == "" || !labelNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid label key: %s", key)
+	}
+	return nil
+}
+
+func validateLabelValue(value string) error {
+	if !labelNamePattern.MatchString(value) {
+		return fmt.Errorf("invalid label value: %s", value)
+	}
+	return nil
+}
+
+// taints are in the format accepted by kubelet --register-with-taints: key=value:Effect or key:Effect
+func validateTaint(taint string) error {
+	colon := strings.LastIndexByte(taint, ':')
+	if colon == -1 {
+		return fmt.Errorf("missing effect in taint: %s", taint)
+	}
+	keyvalue, effect := taint[:colon], taint[colon+1:]
+	if !taintEffects[effect] {
+		return fmt.Errorf("invalid effect in taint: %s", taint)
+	}
+	kv := strings.SplitN(keyvalue, "=", 2)
+	if err := validateLabelKey(kv[0]); err != nil {
+		return errors.Wrap(err, "in taint")
+	}
+	if len(kv) == 2 {
+		if err := validateLabelValue(kv[1]); err != nil {
+			return errors.Wrap(err, "in taint")
+		}
+	}
+	return nil
+}
+
+func (s *SpireNode) validateMetadata() error {
+	for _, value := range []string{s.Rack, s.FailureZone, s.HardwareClass} {
+		if err := validateLabelValue(value); err != nil {
+			return err
+		}
+	}
+	for key, value := range s.Labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+		if err := validateLabelValue(value); err != nil {
+			return err
+		}
+	}
+	for _, taint := range s.Taints {
+		if err := validateTaint(taint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formats labels as accepted by kubelet --node-labels, in a stable order
+func FormatLabels(labels map[string]string) string {
+	var kvs []string
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
 // format for the setup.yaml that spire uses
 type SpireSetup struct {
 	Cluster struct {
 		ExternalDomain string `yaml:"external-domain"`
 		InternalDomain string `yaml:"internal-domain"`
 		KerberosRealm  string `yaml:"kerberos-realm"`
+		// how long before issuance certificates become valid; DefaultCertBackdate if not specified
+		CertBackdate *time.Duration `yaml:"cert-backdate"`
+		// whether nodes can re-enroll by proving possession of their SSH host keys; true if not specified
+		AllowReenrollment *bool `yaml:"allow-reenrollment"`
+		// how long after a node's SSH host certificate expires it can still be used to re-enroll
+		ReenrollmentGrace time.Duration `yaml:"reenrollment-grace"`
+		// whether new workers can ask to join the cluster without being listed here, subject to approval by an admin
+		AllowEnrollment bool `yaml:"allow-enrollment"`
 	}
 	Addresses struct {
 		ServiceAPI string `yaml:"service-api"`
 	}
-	Nodes      []*SpireNode
-	supervisor *SpireNode
-	RootAdmins []string `yaml:"root-admins"`
+	Nodes []*SpireNode
+	// in the order listed; the first is the leader
+	supervisors []*SpireNode
+	RootAdmins  []string `yaml:"root-admins"`
+	// only needed for nodes that enroll while the keyserver is running
+	nodesMutex sync.RWMutex
+}
+
+// certificates are backdated by default, so that a node whose clock is slightly behind the keyserver's can still use a
+// certificate as soon as it's issued
+const DefaultCertBackdate = 5 * time.Minute
+
+// CertBackdate finds how long before issuance certificates should become valid.
+func (s *SpireSetup) CertBackdate() time.Duration {
+	if s.Cluster.CertBackdate == nil {
+		return DefaultCertBackdate
+	}
+	return *s.Cluster.CertBackdate
 }
 
-func (s *SpireSetup) Supervisor() *SpireNode {
-	if s.supervisor == nil {
+// AllowReenrollment determines whether nodes whose keygranting certificates have expired can re-enroll without a new
+// bootstrap token.
+func (s *SpireSetup) AllowReenrollment() bool {
+	return s.Cluster.AllowReenrollment == nil || *s.Cluster.AllowReenrollment
+}
+
+// hostnames of enrolled nodes are chosen by the machines themselves, and end up in local.conf, so they are restricted to
+// a single DNS label
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// EnrolledNode builds the node described by an enrollment request. Only workers can enroll, because other kinds of nodes
+// are part of the cluster's configuration in ways that can't change while it's running.
+func (s *SpireSetup) EnrolledNode(request enrollment.Request) (*SpireNode, error) {
+	if request.Kind != Worker {
+		return nil, fmt.Errorf("only workers can enroll, not %s nodes", request.Kind)
+	}
+	if !hostnamePattern.MatchString(request.Hostname) {
+		return nil, fmt.Errorf("invalid hostname for enrolled node: %s", request.Hostname)
+	}
+	netIP := net.ParseIP(request.IP)
+	if netIP == nil {
+		return nil, fmt.Errorf("could not parse IP: %s", request.IP)
+	}
+	return &SpireNode{
+		Hostname: request.Hostname,
+		IP:       netIP.String(),
+		netIP:    netIP,
+		setup:    s,
+		Kind:     request.Kind,
+	}, nil
+}
+
+// FindNode looks up a node by hostname, or returns nil if there is none.
+func (s *SpireSetup) FindNode(hostname string) *SpireNode {
+	s.nodesMutex.RLock()
+	defer s.nodesMutex.RUnlock()
+	for _, node := range s.Nodes {
+		if node.Hostname == hostname {
+			return node
+		}
+	}
+	return nil
+}
+
+// AddNode adds a node to a setup that may already be in use.
+func (s *SpireSetup) AddNode(node *SpireNode) error {
+	s.nodesMutex.Lock()
+	defer s.nodesMutex.Unlock()
+	for _, existing := range s.Nodes {
+		if existing.Hostname == node.Hostname {
+			return fmt.Errorf("a node named %s already exists", node.Hostname)
+		}
+	}
+	s.Nodes = append(s.Nodes, node)
+	return nil
+}
+
+// RemoveNode removes a node from a setup that may already be in use.
+func (s *SpireSetup) RemoveNode(hostname string) error {
+	s.nodesMutex.Lock()
+	defer s.nodesMutex.Unlock()
+	for i, existing := range s.Nodes {
+		if existing.Hostname == hostname {
+			s.Nodes = append(s.Nodes[:i:i], s.Nodes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no node named %s", hostname)
+}
+
+// ListNodes returns a copy of the list of nodes, for use while the setup may be changing.
+func (s *SpireSetup) ListNodes() []*SpireNode {
+	s.nodesMutex.RLock()
+	defer s.nodesMutex.RUnlock()
+	return append([]*SpireNode(nil), s.Nodes...)
+}
+
+// Supervisors lists the supervisor nodes, each of which runs a keyserver, in the order listed in the setup.
+func (s *SpireSetup) Supervisors() []*SpireNode {
+	if len(s.supervisors) == 0 {
 		panic("uninitialized")
 	}
-	return s.supervisor
+	return s.supervisors
+}
+
+// Leader returns the supervisor whose keyserver manages the cluster's mutable state, which is the first one listed. The
+// keyservers on any other supervisors follow it.
+func (s *SpireSetup) Leader() *SpireNode {
+	return s.Supervisors()[0]
+}
+
+// LocalSupervisor finds the supervisor with the specified hostname, which may be fully qualified. If there is only one
+// supervisor, it is assumed to be the local one, whatever the hostname.
+func (s *SpireSetup) LocalSupervisor(hostname string) (*SpireNode, error) {
+	supervisors := s.Supervisors()
+	for _, node := range supervisors {
+		if node.Hostname == hostname || node.DNS() == hostname {
+			return node, nil
+		}
+	}
+	if len(supervisors) == 1 {
+		return supervisors[0], nil
+	}
+	return nil, fmt.Errorf("hostname %s does not match any supervisor", hostname)
 }
 
 func LoadSpireSetup(path string) (*SpireSetup, error) {
@@ -77,7 +323,6 @@ func LoadSpireSetup(path string) (*SpireSetup, error) {
 		return nil, err
 	}
 	// validation steps
-	supervisors := 0
 	for _, node := range setup.Nodes {
 		if !(node.IsSupervisor() || node.IsMaster() || node.IsWorker()) {
 			return nil, fmt.Errorf("unrecognized kind of node: %s", node.Kind)
@@ -87,13 +332,26 @@ func LoadSpireSetup(path string) (*SpireSetup, error) {
 			return nil, fmt.Errorf("could not parse IP: %s", node.IP)
 		}
 		node.setup = setup
+		if err := node.validateMetadata(); err != nil {
+			return nil, errors.Wrapf(err, "while validating node %s", node.Hostname)
+		}
 		if node.IsSupervisor() {
-			setup.supervisor = node
-			supervisors++
+			for _, other := range setup.supervisors {
+				if other.Hostname == node.Hostname {
+					return nil, fmt.Errorf("duplicate supervisor: %s", node.Hostname)
+				}
+			}
+			setup.supervisors = append(setup.supervisors, node)
 		}
 	}
-	if supervisors != 1 {
-		return nil, fmt.Errorf("expected exactly 1 declared supervisor, not %d", supervisors)
+	if len(setup.supervisors) == 0 {
+		return nil, errors.New("expected at least 1 declared supervisor")
+	}
+	if setup.CertBackdate() < 0 {
+		return nil, fmt.Errorf("invalid negative certificate backdate: %v", setup.CertBackdate())
+	}
+	if setup.Cluster.ReenrollmentGrace < 0 {
+		return nil, fmt.Errorf("invalid negative re-enrollment grace period: %v", setup.Cluster.ReenrollmentGrace)
 	}
 	dupcheck := map[string]struct{}{}
 	for _, rootadmin := range setup.RootAdmins {
@@ -0,0 +1,181 @@
+package worldconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func TestValidateLabelKey(t *testing.T) {
+	for _, key := range []string{
+		"rack",
+		"Rack_1.a-b",
+		"homeworld.private/rack",
+		"example.com/a",
+		strings.Repeat("a", 63),
+		strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "/name",
+	} {
+		if err := validateLabelKey(key); err != nil {
+			t.Errorf("expected %q to be valid: %v", key, err)
+		}
+	}
+	for _, test := range []struct {
+		key string
+		err string
+	}{
+		{"", "invalid label key: "},
+		{"-rack", "invalid label key: -rack"},
+		{"rack-", "invalid label key: rack-"},
+		{"rack zone", "invalid label key: rack zone"},
+		{"rack;reboot", "invalid label key: rack;reboot"},
+		{strings.Repeat("a", 64), "invalid label key"},
+		{"homeworld.private/", "invalid label key: homeworld.private/"},
+		{"/rack", "invalid prefix in label key: /rack"},
+		{"Homeworld.private/rack", "invalid prefix in label key: Homeworld.private/rack"},
+		{"homeworld..private/rack", "invalid prefix in label key"},
+		{"a/b/c", "invalid label key: a/b/c"},
+		{strings.Repeat("a.", 127) + "a/rack", "invalid prefix in label key"},
+	} {
+		testutil.CheckError(t, validateLabelKey(test.key), test.err)
+	}
+}
+
+func TestValidateLabelValue(t *testing.T) {
+	for _, value := range []string{"", "rack1", "Zone_A.1-b", strings.Repeat("a", 63)} {
+		if err := validateLabelValue(value); err != nil {
+			t.Errorf("expected %q to be valid: %v", value, err)
+		}
+	}
+	for _, value := range []string{"-a", "a-", "a b", "a=b", "$(reboot)", "a\nb", strings.Repeat("a", 64)} {
+		testutil.CheckError(t, validateLabelValue(value), "invalid label value")
+	}
+}
+
+func TestValidateTaint(t *testing.T) {
+	for _, taint := range []string{
+		"dedicated=gpu:NoSchedule",
+		"dedicated:PreferNoSchedule",
+		"homeworld.private/maintenance=true:NoExecute",
+		"dedicated=:NoSchedule",
+	} {
+		if err := validateTaint(taint); err != nil {
+			t.Errorf("expected %q to be valid: %v", taint, err)
+		}
+	}
+	for _, test := range []struct {
+		taint string
+		err   string
+	}{
+		{"dedicated=gpu", "missing effect in taint: dedicated=gpu"},
+		{"dedicated=gpu:", "invalid effect in taint: dedicated=gpu:"},
+		{"dedicated=gpu:noschedule", "invalid effect in taint: dedicated=gpu:noschedule"},
+		{":NoSchedule", "in taint: invalid label key: "},
+		{"bad key=gpu:NoSchedule", "in taint: invalid label key: bad key"},
+		{"dedicated=bad value:NoSchedule", "in taint: invalid label value: bad value"},
+		{"dedicated=a=b:NoSchedule", "in taint: invalid label value: a=b"},
+	} {
+		testutil.CheckError(t, validateTaint(test.taint), test.err)
+	}
+}
+
+func TestKubernetesLabels(t *testing.T) {
+	node := &SpireNode{
+		Rack:          "rack3",
+		FailureZone:   "zone-b",
+		HardwareClass: "",
+		Labels:        map[string]string{"team": "infra", RackLabel: "overridden"},
+	}
+	labels := node.KubernetesLabels()
+	if len(labels) != 3 || labels["team"] != "infra" || labels[RackLabel] != "rack3" || labels[FailureZoneLabel] != "zone-b" {
+		t.Errorf("wrong labels: %v", labels)
+	}
+	if node.Labels[RackLabel] != "overridden" {
+		t.Error("node's own labels were modified")
+	}
+	formatted := FormatLabels(labels)
+	expected := "failure-domain.beta.kubernetes.io/zone=zone-b,homeworld.private/rack=rack3,team=infra"
+	if formatted != expected {
+		t.Errorf("wrong formatted labels: %s", formatted)
+	}
+	if FormatLabels(nil) != "" {
+		t.Error("expected no labels to format as an empty string")
+	}
+}
+
+const metadataSetup = `
+cluster:
+  external-domain: example.com
+nodes:
+  - hostname: supervisor1
+    ip: 10.0.0.1
+    kind: supervisor
+  - hostname: worker1
+    ip: 10.0.0.2
+    kind: worker
+`
+
+func loadSetupWithWorker(t *testing.T, metadata string) (*SpireSetup, error) {
+	dir, err := ioutil.TempDir("", "spiresetup-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "setup.yaml")
+	if err := ioutil.WriteFile(filename, []byte(metadataSetup+metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadSpireSetup(filename)
+}
+
+func TestLoadSpireSetup_Metadata(t *testing.T) {
+	setup, err := loadSetupWithWorker(t, `    rack: rack3
+    failure-zone: zone-b
+    hardware-class: no-gpu
+    labels:
+      team: infra
+    taints:
+      - dedicated=infra:NoSchedule
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := setup.FindNode("worker1")
+	if worker == nil {
+		t.Fatal("worker not found")
+	}
+	localconf := GenerateLocalConf(setup, worker)
+	for _, line := range []string{
+		"HOST_NODE=worker1",
+		"HOST_DNS=worker1.example.com",
+		"SCHEDULE_WORK=true",
+		"RACK=rack3",
+		"FAILURE_ZONE=zone-b",
+		"HARDWARE_CLASS=no-gpu",
+		"NODE_LABELS=failure-domain.beta.kubernetes.io/zone=zone-b,homeworld.private/hardware-class=no-gpu,homeworld.private/rack=rack3,team=infra",
+		"NODE_TAINTS=dedicated=infra:NoSchedule",
+	} {
+		if !strings.Contains(localconf+"\n", "\n"+line+"\n") {
+			t.Errorf("missing %s in local.conf:\n%s", line, localconf)
+		}
+	}
+}
+
+func TestLoadSpireSetup_InvalidMetadata(t *testing.T) {
+	for _, test := range []struct {
+		metadata string
+		err      string
+	}{
+		{"    rack: rack 3\n", "while validating node worker1: invalid label value: rack 3"},
+		{"    failure-zone: $(reboot)\n", "while validating node worker1: invalid label value: $(reboot)"},
+		{"    labels:\n      bad key: infra\n", "while validating node worker1: invalid label key: bad key"},
+		{"    labels:\n      team: bad value\n", "while validating node worker1: invalid label value: bad value"},
+		{"    taints:\n      - dedicated=infra\n", "while validating node worker1: missing effect in taint"},
+	} {
+		_, err := loadSetupWithWorker(t, test.metadata)
+		testutil.CheckError(t, err, test.err)
+	}
+}
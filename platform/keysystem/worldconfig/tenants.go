@@ -0,0 +1,84 @@
+package worldconfig
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+)
+
+// if this file exists, the keyserver hosts each of the clusters that it lists, instead of a single cluster configured
+// in the usual locations
+const TenantsPath = "/etc/homeworld/keyserver/tenants.yaml"
+
+// Tenant is one of several clusters hosted by a single keyserver. Each tenant has its own setup, authorities, accounts,
+// static files, and state, which are kept under its root exactly where a keyserver dedicated to the cluster would keep
+// them. Clients select a tenant by the server name that they connect to, which must be the name of one of the tenant's
+// supervisors.
+type Tenant struct {
+	Name string `yaml:"name"`
+	Root string `yaml:"root"`
+}
+
+// Env returns the env in which the tenant's keyserver configuration is loaded.
+func (t Tenant) Env(env hostenv.Env) hostenv.Env {
+	return env.Within(t.Root)
+}
+
+// LoadTenants lists the clusters hosted by the keyserver, or returns nil if it hosts a single cluster.
+func LoadTenants(env hostenv.Env) ([]Tenant, error) {
+	content, err := ioutil.ReadFile(env.Path(TenantsPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Tenants []Tenant `yaml:"tenants"`
+	}
+	err = yaml.UnmarshalStrict(content, &config)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Tenants) == 0 {
+		return nil, fmt.Errorf("no tenants listed in %s", TenantsPath)
+	}
+	names := map[string]bool{}
+	roots := map[string]string{}
+	for _, tenant := range config.Tenants {
+		if tenant.Name == "" {
+			return nil, fmt.Errorf("tenant without a name in %s", TenantsPath)
+		}
+		if names[tenant.Name] {
+			return nil, fmt.Errorf("duplicate tenant: %s", tenant.Name)
+		}
+		names[tenant.Name] = true
+		if !path.IsAbs(tenant.Root) {
+			return nil, fmt.Errorf("root of tenant %s is not an absolute path: %q", tenant.Name, tenant.Root)
+		}
+		// tenants that shared any files would not be isolated from one another
+		root := path.Clean(tenant.Root)
+		for other, otherRoot := range roots {
+			if root == otherRoot {
+				return nil, fmt.Errorf("root of tenant %s is shared with tenant %s: %s", tenant.Name, other, tenant.Root)
+			}
+			if isWithin(root, otherRoot) || isWithin(otherRoot, root) {
+				return nil, fmt.Errorf("roots of tenants %s and %s are nested: %s and %s", tenant.Name, other, tenant.Root, otherRoot)
+			}
+		}
+		roots[tenant.Name] = root
+	}
+	return config.Tenants, nil
+}
+
+// isWithin checks whether child is a subdirectory of parent. Both must be clean absolute paths.
+func isWithin(child string, parent string) bool {
+	if parent == "/" {
+		return child != "/"
+	}
+	return strings.HasPrefix(child, parent+"/")
+}
@@ -0,0 +1,103 @@
+package worldconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/keysystem/hostenv"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func prepTenants(t *testing.T, contents string) (hostenv.Env, func()) {
+	dir, err := ioutil.TempDir("", "tenants-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := hostenv.Relocated(dir)
+	if contents != "" {
+		if err := os.MkdirAll(path.Dir(env.Path(TenantsPath)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(env.Path(TenantsPath), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return env, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadTenants(t *testing.T) {
+	env, cleanup := prepTenants(t, `tenants:
+- name: alpha
+  root: /srv/tenants/alpha
+- name: beta
+  root: /srv/tenants/alphabet/
+`)
+	defer cleanup()
+	tenants, err := LoadTenants(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 2 || tenants[0].Name != "alpha" || tenants[1].Root != "/srv/tenants/alphabet/" {
+		t.Errorf("wrong tenants: %+v", tenants)
+	}
+	if path := tenants[0].Env(env).Path(TenantsPath); path != env.Path("/srv/tenants/alpha"+TenantsPath) {
+		t.Errorf("wrong path within tenant: %s", path)
+	}
+}
+
+func TestLoadTenants_NotConfigured(t *testing.T) {
+	env, cleanup := prepTenants(t, "")
+	defer cleanup()
+	tenants, err := LoadTenants(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenants != nil {
+		t.Errorf("expected no tenants, not %+v", tenants)
+	}
+}
+
+func TestLoadTenants_Invalid(t *testing.T) {
+	for _, test := range []struct {
+		contents string
+		err      string
+	}{
+		{"tenants: []\n", "no tenants listed in /etc/homeworld/keyserver/tenants.yaml"},
+		{"tenants:\n- name: alpha\n  root: /srv/alpha\n  extra: true\n", "field extra not found"},
+		{"tenants:\n- root: /srv/alpha\n", "tenant without a name in /etc/homeworld/keyserver/tenants.yaml"},
+		{"tenants:\n- name: alpha\n  root: /srv/alpha\n- name: alpha\n  root: /srv/beta\n", "duplicate tenant: alpha"},
+		{"tenants:\n- name: alpha\n  root: srv/alpha\n", "root of tenant alpha is not an absolute path: \"srv/alpha\""},
+		{"tenants:\n- name: alpha\n  root: /srv/alpha\n- name: beta\n  root: /srv/./alpha/\n", "root of tenant beta is shared with tenant alpha: /srv/./alpha/"},
+		{"tenants:\n- name: alpha\n  root: /srv/alpha\n- name: beta\n  root: /srv/alpha/beta\n", "roots of tenants beta and alpha are nested: /srv/alpha/beta and /srv/alpha"},
+		{"tenants:\n- name: alpha\n  root: /srv/alpha/beta\n- name: beta\n  root: /srv/alpha\n", "roots of tenants beta and alpha are nested: /srv/alpha and /srv/alpha/beta"},
+		{"tenants:\n- name: alpha\n  root: /srv/alpha\n- name: beta\n  root: /\n", "roots of tenants beta and alpha are nested: / and /srv/alpha"},
+	} {
+		env, cleanup := prepTenants(t, test.contents)
+		_, err := LoadTenants(env)
+		testutil.CheckError(t, err, test.err)
+		cleanup()
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	for _, test := range []struct {
+		child  string
+		parent string
+		within bool
+	}{
+		{"/srv/alpha/beta", "/srv/alpha", true},
+		{"/srv/alpha", "/srv/alpha", false},
+		{"/srv/alphabet", "/srv/alpha", false},
+		{"/srv/alpha", "/srv/alpha/beta", false},
+		{"/srv", "/", true},
+		{"/", "/", false},
+	} {
+		if within := isWithin(test.child, test.parent); within != test.within {
+			t.Errorf("isWithin(%q, %q) = %v", test.child, test.parent, within)
+		}
+	}
+}
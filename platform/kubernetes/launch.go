@@ -188,12 +188,12 @@ func LaunchKubelet() error {
 		return err
 	}
 
-	cmd := exec.Command(
-		"/usr/bin/hyperkube", "kubelet",
+	args := []string{
+		"kubelet",
 
 		"--kubeconfig", kubeconfig,
 
-		"--register-schedulable="+strconv.FormatBool(scheduleWork),
+		"--register-schedulable=" + strconv.FormatBool(scheduleWork),
 		// turn off anonymous authentication
 		"--anonymous-auth=false",
 		// add kubelet auth certs
@@ -208,7 +208,16 @@ func LaunchKubelet() error {
 		"--cluster-dns", serviceDNS, "--cluster-domain", clusterDomain,
 
 		getVerbosityArgument(),
-	)
+	}
+	// per-node scheduling metadata from setup.yaml; already validated by the keyserver
+	if nodeLabels := localConf["NODE_LABELS"]; nodeLabels != "" {
+		args = append(args, "--node-labels", nodeLabels)
+	}
+	if nodeTaints := localConf["NODE_TAINTS"]; nodeTaints != "" {
+		args = append(args, "--register-with-taints", nodeTaints)
+	}
+
+	cmd := exec.Command("/usr/bin/hyperkube", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	err = cmd.Run()
@@ -32,12 +32,13 @@ in-target apt-get update
 in-target apt-get install --fix-broken --yes homeworld-keysystem homeworld-prometheus-node-exporter \
     homeworld-services homeworld-docker-registry homeworld-prometheus homeworld-auth-monitor
 
-in-target systemctl enable keyclient.service prometheus-node-exporter.service
+in-target systemctl enable keyclient.service keyclient-update-ca.service prometheus-node-exporter.service
 in-target systemctl enable homeworld-autostart.service
 
 mkdir -p /target/etc/homeworld/keyclient/
 mkdir -p /target/etc/homeworld/config/
 cp /keyservertls.pem /target/etc/homeworld/keyclient/keyservertls.pem
+cp -r /pins /target/etc/homeworld/keyclient/pins
 cp /keyserver.domain /target/etc/homeworld/config/keyserver.domain
 cp /sshd_config.new /target/etc/ssh/sshd_config
 cat /dns_bootstrap_lines >> /target/etc/hosts
@@ -66,17 +66,25 @@ class KeyreqFailed(command.CommandFailedException):
 
 def call_keyreq(keyreq_command, *params):
     config = configuration.get_config()
-    keyserver_domain = config.keyserver.hostname + "." + config.external_domain + ":20557"
+    if not config.keyservers:
+        command.fail("no supervisors are configured to run keyservers")
 
+    failure = None
     with tempfile.TemporaryDirectory() as tdir:
         https_cert_path = os.path.join(tdir, "clusterca.pem")
         util.writefile(https_cert_path, authority.get_pubkey_by_filename("./clusterca.pem"))
-        keyreq_sp = subprocess.Popen(["keyreq", keyreq_command, https_cert_path, keyserver_domain] + list(params), stdout=subprocess.PIPE, stderr=subprocess.PIPE)
-        output, err_bytes = keyreq_sp.communicate()
-        if keyreq_sp.returncode != 0:
-            err = err_bytes.decode()
-            raise KeyreqFailed(keyreq_sp.returncode, err)
-        return output
+        # the leader comes first; the others are only tried if it can't be reached, so that a request is never made twice
+        for keyserver in config.keyservers:
+            keyserver_domain = keyserver.hostname + "." + config.external_domain + ":20557"
+            keyreq_sp = subprocess.Popen(["keyreq", keyreq_command, https_cert_path, keyserver_domain] + list(params), stdout=subprocess.PIPE, stderr=subprocess.PIPE)
+            output, err_bytes = keyreq_sp.communicate()
+            if keyreq_sp.returncode == 0:
+                return output
+            failure = KeyreqFailed(keyreq_sp.returncode, err_bytes.decode())
+            if KEYREQ_ERROR_CODES.get(keyreq_sp.returncode) != "ERR_CANNOT_ESTABLISH_CONNECTION":
+                break
+            print("[could not reach keyserver on %s; trying the next supervisor]" % keyserver.hostname)
+    raise failure
 
 
 def renew_ssh_cert() -> str:
@@ -302,17 +310,30 @@ def hostkeys_by_fingerprint(node: configuration.Node, fingerprints: list):
 
 def pull_supervisor_key(fingerprints):
     config = configuration.get_config()
-    node = config.keyserver
     known_hosts = get_known_hosts_path()
 
-    for remove in ["%s.%s" % (node.hostname, config.external_domain), str(node.ip)]:
-        subprocess.check_call(["ssh-keygen", "-f", known_hosts, "-R", remove],
-                              stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
-
-    keys = hostkeys_by_fingerprint(node, fingerprints)
-    with open(known_hosts, "a") as f:
-        for key in keys:
-            f.write("%s.%s %s\n" % (node.hostname, config.external_domain, key))
+    # every supervisor is pulled, so that any of them can be used when another is down
+    pulled = False
+    for node in config.keyservers:
+        try:
+            keys = hostkeys_by_fingerprint(node, fingerprints)
+        except subprocess.CalledProcessError:
+            print("[could not scan host keys of %s; skipping]" % node.hostname)
+            continue
+        if not keys:
+            print("[no host keys of %s matched the known fingerprints; skipping]" % node.hostname)
+            continue
+
+        for remove in ["%s.%s" % (node.hostname, config.external_domain), str(node.ip)]:
+            subprocess.check_call(["ssh-keygen", "-f", known_hosts, "-R", remove],
+                                  stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+        with open(known_hosts, "a") as f:
+            for key in keys:
+                f.write("%s.%s %s\n" % (node.hostname, config.external_domain, key))
+        pulled = True
+
+    if not pulled:
+        command.fail("could not pull the host keys of any supervisor")
 
 
 @command.wrap
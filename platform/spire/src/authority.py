@@ -118,6 +118,27 @@ def iterate_keys_decrypted():  # yields (name, contents) pairs
             yield name_for_decrypted_file(name), keycrypt.gpg_decrypt_in_memory(contents)
 
 
+def iterate_keys_sealed(passphrase: bytes):  # yields (name, contents) pairs
+    # tempfile.TemporaryDirectory() creates the directory with 0o600, which protects the private keys
+    with tempfile.TemporaryDirectory() as d:
+        for name, contents in iterate_keys_decrypted():
+            if "/" in name:
+                command.fail("found key in upload list with invalid filename")
+            util.writefile(os.path.join(d, name), contents)
+        try:
+            # seals the private keys in place, the same way that the keyserver expects to find them
+            subprocess.run(["keygen", "seal", d, "/dev/stdin"], input=passphrase, check=True)
+        except FileNotFoundError as e:
+            if e.filename == "keygen":
+                command.fail("could not find keygen binary. is the homeworld-keyserver dependency installed?")
+            else:
+                raise e
+        names = sorted(os.listdir(d))
+        sealed = [(name, util.readfile(os.path.join(d, name))) for name in names]
+        subprocess.check_call(["shred", "--"] + names, cwd=d)
+    yield from sealed
+
+
 def get_upstream_cert_paths():
     # we don't encrypt user-grant-upstream.key, because it's not intended to be saved
     return os.path.join(configuration.get_project(), "user-grant-upstream.key"), \
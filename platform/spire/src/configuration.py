@@ -78,13 +78,9 @@ class Config:
         self.root_admins = kv["root-admins"]
         self.nodes = [Node(n, self) for n in kv["nodes"]]
 
-        self.keyserver = None
-
-        for node in self.nodes:
-            if node.kind == "supervisor":
-                if self.keyserver is not None:
-                    command.fail("in config: multiple supervisors not yet supported")
-                self.keyserver = node
+        # every supervisor runs a keyserver; the first one listed is the leader, which the others follow
+        self.keyservers = [node for node in self.nodes if node.kind == "supervisor"]
+        self.keyserver = self.keyservers[0] if self.keyservers else None
 
     # TODO(#371): make this configuration setting more explicit
     def is_kerberos_enabled(self):
@@ -140,7 +136,8 @@ def get_config() -> Config:
 
 def get_keyserver_domain() -> str:
     config = Config.load_from_project()
-    return config.keyserver.hostname + "." + config.external_domain
+    # one per line, leader first, so that nodes can fail over to the other keyservers
+    return "\n".join(node.hostname + "." + config.external_domain for node in config.keyservers)
 
 
 def get_etcd_endpoints() -> str:
@@ -204,6 +201,10 @@ def get_prometheus_yaml() -> str:
     kcli = {"APISERVER": get_apiserver_default_as_node().ip,
             "NODE-TARGETS": "[%s]" % ",".join("'%s.%s:9100'" % (node.hostname, config.external_domain)
                                               for node in config.nodes),
+            "KEYCLIENT-TARGETS": "[%s]" % ",".join("'%s.%s:9106'" % (node.hostname, config.external_domain)
+                                                   for node in config.nodes),
+            "KEYSERVER-TARGETS": "[%s]" % ",".join("'%s.%s:20557'" % (node.hostname, config.external_domain)
+                                                   for node in config.keyservers),
             "PULL-TARGETS": "[%s]" % ",".join("'%s.%s:9103'" % (node.hostname, config.external_domain)
                                               for node in config.nodes if node.kind != "supervisor"),
             "ETCD-TARGETS": "[%s]" % ",".join("'%s.%s:9101'" % (node.hostname, config.external_domain)
@@ -4,6 +4,7 @@ import configuration
 import setup
 import ssh
 
+import json
 import os
 import traceback
 
@@ -23,7 +24,8 @@ def admit(server_principal: str) -> str:
         errs.append(e)
 
     try:
-        return ssh.check_ssh_output(config.keyserver, "keyinitadmit", principal_hostname).decode().strip()
+        # keyinitadmit on any supervisor gets the token from the leader
+        return ssh.check_ssh_output_failover(config.keyservers, "keyinitadmit", principal_hostname).decode().strip()
     except Exception as e:
         print('[keyinitadmit failed, set SPIRE_DEBUG for traceback]')
         if os.environ.get('SPIRE_DEBUG'):
@@ -58,6 +60,53 @@ def infra_admit_all() -> None:
     print('{:=^16} {:=^8} {:=^14} {:=^23}'.format('host', 'kind', 'ip', 'token'))
 
 
+@command.wrap
+def infra_enrollments(raw: bool=False) -> None:
+    """
+    list requests from machines that have asked to join the cluster
+
+    raw: print the requests as JSON
+    """
+    enrollments = access.call_keyreq("enrollments").decode()
+    if raw:
+        print(enrollments.strip())
+        return
+    for enrollment in json.loads(enrollments):
+        request = enrollment["request"]
+        print("%s: %s %s (%s), host key %s, submitted %s" %
+              (enrollment["id"], request["kind"], request["hostname"], request["ip"],
+               request["host-key-fingerprint"], enrollment["submitted"]))
+        if enrollment["state"] != "pending":
+            print("    %s by %s at %s" % (enrollment["state"], enrollment["decided-by"], enrollment["decided"]))
+
+
+@command.wrap
+def infra_approve(enrollment_id: str) -> None:
+    "admit the machine that submitted an enrollment request; check its host key fingerprint first"
+    hostname = access.call_keyreq("approve-enrollment", enrollment_id).decode().strip()
+    print("Approved enrollment of %s" % hostname)
+
+
+@command.wrap
+def infra_deny(enrollment_id: str) -> None:
+    "reject an enrollment request"
+    access.call_keyreq("deny-enrollment", enrollment_id)
+
+
+@command.wrap
+def infra_decommission(hostname: str) -> None:
+    "remove a worker from the cluster, revoking its certificates and deleting its kubernetes node"
+    config = configuration.get_config()
+    revoked = json.loads(access.call_keyreq("decommission", hostname).decode())
+    for cert in revoked or []:
+        source = cert["path"] or "certificate issued through %s" % cert.get("api", "an unknown API")
+        print("Revoked %s (serial %s, expires %s)" % (source, cert["serial"], cert["expires"]))
+    ssh.check_ssh_failover(config.keyservers, "decommission-node", hostname)
+    print("Decommissioned %s" % hostname)
+    print("Note: %s's kubelet and kube-proxy certificates stay valid for up to two days, until they expire, and its SSH "
+          "host certificate stays valid until it expires" % hostname)
+
+
 @command.wrapop
 def infra_install_packages(ops: command.Operations) -> None:
     "install and update packages on a node"
@@ -83,6 +132,10 @@ def infra_sync_supervisor(ops: command.Operations) -> None:
 main_command = command.Mux("commands about maintaining the infrastructure of a cluster", {
     "admit": infra_admit,
     "admit-all": infra_admit_all,
+    "enrollments": infra_enrollments,
+    "approve": infra_approve,
+    "deny": infra_deny,
+    "decommission": infra_decommission,
     "install-packages": infra_install_packages,
     "sync": infra_sync,
     "sync-supervisor": infra_sync_supervisor,
@@ -16,6 +16,17 @@ import util
 
 PACKAGES = ("homeworld-apt-setup",)
 
+# authorities that the keyclient pins from the start, rather than trusting whatever it first downloads
+PINNED_AUTHORITIES = {
+    "clusterca": "clusterca.pem",
+    "etcd-client": "etcd-client.pem",
+    "etcd-server": "etcd-server.pem",
+    "kubernetes": "kubernetes.pem",
+    "serviceaccount": "serviceaccount.pem",
+    "ssh-host": "ssh-host.pub",
+    "ssh-user": "ssh-user.pub",
+}
+
 # TODO: refactor this file to be more maintainable
 
 
@@ -64,6 +75,12 @@ def gen_iso(iso_image, authorized_key, mode=None):
         util.writefile(os.path.join(d, "keyservertls.pem"), authority.get_pubkey_by_filename("./clusterca.pem"))
         inclusion += ["authorized.pub", "keyservertls.pem"]
 
+        os.makedirs(os.path.join(d, "pins"))
+        inclusion.append("pins")
+        for name, filename in sorted(PINNED_AUTHORITIES.items()):
+            util.writefile(os.path.join(d, "pins", name), authority.get_pubkey_by_filename("./" + filename))
+            inclusion.append(os.path.join("pins", name))
+
         os.makedirs(os.path.join(d, "var/lib/dpkg/info"))
         scripts = {
             "//spire/resources:postinstall.sh": "postinstall.sh",
@@ -1,7 +1,9 @@
+import json
 import ssl
 import urllib.error
 import urllib.request
 
+import access
 import authority
 import command
 import configuration
@@ -17,20 +19,27 @@ def get_verified_keyserver_opener() -> urllib.request.OpenerDirector:
 
 def get_keyurl_data(path):
     config = configuration.get_config()
-    keyserver_hostname = config.keyserver.hostname
-    url = "https://%s.%s:20557/%s" % (keyserver_hostname, config.external_domain, path.lstrip("/"))
-    try:
-        with get_verified_keyserver_opener().open(url) as req:
-            if req.code != 200:
-                command.fail("request failed: %s" % req.read().decode())
-            return req.read().decode()
-    except urllib.error.HTTPError as e:
-        if e.code == 400:
-            command.fail("request failed: 400 " + e.msg + " (possibly an auth error?)")
-        elif e.code == 404:
-            command.fail("path not found: 404 " + e.msg)
-        else:
-            raise e
+    if not config.keyservers:
+        command.fail("no supervisors are configured to run keyservers")
+    # the leader comes first; the others are only tried if it can't be reached
+    for keyserver in config.keyservers:
+        url = "https://%s.%s:20557/%s" % (keyserver.hostname, config.external_domain, path.lstrip("/"))
+        try:
+            with get_verified_keyserver_opener().open(url) as req:
+                if req.code != 200:
+                    command.fail("request failed: %s" % req.read().decode())
+                return req.read().decode()
+        except urllib.error.HTTPError as e:
+            if e.code == 400:
+                command.fail("request failed: 400 " + e.msg + " (possibly an auth error?)")
+            elif e.code == 404:
+                command.fail("path not found: 404 " + e.msg)
+            else:
+                raise e
+        except urllib.error.URLError as e:
+            if keyserver == config.keyservers[-1]:
+                raise e
+            print("[could not reach keyserver on %s: %s; trying the next supervisor]" % (keyserver.hostname, e.reason))
 
 
 @command.wrap
@@ -39,6 +48,32 @@ def query_keyurl(path):
     print(get_keyurl_data(path))
 
 
+@command.wrap
+def query_inventory(raw: bool=False):
+    """
+    list the state that each node last reported when checking in with the keyserver
+
+    raw: print the inventory as JSON
+    """
+    inventory = access.call_keyreq("inventory").decode()
+    if raw:
+        print(inventory.strip())
+        return
+    for node in json.loads(inventory):
+        report = node.get("report")
+        if report is None:
+            print("%s: never checked in" % node["principal"])
+            continue
+        skew = node.get("clock-skew", 0) / 1e9
+        print("%s: last seen %s (clock skew %.1fs), keyclient version %s" %
+              (node["principal"], node["last-seen"], skew, report["version"]))
+        for cert in report.get("certificates") or []:
+            print("    %s: serial %s, expires %s" % (cert["path"], cert["serial"] or "unknown", cert["expires"]))
+        for blocked in report.get("blocked") or []:
+            print("    blocked: %s" % blocked)
+
+
 main_command = command.Mux("commands about querying the state of a cluster", {
     "keyurl": query_keyurl,
+    "inventory": query_inventory,
 })
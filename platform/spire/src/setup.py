@@ -1,3 +1,4 @@
+import getpass
 import os
 import subprocess
 
@@ -46,6 +47,17 @@ STATICS_DIR = "/etc/homeworld/keyserver/static"
 CONFIG_DIR = "/etc/homeworld/config"
 KEYCLIENT_DIR = "/etc/homeworld/keyclient"
 KEYTAB_PATH = "/etc/krb5.keytab"
+PASSPHRASE_DIR = "/run/homeworld/keyserver"
+PASSPHRASE_PATH = PASSPHRASE_DIR + "/authority-passphrase"
+
+
+def ask_authority_passphrase() -> bytes:
+    passphrase = getpass.getpass("Passphrase to seal the keyserver authorities with: ")
+    if not passphrase:
+        command.fail("the keyserver authorities must be sealed with a passphrase")
+    if getpass.getpass("Passphrase again: ") != passphrase:
+        command.fail("passphrases did not match")
+    return passphrase.encode()
 
 
 @command.wrapop
@@ -53,16 +65,23 @@ def setup_keyserver(ops: command.Operations) -> None:
     "deploy keys and configuration for keyserver; start keyserver"
 
     config = configuration.get_config()
+    # the private keys are sealed before they leave this machine, so that they are never stored unsealed on a supervisor
+    passphrase = ask_authority_passphrase()
+    sealed = list(authority.iterate_keys_sealed(passphrase))
     for node in config.nodes:
         if node.kind != "supervisor":
             continue
-        ssh_mkdir(ops, "create directories on @HOST", node, AUTHORITY_DIR, STATICS_DIR, CONFIG_DIR)
-        for name, data in authority.iterate_keys_decrypted():
-            # TODO: keep these keys in memory
-            if "/" in name:
-                command.fail("found key in upload list with invalid filename")
-            # TODO: avoid keeping these keys in memory for this long
+        ssh_mkdir(ops, "create directories on @HOST", node, AUTHORITY_DIR, STATICS_DIR, CONFIG_DIR, PASSPHRASE_DIR)
+        for name, data in sealed:
             ssh_upload_bytes(ops, "upload authority %s to @HOST" % name, node, data, os.path.join(AUTHORITY_DIR, name))
+        # the passphrase only goes on a tmpfs, from which keyserver.service loads it, so that the keyserver can start
+        # now, but a copy of the disk does not reveal the keys; after a reboot, an administrator must provide it again
+        ssh_cmd(ops, "restrict access to passphrase directory on @HOST", node, "chmod", "0700", PASSPHRASE_DIR)
+        ssh_upload_bytes(ops, "upload authority passphrase to @HOST", node, passphrase, PASSPHRASE_PATH)
+        ssh_cmd(ops, "restrict access to authority passphrase on @HOST", node, "chmod", "0600", PASSPHRASE_PATH)
+        # the keyserver runs as its own user, and nothing else should be able to read the authorities
+        ssh_cmd(ops, "give authorities to keyserver user on @HOST", node, "chown", "-R", "keyserver:keyserver", AUTHORITY_DIR)
+        ssh_cmd(ops, "restrict access to authorities on @HOST", node, "chmod", "0700", AUTHORITY_DIR)
         ssh_upload_bytes(ops, "upload cluster config to @HOST", node,
                          configuration.get_cluster_conf().encode(), STATICS_DIR + "/cluster.conf")
         ssh_upload_path(ops, "upload cluster setup to @HOST", node,
@@ -199,7 +218,9 @@ def modify_temporary_dns(node: configuration.Node, additional: dict) -> None:
 def dns_bootstrap_lines() -> str:
     config = configuration.get_config()
     dns_hosts = config.dns_bootstrap.copy()
-    dns_hosts["homeworld.private"] = config.keyserver.ip
+    # every supervisor runs a registry, so each is listed, and pulls can fail over to the others while one is down
+    dns_hosts.pop("homeworld.private", None)
+    registries = [(node.ip, "homeworld.private") for node in config.keyservers]
     for node in config.nodes:
         full_hostname = "%s.%s" % (node.hostname, config.external_domain)
         if node.hostname in dns_hosts:
@@ -208,7 +229,8 @@ def dns_bootstrap_lines() -> str:
             command.fail("redundant /etc/hosts entry: %s", full_hostname)
         dns_hosts[node.hostname] = node.ip
         dns_hosts[full_hostname] = node.ip
-    return "".join("%s\t%s # AUTO-HOMEWORLD-BOOTSTRAP\n" % (ip, hostname) for hostname, ip in dns_hosts.items())
+    entries = registries + [(ip, hostname) for hostname, ip in dns_hosts.items()]
+    return "".join("%s\t%s # AUTO-HOMEWORLD-BOOTSTRAP\n" % (ip, hostname) for ip, hostname in entries)
 
 
 @command.wrapop
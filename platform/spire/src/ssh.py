@@ -30,6 +30,32 @@ def check_ssh_output(node: configuration.Node, *script: str) -> bytes:
     return subprocess.check_output(build_ssh(node, *script))
 
 
+# ssh exits with this status when it cannot reach the node, rather than passing on the status of the remote command
+SSH_CONNECTION_FAILED = 255
+
+
+def failover(nodes: list, run):
+    "calls run on each node in order, until one can be reached, so that commands still work while some nodes are down"
+    if not nodes:
+        raise Exception("no nodes to connect to")
+    for node in nodes[:-1]:
+        try:
+            return run(node)
+        except subprocess.CalledProcessError as e:
+            if e.returncode != SSH_CONNECTION_FAILED:
+                raise
+            print("[could not reach %s; trying the next one]" % node.hostname)
+    return run(nodes[-1])
+
+
+def check_ssh_failover(nodes: list, *script: str) -> None:
+    failover(nodes, lambda node: check_ssh(node, *script))
+
+
+def check_ssh_output_failover(nodes: list, *script: str) -> bytes:
+    return failover(nodes, lambda node: check_ssh_output(node, *script))
+
+
 def check_scp_up(node: configuration.Node, source_path: str, dest_path: str) -> None:
     subprocess.check_call(build_scp_up(node, source_path, dest_path))
 
@@ -3,13 +3,12 @@ package certutil
 import (
 	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"math/big"
 )
 
-func FinishCertificate(template *x509.Certificate, parent *x509.Certificate, pubkey crypto.PublicKey, signer *rsa.PrivateKey) ([]byte, error) {
+func FinishCertificate(template *x509.Certificate, parent *x509.Certificate, pubkey crypto.PublicKey, signer crypto.Signer) ([]byte, error) {
 	var err error
 	template.SignatureAlgorithm = x509.SHA256WithRSA
 	template.SerialNumber, err = rand.Int(rand.Reader, (&big.Int{}).Exp(big.NewInt(2), big.NewInt(159), nil))
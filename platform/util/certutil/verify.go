@@ -0,0 +1,122 @@
+package certutil
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/wraputil"
+)
+
+func hasName(cert *x509.Certificate, name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, certIP := range cert.IPAddresses {
+			if certIP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, certName := range cert.DNSNames {
+		if strings.EqualFold(certName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyTLSCert checks that a PEM-encoded certificate is valid at the time now, is for the public half of a PEM-encoded RSA
+// private key, was issued by a PEM-encoded authority (unless no authority is provided), and includes each of the
+// listed DNS names and IP addresses.
+func VerifyTLSCert(certdata []byte, keydata []byte, authoritydata []byte, names []string, now time.Time) error {
+	cert, err := wraputil.LoadX509CertFromPEM(certdata)
+	if err != nil {
+		return errors.Wrap(err, "while parsing certificate")
+	}
+	key, err := wraputil.LoadRSAKeyFromPEM(keydata)
+	if err != nil {
+		return errors.Wrap(err, "while parsing private key")
+	}
+	certkey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || certkey.E != key.E || certkey.N.Cmp(key.N) != 0 {
+		return errors.New("certificate does not match private key")
+	}
+	if authoritydata != nil {
+		authority, err := wraputil.LoadX509CertFromPEM(authoritydata)
+		if err != nil {
+			return errors.Wrap(err, "while parsing authority")
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(authority)
+		_, err = cert.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			CurrentTime: now,
+		})
+		if err != nil {
+			return errors.Wrap(err, "while verifying certificate against authority")
+		}
+	} else if now.After(cert.NotAfter) {
+		return errors.New("certificate has already expired")
+	}
+	for _, name := range names {
+		if !hasName(cert, name) {
+			return fmt.Errorf("certificate is missing expected name %s", name)
+		}
+	}
+	return nil
+}
+
+// VerifySSHHostCert checks that an SSH certificate is a host certificate valid at the time now for the provided SSH public
+// key, was signed by the provided SSH authority (unless no authority is provided), and lists each of the expected
+// principals.
+func VerifySSHHostCert(certdata []byte, pubkeydata []byte, authoritydata []byte, principals []string, now time.Time) error {
+	pubkey, err := wraputil.ParseSSHTextPubkey(certdata)
+	if err != nil {
+		return errors.Wrap(err, "while parsing certificate")
+	}
+	cert, ok := pubkey.(*ssh.Certificate)
+	if !ok {
+		return errors.New("found public key instead of certificate")
+	}
+	hostkey, err := wraputil.ParseSSHTextPubkey(pubkeydata)
+	if err != nil {
+		return errors.Wrap(err, "while parsing public key")
+	}
+	if !bytes.Equal(cert.Key.Marshal(), hostkey.Marshal()) {
+		return errors.New("certificate does not match public key")
+	}
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("certificate has type %d instead of host certificate", cert.CertType)
+	}
+	if authoritydata != nil {
+		authority, err := wraputil.ParseSSHTextPubkey(authoritydata)
+		if err != nil {
+			return errors.Wrap(err, "while parsing authority")
+		}
+		if !bytes.Equal(cert.SignatureKey.Marshal(), authority.Marshal()) {
+			return errors.New("certificate was not signed by authority")
+		}
+	}
+	checker := &ssh.CertChecker{Clock: func() time.Time { return now }}
+	for _, principal := range principals {
+		// CheckCert verifies the signature itself, the validity period, and the presence of the principal
+		err = checker.CheckCert(principal, cert)
+		if err != nil {
+			return errors.Wrap(err, "while checking certificate")
+		}
+	}
+	if len(principals) == 0 {
+		unixNow := uint64(now.Unix())
+		if unixNow < cert.ValidAfter || unixNow >= cert.ValidBefore {
+			return errors.New("certificate is not currently valid")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package certutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/testkeyutil"
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func TestVerifyTLSCert(t *testing.T) {
+	authkey, _, authcert := testkeyutil.GenerateTLSRootPEMsForTests(t, "authority", nil, nil)
+	key, _, cert := testkeyutil.GenerateTLSKeypairPEMsForTests(t, "leaf", []string{"node.example.com"}, []net.IP{net.IPv4(10, 0, 0, 1)}, authcert, authkey)
+	err := VerifyTLSCert(cert, key, authcert, []string{"node.example.com", "10.0.0.1"}, time.Now())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyTLSCert_NoAuthority(t *testing.T) {
+	authkey, _, authcert := testkeyutil.GenerateTLSRootPEMsForTests(t, "authority", nil, nil)
+	key, _, cert := testkeyutil.GenerateTLSKeypairPEMsForTests(t, "leaf", nil, nil, authcert, authkey)
+	err := VerifyTLSCert(cert, key, nil, nil, time.Now())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyTLSCert_WrongKey(t *testing.T) {
+	authkey, _, authcert := testkeyutil.GenerateTLSRootPEMsForTests(t, "authority", nil, nil)
+	_, _, cert := testkeyutil.GenerateTLSKeypairPEMsForTests(t, "leaf", nil, nil, authcert, authkey)
+	err := VerifyTLSCert(cert, authkey, authcert, nil, time.Now())
+	testutil.CheckError(t, err, "certificate does not match private key")
+}
+
+func TestVerifyTLSCert_WrongAuthority(t *testing.T) {
+	authkey, _, authcert := testkeyutil.GenerateTLSRootPEMsForTests(t, "authority", nil, nil)
+	_, _, othercert := testkeyutil.GenerateTLSRootPEMsForTests(t, "other-authority", nil, nil)
+	key, _, cert := testkeyutil.GenerateTLSKeypairPEMsForTests(t, "leaf", nil, nil, authcert, authkey)
+	err := VerifyTLSCert(cert, key, othercert, nil, time.Now())
+	testutil.CheckError(t, err, "while verifying certificate against authority")
+}
+
+func TestVerifyTLSCert_MissingName(t *testing.T) {
+	authkey, _, authcert := testkeyutil.GenerateTLSRootPEMsForTests(t, "authority", nil, nil)
+	key, _, cert := testkeyutil.GenerateTLSKeypairPEMsForTests(t, "leaf", []string{"node.example.com"}, nil, authcert, authkey)
+	err := VerifyTLSCert(cert, key, authcert, []string{"node.example.com", "10.0.0.1"}, time.Now())
+	testutil.CheckError(t, err, "certificate is missing expected name 10.0.0.1")
+}
+
+func TestVerifyTLSCert_Malformed(t *testing.T) {
+	key, _, _ := testkeyutil.GenerateTLSRootPEMsForTests(t, "authority", nil, nil)
+	err := VerifyTLSCert([]byte("invalid"), key, nil, nil, time.Now())
+	testutil.CheckError(t, err, "while parsing certificate: Missing expected PEM header")
+}
+
+func generateSSHHostCert(t *testing.T, certType uint32, principals []string) (cert []byte, pubkey []byte, authority []byte) {
+	signkey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(signkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostkey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := ssh.NewPublicKey(hostkey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshcert := &ssh.Certificate{
+		Key:             pk,
+		CertType:        certType,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	err = sshcert.SignCert(rand.Reader, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.MarshalAuthorizedKey(sshcert), ssh.MarshalAuthorizedKey(pk), ssh.MarshalAuthorizedKey(signer.PublicKey())
+}
+
+func TestVerifySSHHostCert(t *testing.T) {
+	cert, pubkey, authority := generateSSHHostCert(t, ssh.HostCert, []string{"node.example.com", "10.0.0.1"})
+	err := VerifySSHHostCert(cert, pubkey, authority, []string{"node.example.com", "10.0.0.1"}, time.Now())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifySSHHostCert_UserCert(t *testing.T) {
+	cert, pubkey, authority := generateSSHHostCert(t, ssh.UserCert, []string{"node.example.com"})
+	err := VerifySSHHostCert(cert, pubkey, authority, []string{"node.example.com"}, time.Now())
+	testutil.CheckError(t, err, "certificate has type 1 instead of host certificate")
+}
+
+func TestVerifySSHHostCert_WrongKey(t *testing.T) {
+	cert, _, authority := generateSSHHostCert(t, ssh.HostCert, []string{"node.example.com"})
+	err := VerifySSHHostCert(cert, authority, authority, []string{"node.example.com"}, time.Now())
+	testutil.CheckError(t, err, "certificate does not match public key")
+}
+
+func TestVerifySSHHostCert_WrongAuthority(t *testing.T) {
+	cert, pubkey, _ := generateSSHHostCert(t, ssh.HostCert, []string{"node.example.com"})
+	err := VerifySSHHostCert(cert, pubkey, pubkey, []string{"node.example.com"}, time.Now())
+	testutil.CheckError(t, err, "certificate was not signed by authority")
+}
+
+func TestVerifySSHHostCert_MissingPrincipal(t *testing.T) {
+	cert, pubkey, authority := generateSSHHostCert(t, ssh.HostCert, []string{"node.example.com"})
+	err := VerifySSHHostCert(cert, pubkey, authority, []string{"node.example.com", "10.0.0.1"}, time.Now())
+	testutil.CheckError(t, err, "while checking certificate: ssh: principal \"10.0.0.1\" not in the set of valid principals for given certificate")
+}
+
+func TestVerifySSHHostCert_Expired(t *testing.T) {
+	cert, pubkey, authority := generateSSHHostCert(t, ssh.HostCert, []string{"node.example.com"})
+	err := VerifySSHHostCert(cert, pubkey, authority, nil, time.Now().Add(2*time.Hour))
+	testutil.CheckError(t, err, "certificate is not currently valid")
+}
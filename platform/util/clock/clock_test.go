@@ -0,0 +1,32 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNow_Nil(t *testing.T) {
+	before := time.Now()
+	now := Now(nil)
+	if now.Before(before) || now.After(time.Now()) {
+		t.Error("expected nil clock to use the system time")
+	}
+}
+
+func TestFake(t *testing.T) {
+	start := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake := NewFake(start)
+	if !Now(fake).Equal(start) {
+		t.Error("wrong initial time")
+	}
+	if !fake.Advance(time.Hour).Equal(start.Add(time.Hour)) {
+		t.Error("wrong time returned from Advance")
+	}
+	if !fake.Now().Equal(start.Add(time.Hour)) {
+		t.Error("wrong time after Advance")
+	}
+	fake.Set(start)
+	if !fake.Now().Equal(start) {
+		t.Error("wrong time after Set")
+	}
+}
@@ -0,0 +1,100 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// the previous version of a file replaced by ReplaceKeepingPrevious is kept next to it with this suffix
+const PreviousSuffix = ".prev"
+
+func syncDir(dirname string) error {
+	dir, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if err != nil {
+		dir.Close() // ignore failure: already failed
+		return err
+	}
+	return dir.Close()
+}
+
+// WriteAtomic writes a file such that readers will see either the old contents or the new contents, never a partial
+// file, and such that the new contents will survive a crash once WriteAtomic returns.
+func WriteAtomic(filename string, contents []byte, permissions os.FileMode) error {
+	dirname := filepath.Dir(filename)
+	temp, err := ioutil.TempFile(dirname, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(contents)
+	if err == nil {
+		err = temp.Chmod(permissions)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if err != nil {
+		temp.Close()           // ignore failure: already failed
+		os.Remove(temp.Name()) // ignore failure: nothing more we can do
+		return err
+	}
+	err = temp.Close()
+	if err == nil {
+		err = os.Rename(temp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(temp.Name()) // ignore failure: nothing more we can do
+		return err
+	}
+	return syncDir(dirname)
+}
+
+// RenameAtomic renames a file (or directory) over another, such that the rename will survive a crash once RenameAtomic
+// returns. Both must be in the same directory.
+func RenameAtomic(source string, destination string) error {
+	err := os.Rename(source, destination)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(destination))
+}
+
+// KeepPrevious saves a copy of the current version of a file (if any), so that a later replacement can be undone with
+// RestorePrevious.
+func KeepPrevious(filename string) error {
+	previous, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		// nothing to keep, and an older saved version would no longer be the previous one
+		err = os.Remove(filename + PreviousSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	return WriteAtomic(filename+PreviousSuffix, previous, info.Mode().Perm())
+}
+
+// ReplaceKeepingPrevious atomically replaces a file, and keeps a copy of the version it replaced (if any), so that the
+// replacement can be undone with RestorePrevious.
+func ReplaceKeepingPrevious(filename string, contents []byte, permissions os.FileMode) error {
+	err := KeepPrevious(filename)
+	if err != nil {
+		return err
+	}
+	return WriteAtomic(filename, contents, permissions)
+}
+
+// RestorePrevious undoes the last ReplaceKeepingPrevious on a file. It fails if no previous version was kept.
+func RestorePrevious(filename string) error {
+	return RenameAtomic(filename+PreviousSuffix, filename)
+}
@@ -0,0 +1,125 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func checkContents(t *testing.T, filename string, expected string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != expected {
+		t.Errorf("wrong file data in %s: %q instead of %q", filename, string(data), expected)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	err := EnsureIsFolder("testdir/atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("testdir/atomic/file.txt", []byte("original\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteAtomic("testdir/atomic/file.txt", []byte("hello world\n"), os.FileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, "testdir/atomic/file.txt", "hello world\n")
+	info, err := os.Stat("testdir/atomic/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("wrong permissions %v", info.Mode().Perm())
+	}
+	files, err := ioutil.ReadDir("testdir/atomic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Error("temporary file left behind")
+	}
+}
+
+func TestWriteAtomic_NoDirectory(t *testing.T) {
+	err := WriteAtomic("testdir/nonexistent-dir/file.txt", []byte("hello world\n"), os.FileMode(0644))
+	testutil.CheckError(t, err, "no such file or directory")
+}
+
+func TestRenameAtomic(t *testing.T) {
+	err := EnsureIsFolder("testdir/rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("testdir/rename/file.txt", []byte("original\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("testdir/rename/file.txt.next", []byte("replacement\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RenameAtomic("testdir/rename/file.txt.next", "testdir/rename/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, "testdir/rename/file.txt", "replacement\n")
+	if Exists("testdir/rename/file.txt.next") {
+		t.Error("source left behind")
+	}
+	err = RenameAtomic("testdir/rename/file.txt.next", "testdir/rename/file.txt")
+	testutil.CheckError(t, err, "no such file or directory")
+	checkContents(t, "testdir/rename/file.txt", "replacement\n")
+}
+
+func TestReplaceKeepingPrevious(t *testing.T) {
+	err := EnsureIsFolder("testdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("testdir/replaced.txt", []byte("original\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReplaceKeepingPrevious("testdir/replaced.txt", []byte("replacement\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, "testdir/replaced.txt", "replacement\n")
+	checkContents(t, "testdir/replaced.txt.prev", "original\n")
+	err = RestorePrevious("testdir/replaced.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, "testdir/replaced.txt", "original\n")
+	if Exists("testdir/replaced.txt.prev") {
+		t.Error("previous version should have been consumed")
+	}
+}
+
+func TestReplaceKeepingPrevious_NoOriginal(t *testing.T) {
+	err := EnsureIsFolder("testdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("testdir/new.txt") // ignore errors
+	err = ioutil.WriteFile("testdir/new.txt.prev", []byte("stale\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReplaceKeepingPrevious("testdir/new.txt", []byte("created\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, "testdir/new.txt", "created\n")
+	err = RestorePrevious("testdir/new.txt")
+	testutil.CheckError(t, err, "no such file or directory")
+	checkContents(t, "testdir/new.txt", "created\n")
+}
@@ -0,0 +1,209 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Two files that must match each other, such as a private key and its certificate, cannot be replaced together by
+ * renaming each of them, because a reader (or a crash) between the two renames would see a mismatched pair. Instead,
+ * InstallPair turns both files into symlinks through a versioned directory next to the first file:
+ *   <first>.pair/<version>/{first,second}  the contents of each version of the pair
+ *   <first>.pair/current -> <version>       the version in use
+ *   <first>.pair/previous -> <version>      the version replaced by the last InstallPair, if any
+ *   <first> -> <first>.pair/current/first
+ *   <second> -> <first>.pair/current/second
+ * so that renaming a single link over <first>.pair/current switches both files at once.
+ */
+
+// the versioned directory for a pair of files is kept next to the first file with this suffix
+const PairSuffix = ".pair"
+
+const (
+	pairCurrent  = "current"
+	pairPrevious = "previous"
+	pairFirst    = "first"
+	pairSecond   = "second"
+)
+
+// replaceLink atomically points link at target.
+func replaceLink(target string, link string) error {
+	temp := link + ".tmp"
+	err := os.Remove(temp)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Symlink(target, temp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(temp, link)
+	if err != nil {
+		os.Remove(temp) // ignore failure: nothing more we can do
+		return err
+	}
+	return syncDir(filepath.Dir(link))
+}
+
+// copyInto copies a file (following any symlinks) to a new file, and keeps its permissions and modification time.
+func copyInto(source string, destination string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	err = WriteAtomic(destination, contents, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(destination, info.ModTime(), info.ModTime())
+}
+
+// linkPair makes first and second into symlinks through the current version of the pair, if they are not already.
+// Whatever they currently contain is copied into a new current version first, so that readers see the same contents
+// throughout.
+func linkPair(dir string, first string, second string) error {
+	firstLink, secondLink := filepath.Join(dir, pairCurrent, pairFirst), filepath.Join(dir, pairCurrent, pairSecond)
+	if target, err := os.Readlink(first); err == nil && target == firstLink {
+		if target, err := os.Readlink(second); err == nil && target == secondLink {
+			return nil
+		}
+	}
+	if Exists(first) || Exists(second) {
+		version, err := ioutil.TempDir(dir, "v")
+		if err != nil {
+			return err
+		}
+		for source, name := range map[string]string{first: pairFirst, second: pairSecond} {
+			if !Exists(source) {
+				continue
+			}
+			err = copyInto(source, filepath.Join(version, name))
+			if err != nil {
+				os.RemoveAll(version) // ignore failure: nothing more we can do
+				return err
+			}
+		}
+		err = replaceLink(filepath.Base(version), filepath.Join(dir, pairCurrent))
+		if err != nil {
+			return err
+		}
+	}
+	return relinkPair(dir, first, second)
+}
+
+// relinkPair points first and second through the current version of the pair, without regard to what they contain.
+func relinkPair(dir string, first string, second string) error {
+	err := replaceLink(filepath.Join(dir, pairCurrent, pairFirst), first)
+	if err != nil {
+		return err
+	}
+	return replaceLink(filepath.Join(dir, pairCurrent, pairSecond), second)
+}
+
+// cleanPair removes every version of the pair except for the current and previous versions.
+func cleanPair(dir string) error {
+	keep := map[string]bool{pairCurrent: true, pairPrevious: true}
+	for _, link := range []string{pairCurrent, pairPrevious} {
+		if target, err := os.Readlink(filepath.Join(dir, link)); err == nil {
+			keep[target] = true
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !keep[entry.Name()] && strings.HasPrefix(entry.Name(), "v") && entry.IsDir() {
+			err := os.RemoveAll(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// InstallPair replaces first and second together, such that readers see either both old versions or both new versions,
+// with firstSource and secondSource, which are moved into place, and so must be on the same filesystem as first. The
+// replaced versions are kept, so that the replacement can be undone with RestorePair.
+func InstallPair(first string, firstSource string, second string, secondSource string) error {
+	// the links must still resolve if the working directory changes
+	dir, err := filepath.Abs(first + PairSuffix)
+	if err != nil {
+		return err
+	}
+	err = EnsureIsFolder(dir)
+	if err != nil {
+		return err
+	}
+	err = linkPair(dir, first, second)
+	if err != nil {
+		return err
+	}
+	version, err := ioutil.TempDir(dir, "v")
+	if err != nil {
+		return err
+	}
+	err = os.Rename(firstSource, filepath.Join(version, pairFirst))
+	if err == nil {
+		err = os.Rename(secondSource, filepath.Join(version, pairSecond))
+	}
+	if err == nil {
+		err = syncDir(version)
+	}
+	if err != nil {
+		// the sources are left alone if either rename failed; otherwise, move the first back
+		if Exists(filepath.Join(version, pairFirst)) && !Exists(firstSource) {
+			os.Rename(filepath.Join(version, pairFirst), firstSource) // ignore failure: nothing more we can do
+		}
+		os.RemoveAll(version) // ignore failure: nothing more we can do
+		return err
+	}
+	current, err := os.Readlink(filepath.Join(dir, pairCurrent))
+	if err == nil {
+		err = replaceLink(current, filepath.Join(dir, pairPrevious))
+	} else if os.IsNotExist(err) {
+		// nothing to keep, and an older saved version would no longer be the previous one
+		err = os.Remove(filepath.Join(dir, pairPrevious))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = replaceLink(filepath.Base(version), filepath.Join(dir, pairCurrent))
+	if err != nil {
+		return err
+	}
+	return cleanPair(dir)
+}
+
+// RestorePair undoes the last InstallPair of first and second. It fails if no previous version was kept.
+func RestorePair(first string, second string) error {
+	dir, err := filepath.Abs(first + PairSuffix)
+	if err != nil {
+		return err
+	}
+	previous, err := os.Readlink(filepath.Join(dir, pairPrevious))
+	if err != nil {
+		return err
+	}
+	err = replaceLink(previous, filepath.Join(dir, pairCurrent))
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filepath.Join(dir, pairPrevious))
+	if err != nil {
+		return err
+	}
+	// in case either file was replaced directly since the pair was installed, such as by renewing the certificate
+	return relinkPair(dir, first, second)
+}
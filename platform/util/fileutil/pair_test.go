@@ -0,0 +1,189 @@
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func preparePair(t *testing.T, dir string) (first string, second string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = EnsureIsFolder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second = filepath.Join(dir, "pair.key"), filepath.Join(dir, "pair.pem")
+	err = ioutil.WriteFile(first, []byte("key 1\n"), os.FileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(second, []byte("cert 1\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return first, second
+}
+
+func stagePair(t *testing.T, first string, second string, version string) {
+	err := ioutil.WriteFile(first+".next", []byte("key "+version+"\n"), os.FileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(second+".next", []byte("cert "+version+"\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countVersions(t *testing.T, first string) int {
+	entries, err := ioutil.ReadDir(first + PairSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions++
+		}
+	}
+	return versions
+}
+
+func TestInstallPair(t *testing.T) {
+	first, second := preparePair(t, "testdir/pair")
+	stagePair(t, first, second, "2")
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := os.Chtimes(first+".next", stamp, stamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InstallPair(first, first+".next", second, second+".next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, first, "key 2\n")
+	checkContents(t, second, "cert 2\n")
+	if Exists(first+".next") || Exists(second+".next") {
+		t.Error("sources should have been moved into place")
+	}
+	for _, filename := range []string{first, second} {
+		if info, err := os.Lstat(filename); err != nil {
+			t.Fatal(err)
+		} else if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s should be a symlink", filename)
+		}
+	}
+	info, err := os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("wrong permissions %v", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(stamp) {
+		t.Errorf("modification time not kept: %v", info.ModTime())
+	}
+
+	stagePair(t, first, second, "3")
+	err = InstallPair(first, first+".next", second, second+".next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, first, "key 3\n")
+	checkContents(t, second, "cert 3\n")
+	if versions := countVersions(t, first); versions != 2 {
+		t.Errorf("expected only the current and previous versions to be kept, but found %d", versions)
+	}
+
+	err = RestorePair(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, first, "key 2\n")
+	checkContents(t, second, "cert 2\n")
+	err = RestorePair(first, second)
+	testutil.CheckError(t, err, "no such file or directory")
+	checkContents(t, first, "key 2\n")
+	checkContents(t, second, "cert 2\n")
+}
+
+func TestInstallPair_Rollback(t *testing.T) {
+	first, second := preparePair(t, "testdir/pair-rollback")
+	stagePair(t, first, second, "2")
+	err := InstallPair(first, first+".next", second, second+".next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RestorePair(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the original files were not symlinks, but are restored through the pair
+	checkContents(t, first, "key 1\n")
+	checkContents(t, second, "cert 1\n")
+}
+
+func TestInstallPair_ReplacedDirectly(t *testing.T) {
+	first, second := preparePair(t, "testdir/pair-replaced")
+	stagePair(t, first, second, "2")
+	err := InstallPair(first, first+".next", second, second+".next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// such as when a certificate is renewed for the same key
+	err = WriteAtomic(second, []byte("cert 2 renewed\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stagePair(t, first, second, "3")
+	err = InstallPair(first, first+".next", second, second+".next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, first, "key 3\n")
+	checkContents(t, second, "cert 3\n")
+	err = RestorePair(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, first, "key 2\n")
+	checkContents(t, second, "cert 2 renewed\n")
+}
+
+func TestInstallPair_Resume(t *testing.T) {
+	first, second := preparePair(t, "testdir/pair-resume")
+	err := ioutil.WriteFile(first+".next", []byte("key 2\n"), os.FileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second source has not been prepared yet, so nothing is installed, and the first source is left in place
+	err = InstallPair(first, first+".next", second, second+".next")
+	testutil.CheckError(t, err, "no such file or directory")
+	checkContents(t, first, "key 1\n")
+	checkContents(t, second, "cert 1\n")
+	checkContents(t, first+".next", "key 2\n")
+
+	err = ioutil.WriteFile(second+".next", []byte("cert 2\n"), os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = InstallPair(first, first+".next", second, second+".next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, first, "key 2\n")
+	checkContents(t, second, "cert 2\n")
+	err = RestorePair(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContents(t, first, "key 1\n")
+	checkContents(t, second, "cert 1\n")
+}
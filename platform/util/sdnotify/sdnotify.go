@@ -0,0 +1,165 @@
+package sdnotify
+
+/*
+ * This package implements the parts of systemd's service protocol that keysystem daemons use, without depending on
+ * libsystemd or shelling out to systemd-notify (which is racy, because systemd may attribute the message to the
+ * short-lived systemd-notify process instead of the daemon):
+ *
+ *  - sd_notify(3): state changes (READY=1, STATUS=..., WATCHDOG=1) sent as datagrams to $NOTIFY_SOCKET
+ *  - the service watchdog, requested through $WATCHDOG_USEC and $WATCHDOG_PID
+ *  - sd_listen_fds(3): listening sockets passed in by socket activation, described by $LISTEN_PID and $LISTEN_FDS
+ *
+ * Each of these is a no-op when the process is not running under systemd.
+ */
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const Ready = "READY=1"
+const Stopping = "STOPPING=1"
+const Watchdog = "WATCHDOG=1"
+
+// Status formats a single-line description of the daemon's state, which systemctl status displays.
+func Status(text string) string {
+	return "STATUS=" + strings.Replace(text, "\n", " ", -1)
+}
+
+// Notify sends the state assignments to the service manager, or does nothing if the process was not started by a
+// service manager that asked for notifications.
+func Notify(state ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// a leading '@' indicates a socket in the abstract namespace, which the net package handles on its own
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "while connecting to notification socket")
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n")))
+	if err != nil {
+		return errors.Wrap(err, "while sending notification")
+	}
+	return nil
+}
+
+// WatchdogInterval returns how often the service manager expects a Watchdog notification, or zero if it doesn't.
+func WatchdogInterval() (time.Duration, error) {
+	usecs := os.Getenv("WATCHDOG_USEC")
+	if usecs == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// the watchdog was requested for a different process, such as our parent
+		return 0, nil
+	}
+	usec, err := strconv.ParseUint(usecs, 10, 63)
+	if err != nil || usec == 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC: %s", usecs)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// the first file descriptor passed by socket activation; 0, 1, and 2 are stdin, stdout, and stderr
+const listenFDsStart = 3
+
+// Listeners returns the listening sockets passed to this process by socket activation, in order, or none if the
+// process was not socket-activated. The environment variables are cleared, so that child processes don't also try
+// to use the sockets.
+func Listeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// passed to a different process
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %s", fds)
+	}
+	var listeners []net.Listener
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		// FileListener duplicates the descriptor, so the original is no longer needed either way
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "while using passed socket %s", name)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// how often Supervise reports changes in status when the service manager hasn't requested a watchdog
+const StatusInterval = 5 * time.Second
+
+// Supervise runs forever, reporting the daemon's status to the service manager whenever it changes, and pinging the
+// watchdog, if one was requested, for as long as healthy returns nil. Once the daemon is unhealthy, the watchdog is
+// allowed to expire, so that the service manager restarts it. Either status or healthy may be nil.
+func Supervise(notify func(state ...string) error, status func() string, healthy func() error, logger *log.Logger) {
+	watchdog, err := WatchdogInterval()
+	if err != nil {
+		logger.Printf("not pinging watchdog: %v\n", err)
+	}
+	interval := StatusInterval
+	if watchdog > 0 {
+		// systemd recommends pinging at half the interval, so that a slightly delayed ping isn't fatal
+		interval = watchdog / 2
+	}
+	lastStatus := ""
+	unhealthy := false
+	for {
+		var state []string
+		if status != nil {
+			if current := status(); current != lastStatus {
+				state = append(state, Status(current))
+				lastStatus = current
+			}
+		}
+		if watchdog > 0 {
+			if healthy == nil {
+				state = append(state, Watchdog)
+			} else if err := healthy(); err != nil {
+				if !unhealthy {
+					logger.Printf("no longer pinging watchdog, because daemon is unhealthy: %v\n", err)
+				}
+				unhealthy = true
+			} else {
+				unhealthy = false
+				state = append(state, Watchdog)
+			}
+		}
+		if len(state) > 0 {
+			if err := notify(state...); err != nil {
+				logger.Printf("failed to notify service manager: %v\n", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,111 @@
+package sdnotify
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+func TestNotify_NoSocket(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify(Ready); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdnotify-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err := Notify(Ready, Status("converging\n3 actions")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1\nSTATUS=converging 3 actions" {
+		t.Errorf("unexpected notification %q", string(buf[:n]))
+	}
+}
+
+func TestNotify_Unreachable(t *testing.T) {
+	os.Setenv("NOTIFY_SOCKET", "/nonexistent/notify")
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify(Ready); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_PID")
+	os.Unsetenv("WATCHDOG_USEC")
+	if interval, err := WatchdogInterval(); err != nil || interval != 0 {
+		t.Errorf("unexpected watchdog interval %v (%v)", interval, err)
+	}
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if interval, err := WatchdogInterval(); err != nil || interval != 30*time.Second {
+		t.Errorf("unexpected watchdog interval %v (%v)", interval, err)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval, err := WatchdogInterval(); err != nil || interval != 30*time.Second {
+		t.Errorf("unexpected watchdog interval %v (%v)", interval, err)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval, err := WatchdogInterval(); err != nil || interval != 0 {
+		t.Errorf("unexpected watchdog interval for another process %v (%v)", interval, err)
+	}
+	os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "soon")
+	_, err := WatchdogInterval()
+	testutil.CheckError(t, err, "invalid WATCHDOG_USEC: soon")
+}
+
+func TestListeners_NotActivated(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	listeners, err := Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("unexpected listeners %v (%v)", listeners, err)
+	}
+}
+
+func TestListeners_OtherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("unexpected listeners %v (%v)", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("expected LISTEN_FDS to be cleared")
+	}
+}
+
+func TestListeners_Invalid(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "many")
+	_, err := Listeners()
+	testutil.CheckError(t, err, "invalid LISTEN_FDS: many")
+}
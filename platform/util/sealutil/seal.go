@@ -0,0 +1,177 @@
+package sealutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"strconv"
+)
+
+/*
+ * Sealed data is encrypted under a passphrase, so that secrets such as authority keys can be stored on disk without a
+ * copy of the disk revealing them. The passphrase is stretched with scrypt, using a salt chosen each time that data is
+ * sealed, and the data is encrypted and authenticated with AES-256-GCM. Sealed data is PEM-encoded, and the PEM headers
+ * record everything needed to unseal it other than the passphrase.
+ */
+
+const SealedBlockType = "HOMEWORLD SEALED DATA"
+
+// scrypt parameters for newly-sealed data, as recommended for interactive logins in 2017; unsealing takes a fraction of
+// a second, which only happens once per key when the keyserver starts
+const (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+)
+
+// limits on the scrypt parameters of data being unsealed, so that tampered headers cannot make unsealing exhaust memory
+// or run indefinitely; these allow up to eight times the memory and sixteen times the work of the parameters above
+const (
+	maxScryptMemory = 256 << 20 // bytes, which scrypt needs 128 * N * R of
+	maxScryptP      = 16
+)
+
+const saltBytes = 16
+const keyBytes = 32
+
+func deriveCipher(passphrase []byte, salt []byte, n int, r int, p int) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	key, err := scrypt.Key(passphrase, salt, n, r, p, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts data under passphrase.
+func Seal(data []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, saltBytes)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := deriveCipher(passphrase, salt, ScryptN, ScryptR, ScryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: SealedBlockType,
+		Headers: map[string]string{
+			"KDF":   "scrypt",
+			"N":     strconv.Itoa(ScryptN),
+			"R":     strconv.Itoa(ScryptR),
+			"P":     strconv.Itoa(ScryptP),
+			"Salt":  base64.StdEncoding.EncodeToString(salt),
+			"Nonce": base64.StdEncoding.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, data, nil),
+	}), nil
+}
+
+// ParsePassphrase extracts a passphrase from the contents of a passphrase file, or the output of a prompt, which may end
+// with a newline.
+func ParsePassphrase(data []byte) ([]byte, error) {
+	passphrase := bytes.TrimRight(data, "\r\n")
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// IsSealed determines whether data was sealed by Seal, without checking whether it can be unsealed.
+func IsSealed(data []byte) bool {
+	block, _ := pem.Decode(data)
+	return block != nil && block.Type == SealedBlockType
+}
+
+func headerInt(block *pem.Block, name string) (int, error) {
+	value, err := strconv.Atoi(block.Headers[name])
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s header in sealed data", name)
+	}
+	return value, nil
+}
+
+func checkScryptParams(n int, r int, p int) error {
+	if n < 2 || n&(n-1) != 0 {
+		return errors.New("invalid N header in sealed data: must be a power of two")
+	}
+	if r < 1 || p < 1 {
+		return errors.New("invalid R or P header in sealed data: must be positive")
+	}
+	if r > maxScryptMemory/128/n || p > maxScryptP {
+		return fmt.Errorf("scrypt parameters N=%d, R=%d, P=%d in sealed data exceed the supported limits", n, r, p)
+	}
+	return nil
+}
+
+func headerBytes(block *pem.Block, name string) ([]byte, error) {
+	value, err := base64.StdEncoding.DecodeString(block.Headers[name])
+	if err != nil || len(value) == 0 {
+		return nil, fmt.Errorf("invalid %s header in sealed data", name)
+	}
+	return value, nil
+}
+
+// Unseal decrypts data sealed by Seal, and fails if the passphrase is wrong or the sealed data has been modified.
+func Unseal(sealed []byte, passphrase []byte) ([]byte, error) {
+	block, rest := pem.Decode(sealed)
+	if block == nil || block.Type != SealedBlockType {
+		return nil, errors.New("not sealed data")
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data found after sealed data")
+	}
+	if block.Headers["KDF"] != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function in sealed data: %q", block.Headers["KDF"])
+	}
+	var params [3]int
+	for i, name := range []string{"N", "R", "P"} {
+		value, err := headerInt(block, name)
+		if err != nil {
+			return nil, err
+		}
+		params[i] = value
+	}
+	err := checkScryptParams(params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	salt, err := headerBytes(block, "Salt")
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := headerBytes(block, "Nonce")
+	if err != nil {
+		return nil, err
+	}
+	aead, err := deriveCipher(passphrase, salt, params[0], params[1], params[2])
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid Nonce header in sealed data")
+	}
+	data, err := aead.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.New("could not unseal data: wrong passphrase, or data has been modified")
+	}
+	return data, nil
+}
@@ -0,0 +1,131 @@
+package shamirutil
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+/*
+ * Shamir's secret sharing splits a secret into shares, such that any threshold number of the shares can be combined to
+ * recover the secret, but fewer shares reveal nothing about it. Each byte of the secret is the constant term of a
+ * random polynomial over GF(2^8) whose degree is one less than the threshold, and each share holds the value of every
+ * polynomial at a distinct nonzero point, which is stored as the first byte of the share.
+ */
+
+const MaxShares = 255
+
+// logarithms and exponents in GF(2^8), with the AES reduction polynomial and the generator 3
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		// multiply x by the generator 3, which is x * 2 + x
+		double := x << 1
+		if x&0x80 != 0 {
+			double ^= 0x1b
+		}
+		x ^= double
+	}
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a byte, b byte) byte {
+	if b == 0 {
+		panic("division by zero in GF(2^8)")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// evaluate the polynomial with the specified coefficients, constant term first, at x
+func evaluate(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfMul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// Split divides secret into the specified number of shares, any threshold of which can be combined to recover it.
+func Split(secret []byte, shares int, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 1 || threshold > shares {
+		return nil, fmt.Errorf("threshold must be between 1 and the number of shares, not %d", threshold)
+	}
+	if shares > MaxShares {
+		return nil, fmt.Errorf("cannot split a secret into more than %d shares", MaxShares)
+	}
+	result := make([][]byte, shares)
+	for i := range result {
+		result[i] = make([]byte, len(secret)+1)
+		result[i][0] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		_, err := rand.Read(coefficients[1:])
+		if err != nil {
+			return nil, err
+		}
+		coefficients[0] = b
+		for _, share := range result {
+			share[j+1] = evaluate(coefficients, share[0])
+		}
+	}
+	return result, nil
+}
+
+// Combine recovers a secret from shares produced by Split. If fewer shares are provided than the threshold that the
+// secret was split with, or shares of different secrets are mixed, the result will be wrong, without any error, so
+// callers must be able to recognize the correct secret.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares to combine")
+	}
+	length := len(shares[0])
+	if length < 2 {
+		return nil, errors.New("share is too short")
+	}
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if len(share) != length {
+			return nil, errors.New("shares have different lengths")
+		}
+		if share[0] == 0 {
+			return nil, errors.New("invalid share")
+		}
+		if seen[share[0]] {
+			return nil, fmt.Errorf("share %d provided more than once", share[0])
+		}
+		seen[share[0]] = true
+	}
+	secret := make([]byte, length-1)
+	for i, share := range shares {
+		// the Lagrange basis polynomial for this share, evaluated at zero
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other[0], other[0]^share[0]))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= gfMul(basis, share[k+1])
+		}
+	}
+	return secret, nil
+}
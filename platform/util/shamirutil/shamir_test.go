@@ -0,0 +1,108 @@
+package shamirutil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sipb/homeworld/platform/util/testutil"
+)
+
+var testSecret = []byte("the quick brown fox jumps over the lazy dog")
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			product := gfMul(byte(a), byte(b))
+			if gfDiv(product, byte(b)) != byte(a) {
+				t.Fatalf("%d * %d / %d != %d", a, b, b, a)
+			}
+		}
+	}
+	// from the AES specification
+	if gfMul(0x57, 0x83) != 0xc1 {
+		t.Error("wrong product in GF(2^8)")
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	shares, err := Split(testSecret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("wrong number of shares: %d", len(shares))
+	}
+	subsets := [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}, {3, 1, 0, 2}}
+	for _, subset := range subsets {
+		var selected [][]byte
+		for _, i := range subset {
+			selected = append(selected, shares[i])
+		}
+		secret, err := Combine(selected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(secret, testSecret) {
+			t.Errorf("wrong secret recovered from shares %v: %q", subset, secret)
+		}
+	}
+}
+
+func TestCombine_BelowThreshold(t *testing.T) {
+	shares, err := Split(testSecret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret, testSecret) {
+		t.Error("secret recovered from fewer shares than the threshold")
+	}
+}
+
+func TestSplit_ThresholdOne(t *testing.T) {
+	shares, err := Split(testSecret, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, share := range shares {
+		secret, err := Combine([][]byte{share})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(secret, testSecret) {
+			t.Errorf("wrong secret recovered: %q", secret)
+		}
+	}
+}
+
+func TestSplit_Invalid(t *testing.T) {
+	_, err := Split(nil, 3, 2)
+	testutil.CheckError(t, err, "cannot split an empty secret")
+	_, err = Split(testSecret, 3, 4)
+	testutil.CheckError(t, err, "threshold must be between 1 and the number of shares, not 4")
+	_, err = Split(testSecret, 3, 0)
+	testutil.CheckError(t, err, "threshold must be between 1 and the number of shares, not 0")
+	_, err = Split(testSecret, 256, 2)
+	testutil.CheckError(t, err, "cannot split a secret into more than 255 shares")
+}
+
+func TestCombine_Invalid(t *testing.T) {
+	shares, err := Split(testSecret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Combine(nil)
+	testutil.CheckError(t, err, "no shares to combine")
+	_, err = Combine([][]byte{{1}})
+	testutil.CheckError(t, err, "share is too short")
+	_, err = Combine([][]byte{shares[0], shares[1][:5]})
+	testutil.CheckError(t, err, "shares have different lengths")
+	_, err = Combine([][]byte{shares[0], shares[0]})
+	testutil.CheckError(t, err, "share 1 provided more than once")
+	zero := append([]byte{0}, shares[1][1:]...)
+	_, err = Combine([][]byte{shares[0], zero})
+	testutil.CheckError(t, err, "invalid share")
+}
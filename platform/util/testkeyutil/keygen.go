@@ -48,7 +48,7 @@ func GenerateTLSKeypairForTests(t *testing.T, commonname string, dns []string, i
 }
 
 func GenerateTLSKeypairForTests_WithTime(t *testing.T, commonname string, dns []string, ips []net.IP, parent *x509.Certificate, parentkey *rsa.PrivateKey, issueat time.Time, duration time.Duration) (*rsa.PrivateKey, *x509.Certificate) {
-	key, err := rsa.GenerateKey(rand.Reader, 512) // NOTE: this is LAUGHABLY SMALL! do not attempt to use this in production.
+	key, err := rsa.GenerateKey(rand.Reader, 1024) // NOTE: this is LAUGHABLY SMALL! do not attempt to use this in production.
 	if err != nil {
 		t.Fatal("Could not generate TLS keypair: " + err.Error())
 	}